@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"delogger/parser"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// HTTPRequest holds the request fields of an access log line, see parser.HTTPRequest.
+type HTTPRequest = parser.HTTPRequest
+
+// httpColumns returns the values of the http_* columns of e, zero when it has no request.
+func httpColumns(e LogEntry) (method, path string, status int, bytes int64, latency *float64) {
+	if e.HTTP == nil {
+		return "", "", 0, 0, nil
+	}
+	return e.HTTP.Method, e.HTTP.Path, e.HTTP.Status, e.HTTP.Bytes, e.HTTP.LatencyMS
+}
+
+// Limits for the number of paths returned by /api/stats/latency.
+const (
+	defaultLatencyPaths = 20
+	maxLatencyPaths     = 500
+)
+
+// PathLatency summarizes the request durations of one method and path, in milliseconds.
+type PathLatency struct {
+	Method string  `json:"method"`
+	Path   string  `json:"path"`
+	Count  int64   `json:"count"`
+	Avg    float64 `json:"avg_ms"`
+	P50    float64 `json:"p50_ms"`
+	P95    float64 `json:"p95_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+// LatencyStats is the response of /api/stats/latency.
+type LatencyStats struct {
+	Paths []PathLatency `json:"paths"`
+}
+
+// latencyStatsHandler handles GET /api/stats/latency, returning duration percentiles of the
+// busiest paths among access log entries matching the usual filter parameters.
+func latencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultLatencyPaths
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLatencyPaths {
+			http.Error(w, "Invalid 'limit': must be between 1 and "+strconv.Itoa(maxLatencyPaths), http.StatusBadRequest)
+			return
+		}
+	}
+
+	paths, err := loadLatencyStats(r.Context(), filter, limit)
+	if err != nil {
+		writeQueryError(w, r, err, "compute latency statistics")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, LatencyStats{Paths: paths})
+}
+
+// loadLatencyStats returns the duration percentiles of the limit busiest paths.
+func loadLatencyStats(ctx context.Context, filter entryFilter, limit int) ([]PathLatency, error) {
+	var args sqlArgs
+	where := andWhere(filter.where(&args), "e.http_latency_ms IS NOT NULL")
+	sql := `
+	SELECT e.http_method, e.http_path, count(*), avg(e.http_latency_ms),
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY e.http_latency_ms),
+		percentile_cont(0.95) WITHIN GROUP (ORDER BY e.http_latency_ms),
+		percentile_cont(0.99) WITHIN GROUP (ORDER BY e.http_latency_ms),
+		max(e.http_latency_ms)
+	FROM delogged_entries e
+	JOIN delogged d ON d.id = e.log_id
+	` + where + `
+	GROUP BY e.http_method, e.http_path
+	ORDER BY count(*) DESC, e.http_path, e.http_method
+	LIMIT ` + args.add(limit)
+
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := pgx.CollectRows(rows, pgx.RowToStructByPos[PathLatency])
+	if paths == nil {
+		paths = []PathLatency{}
+	}
+	return paths, err
+}
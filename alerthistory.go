@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every alert that notifies is kept in alert_history: one row per time a rule fires, from
+// the firing notification to the resolved one, with the event that triggered it and the
+// result of each notification. Alerts are acknowledged through the API, recording who is
+// looking into them; an acknowledged alert is not notified again by its repeat interval.
+
+// AlertNotification is one notification of an alert.
+type AlertNotification struct {
+	Status  string               `json:"status"`
+	SentAt  time.Time            `json:"sent_at"`
+	Summary string               `json:"summary"`
+	Results []NotificationResult `json:"results"`
+}
+
+// AlertHistoryEntry is one firing of a rule.
+type AlertHistoryEntry struct {
+	ID             int64               `json:"id"`
+	RuleID         int64               `json:"rule_id"`
+	Rule           string              `json:"rule"`
+	Condition      string              `json:"condition"`
+	Status         string              `json:"status"` // firing or resolved
+	StartsAt       time.Time           `json:"starts_at"`
+	ResolvedAt     *time.Time          `json:"resolved_at,omitempty"`
+	Event          AlertEvent          `json:"event"` // the latest firing event
+	Notifications  []AlertNotification `json:"notifications"`
+	AcknowledgedAt *time.Time          `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string              `json:"acknowledged_by,omitempty"`
+	AckComment     string              `json:"ack_comment,omitempty"`
+}
+
+// alertHistoryUpsertSQL records a notification, adding it to the row of the firing it belongs to.
+const alertHistoryUpsertSQL = `
+	INSERT INTO alert_history (rule_id, rule, condition, status, starts_at, resolved_at, event, notifications)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (rule_id, starts_at) DO UPDATE SET
+		rule = EXCLUDED.rule,
+		status = EXCLUDED.status,
+		resolved_at = EXCLUDED.resolved_at,
+		event = CASE EXCLUDED.status WHEN 'firing' THEN EXCLUDED.event ELSE alert_history.event END,
+		notifications = alert_history.notifications || EXCLUDED.notifications`
+
+// recordAlert adds a notification of rule's event, with the results of sending it, to the history.
+func recordAlert(ctx context.Context, rule AlertRule, event AlertEvent, results []NotificationResult) error {
+	var resolvedAt *time.Time
+	if event.Status == "resolved" {
+		resolvedAt = &event.EvaluatedAt
+	}
+	notification := AlertNotification{Status: event.Status, SentAt: time.Now(), Summary: event.Summary, Results: results}
+	_, err := dbPool.Exec(ctx, alertHistoryUpsertSQL, rule.ID, rule.Name, rule.Condition, event.Status,
+		event.StartsAt, resolvedAt, event, []AlertNotification{notification})
+	return err
+}
+
+// alertHistorySelectSQL is the column list scanned by scanAlertHistory.
+const alertHistorySelectSQL = `SELECT id, rule_id, rule, condition, status, starts_at, resolved_at, event, notifications,
+	acknowledged_at, acknowledged_by, ack_comment FROM alert_history`
+
+func scanAlertHistory(row pgx.Row) (AlertHistoryEntry, error) {
+	var h AlertHistoryEntry
+	err := row.Scan(&h.ID, &h.RuleID, &h.Rule, &h.Condition, &h.Status, &h.StartsAt, &h.ResolvedAt, &h.Event,
+		&h.Notifications, &h.AcknowledgedAt, &h.AcknowledgedBy, &h.AckComment)
+	return h, err
+}
+
+// writeAlertHistoryError maps a storage error to a response.
+func writeAlertHistoryError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Could not access alert history", http.StatusInternalServerError)
+	slog.ErrorContext(r.Context(), "Error accessing alert history", "err", err)
+}
+
+// AlertHistoryPage is the response of GET /api/alerts/history. NextCursor is empty on the
+// last page.
+type AlertHistoryPage struct {
+	Alerts     []AlertHistoryEntry `json:"alerts"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// listAlertHistoryHandler handles GET /api/alerts/history, keyset-paginated by starts_at,
+// newest first.
+func listAlertHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, cursor, err := parsePage(query, 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args sqlArgs
+	var conds []string
+	if query.Has("rule") {
+		conds = append(conds, "rule = "+args.add(query.Get("rule")))
+	}
+	switch status := query.Get("status"); status {
+	case "":
+	case "firing", "resolved":
+		conds = append(conds, "status = "+args.add(status))
+	default:
+		http.Error(w, "Invalid 'status': must be firing or resolved", http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("acknowledged"); v != "" {
+		acknowledged, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid 'acknowledged': must be true or false", http.StatusBadRequest)
+			return
+		}
+		if acknowledged {
+			conds = append(conds, "acknowledged_at IS NOT NULL")
+		} else {
+			conds = append(conds, "acknowledged_at IS NULL")
+		}
+	}
+	for _, bound := range []struct{ name, op string }{{"from", ">="}, {"to", "<"}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid '"+bound.name+"' timestamp: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, "starts_at "+bound.op+" "+args.add(t))
+		}
+	}
+	if cursor != nil {
+		if cursor.Time == nil {
+			http.Error(w, "invalid 'cursor'", http.StatusBadRequest)
+			return
+		}
+		conds = append(conds, "(starts_at, id) < ("+args.add(*cursor.Time)+", "+args.add(cursor.ID)+")")
+	}
+
+	sql := alertHistorySelectSQL
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY starts_at DESC, id DESC LIMIT " + args.add(limit+1)
+
+	rows, err := dbPool.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeAlertHistoryError(w, r, err)
+		return
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AlertHistoryEntry, error) {
+		return scanAlertHistory(row)
+	})
+	if err != nil {
+		writeAlertHistoryError(w, r, err)
+		return
+	}
+
+	page := AlertHistoryPage{Alerts: entries}
+	if page.Alerts == nil {
+		page.Alerts = []AlertHistoryEntry{}
+	}
+	if len(page.Alerts) > limit {
+		page.Alerts = page.Alerts[:limit]
+		last := page.Alerts[limit-1]
+		page.NextCursor = pageCursor{Time: &last.StartsAt, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// alertHistoryID parses the {id} path value, writing a 400 response if it is invalid.
+func alertHistoryID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid alert id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// getAlertHistoryHandler handles GET /api/alerts/history/{id}.
+func getAlertHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertHistoryID(w, r)
+	if !ok {
+		return
+	}
+	h, err := scanAlertHistory(dbPool.QueryRow(r.Context(), alertHistorySelectSQL+" WHERE id = $1", id))
+	if err != nil {
+		writeAlertHistoryError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// AlertAck is the request of POST /api/alerts/history/{id}/ack.
+type AlertAck struct {
+	By      string `json:"by"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// ackAlertHandler handles POST /api/alerts/history/{id}/ack. Acknowledging again replaces
+// who acknowledged the alert and why.
+func ackAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertHistoryID(w, r)
+	if !ok {
+		return
+	}
+	var ack AlertAck
+	if err := readJSON(r, &ack); err != nil {
+		http.Error(w, "Invalid acknowledgement: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	ack.By = strings.TrimSpace(ack.By)
+	if ack.By == "" {
+		http.Error(w, "Invalid acknowledgement: by is required", http.StatusBadRequest)
+		return
+	}
+
+	h, err := scanAlertHistory(dbPool.QueryRow(r.Context(), `
+	UPDATE alert_history SET acknowledged_at = now(), acknowledged_by = $2, ack_comment = $3
+	WHERE id = $1
+	RETURNING id, rule_id, rule, condition, status, starts_at, resolved_at, event, notifications,
+		acknowledged_at, acknowledged_by, ack_comment`,
+		id, ack.By, strings.TrimSpace(ack.Comment)))
+	if err != nil {
+		writeAlertHistoryError(w, r, err)
+		return
+	}
+
+	// Stop repeat notifications if the alert is still firing. starts_at was stored
+	// truncated to microseconds.
+	alerts.mu.Lock()
+	if f, ok := alerts.firing[h.RuleID]; ok && f.startsAt.Truncate(time.Microsecond).Equal(h.StartsAt) {
+		f.acknowledged = true
+		alerts.firing[h.RuleID] = f
+	}
+	alerts.mu.Unlock()
+
+	slog.InfoContext(r.Context(), "Acknowledged alert", "id", h.ID, "rule", h.Rule, "by", h.AcknowledgedBy)
+	writeJSON(w, http.StatusOK, h)
+}
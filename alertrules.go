@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// alertRuleSelectSQL is the column list scanned by scanAlertRule.
+const alertRuleSelectSQL = `SELECT id, name, tenant, enabled, condition, filter, threshold, time_window, sensitivity, pattern,
+	repeat_interval, factor, compare_offset, channels, created_at, updated_at FROM alert_rules`
+
+// alertRuleReturning is alertRuleSelectSQL's column list for RETURNING clauses.
+const alertRuleReturning = `RETURNING id, name, tenant, enabled, condition, filter, threshold, time_window, sensitivity, pattern,
+	repeat_interval, factor, compare_offset, channels, created_at, updated_at`
+
+func scanAlertRule(row pgx.Row) (AlertRule, error) {
+	var a AlertRule
+	err := row.Scan(&a.ID, &a.Name, &a.Tenant, &a.Enabled, &a.Condition, &a.Filter, &a.Threshold, &a.Window, &a.Sensitivity, &a.Pattern,
+		&a.RepeatInterval, &a.Factor, &a.CompareOffset, &a.Channels, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// alertRuleID parses the {id} path value, writing a 400 response if it is invalid.
+func alertRuleID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid alert rule id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeAlertRuleError maps a storage error to a response.
+func writeAlertRuleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+	case isUniqueViolation(err):
+		http.Error(w, "An alert rule with that name already exists", http.StatusConflict)
+	default:
+		http.Error(w, "Could not access alert rules", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error accessing alert rules", "err", err)
+	}
+}
+
+// readAlertRule decodes and validates a rule from the request body, writing a 400
+// response if it is invalid. Enabled defaults to true.
+func readAlertRule(w http.ResponseWriter, r *http.Request) (AlertRule, bool) {
+	rule := AlertRule{Enabled: true}
+	if err := readJSON(r, &rule); err != nil {
+		http.Error(w, "Invalid alert rule: "+err.Error(), bodyErrorStatus(err))
+		return rule, false
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, "Invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+	return rule, true
+}
+
+// AlertRulesPage is the response of GET /api/alerts. NextCursor is empty on the last page.
+type AlertRulesPage struct {
+	Rules      []AlertRule `json:"rules"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// listAlertRulesHandler handles GET /api/alerts, keyset-paginated by name.
+func listAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parsePage(r.URL.Query(), 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules, err := listAlertRules(r.Context(), cursor, limit+1)
+	if err != nil {
+		writeAlertRuleError(w, r, err)
+		return
+	}
+
+	page := AlertRulesPage{Rules: rules}
+	if len(page.Rules) > limit {
+		page.Rules = page.Rules[:limit]
+		last := page.Rules[limit-1]
+		page.NextCursor = pageCursor{Key: last.Name, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// getAlertRuleHandler handles GET /api/alerts/{id}.
+func getAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertRuleID(w, r)
+	if !ok {
+		return
+	}
+	rule, err := scanAlertRule(dbPool.QueryRow(r.Context(), alertRuleSelectSQL+" WHERE id = $1", id))
+	if err != nil {
+		writeAlertRuleError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// createAlertRuleHandler handles POST /api/alerts.
+func createAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := readAlertRule(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := scanAlertRule(dbPool.QueryRow(r.Context(), `
+	INSERT INTO alert_rules (name, enabled, condition, filter, threshold, time_window, sensitivity, pattern, repeat_interval,
+		factor, compare_offset, channels, tenant)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`+alertRuleReturning,
+		rule.Name, rule.Enabled, rule.Condition, rule.Filter, rule.Threshold, rule.Window, rule.Sensitivity, rule.Pattern,
+		rule.RepeatInterval, rule.Factor, rule.CompareOffset, rule.Channels, rule.Tenant))
+	if err != nil {
+		writeAlertRuleError(w, r, err)
+		return
+	}
+	saved.keepParsed(rule)
+	alerts.put(saved)
+
+	slog.InfoContext(r.Context(), "Created alert rule", "id", saved.ID, "name", saved.Name)
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+// updateAlertRuleHandler handles PUT /api/alerts/{id}, replacing the whole rule.
+func updateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertRuleID(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := readAlertRule(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := scanAlertRule(dbPool.QueryRow(r.Context(), `
+	UPDATE alert_rules SET name = $2, enabled = $3, condition = $4, filter = $5, threshold = $6, time_window = $7,
+		sensitivity = $8, pattern = $9, repeat_interval = $10, factor = $11, compare_offset = $12, channels = $13,
+		tenant = $14, updated_at = now()
+	WHERE id = $1
+	`+alertRuleReturning,
+		id, rule.Name, rule.Enabled, rule.Condition, rule.Filter, rule.Threshold, rule.Window, rule.Sensitivity, rule.Pattern,
+		rule.RepeatInterval, rule.Factor, rule.CompareOffset, rule.Channels, rule.Tenant))
+	if err != nil {
+		writeAlertRuleError(w, r, err)
+		return
+	}
+	saved.keepParsed(rule)
+	alerts.put(saved)
+
+	slog.InfoContext(r.Context(), "Updated alert rule", "id", saved.ID, "name", saved.Name)
+	writeJSON(w, http.StatusOK, saved)
+}
+
+// setAlertRuleEnabledHandler returns the handler of POST /api/alerts/{id}/enable or /disable.
+func setAlertRuleEnabledHandler(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := alertRuleID(w, r)
+		if !ok {
+			return
+		}
+
+		rule, err := scanAlertRule(dbPool.QueryRow(r.Context(), alertRuleSelectSQL+" WHERE id = $1", id))
+		if err != nil {
+			writeAlertRuleError(w, r, err)
+			return
+		}
+		// A rule stored before the environment changed, e.g. SMTP_HOST was unset, can no
+		// longer be evaluated and must be replaced instead.
+		if err := rule.validate(); err != nil && enabled {
+			http.Error(w, "Alert rule is no longer valid: "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		saved, err := scanAlertRule(dbPool.QueryRow(r.Context(), `
+		UPDATE alert_rules SET enabled = $2, updated_at = now()
+		WHERE id = $1
+		`+alertRuleReturning,
+			id, enabled))
+		if err != nil {
+			writeAlertRuleError(w, r, err)
+			return
+		}
+		saved.keepParsed(rule)
+		alerts.put(saved)
+
+		state := "Disabled"
+		if enabled {
+			state = "Enabled"
+		}
+		slog.InfoContext(r.Context(), state+" alert rule", "id", saved.ID, "name", saved.Name)
+		writeJSON(w, http.StatusOK, saved)
+	}
+}
+
+// deleteAlertRuleHandler handles DELETE /api/alerts/{id}.
+func deleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := alertRuleID(w, r)
+	if !ok {
+		return
+	}
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM alert_rules WHERE id = $1`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		writeAlertRuleError(w, r, err)
+		return
+	}
+	alerts.remove(id)
+
+	slog.InfoContext(r.Context(), "Deleted alert rule", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listAlertRules returns up to limit rules ordered by name, starting after cursor when it is not nil.
+func listAlertRules(ctx context.Context, cursor *pageCursor, limit int) ([]AlertRule, error) {
+	var args sqlArgs
+	sql := alertRuleSelectSQL
+	if cursor != nil {
+		sql += " WHERE (name, id) > (" + args.add(cursor.Key) + ", " + args.add(cursor.ID) + ")"
+	}
+	sql += " ORDER BY name, id LIMIT " + args.add(limit)
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AlertRule, error) {
+		return scanAlertRule(row)
+	})
+	if rules == nil {
+		rules = []AlertRule{}
+	}
+	return rules, err
+}
+
+// upsertAlertRule creates rule, or replaces the rule with the same name.
+func upsertAlertRule(ctx context.Context, rule AlertRule) (AlertRule, error) {
+	return scanAlertRule(dbPool.QueryRow(ctx, `
+	INSERT INTO alert_rules (name, enabled, condition, filter, threshold, time_window, sensitivity, pattern, repeat_interval,
+		factor, compare_offset, channels, tenant)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, condition = EXCLUDED.condition,
+		filter = EXCLUDED.filter, threshold = EXCLUDED.threshold, time_window = EXCLUDED.time_window,
+		sensitivity = EXCLUDED.sensitivity, pattern = EXCLUDED.pattern, repeat_interval = EXCLUDED.repeat_interval,
+		factor = EXCLUDED.factor, compare_offset = EXCLUDED.compare_offset, channels = EXCLUDED.channels,
+		tenant = EXCLUDED.tenant, updated_at = now()
+	`+alertRuleReturning,
+		rule.Name, rule.Enabled, rule.Condition, rule.Filter, rule.Threshold, rule.Window, rule.Sensitivity, rule.Pattern,
+		rule.RepeatInterval, rule.Factor, rule.CompareOffset, rule.Channels, rule.Tenant))
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert rules are stored in alert_rules, managed through /api/alerts (see alertrules.go),
+// evaluated in the background and notify their channels when they start and stop firing.
+// The environment configures the evaluation:
+//
+//	ALERT_RULES         path to a JSON file holding an array of rules, created or replaced by name at startup
+//	ALERT_INTERVAL      how often rules are evaluated; default 1m
+//	ALERT_GROUP_WINDOW  a rule that fires again within this time of resolving continues the
+//	                    same alert instead of notifying again; default 0
+//	PUBLIC_URL          base URL of this server, used to link notifications to the matching entries
+//
+// A rule fires when more than threshold entries matching its filter were received within
+// its window, e.g. more than 50 ERROR entries from host web-1 in 5 minutes:
+//
+//	{"name": "web-1 errors", "filter": {"level": "ERROR", "host": "web-1"},
+//	 "threshold": 50, "window": "5m",
+//	 "channels": [{"type": "webhook", "url": "https://hooks.example.com/delogger"}]}
+//
+// With "condition": "anomaly" it fires instead when a source's count is far above that
+// source's usual count (see anomaly.go); threshold is then a floor below which it stays quiet:
+//
+//	{"name": "error spikes", "condition": "anomaly", "sensitivity": 3,
+//	 "filter": {"level": "ERROR"}, "threshold": 10, "window": "5m", "channels": [...]}
+//
+// "condition": "absence" alerts on sources that stopped sending instead (see
+// sourceactivity.go), and "condition": "pattern" as soon as a line matching a regular
+// expression or grok pattern (see grok.go) is received, staying firing until none has
+// matched for a window:
+//
+//	{"name": "out of memory", "condition": "pattern", "pattern": "OutOfMemoryError|segfault",
+//	 "window": "10m", "channels": [...]}
+//
+// "condition": "change" compares the count with an earlier window, e.g. when 5xx responses
+// doubled compared with the previous hour:
+//
+//	{"name": "5xx doubled", "condition": "change", "factor": 2, "filter": {"q": "http_status>=500"},
+//	 "threshold": 20, "window": "1h", "channels": [...]}
+//
+// Silences (see silences.go) mute the notifications of matching rules, e.g. during maintenance.
+// Notified alerts are kept in the alert history (see alerthistory.go) and can be acknowledged.
+
+// maxAlertWindow bounds the window of a rule, which is scanned on every evaluation.
+const maxAlertWindow = 24 * time.Hour
+
+// maxCompareOffset bounds how far back change rules look for the window they compare with.
+const maxCompareOffset = 7 * 24 * time.Hour
+
+// alertSampleLines is the number of recent matching lines included in a firing event.
+const alertSampleLines = 5
+
+// AlertRule counts the entries matching Filter over the last Window. Condition decides
+// when it fires: threshold (the default) when the count is above Threshold, anomaly when a
+// source's count is Sensitivity standard deviations above its baseline (see anomaly.go),
+// absence when more than Threshold sources sent nothing in the window (see
+// sourceactivity.go), pattern as soon as an entry received matches Pattern, change when the
+// count is Factor times that of the window CompareOffset earlier (the preceding window by
+// default), or with a Factor below 1 has dropped to Factor times it; Threshold is then the
+// count the larger window must exceed. A firing rule
+// is notified again every RepeatInterval, if set. A rule with a Tenant only counts that
+// tenant's entries and sources. Disabled rules are kept but not evaluated.
+type AlertRule struct {
+	ID             int64             `json:"id"`
+	Name           string            `json:"name"`
+	Tenant         string            `json:"tenant,omitempty"`
+	Enabled        bool              `json:"enabled"`
+	Condition      string            `json:"condition"`
+	Filter         map[string]string `json:"filter"`
+	Threshold      int64             `json:"threshold"`
+	Window         string            `json:"window"`
+	Sensitivity    float64           `json:"sensitivity,omitempty"`
+	Pattern        string            `json:"pattern,omitempty"`
+	RepeatInterval string            `json:"repeat_interval,omitempty"`
+	Factor         float64           `json:"factor,omitempty"`
+	CompareOffset  string            `json:"compare_offset,omitempty"`
+	Channels       []AlertChannel    `json:"channels"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+
+	window  time.Duration
+	filter  entryFilter
+	pattern *regexp.Regexp
+	repeat  time.Duration
+	offset  time.Duration
+}
+
+// AlertChannel is a destination for a rule's notifications. Type selects the notifier;
+// which of the other settings apply depends on it. Template overrides the notifier's
+// default message text (see notify.go).
+type AlertChannel struct {
+	Type       string            `json:"type"`
+	URL        string            `json:"url,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Token      string            `json:"token,omitempty"`
+	Channel    string            `json:"channel,omitempty"`
+	To         []string          `json:"to,omitempty"`
+	Subject    string            `json:"subject,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	RoutingKey string            `json:"routing_key,omitempty"`
+	Severity   string            `json:"severity,omitempty"`
+}
+
+// validate normalizes r and checks its filter, window and channels.
+func (r *AlertRule) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+	switch r.Condition {
+	case "":
+		r.Condition = "threshold"
+	case "threshold":
+	case "anomaly":
+		if r.Sensitivity == 0 {
+			r.Sensitivity = defaultAnomalySensitivity
+		}
+		if r.Sensitivity < 0 {
+			return errors.New("sensitivity must be positive")
+		}
+	case "absence":
+		for k := range r.Filter {
+			if !slices.Contains(absenceFilterKeys, k) {
+				return fmt.Errorf("absence rules can only filter on %s", strings.Join(absenceFilterKeys, ", "))
+			}
+		}
+	case "pattern":
+		if r.Pattern == "" {
+			return errors.New("pattern is required")
+		}
+		var err error
+		if r.pattern, err = compilePattern(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	case "change":
+		if r.Factor <= 0 || r.Factor == 1 {
+			return errors.New("factor must be positive and not 1, such as 2 for a doubling or 0.5 for a halving")
+		}
+	default:
+		return fmt.Errorf("unknown condition %q: must be threshold, anomaly, absence, pattern or change", r.Condition)
+	}
+	if r.Pattern != "" && r.Condition != "pattern" {
+		return errors.New("pattern is only used by pattern rules")
+	}
+	if (r.Factor != 0 || r.CompareOffset != "") && r.Condition != "change" {
+		return errors.New("factor and compare_offset are only used by change rules")
+	}
+
+	var err error
+	r.window, err = time.ParseDuration(r.Window)
+	if err != nil || r.window <= 0 || r.window > maxAlertWindow {
+		return fmt.Errorf("window must be a duration between 1s and %s, such as 5m", maxAlertWindow)
+	}
+	r.offset = r.window
+	if r.CompareOffset != "" {
+		r.offset, err = time.ParseDuration(r.CompareOffset)
+		if err != nil || r.offset <= 0 || r.offset > maxCompareOffset {
+			return fmt.Errorf("compare_offset must be a duration between 1s and %s, such as 24h", maxCompareOffset)
+		}
+	}
+	r.repeat = 0
+	if r.RepeatInterval != "" {
+		r.repeat, err = time.ParseDuration(r.RepeatInterval)
+		if err != nil || r.repeat < time.Minute {
+			return errors.New("repeat_interval must be a duration of at least 1m, such as 4h")
+		}
+	}
+
+	if r.Filter == nil {
+		r.Filter = map[string]string{}
+	}
+	q := url.Values{}
+	for k, v := range r.Filter {
+		if k == "from" || k == "to" {
+			return fmt.Errorf("filter must not set %q; the window decides the time range", k)
+		}
+		q.Set(k, v)
+	}
+	r.filter, err = parseEntryFilter(q)
+	if err != nil {
+		return err
+	}
+	if r.Tenant != "" && !tenantExists(r.Tenant) {
+		return fmt.Errorf("unknown tenant %q", r.Tenant)
+	}
+	r.filter.Tenant = r.Tenant
+
+	if len(r.Channels) == 0 {
+		return errors.New("at least one channel is required")
+	}
+	for i, c := range r.Channels {
+		n, ok := notifiers[c.Type]
+		if !ok {
+			return fmt.Errorf("channel %d: unknown type %q", i+1, c.Type)
+		}
+		if err := n.validate(c); err != nil {
+			return fmt.Errorf("channel %d: %v", i+1, err)
+		}
+		if _, err := parseMessageTemplate(c.Template, ""); err != nil {
+			return fmt.Errorf("channel %d: invalid template: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// AlertEvent is sent to a rule's channels when it starts firing and when it resolves.
+type AlertEvent struct {
+	Rule        string            `json:"rule"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Status      string            `json:"status"`  // firing or resolved
+	Summary     string            `json:"summary"` // the condition's state, e.g. "52 entries in 5m (threshold 50)"
+	Count       int64             `json:"count"`
+	Threshold   int64             `json:"threshold"`
+	Window      string            `json:"window"`
+	Filter      map[string]string `json:"filter"`
+	StartsAt    time.Time         `json:"starts_at"`
+	EvaluatedAt time.Time         `json:"evaluated_at"`
+	Samples     []string          `json:"samples,omitempty"`   // most recent matching lines, when firing
+	QueryURL    string            `json:"query_url,omitempty"` // the matching entries, if PUBLIC_URL is set
+	Anomalies   []SourceAnomaly   `json:"anomalies,omitempty"` // sources above their baseline, for anomaly rules
+	Silent      []SourceActivity  `json:"silent,omitempty"`    // sources without entries, for absence rules
+	Previous    *int64            `json:"previous,omitempty"`  // count of the compared window, for change rules
+}
+
+// keepParsed copies what validate parsed from rule into r, the same rule read back after
+// it was stored.
+func (r *AlertRule) keepParsed(rule AlertRule) {
+	r.window, r.filter, r.pattern, r.repeat, r.offset = rule.window, rule.filter, rule.pattern, rule.repeat, rule.offset
+}
+
+// alerter evaluates the rules and remembers which of them are firing.
+type alerter struct {
+	interval    time.Duration
+	groupWindow time.Duration
+	publicURL   string
+
+	mu        sync.Mutex
+	rules     map[int64]AlertRule
+	firing    map[int64]firingAlert
+	baselines map[int64]map[string]*ewmaBaseline // anomaly rule to per-source baselines
+	silences  map[int64]Silence
+}
+
+// firingAlert is a rule that is firing, or was until less than groupWindow ago.
+type firingAlert struct {
+	rule           AlertRule
+	startsAt       time.Time
+	notifiedAt     time.Time // zero while the firing notification is held back by a silence
+	resolvingSince time.Time // set while it is not firing, until groupWindow has passed
+	lastMatch      time.Time // pattern rules only
+	acknowledged   bool      // no repeat notifications, see alerthistory.go
+}
+
+// alerts holds the rules, set up by setupAlerts.
+var alerts = &alerter{
+	rules:     map[int64]AlertRule{},
+	firing:    map[int64]firingAlert{},
+	baselines: map[int64]map[string]*ewmaBaseline{},
+	silences:  map[int64]Silence{},
+}
+
+// setupAlerts loads the stored rules, applies ALERT_RULES and starts evaluating them.
+func setupAlerts() {
+	publicURL := strings.TrimRight(setting("PUBLIC_URL"), "/")
+	if publicURL != "" {
+		if err := validateHTTPURL(publicURL); err != nil {
+			fatalConfig("Invalid PUBLIC_URL", "err", err)
+		}
+	}
+	alerts.interval = envDuration("ALERT_INTERVAL", time.Minute)
+	alerts.groupWindow = envDuration("ALERT_GROUP_WINDOW", 0)
+	alerts.publicURL = publicURL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stored, err := listAlertRules(ctx, nil, math.MaxInt32)
+	if err != nil {
+		fatal("Failed to load alert rules", "err", err)
+	}
+	for _, rule := range stored {
+		// A rule can become invalid when the environment changes, e.g. SMTP_HOST is unset.
+		if err := rule.validate(); err != nil {
+			slog.Warn("Skipping invalid alert rule", "id", rule.ID, "name", rule.Name, "err", err)
+			continue
+		}
+		alerts.put(rule)
+	}
+
+	silences, err := loadSilences(ctx)
+	if err != nil {
+		fatal("Failed to load alert silences", "err", err)
+	}
+	for _, s := range silences {
+		alerts.silences[s.ID] = s
+	}
+
+	if path := setting("ALERT_RULES"); path != "" {
+		rules, err := loadAlertRules(path)
+		if err != nil {
+			fatalConfig("Failed to load ALERT_RULES", "path", path, "err", err)
+		}
+		if err := applyAlertRules(ctx, rules); err != nil {
+			fatal("Failed to save alert rule from ALERT_RULES", "err", err)
+		}
+	}
+
+	go alerts.run()
+	slog.Info("Evaluating alert rules", "rules", len(alerts.rules), "interval", alerts.interval)
+}
+
+// applyAlertRules saves the rules of ALERT_RULES, replacing the stored rules of the same
+// name, and evaluates them from now on.
+func applyAlertRules(ctx context.Context, rules []AlertRule) error {
+	for _, rule := range rules {
+		saved, err := upsertAlertRule(ctx, rule)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		saved.keepParsed(rule)
+		alerts.put(saved)
+	}
+	return nil
+}
+
+// put adds or replaces a validated rule. Baselines are learnt again, as the filter or
+// window may have changed.
+func (a *alerter) put(rule AlertRule) {
+	a.mu.Lock()
+	a.rules[rule.ID] = rule
+	delete(a.baselines, rule.ID)
+	a.mu.Unlock()
+}
+
+// remove forgets a deleted rule.
+func (a *alerter) remove(id int64) {
+	a.mu.Lock()
+	delete(a.rules, id)
+	delete(a.baselines, id)
+	a.mu.Unlock()
+}
+
+// loadAlertRules reads and validates a JSON array of rules.
+func loadAlertRules(path string) ([]AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []AlertRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Enabled = true
+	}
+	names := map[string]bool{}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if names[rules[i].Name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %q", i+1, rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return rules, nil
+}
+
+// run evaluates every enabled rule once per interval. Rules that were firing when they
+// were disabled or deleted are resolved.
+func (a *alerter) run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.mu.Lock()
+		var enabled []AlertRule
+		for _, rule := range a.rules {
+			if rule.Enabled {
+				enabled = append(enabled, rule)
+			}
+		}
+		var gone []firingAlert
+		for id, f := range a.firing {
+			if rule, ok := a.rules[id]; !ok || !rule.Enabled {
+				gone = append(gone, f)
+				delete(a.firing, id)
+			}
+		}
+		a.mu.Unlock()
+
+		for _, rule := range enabled {
+			a.evaluate(rule)
+		}
+		for _, f := range gone {
+			a.resolveRemoved(f)
+		}
+	}
+}
+
+// resolveRemoved sends the resolved event of a rule that was disabled or deleted while firing.
+func (a *alerter) resolveRemoved(f firingAlert) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.interval)
+	defer cancel()
+
+	if f.notifiedAt.IsZero() {
+		return
+	}
+	slog.Info("Alert rule is resolved: it was disabled or deleted", "rule", f.rule.Name)
+	a.notify(ctx, f.rule, AlertEvent{
+		Rule:        f.rule.Name,
+		Tenant:      f.rule.Tenant,
+		Status:      "resolved",
+		Threshold:   f.rule.Threshold,
+		Window:      f.rule.Window,
+		Filter:      f.rule.Filter,
+		StartsAt:    f.startsAt,
+		EvaluatedAt: time.Now(),
+	})
+}
+
+// evaluate counts the entries of rule's window and notifies its channels if the rule
+// started or stopped firing.
+func (a *alerter) evaluate(rule AlertRule) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.interval)
+	defer cancel()
+
+	now := time.Now()
+	filter := rule.filter
+	filter.From = now.Add(-rule.window)
+
+	var count, previous int64
+	var counts map[string]int64
+	var silent []SourceActivity
+	var err error
+	switch rule.Condition {
+	case "anomaly":
+		counts, err = countBySource(ctx, filter)
+	case "absence":
+		silent, err = loadSourceActivity(ctx, filter, filter.From)
+		count = int64(len(silent))
+	case "pattern":
+		// Fired at ingest by matchPatterns; resolved below once nothing matched for a window.
+	case "change":
+		count, err = countEntries(ctx, filter)
+		if err == nil {
+			earlier := filter
+			earlier.From, earlier.To = filter.From.Add(-rule.offset), now.Add(-rule.offset)
+			previous, err = countEntries(ctx, earlier)
+		}
+	default:
+		count, err = countEntries(ctx, filter)
+	}
+	if err != nil {
+		slog.Error("Error evaluating alert rule", "rule", rule.Name, "err", err)
+		return
+	}
+
+	a.mu.Lock()
+	if current, ok := a.rules[rule.ID]; !ok || !current.Enabled {
+		// Disabled or deleted during the evaluation; run resolves it if it was firing.
+		a.mu.Unlock()
+		return
+	}
+	firing := count > rule.Threshold
+	var anomalies []SourceAnomaly
+	switch rule.Condition {
+	case "anomaly":
+		anomalies = a.detectAnomalies(rule, counts)
+		firing = len(anomalies) > 0
+		for _, n := range counts {
+			count += n
+		}
+	case "pattern":
+		lastMatch := a.firing[rule.ID].lastMatch
+		firing = !lastMatch.IsZero() && !lastMatch.Before(filter.From)
+	case "change":
+		if rule.Factor > 1 {
+			firing = firing && float64(count) >= rule.Factor*float64(previous)
+		} else {
+			firing = previous > rule.Threshold && float64(count) <= rule.Factor*float64(previous)
+		}
+	}
+	f, status := a.transition(rule, firing, now)
+	a.mu.Unlock()
+
+	if status == "" {
+		return
+	}
+	event := AlertEvent{
+		Rule:        rule.Name,
+		Tenant:      rule.Tenant,
+		Status:      status,
+		Summary:     fmt.Sprintf("%d entries in %s (threshold %d)", count, rule.Window, rule.Threshold),
+		Count:       count,
+		Threshold:   rule.Threshold,
+		Window:      rule.Window,
+		Filter:      rule.Filter,
+		StartsAt:    f.startsAt,
+		EvaluatedAt: now,
+		Anomalies:   anomalies,
+		Silent:      silent,
+	}
+	switch rule.Condition {
+	case "anomaly":
+		event.Summary = fmt.Sprintf("%d entries in %s, %d sources above their baseline", count, rule.Window, len(anomalies))
+	case "absence":
+		event.Summary = fmt.Sprintf("%d sources sent nothing in %s (threshold %d)", count, rule.Window, rule.Threshold)
+	case "pattern":
+		event.Summary = fmt.Sprintf("no entries matched %s in %s", rule.Pattern, rule.Window)
+		if firing {
+			event.Summary = fmt.Sprintf("entries matching %s were received in the last %s", rule.Pattern, rule.Window)
+		}
+	case "change":
+		offset := rule.CompareOffset
+		if offset == "" {
+			offset = rule.Window
+		}
+		event.Previous = &previous
+		event.Summary = fmt.Sprintf("%d entries in %s vs %d %s earlier (factor %g)", count, rule.Window, previous, offset, rule.Factor)
+		if firing {
+			event.Samples = sampleLines(ctx, filter)
+		}
+	default:
+		if firing {
+			event.Samples = sampleLines(ctx, filter)
+		}
+	}
+	if a.publicURL != "" && rule.Condition != "absence" {
+		event.QueryURL = a.publicURL + "/api/logs?" + filterQuery(rule.Filter, filter.From, now).Encode()
+	}
+	slog.Info("Alert rule is "+event.Status, "rule", rule.Name, "summary", event.Summary)
+	a.notify(ctx, rule, event)
+}
+
+// notify sends event to rule's channels and records it in the alert history.
+func (a *alerter) notify(ctx context.Context, rule AlertRule, event AlertEvent) {
+	results := notifyChannels(ctx, rule.Channels, event)
+	if err := recordAlert(ctx, rule, event, results); err != nil {
+		slog.ErrorContext(ctx, "Error recording alert in the history", "rule", rule.Name, "err", err)
+	}
+}
+
+// transition records whether rule is firing at now and returns its state with the status
+// to notify, or "" if no notification is due. a.mu must be held.
+//
+// A rule that stops firing is only resolved once it has not fired again for groupWindow,
+// so a flapping rule sends one firing and one resolved notification. While a silence
+// matches the rule, its firing notification is held back and sent if it is still firing
+// when the silence ends; the resolved one is only sent if the firing one was. A rule with
+// a repeat interval is notified again for as long as it keeps firing, until the alert is
+// acknowledged.
+func (a *alerter) transition(rule AlertRule, firing bool, now time.Time) (firingAlert, string) {
+	f, active := a.firing[rule.ID]
+	if !firing {
+		if !active {
+			return f, ""
+		}
+		if f.resolvingSince.IsZero() {
+			f.resolvingSince = now
+		}
+		if now.Sub(f.resolvingSince) < a.groupWindow {
+			a.firing[rule.ID] = f
+			return f, ""
+		}
+		delete(a.firing, rule.ID)
+		if f.notifiedAt.IsZero() {
+			return f, ""
+		}
+		return f, "resolved"
+	}
+
+	if !active {
+		f = firingAlert{startsAt: now}
+	}
+	f.rule = rule
+	f.resolvingSince = time.Time{}
+	status := ""
+	repeat := rule.repeat > 0 && !f.acknowledged && now.Sub(f.notifiedAt) >= rule.repeat
+	if (f.notifiedAt.IsZero() || repeat) && !a.silenced(rule, now) {
+		f.notifiedAt = now
+		status = "firing"
+	}
+	a.firing[rule.ID] = f
+	return f, status
+}
+
+// matchPatterns checks newly stored entries against the enabled pattern rules. A rule that
+// matches starts firing immediately; evaluate resolves it once nothing matched for its window.
+func (a *alerter) matchPatterns(entries []StoredEntry) {
+	now := time.Now()
+	var events []AlertEvent
+	var rules []AlertRule
+
+	a.mu.Lock()
+	for _, rule := range a.rules {
+		if !rule.Enabled || rule.Condition != "pattern" {
+			continue
+		}
+		var matched []string
+		for _, e := range entries {
+			line := entryLine(e.LogEntry)
+			if rule.filter.Matches(e) && rule.pattern.MatchString(line) {
+				matched = append(matched, line)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		f, status := a.transition(rule, true, now)
+		f.lastMatch = now
+		a.firing[rule.ID] = f
+		if status == "" {
+			continue
+		}
+
+		event := AlertEvent{
+			Rule:        rule.Name,
+			Tenant:      rule.Tenant,
+			Status:      status,
+			Summary:     fmt.Sprintf("%d entries matched %s", len(matched), rule.Pattern),
+			Count:       int64(len(matched)),
+			Threshold:   rule.Threshold,
+			Window:      rule.Window,
+			Filter:      rule.Filter,
+			StartsAt:    f.startsAt,
+			EvaluatedAt: now,
+			Samples:     matched[:min(len(matched), alertSampleLines)],
+		}
+		if a.publicURL != "" {
+			event.QueryURL = a.publicURL + "/api/logs?" + filterQuery(rule.Filter, now.Add(-rule.window), now).Encode()
+		}
+		events = append(events, event)
+		rules = append(rules, rule)
+	}
+	a.mu.Unlock()
+
+	// Notify in the background so ingestion doesn't wait for the channels.
+	for i, event := range events {
+		slog.Info("Alert rule is "+event.Status, "rule", event.Rule, "summary", event.Summary)
+		go a.notify(context.Background(), rules[i], event)
+	}
+}
+
+// sampleLines returns the most recent lines matching filter, or nil if they can't be read.
+func sampleLines(ctx context.Context, filter entryFilter) []string {
+	entries, err := store.LatestEntries(ctx, filter, nil, alertSampleLines)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading alert sample lines", "err", err)
+		return nil
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = entryLine(e.LogEntry)
+	}
+	return lines
+}
+
+// filterQuery returns the query parameters selecting filter's entries between from and to.
+func filterQuery(filter map[string]string, from, to time.Time) url.Values {
+	q := url.Values{}
+	for k, v := range filter {
+		q.Set(k, v)
+	}
+	q.Set("from", from.UTC().Format(time.RFC3339))
+	q.Set("to", to.UTC().Add(time.Second).Format(time.RFC3339))
+	return q
+}
+
+// countEntries returns the number of lines matching filter, counting collapsed repeats.
+func countEntries(ctx context.Context, filter entryFilter) (int64, error) {
+	var args sqlArgs
+	sql := `
+	SELECT COALESCE(sum(e.repeats), 0)::bigint
+	FROM delogged_entries e
+	JOIN delogged d ON d.id = e.log_id
+	` + filter.where(&args)
+
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	var count int64
+	err := dbPool.QueryRow(ctx, sql, args...).Scan(&count)
+	return count, err
+}
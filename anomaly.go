@@ -0,0 +1,116 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Anomaly rules (condition "anomaly") learn a baseline of each source's count of matching
+// entries per window and fire when a source's current count is more than sensitivity
+// standard deviations above it, and above threshold. This catches a jump from 2 to 40
+// errors on a quiet source as well as from 500 to 5000 on a busy one, which a single
+// threshold cannot. Baselines are exponentially weighted moving averages updated at every
+// evaluation and kept in memory, so they are learnt again after a restart.
+
+// Anomaly detection parameters.
+const (
+	defaultAnomalySensitivity = 3.0
+	anomalyAlpha              = 0.1 // weight of the newest count in the baseline
+	anomalyWarmup             = 10  // evaluations before a source's baseline is trusted
+)
+
+// ewmaBaseline is the moving mean and variance of one source's count.
+type ewmaBaseline struct {
+	mean, variance float64
+	n              int
+}
+
+// update adds an observation.
+func (b *ewmaBaseline) update(x float64) {
+	if b.n == 0 {
+		b.mean = x
+	} else {
+		diff := x - b.mean
+		incr := anomalyAlpha * diff
+		b.mean += incr
+		b.variance = (1 - anomalyAlpha) * (b.variance + diff*incr)
+	}
+	b.n++
+}
+
+// stddev is the baseline's standard deviation, at least that of a Poisson process with
+// the same mean and at least 1, so near-constant sources don't alert on tiny changes.
+func (b *ewmaBaseline) stddev() float64 {
+	return max(math.Sqrt(b.variance), math.Sqrt(b.mean), 1)
+}
+
+// SourceAnomaly is a source whose count is far above its baseline.
+type SourceAnomaly struct {
+	Source   string  `json:"source"`
+	Count    int64   `json:"count"`
+	Baseline float64 `json:"baseline"`
+	StdDev   float64 `json:"stddev"`
+}
+
+// countBySource returns the number of entries matching filter per source.
+func countBySource(ctx context.Context, filter entryFilter) (map[string]int64, error) {
+	var args sqlArgs
+	sql := `
+	SELECT ` + sourceExpr + `, count(*)
+	FROM delogged_entries e
+	JOIN delogged d ON d.id = e.log_id
+	` + filter.where(&args) + `
+	GROUP BY 1`
+
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	var source string
+	var count int64
+	_, err = pgx.ForEachRow(rows, []any{&source, &count}, func() error {
+		counts[source] = count
+		return nil
+	})
+	return counts, err
+}
+
+// detectAnomalies compares counts with rule's baselines, then adds them to the baselines.
+// Sources that stopped sending count as 0 until their baseline decays.
+// a.mu must be held.
+func (a *alerter) detectAnomalies(rule AlertRule, counts map[string]int64) []SourceAnomaly {
+	baselines := a.baselines[rule.ID]
+	if baselines == nil {
+		baselines = map[string]*ewmaBaseline{}
+		a.baselines[rule.ID] = baselines
+	}
+	for source := range counts {
+		if baselines[source] == nil {
+			baselines[source] = &ewmaBaseline{}
+		}
+	}
+
+	var anomalies []SourceAnomaly
+	for source, b := range baselines {
+		count := counts[source]
+		x := float64(count)
+		if b.n >= anomalyWarmup && count > rule.Threshold && x > b.mean+rule.Sensitivity*b.stddev() {
+			anomalies = append(anomalies, SourceAnomaly{Source: source, Count: count, Baseline: b.mean, StdDev: b.stddev()})
+		}
+		b.update(x)
+		if count == 0 && b.mean < 0.01 {
+			delete(baselines, source)
+		}
+	}
+
+	slices.SortFunc(anomalies, func(x, y SourceAnomaly) int { return cmp.Compare(y.Count, x.Count) })
+	return anomalies
+}
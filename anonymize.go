@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// IP anonymization rewrites the IP addresses in ingested lines before they are parsed or stored.
+// IP_ANONYMIZE sets the default mode and /api/ip-anonymization overrides it per source:
+//
+//	off       keep addresses as they are (default)
+//	truncate  zero the host part: the last octet of IPv4, everything after /48 for IPv6
+//	hash      replace with "ip-" and the start of HMAC-SHA256(IP_ANONYMIZE_KEY, address)
+//
+// Truncated addresses still resolve to a country for GeoIP; hashed ones stay joinable
+// across entries without being reversible.
+
+// ipAnonymizeModes lists the accepted modes.
+var ipAnonymizeModes = []string{"off", "truncate", "hash"}
+
+// ipCandidateRegex finds text that may be an IPv4 or IPv6 address; netip decides.
+var ipCandidateRegex = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f]{1,4})?|(?:\d{1,3}\.){3}\d{1,3}`)
+
+// ipAnonymization holds the default mode, the HMAC key and the per-source modes from source_ip_modes.
+var ipAnonymization = struct {
+	sync.RWMutex
+	defaultMode string
+	key         []byte
+	bySource    map[string]string
+}{defaultMode: "off", bySource: map[string]string{}}
+
+// loadIPAnonymization reads IP_ANONYMIZE, IP_ANONYMIZE_KEY and the per-source modes into memory.
+func loadIPAnonymization() {
+	defaultMode := "off"
+	if v := setting("IP_ANONYMIZE"); v != "" {
+		defaultMode = v
+	}
+	if !slices.Contains(ipAnonymizeModes, defaultMode) {
+		fatalConfig("Invalid IP_ANONYMIZE: must be one of "+strings.Join(ipAnonymizeModes, ", "), "value", defaultMode)
+	}
+	key := []byte(secretEnv("IP_ANONYMIZE_KEY"))
+
+	bySource := map[string]string{}
+	if !inMemory() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		rows, err := dbPool.Query(ctx, `SELECT source, mode FROM source_ip_modes`)
+		if err != nil {
+			fatal("Failed to load IP anonymization modes", "err", err)
+		}
+		var source, mode string
+		_, err = pgx.ForEachRow(rows, []any{&source, &mode}, func() error {
+			bySource[source] = mode
+			return nil
+		})
+		if err != nil {
+			fatal("Failed to load IP anonymization modes", "err", err)
+		}
+	}
+
+	usesHash := defaultMode == "hash"
+	for _, mode := range bySource {
+		usesHash = usesHash || mode == "hash"
+	}
+	if usesHash && len(key) == 0 {
+		fatalConfig("IP_ANONYMIZE_KEY is required when IP addresses are hashed")
+	}
+
+	ipAnonymization.Lock()
+	ipAnonymization.defaultMode = defaultMode
+	ipAnonymization.key = key
+	ipAnonymization.bySource = bySource
+	ipAnonymization.Unlock()
+}
+
+// anonymizeIPs rewrites every IP address in text according to source's mode.
+func anonymizeIPs(text, source string) string {
+	ipAnonymization.RLock()
+	mode, ok := ipAnonymization.bySource[source]
+	if !ok {
+		mode = ipAnonymization.defaultMode
+	}
+	key := ipAnonymization.key
+	ipAnonymization.RUnlock()
+
+	if mode == "off" {
+		return text
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range ipCandidateRegex.FindAllStringIndex(text, -1) {
+		start, end := m[0], m[1]
+		// Skip parts of longer tokens such as version numbers 1.2.3.4.5 or hex ids.
+		if start > 0 && (isAlnum(text[start-1]) || text[start-1] == '.') || end < len(text) && isAlnum(text[end]) ||
+			end+1 < len(text) && text[end] == '.' && text[end+1] >= '0' && text[end+1] <= '9' {
+			continue
+		}
+		addr, err := netip.ParseAddr(text[start:end])
+		if err != nil || addr.IsUnspecified() {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(anonymizeIP(addr, mode, key))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// anonymizeIP applies mode to one address.
+func anonymizeIP(addr netip.Addr, mode string, key []byte) string {
+	switch mode {
+	case "truncate":
+		bits := 48
+		if addr.Unmap().Is4() {
+			addr, bits = addr.Unmap(), 24
+		}
+		prefix, _ := addr.Prefix(bits)
+		return prefix.Addr().String()
+	case "hash":
+		mac := hmac.New(sha256.New, key)
+		mac.Write(addr.Unmap().AsSlice())
+		return "ip-" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return addr.String()
+}
+
+// SourceIPMode is the anonymization mode applied to the addresses in a source's lines.
+type SourceIPMode struct {
+	Source string `json:"source"`
+	Mode   string `json:"mode"`
+}
+
+// SourceIPModes is the response of GET /api/ip-anonymization.
+type SourceIPModes struct {
+	Default string         `json:"default"`
+	Sources []SourceIPMode `json:"sources"`
+}
+
+// listIPModesHandler handles GET /api/ip-anonymization.
+func listIPModesHandler(w http.ResponseWriter, r *http.Request) {
+	ipAnonymization.RLock()
+	result := SourceIPModes{Default: ipAnonymization.defaultMode, Sources: []SourceIPMode{}}
+	for source, mode := range ipAnonymization.bySource {
+		result.Sources = append(result.Sources, SourceIPMode{Source: source, Mode: mode})
+	}
+	ipAnonymization.RUnlock()
+
+	slices.SortFunc(result.Sources, func(a, b SourceIPMode) int { return strings.Compare(a.Source, b.Source) })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// putIPModeHandler handles PUT /api/ip-anonymization/{source}, setting the mode of a source.
+// It applies to requests received from then on.
+func putIPModeHandler(w http.ResponseWriter, r *http.Request) {
+	var m SourceIPMode
+	if err := readJSON(r, &m); err != nil {
+		http.Error(w, "Invalid IP anonymization mode: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	m.Source = r.PathValue("source")
+	if !slices.Contains(ipAnonymizeModes, m.Mode) {
+		http.Error(w, "Invalid IP anonymization mode: must be one of "+strings.Join(ipAnonymizeModes, ", "), http.StatusBadRequest)
+		return
+	}
+
+	ipAnonymization.RLock()
+	noKey := len(ipAnonymization.key) == 0
+	ipAnonymization.RUnlock()
+	if m.Mode == "hash" && noKey {
+		http.Error(w, "Invalid IP anonymization mode: hash requires IP_ANONYMIZE_KEY to be set", http.StatusBadRequest)
+		return
+	}
+
+	_, err := dbPool.Exec(r.Context(), `
+	INSERT INTO source_ip_modes (source, mode) VALUES ($1, $2)
+	ON CONFLICT (source) DO UPDATE SET mode = EXCLUDED.mode`,
+		m.Source, m.Mode)
+	if err != nil {
+		http.Error(w, "Could not save IP anonymization mode", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving IP anonymization mode", "source", m.Source, "err", err)
+		return
+	}
+
+	ipAnonymization.Lock()
+	ipAnonymization.bySource[m.Source] = m.Mode
+	ipAnonymization.Unlock()
+
+	slog.InfoContext(r.Context(), "Set IP anonymization mode", "source", m.Source, "mode", m.Mode)
+	writeJSON(w, http.StatusOK, m)
+}
+
+// deleteIPModeHandler handles DELETE /api/ip-anonymization/{source}, reverting the source to the default.
+func deleteIPModeHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM source_ip_modes WHERE source = $1`, source)
+	if err != nil {
+		http.Error(w, "Could not delete IP anonymization mode", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting IP anonymization mode", "source", source, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Source IP anonymization mode not found", http.StatusNotFound)
+		return
+	}
+
+	ipAnonymization.Lock()
+	delete(ipAnonymization.bySource, source)
+	ipAnonymization.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted IP anonymization mode", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
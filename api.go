@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"delogger/api"
+)
+
+// apiParam documents a query or path parameter.
+type apiParam = api.Param
+
+// apiRoute is one operation of the HTTP API. Routes are registered on the mux and
+// described in /api/openapi.json from this single table, so the two cannot drift apart.
+// The fields up to OwnMethods are those of api.Route; the others say how the server wraps
+// the handler.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Params  []apiParam
+	// Request is the JSON request body type, or nil.
+	Request any
+	// RequestType is the content type of a non-JSON request body.
+	RequestType string
+	// Response is the JSON response body type, or nil.
+	Response any
+	// ResponseType is the content type of a non-JSON response body.
+	ResponseType string
+	Status       int
+	Handler      http.HandlerFunc
+	// OwnMethods marks handlers that check the method themselves; they are registered
+	// for the bare path so they can answer 405 their own way.
+	OwnMethods bool
+	// Audit is the table changed by a mutating admin route, to record its calls in the
+	// audit log (see audit.go).
+	Audit string
+	// Public routes are served without authentication (see auth.go).
+	Public bool
+	// Admin marks routes requiring the admin role that change no audited table, e.g. the
+	// audit log.
+	Admin bool
+	// Tenanted routes limit what they return to the caller's tenant, and are the only
+	// ones open to tenant keys (see tenants.go).
+	Tenanted bool
+	// Memory routes are served when records are stored in memory; the others answer 501
+	// (see storage.go).
+	Memory bool
+	// Management routes are served on ADMIN_ADDR instead of the API's sockets when it is
+	// set (see listen.go).
+	Management bool
+	// Stream routes respond for as long as the client wants, exempt from the server's read
+	// and write timeouts (see server.go).
+	Stream bool
+	// Query routes read stored entries; their calls are metered as queries (see usage.go).
+	Query bool
+	// Input is the input of DISABLE_INPUTS the route serves; it isn't registered when the
+	// input is disabled (see features.go).
+	Input string
+}
+
+// filterParams are the entry filter parameters accepted by every read endpoint.
+var filterParams = []apiParam{
+	{Name: "from", In: "query", Type: "string", Description: "Only entries received at or after this RFC 3339 time."},
+	{Name: "to", In: "query", Type: "string", Description: "Only entries received before this RFC 3339 time."},
+	{Name: "level", In: "query", Type: "string", Description: "Exact level, case-insensitive."},
+	{Name: "contains", In: "query", Type: "string", Description: "Substring of the message or raw line, case-insensitive."},
+	{Name: "status", In: "query", Type: "integer", Description: "HTTP status of the ingest request."},
+	{Name: "host", In: "query", Type: "string", Description: "Exact X-DeLogger-Host of the ingest request."},
+	{Name: "service", In: "query", Type: "string", Description: "Exact X-DeLogger-Service of the ingest request."},
+	{Name: "env", In: "query", Type: "string", Description: "Exact X-DeLogger-Env of the ingest request."},
+	{Name: "regex", In: "query", Type: "string", Description: "RE2-compatible pattern matched against the original line."},
+	{Name: "q", In: "query", Type: "string", Description: `Query expression, e.g. level=error AND msg~"timeout" AND status>=500.`},
+}
+
+// pageParams are the keyset pagination parameters of list endpoints.
+var pageParams = []apiParam{
+	{Name: "limit", In: "query", Type: "integer", Description: "Page size."},
+	{Name: "cursor", In: "query", Type: "string", Description: "next_cursor from the previous page."},
+}
+
+var (
+	idParam      = apiParam{Name: "id", In: "path", Type: "integer", Required: true}
+	aliasParam   = apiParam{Name: "alias", In: "path", Type: "string", Required: true}
+	sourceParam  = apiParam{Name: "source", In: "path", Type: "string", Required: true, Description: "Client address without the port."}
+	tenantParam  = apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "Tenant id."}
+	projectParam = apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "Project id."}
+
+	sourceTokenParam = apiParam{Name: sourceTokenHeader, In: "header", Type: "string", Description: "Token of the registered source sending the payload."}
+)
+
+func params(groups ...[]apiParam) []apiParam {
+	var all []apiParam
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// apiRoutes lists every endpoint served by the backend.
+var apiRoutes = []apiRoute{
+	{Method: "POST", Path: "/api/parse", Summary: "Parse and store log text",
+		Params: []apiParam{
+			{Name: "X-DeLogger-Host", In: "header", Type: "string", Description: "Host the lines come from."},
+			{Name: "X-DeLogger-Service", In: "header", Type: "string", Description: "Service the lines come from."},
+			{Name: "X-DeLogger-Env", In: "header", Type: "string", Description: "Environment, e.g. prod or staging."},
+			sourceTokenParam,
+			{Name: "dry_run", In: "query", Type: "boolean", Description: "true to answer as /api/parse/preview, storing nothing."},
+		},
+		RequestType: "text/plain", Response: []LogEntry{}, Public: true, Tenanted: true, Memory: true, Input: "parse", Handler: parseHandler, OwnMethods: true},
+	{Method: "POST", Path: "/api/parse/preview", Summary: "Parse and enrich log text as /api/parse would, without storing it",
+		Params: []apiParam{
+			{Name: "X-DeLogger-Host", In: "header", Type: "string", Description: "Host the lines come from."},
+			{Name: "X-DeLogger-Service", In: "header", Type: "string", Description: "Service the lines come from."},
+			{Name: "X-DeLogger-Env", In: "header", Type: "string", Description: "Environment, e.g. prod or staging."},
+			sourceTokenParam,
+		},
+		RequestType: "text/plain", Response: ParsePreview{}, Public: true, Tenanted: true, Memory: true, Input: "preview", Handler: previewHandler},
+	{Method: "POST", Path: "/api/parse/archive", Summary: "Parse and store the log files of a zip, tar or tar.gz archive, or a gzipped log file",
+		Params: []apiParam{
+			{Name: "X-DeLogger-Host", In: "header", Type: "string", Description: "Host the files come from."},
+			{Name: "X-DeLogger-Service", In: "header", Type: "string", Description: "Service the files come from."},
+			{Name: "X-DeLogger-Env", In: "header", Type: "string", Description: "Environment, e.g. prod or staging."},
+			sourceTokenParam,
+		},
+		RequestType: "application/zip", Response: ArchiveResult{}, Public: true, Tenanted: true, Memory: true, Input: "archive", Handler: parseArchiveHandler},
+	{Method: "GET", Path: "/api/export", Summary: "Export matching entries as NDJSON or Parquet",
+		Params: params(filterParams, []apiParam{
+			{Name: "format", In: "query", Type: "string", Description: "ndjson (default) or parquet."},
+			{Name: "columns", In: "query", Type: "string", Description: "Comma-separated columns to export, in order; every field by default."},
+			{Name: "search", In: "query", Type: "integer", Description: "Saved search supplying default parameters."},
+		}),
+		ResponseType: "application/x-ndjson", Tenanted: true, Memory: true, Stream: true, Query: true, Handler: exportHandler, OwnMethods: true},
+	{Method: "GET", Path: "/api/logs", Summary: "List matching entries, newest first",
+		Params: params(filterParams, pageParams), Response: LogsPage{}, Tenanted: true, Memory: true, Query: true, Handler: logsHandler},
+	{Method: "GET", Path: "/api/records/{id}", Summary: "A stored ingest request with its body and parse result, decrypted",
+		Params: []apiParam{idParam}, Response: StoredRecord{}, Admin: true, Handler: getRecordHandler},
+	{Method: "GET", Path: "/api/logs/{id}/context", Summary: "Entries around one entry from the same source",
+		Params: []apiParam{idParam,
+			{Name: "before", In: "query", Type: "integer"},
+			{Name: "after", In: "query", Type: "integer"},
+		},
+		Response: EntryContext{}, Tenanted: true, Query: true, Handler: contextHandler},
+	{Method: "GET", Path: "/api/correlate/{id}", Summary: "Entries carrying a correlation, trace or request id",
+		Params:   []apiParam{{Name: "id", In: "path", Type: "string", Required: true}},
+		Response: Correlation{}, Tenanted: true, Query: true, Handler: correlateHandler},
+	{Method: "GET", Path: "/api/tail", Summary: "Stream new matching entries as Server-Sent Events",
+		Params: filterParams, ResponseType: "text/event-stream", Tenanted: true, Memory: true, Stream: true, Query: true, Handler: tailHandler},
+	{Method: "GET", Path: "/api/tail/ws", Summary: "Stream new matching entries over a WebSocket, after a backfill",
+		Params: params(filterParams, []apiParam{{Name: "backfill", In: "query", Type: "integer"}}),
+		Status: http.StatusSwitchingProtocols, Tenanted: true, Memory: true, Stream: true, Query: true, Handler: tailWSHandler},
+	{Method: "GET", Path: "/api/stats", Summary: "Ingestion statistics",
+		Response: IngestStats{}, Query: true, Handler: statsHandler},
+	{Method: "GET", Path: "/api/stats/top-errors", Summary: "Most frequent error message templates",
+		Params: params(filterParams, []apiParam{{Name: "limit", In: "query", Type: "integer"}}), Response: TopErrors{}, Tenanted: true, Query: true, Handler: topErrorsHandler},
+	{Method: "GET", Path: "/api/stats/latency", Summary: "Request duration percentiles of the busiest access log paths",
+		Params: params(filterParams, []apiParam{{Name: "limit", In: "query", Type: "integer"}}), Response: LatencyStats{}, Tenanted: true, Query: true, Handler: latencyStatsHandler},
+	{Method: "GET", Path: "/api/facets", Summary: "Distinct values of a field with counts",
+		Params: params([]apiParam{{Name: "field", In: "query", Type: "string", Required: true}}, filterParams,
+			[]apiParam{{Name: "limit", In: "query", Type: "integer"}}),
+		Response: Facets{}, Tenanted: true, Query: true, Handler: facetsHandler},
+	{Method: "GET", Path: "/api/templates", Summary: "Mined message templates with counts",
+		Params: []apiParam{
+			{Name: "sort", In: "query", Type: "string", Description: "count (default) or new"},
+			{Name: "since", In: "query", Type: "string", Description: "Only templates first seen at or after this RFC 3339 time"},
+			{Name: "limit", In: "query", Type: "integer"},
+		},
+		Response: LogTemplates{}, Handler: templatesHandler},
+	{Method: "GET", Path: "/api/issues", Summary: "Error entries grouped into issues by service and template",
+		Params: []apiParam{
+			{Name: "status", In: "query", Type: "string", Description: "unresolved (default), resolved, ignored or all"},
+			{Name: "service", In: "query", Type: "string"},
+			{Name: "sort", In: "query", Type: "string", Description: "last_seen (default), first_seen or count"},
+			{Name: "limit", In: "query", Type: "integer"},
+		},
+		Response: Issues{}, Handler: listIssuesHandler},
+	{Method: "GET", Path: "/api/issues/{id}", Summary: "An issue and its latest entries",
+		Params: []apiParam{idParam}, Response: IssueDetail{}, Handler: getIssueHandler},
+	{Method: "POST", Path: "/api/issues/{id}/resolve", Summary: "Resolve an issue; it reopens if it occurs again",
+		Params: []apiParam{idParam}, Response: Issue{}, Audit: "issues", Handler: setIssueStatusHandler("resolved")},
+	{Method: "POST", Path: "/api/issues/{id}/ignore", Summary: "Ignore an issue, hiding it from the default list",
+		Params: []apiParam{idParam}, Response: Issue{}, Audit: "issues", Handler: setIssueStatusHandler("ignored")},
+	{Method: "POST", Path: "/api/issues/{id}/unresolve", Summary: "Reopen a resolved or ignored issue",
+		Params: []apiParam{idParam}, Response: Issue{}, Audit: "issues", Handler: setIssueStatusHandler("unresolved")},
+	{Method: "POST", Path: "/api/graphql", Summary: "GraphQL endpoint (GET with ?query= is also accepted)",
+		Request: graphQLRequest{}, Response: map[string]any{}, Query: true, Handler: graphQLHandler, OwnMethods: true},
+	{Method: "GET", Path: "/api/searches", Summary: "List saved searches",
+		Params: pageParams, Response: SearchesPage{}, Handler: listSearchesHandler},
+	{Method: "POST", Path: "/api/searches", Summary: "Create a saved search",
+		Request: SavedSearch{}, Response: SavedSearch{}, Status: http.StatusCreated, Audit: "saved_searches", Handler: createSearchHandler},
+	{Method: "GET", Path: "/api/searches/{id}", Summary: "Get a saved search",
+		Params: []apiParam{idParam}, Response: SavedSearch{}, Handler: getSearchHandler},
+	{Method: "PUT", Path: "/api/searches/{id}", Summary: "Replace a saved search",
+		Params: []apiParam{idParam}, Request: SavedSearch{}, Response: SavedSearch{}, Audit: "saved_searches", Handler: updateSearchHandler},
+	{Method: "DELETE", Path: "/api/searches/{id}", Summary: "Delete a saved search",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "saved_searches", Handler: deleteSearchHandler},
+	{Method: "GET", Path: "/api/alerts", Summary: "List alert rules",
+		Params: pageParams, Response: AlertRulesPage{}, Handler: listAlertRulesHandler},
+	{Method: "POST", Path: "/api/alerts", Summary: "Create an alert rule",
+		Request: AlertRule{}, Response: AlertRule{}, Status: http.StatusCreated, Audit: "alert_rules", Handler: createAlertRuleHandler},
+	{Method: "GET", Path: "/api/alerts/{id}", Summary: "Get an alert rule",
+		Params: []apiParam{idParam}, Response: AlertRule{}, Handler: getAlertRuleHandler},
+	{Method: "PUT", Path: "/api/alerts/{id}", Summary: "Replace an alert rule",
+		Params: []apiParam{idParam}, Request: AlertRule{}, Response: AlertRule{}, Audit: "alert_rules", Handler: updateAlertRuleHandler},
+	{Method: "POST", Path: "/api/alerts/{id}/enable", Summary: "Enable an alert rule",
+		Params: []apiParam{idParam}, Response: AlertRule{}, Audit: "alert_rules", Handler: setAlertRuleEnabledHandler(true)},
+	{Method: "POST", Path: "/api/alerts/{id}/disable", Summary: "Disable an alert rule, resolving it if it is firing",
+		Params: []apiParam{idParam}, Response: AlertRule{}, Audit: "alert_rules", Handler: setAlertRuleEnabledHandler(false)},
+	{Method: "DELETE", Path: "/api/alerts/{id}", Summary: "Delete an alert rule, resolving it if it is firing",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "alert_rules", Handler: deleteAlertRuleHandler},
+	{Method: "GET", Path: "/api/alerts/history", Summary: "Alerts that notified, newest first, with their notifications and acknowledgement",
+		Params: params([]apiParam{
+			{Name: "rule", In: "query", Type: "string", Description: "Exact rule name."},
+			{Name: "status", In: "query", Type: "string", Description: "firing or resolved."},
+			{Name: "acknowledged", In: "query", Type: "boolean"},
+			{Name: "from", In: "query", Type: "string", Description: "Only alerts that started at or after this RFC 3339 time."},
+			{Name: "to", In: "query", Type: "string", Description: "Only alerts that started before this RFC 3339 time."},
+		}, pageParams),
+		Response: AlertHistoryPage{}, Handler: listAlertHistoryHandler},
+	{Method: "GET", Path: "/api/alerts/history/{id}", Summary: "Get an alert from the history",
+		Params: []apiParam{idParam}, Response: AlertHistoryEntry{}, Handler: getAlertHistoryHandler},
+	{Method: "POST", Path: "/api/alerts/history/{id}/ack", Summary: "Acknowledge an alert, stopping its repeat notifications",
+		Params: []apiParam{idParam}, Request: AlertAck{}, Response: AlertHistoryEntry{}, Audit: "alert_history", Handler: ackAlertHandler},
+	{Method: "GET", Path: "/api/silences", Summary: "List alert silences that have not ended",
+		Response: Silences{}, Handler: listSilencesHandler},
+	{Method: "POST", Path: "/api/silences", Summary: "Mute the notifications of matching alert rules for a time range",
+		Request: Silence{}, Response: Silence{}, Status: http.StatusCreated, Audit: "alert_silences", Handler: createSilenceHandler},
+	{Method: "DELETE", Path: "/api/silences/{id}", Summary: "End a silence",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "alert_silences", Handler: deleteSilenceHandler},
+	{Method: "GET", Path: "/api/reports", Summary: "List scheduled reports",
+		Params: pageParams, Response: ReportsPage{}, Handler: listReportsHandler},
+	{Method: "POST", Path: "/api/reports", Summary: "Create a scheduled report",
+		Request: Report{}, Response: Report{}, Status: http.StatusCreated, Audit: "reports", Handler: createReportHandler},
+	{Method: "GET", Path: "/api/reports/{id}", Summary: "Get a scheduled report",
+		Params: []apiParam{idParam}, Response: Report{}, Handler: getReportHandler},
+	{Method: "PUT", Path: "/api/reports/{id}", Summary: "Replace a scheduled report",
+		Params: []apiParam{idParam}, Request: Report{}, Response: Report{}, Audit: "reports", Handler: updateReportHandler},
+	{Method: "DELETE", Path: "/api/reports/{id}", Summary: "Delete a scheduled report",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "reports", Handler: deleteReportHandler},
+	{Method: "POST", Path: "/api/reports/{id}/run", Summary: "Send a report now, covering the time since its last scheduled run",
+		Params: []apiParam{idParam}, Response: ReportSummary{}, Audit: "reports", Handler: runReportHandler},
+	{Method: "GET", Path: "/api/timezones", Summary: "Default and per-source timezones for timestamps without one",
+		Response: SourceTimezones{}, Handler: listTimezonesHandler},
+	{Method: "PUT", Path: "/api/timezones/{source}", Summary: "Set the timezone of a source",
+		Params: []apiParam{sourceParam}, Request: SourceTimezone{}, Response: SourceTimezone{}, Audit: "source_timezones", Handler: putTimezoneHandler},
+	{Method: "DELETE", Path: "/api/timezones/{source}", Summary: "Revert a source to the default timezone",
+		Params: []apiParam{sourceParam}, Status: http.StatusNoContent, Audit: "source_timezones", Handler: deleteTimezoneHandler},
+	{Method: "GET", Path: "/api/sampling", Summary: "Default and per-source sampling policies",
+		Response: SamplingPolicies{}, Handler: listSamplingHandler},
+	{Method: "PUT", Path: "/api/sampling/{source}", Summary: "Set the fraction of entries of a source kept per severity",
+		Params: []apiParam{sourceParam}, Request: SamplingPolicy{}, Response: SamplingPolicy{}, Audit: "source_sampling", Handler: putSamplingHandler},
+	{Method: "DELETE", Path: "/api/sampling/{source}", Summary: "Revert a source to the default sampling policy",
+		Params: []apiParam{sourceParam}, Status: http.StatusNoContent, Audit: "source_sampling", Handler: deleteSamplingHandler},
+	{Method: "GET", Path: "/api/ip-anonymization", Summary: "Default and per-source IP anonymization modes",
+		Response: SourceIPModes{}, Handler: listIPModesHandler},
+	{Method: "PUT", Path: "/api/ip-anonymization/{source}", Summary: "Set how IP addresses in a source's lines are anonymized",
+		Params: []apiParam{sourceParam}, Request: SourceIPMode{}, Response: SourceIPMode{}, Audit: "source_ip_modes", Handler: putIPModeHandler},
+	{Method: "DELETE", Path: "/api/ip-anonymization/{source}", Summary: "Revert a source to the default IP anonymization mode",
+		Params: []apiParam{sourceParam}, Status: http.StatusNoContent, Audit: "source_ip_modes", Handler: deleteIPModeHandler},
+	{Method: "GET", Path: "/api/source-fields", Summary: "Static fields attached to each source's requests",
+		Response: []SourceFields{}, Handler: listStaticFieldsHandler},
+	{Method: "PUT", Path: "/api/source-fields/{source}", Summary: "Replace the static fields of a source",
+		Params: []apiParam{sourceParam}, Request: SourceFields{}, Response: SourceFields{}, Audit: "source_fields", Handler: putStaticFieldsHandler},
+	{Method: "DELETE", Path: "/api/source-fields/{source}", Summary: "Remove the static fields of a source",
+		Params: []apiParam{sourceParam}, Status: http.StatusNoContent, Audit: "source_fields", Handler: deleteStaticFieldsHandler},
+	{Method: "GET", Path: "/api/source-activity", Summary: "Registered sources and when they last sent logs, quietest first",
+		Response: SourceActivities{}, Handler: listSourceActivityHandler},
+	{Method: "DELETE", Path: "/api/source-activity/{source}", Summary: "Forget a source until it sends again, e.g. when it is decommissioned",
+		Params: []apiParam{sourceParam}, Status: http.StatusNoContent, Audit: "source_activity", Handler: deleteSourceActivityHandler},
+	{Method: "GET", Path: "/api/severities", Summary: "Canonical severities and the level aliases mapped to them",
+		Response: SeverityMappings{}, Handler: listSeveritiesHandler},
+	{Method: "PUT", Path: "/api/severities/{alias}", Summary: "Map a level spelling to a canonical severity",
+		Params: []apiParam{aliasParam}, Request: SeverityAlias{}, Response: SeverityAlias{}, Audit: "severity_aliases", Handler: putSeverityHandler},
+	{Method: "DELETE", Path: "/api/severities/{alias}", Summary: "Remove a user-defined level alias",
+		Params: []apiParam{aliasParam}, Status: http.StatusNoContent, Audit: "severity_aliases", Handler: deleteSeverityHandler},
+	{Method: "GET", Path: "/api/ip-access", Summary: "Client address rules of the ingest and admin routes",
+		Response: IPAccessRules{}, Admin: true, Handler: listIPAccessHandler},
+	{Method: "POST", Path: "/api/ip-access", Summary: "Allow or deny a CIDR on the ingest or admin routes",
+		Request: IPAccessRule{}, Response: IPAccessRule{}, Status: http.StatusCreated, Audit: "ip_access_rules", Handler: createIPAccessHandler},
+	{Method: "DELETE", Path: "/api/ip-access/{id}", Summary: "Delete a client address rule",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "ip_access_rules", Handler: deleteIPAccessHandler},
+	{Method: "GET", Path: "/api/audit", Summary: "Audited admin operations, newest first, with the changed row before and after",
+		Params: params([]apiParam{
+			{Name: "actor", In: "query", Type: "string"},
+			{Name: "action", In: "query", Type: "string", Description: "Prefix of the method and route, e.g. DELETE or PUT /api/alerts."},
+			{Name: "resource", In: "query", Type: "string", Description: "Table changed, e.g. alert_rules."},
+			{Name: "resource_id", In: "query", Type: "string"},
+			{Name: "from", In: "query", Type: "string", Description: "Only operations at or after this RFC 3339 time."},
+			{Name: "to", In: "query", Type: "string", Description: "Only operations before this RFC 3339 time."},
+		}, pageParams),
+		Response: AuditPage{}, Admin: true, Handler: listAuditHandler},
+	{Method: "GET", Path: "/api/security-events", Summary: "Rejected requests, newest first: failed authentication, refused addresses and oversized payloads",
+		Params: params([]apiParam{
+			{Name: "kind", In: "query", Type: "string", Description: "auth_failed, forbidden, ip_denied or payload_too_large."},
+			{Name: "remote_addr", In: "query", Type: "string", Description: "Client address without the port."},
+			{Name: "actor", In: "query", Type: "string"},
+			{Name: "path", In: "query", Type: "string"},
+			{Name: "from", In: "query", Type: "string", Description: "Only events at or after this RFC 3339 time."},
+			{Name: "to", In: "query", Type: "string", Description: "Only events before this RFC 3339 time."},
+		}, pageParams),
+		Response: SecurityEventsPage{}, Admin: true, Handler: listSecurityEventsHandler},
+	{Method: "GET", Path: "/api/security-events/summary", Summary: "Client addresses with the most rejected requests, by kind; the last 24 hours by default",
+		Params: []apiParam{
+			{Name: "kind", In: "query", Type: "string"},
+			{Name: "from", In: "query", Type: "string", Description: "Only events at or after this RFC 3339 time; default 24 hours ago."},
+			{Name: "to", In: "query", Type: "string", Description: "Only events before this RFC 3339 time."},
+			{Name: "limit", In: "query", Type: "integer", Description: "Number of addresses."},
+		},
+		Response: SecurityEventSummary{}, Admin: true, Handler: securityEventSummaryHandler},
+	{Method: "GET", Path: "/api/tenants", Summary: "Registered tenants",
+		Response: Tenants{}, Admin: true, Handler: listTenantsHandler},
+	{Method: "PUT", Path: "/api/tenants/{id}", Summary: "Register a tenant, or rename it",
+		Params: []apiParam{tenantParam}, Request: Tenant{}, Response: Tenant{}, Audit: "tenants", Handler: putTenantHandler},
+	{Method: "POST", Path: "/api/tenants/{id}/suspend", Summary: "Suspend a tenant, refusing its keys",
+		Params: []apiParam{tenantParam}, Response: Tenant{}, Audit: "tenants", Handler: setTenantSuspendedHandler(true)},
+	{Method: "POST", Path: "/api/tenants/{id}/resume", Summary: "Resume a suspended tenant",
+		Params: []apiParam{tenantParam}, Response: Tenant{}, Audit: "tenants", Handler: setTenantSuspendedHandler(false)},
+	{Method: "POST", Path: "/api/tenants/{id}/rotate-keys", Summary: "Replace a tenant's API keys with new ones; the response is the only time they are shown",
+		Params: []apiParam{tenantParam}, Response: APIKeys{}, Audit: "tenants", Handler: rotateTenantKeysHandler},
+	{Method: "GET", Path: "/api/tenants/{id}/export", Summary: "Export a suspended tenant's entries as NDJSON or Parquet",
+		Params: params([]apiParam{tenantParam}, filterParams, []apiParam{
+			{Name: "format", In: "query", Type: "string", Description: "ndjson (default) or parquet."},
+			{Name: "columns", In: "query", Type: "string", Description: "Comma-separated columns to export, in order; every field by default."},
+		}),
+		ResponseType: "application/x-ndjson", Admin: true, Stream: true, Handler: exportTenantHandler},
+	{Method: "POST", Path: "/api/tenants/{id}/purge", Summary: "Delete a suspended tenant's records in the background",
+		Params: []apiParam{tenantParam}, Response: TenantPurge{}, Status: http.StatusAccepted, Audit: "tenants", Handler: purgeTenantHandler},
+	{Method: "DELETE", Path: "/api/tenants/{id}", Summary: "Delete a suspended tenant without records, with its keys and alert rules",
+		Params: []apiParam{tenantParam}, Status: http.StatusNoContent, Audit: "tenants", Handler: deleteTenantHandler},
+	{Method: "GET", Path: "/api/projects", Summary: "Registered projects",
+		Response: Projects{}, Admin: true, Handler: listProjectsHandler},
+	{Method: "PUT", Path: "/api/projects/{id}", Summary: "Register a project, or rename it",
+		Params: []apiParam{projectParam}, Request: Project{}, Response: Project{}, Audit: "projects", Handler: putProjectHandler},
+	{Method: "GET", Path: "/api/sources", Summary: "Registered log sources, without their tokens",
+		Response: Sources{}, Admin: true, Handler: listSourcesHandler},
+	{Method: "POST", Path: "/api/sources", Summary: "Register a log source; the response is the only time its token is shown",
+		Request: Source{}, Response: Source{}, Status: http.StatusCreated, Audit: "sources", Handler: createSourceHandler},
+	{Method: "GET", Path: "/api/sources/{id}", Summary: "A registered log source, without its token",
+		Params: []apiParam{idParam}, Response: Source{}, Admin: true, Handler: getSourceHandler},
+	{Method: "PUT", Path: "/api/sources/{id}", Summary: "Change a log source's name, format, parser or retention; its token stays",
+		Params: []apiParam{idParam}, Request: Source{}, Response: Source{}, Audit: "sources", Handler: updateSourceHandler},
+	{Method: "DELETE", Path: "/api/sources/{id}", Summary: "Delete a log source without stored records, revoking its token",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "sources", Handler: deleteSourceHandler},
+	{Method: "GET", Path: "/api/usage", Summary: "Records, entries, bytes stored and queries by tenant over a month",
+		Params: []apiParam{
+			{Name: "month", In: "query", Type: "string", Description: "Month such as 2006-01, in UTC; default the current one."},
+			{Name: "tenant", In: "query", Type: "string", Description: "Only this tenant; \"\" for callers without one."},
+		},
+		Response: UsageReport{}, Tenanted: true, Handler: usageHandler},
+	{Method: "GET", Path: "/api/keys", Summary: "API keys and the roles they grant, without the keys",
+		Response: APIKeys{}, Admin: true, Handler: listAPIKeysHandler},
+	{Method: "POST", Path: "/api/keys", Summary: "Create an API key; the response is the only time the key is shown",
+		Request: APIKey{}, Response: APIKey{}, Status: http.StatusCreated, Audit: "api_keys", Handler: createAPIKeyHandler},
+	{Method: "DELETE", Path: "/api/keys/{id}", Summary: "Revoke an API key",
+		Params: []apiParam{idParam}, Status: http.StatusNoContent, Audit: "api_keys", Handler: deleteAPIKeyHandler},
+	{Method: "GET", Path: "/api/version", Summary: "Version, build and the parsers, sinks and optional features of this server",
+		Response: VersionInfo{}, Tenanted: true, Memory: true, Handler: versionHandler},
+	{Method: "GET", Path: "/api/debug/db", Summary: "Connection pool statistics and the database's connections by state",
+		Response: DBDebug{}, Admin: true, Management: true, Handler: debugDBHandler},
+	{Method: "POST", Path: "/api/admin/reload", Summary: "Reload the configuration file, redaction, enrichment and ALERT_RULES",
+		Response: ReloadResult{}, Admin: true, Management: true, Handler: reloadHandler},
+	{Method: "GET", Path: "/metrics", Summary: "Ingest counters and histograms in the Prometheus text format",
+		ResponseType: "text/plain", Public: true, Memory: true, Management: true, Handler: metricsHandler},
+	{Method: "GET", Path: "/healthz", Summary: "Liveness: 200 while the process serves requests",
+		ResponseType: "text/plain", Public: true, Memory: true, Management: true, Handler: healthzHandler},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness: 503 while the database is unreachable or its connections are exhausted",
+		Response: Readiness{}, Public: true, Memory: true, Management: true, Handler: readyzHandler},
+}
+
+// The document describes itself too; appended here because the handler reads apiRoutes.
+func init() {
+	apiRoutes = append(apiRoutes, apiRoute{Method: "GET", Path: "/api/openapi.json", Summary: "This OpenAPI document",
+		Response: map[string]any{}, Public: true, Memory: true, Handler: openAPIHandler})
+}
+
+// registerRoutes installs every apiRoutes handler on api, but the management routes, which
+// go on admin.
+func registerRoutes(api, admin *http.ServeMux) {
+	registered := map[string]bool{}
+	for _, rt := range apiRoutes {
+		mux := api
+		if rt.Management {
+			mux = admin
+		}
+		pattern := rt.route().Pattern()
+		h := rt.Handler
+		if rt.Audit != "" {
+			h = auditHandler(rt, h)
+		}
+		if inMemory() && !rt.Memory {
+			h = notInMemory
+		}
+		if rt.RequestType != "" {
+			h = identifySource(h)
+		}
+		if rt.Query {
+			h = meterQuery(h)
+		}
+		if rt.Stream {
+			h = withoutTimeouts(h)
+		}
+		// Log payloads are the only bodies that aren't JSON.
+		if rt.RequestType != "" {
+			h = limitBody(h, maxIngestBytes)
+		} else {
+			h = limitBody(h, maxRequestBytes)
+		}
+		if !rt.Public || routeRole(rt) == "ingest" && authConfig.ingest {
+			h = authenticate(rt, h)
+		}
+		if scope := routeScope(rt); scope != "" {
+			h = checkIPAccess(scope, h)
+		}
+		h = compressResponse(h)
+		if !registered[pattern] {
+			mux.HandleFunc(pattern, traceHandler(rt.Path, h))
+			registered[pattern] = true
+		}
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// openAPIHandler handles GET /api/openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(openAPIDoc)
+}
+
+// buildOpenAPI renders apiRoutes as an OpenAPI 3 document.
+func buildOpenAPI() map[string]any {
+	routes := make([]api.Route, len(apiRoutes))
+	for i, rt := range apiRoutes {
+		routes[i] = rt.route()
+	}
+	return api.OpenAPI(api.Info{Title: "DeLogger API", Version: "1.0.0", Auth: "OIDC JWT or API key"}, routes)
+}
+
+// route returns rt as documented: with the role authenticate checks, and the 503 of the
+// ingest routes when the write queue is full.
+func (rt apiRoute) route() api.Route {
+	r := api.Route{Method: rt.Method, Path: rt.Path, Summary: rt.Summary, Params: rt.Params,
+		Request: rt.Request, RequestType: rt.RequestType, Response: rt.Response, ResponseType: rt.ResponseType,
+		Status: rt.Status, Handler: rt.Handler, OwnMethods: rt.OwnMethods}
+	if role := routeRole(rt); !rt.Public || role == "ingest" {
+		r.Role = role
+	}
+	if rt.RequestType != "" {
+		r.Errors = map[int]string{http.StatusServiceUnavailable: "Too many records waiting to be stored; retry after the Retry-After seconds"}
+	}
+	return r
+}
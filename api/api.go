@@ -0,0 +1,72 @@
+// Package api describes an HTTP API as a table of routes, from which it is both served and
+// documented as OpenAPI 3, so the two cannot drift apart. The DeLogger server describes its
+// own API this way; programs embedding the parser can serve theirs the same way.
+//
+//	routes := []api.Route{{Method: "POST", Path: "/parse", Summary: "Parse log text",
+//		RequestType: "text/plain", Response: []parser.Entry{}, Handler: parse}}
+//	for _, rt := range routes {
+//		mux.HandleFunc(rt.Pattern(), rt.Handler)
+//	}
+//	doc := api.OpenAPI(api.Info{Title: "Parser", Version: "1.0.0"}, routes)
+//
+// What the server wraps around its handlers, such as authentication, auditing and rate
+// limits, is not part of the package: it depends on the server's configuration.
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Param documents a query, path or header parameter.
+type Param struct {
+	Name        string
+	In          string // "query", "path" or "header"
+	Type        string // OpenAPI primitive type
+	Description string
+	Required    bool
+}
+
+// Route is one operation of an HTTP API.
+type Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Params  []Param
+	// Request is the JSON request body type, or nil.
+	Request any
+	// RequestType is the content type of a non-JSON request body.
+	RequestType string
+	// Response is the JSON response body type, or nil.
+	Response any
+	// ResponseType is the content type of a non-JSON response body.
+	ResponseType string
+	Status       int // of success, 200 if zero
+	Handler      http.HandlerFunc
+	// OwnMethods marks handlers that check the method themselves; they are registered
+	// for the bare path so they can answer 405 their own way.
+	OwnMethods bool
+	// Role is the role a bearer token must grant to call the route, "" for routes served
+	// without authentication.
+	Role string
+	// Errors documents error responses besides 400, 500 and those of Role, by status.
+	Errors map[int]string
+}
+
+// Pattern returns the pattern to register the route's handler for on an http.ServeMux.
+func (rt Route) Pattern() string {
+	if rt.OwnMethods {
+		return rt.Path
+	}
+	return rt.Method + " " + rt.Path
+}
+
+// OperationID derives a stable operation id such as getApiLogsIdContext.
+func (rt Route) OperationID() string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.Method))
+	for _, part := range strings.FieldsFunc(rt.Path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Info is the title and version of a document, and the description of the bearer tokens
+// accepted by routes with a Role.
+type Info struct {
+	Title   string
+	Version string
+	Auth    string
+}
+
+// OpenAPI renders routes as an OpenAPI 3 document, ready to be encoded as JSON.
+func OpenAPI(info Info, routes []Route) map[string]any {
+	gen := &schemaGen{components: map[string]any{}}
+	paths := map[string]map[string]any{}
+
+	for _, rt := range routes {
+		op := map[string]any{
+			"summary":     rt.Summary,
+			"operationId": rt.OperationID(),
+		}
+
+		if len(rt.Params) > 0 {
+			var ps []map[string]any
+			for _, p := range rt.Params {
+				ps = append(ps, map[string]any{
+					"name":        p.Name,
+					"in":          p.In,
+					"required":    p.Required || p.In == "path",
+					"description": p.Description,
+					"schema":      map[string]any{"type": p.Type},
+				})
+			}
+			op["parameters"] = ps
+		}
+
+		if rt.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": gen.schema(reflect.TypeOf(rt.Request))}},
+			}
+		} else if rt.RequestType != "" {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{rt.RequestType: map[string]any{"schema": map[string]any{"type": "string"}}},
+			}
+		}
+
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]any{"description": http.StatusText(status)}
+		if rt.Response != nil {
+			resp["content"] = map[string]any{"application/json": map[string]any{"schema": gen.schema(reflect.TypeOf(rt.Response))}}
+		} else if rt.ResponseType != "" {
+			resp["content"] = map[string]any{rt.ResponseType: map[string]any{"schema": map[string]any{"type": "string"}}}
+		}
+		responses := map[string]any{
+			strconv.Itoa(status): resp,
+			"400":                map[string]any{"description": "Invalid request"},
+			"500":                map[string]any{"description": "Internal error"},
+		}
+		if rt.Role != "" {
+			op["security"] = []map[string]any{{"bearerAuth": []string{}}}
+			op["x-required-role"] = rt.Role
+			responses["401"] = map[string]any{"description": "Missing or invalid token, when authentication is on"}
+			responses["403"] = map[string]any{"description": "The token does not grant the " + rt.Role + " role"}
+		}
+		for code, description := range rt.Errors {
+			responses[strconv.Itoa(code)] = map[string]any{"description": description}
+		}
+		op["responses"] = responses
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = map[string]any{}
+		}
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   info.Title,
+			"version": info.Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         gen.components,
+			"securitySchemes": map[string]any{"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": info.Auth}},
+		},
+	}
+}
+
+// schemaGen converts Go types to OpenAPI schemas, following json tags. Named structs are
+// emitted once under components/schemas and referenced elsewhere.
+type schemaGen struct {
+	components map[string]any
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawType           = reflect.TypeOf(json.RawMessage{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]any{}
+	case t.Kind() == reflect.Struct && t.Implements(textMarshalerType):
+		return map[string]any{"type": "string"} // e.g. netip.Prefix
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = map[string]any{} // placeholder guards against recursion
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object builds the schema of a struct, flattening embedded structs like encoding/json does.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				collect(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+		}
+	}
+	collect(t)
+	return map[string]any{"type": "object", "properties": props}
+}
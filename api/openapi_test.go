@@ -0,0 +1,67 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	ID      int64      `json:"id"`
+	At      time.Time  `json:"at"`
+	Next    *testEntry `json:"next,omitempty"`
+	Ignored string     `json:"-"`
+	testEmbedded
+}
+
+type testEmbedded struct {
+	Line string `json:"line"`
+}
+
+func TestOpenAPI(t *testing.T) {
+	routes := []Route{
+		{Method: "GET", Path: "/api/logs/{id}/context", Summary: "Context", Params: []Param{{Name: "id", In: "path", Type: "integer"}},
+			Response: []testEntry{}, Role: "read"},
+		{Method: "POST", Path: "/api/parse", Summary: "Parse", RequestType: "text/plain", Status: 201, OwnMethods: true,
+			Errors: map[int]string{503: "Busy"}},
+	}
+	if got := routes[0].Pattern(); got != "GET /api/logs/{id}/context" {
+		t.Errorf("Pattern() = %q", got)
+	}
+	if got := routes[1].Pattern(); got != "/api/parse" {
+		t.Errorf("Pattern() = %q", got)
+	}
+
+	doc := OpenAPI(Info{Title: "Test", Version: "1"}, routes)
+	paths := doc["paths"].(map[string]map[string]any)
+	get := paths["/api/logs/{id}/context"]["get"].(map[string]any)
+	if get["operationId"] != "getApiLogsIdContext" || get["x-required-role"] != "read" {
+		t.Errorf("get = %v", get)
+	}
+	if !get["parameters"].([]map[string]any)[0]["required"].(bool) {
+		t.Error("path parameter not required")
+	}
+	responses := get["responses"].(map[string]any)
+	for _, code := range []string{"200", "400", "401", "403", "500"} {
+		if responses[code] == nil {
+			t.Errorf("get has no %s response", code)
+		}
+	}
+
+	post := paths["/api/parse"]["post"].(map[string]any)
+	responses = post["responses"].(map[string]any)
+	if responses["201"] == nil || responses["503"] == nil || responses["401"] != nil || post["security"] != nil {
+		t.Errorf("post responses = %v, security = %v", responses, post["security"])
+	}
+
+	schemas := doc["components"].(map[string]any)["schemas"].(map[string]any)
+	want := map[string]any{"type": "object", "properties": map[string]any{
+		"id":   map[string]any{"type": "integer"},
+		"at":   map[string]any{"type": "string", "format": "date-time"},
+		"next": map[string]any{"$ref": "#/components/schemas/testEntry"},
+		"line": map[string]any{"type": "string"},
+	}}
+	if !reflect.DeepEqual(schemas["testEntry"], want) {
+		t.Errorf("testEntry schema = %v, want %v", schemas["testEntry"], want)
+	}
+}
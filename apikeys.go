@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// API keys authenticate agents and dashboards that can't get a token from the OIDC
+// provider. A key is shown once, when it is created; only its SHA-256 hash is stored, in
+// api_keys, with the roles it grants (see roles in auth.go). Keys are sent like tokens,
+// as Authorization: Bearer dlk_..., and are accepted whenever authentication is on. A key
+// can be bound to a tenant (see tenants.go), to a project (see projects.go), or to both.
+// A key is revoked at once on the replica revoking it, and on the others when they are
+// notified (see replicas.go).
+
+// apiKeyPrefix starts every key, telling keys from JWTs.
+const apiKeyPrefix = "dlk_"
+
+// APIKey is a stored key. Key is only set in the response of its creation.
+type APIKey struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Roles     []string  `json:"roles"`
+	Tenant    string    `json:"tenant,omitempty"`  // the tenant whose data the key is limited to
+	Project   string    `json:"project,omitempty"` // the project whose data the key is limited to
+	Hint      string    `json:"hint"`              // first characters of the key, to tell keys apart
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// validate normalizes k and checks its name and roles.
+func (k *APIKey) validate() error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(k.Roles) == 0 {
+		return errors.New("at least one role is required")
+	}
+	for _, role := range k.Roles {
+		if !slices.Contains(roles, role) {
+			return errors.New("roles must be among " + strings.Join(roles, ", "))
+		}
+	}
+	if k.Tenant != "" {
+		if !tenantExists(k.Tenant) {
+			return errors.New("unknown tenant " + strconv.Quote(k.Tenant) + ": register it with PUT /api/tenants/{id}")
+		}
+		if slices.Contains(k.Roles, "admin") {
+			return errors.New("tenant keys can't have the admin role")
+		}
+	}
+	if k.Project != "" {
+		if !projectExists(k.Project) {
+			return errors.New("unknown project " + strconv.Quote(k.Project) + ": register it with PUT /api/projects/{id}")
+		}
+		if slices.Contains(k.Roles, "admin") {
+			return errors.New("project keys can't have the admin role")
+		}
+	}
+	slices.Sort(k.Roles)
+	k.Roles = slices.Compact(k.Roles)
+	return nil
+}
+
+// apiKeys holds the stored keys by the hash of the key.
+var apiKeys struct {
+	sync.RWMutex
+	byHash map[[sha256.Size]byte]APIKey
+}
+
+// loadAPIKeys reads the stored keys into memory.
+func loadAPIKeys() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := reloadAPIKeys(ctx); err != nil {
+		fatal("Failed to load API keys", "err", err)
+	}
+}
+
+// reloadAPIKeys replaces the keys in memory with the stored ones, keeping them if the
+// database can't be read.
+func reloadAPIKeys(ctx context.Context) error {
+	rows, err := dbPool.Query(ctx, `SELECT key_hash, id, name, roles, tenant, project, hint, created_at FROM api_keys`)
+	if err != nil {
+		return err
+	}
+	byHash := map[[sha256.Size]byte]APIKey{}
+	var hash []byte
+	var k APIKey
+	_, err = pgx.ForEachRow(rows, []any{&hash, &k.ID, &k.Name, &k.Roles, &k.Tenant, &k.Project, &k.Hint, &k.CreatedAt}, func() error {
+		byHash[[sha256.Size]byte(hash)] = k
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	apiKeys.Lock()
+	apiKeys.byHash = byHash
+	apiKeys.Unlock()
+	return nil
+}
+
+// lookupAPIKey returns the stored key matching key.
+func lookupAPIKey(key string) (APIKey, bool) {
+	apiKeys.RLock()
+	defer apiKeys.RUnlock()
+	k, ok := apiKeys.byHash[sha256.Sum256([]byte(key))]
+	return k, ok
+}
+
+// APIKeys is the response of GET /api/keys.
+type APIKeys struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// listAPIKeysHandler handles GET /api/keys.
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	apiKeys.RLock()
+	keys := []APIKey{}
+	for _, k := range apiKeys.byHash {
+		keys = append(keys, k)
+	}
+	apiKeys.RUnlock()
+	slices.SortFunc(keys, func(a, b APIKey) int { return int(a.ID - b.ID) })
+	writeJSON(w, http.StatusOK, APIKeys{Keys: keys})
+}
+
+// generate sets a new random key and its hint, returning its hash.
+func (k *APIKey) generate() [sha256.Size]byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	k.Key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	k.Hint = k.Key[:len(apiKeyPrefix)+6]
+	return sha256.Sum256([]byte(k.Key))
+}
+
+// createAPIKeyHandler handles POST /api/keys, generating the key.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var k APIKey
+	if err := readJSON(r, &k); err != nil {
+		http.Error(w, "Invalid API key: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := k.validate(); err != nil {
+		http.Error(w, "Invalid API key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash := k.generate()
+	err := dbPool.QueryRow(r.Context(), `
+	INSERT INTO api_keys (name, key_hash, roles, tenant, project, hint) VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`,
+		k.Name, hash[:], k.Roles, k.Tenant, k.Project, k.Hint).Scan(&k.ID, &k.CreatedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "An API key with that name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not save API key", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving API key", "err", err)
+		return
+	}
+
+	stored := k
+	stored.Key = ""
+	apiKeys.Lock()
+	apiKeys.byHash[hash] = stored
+	apiKeys.Unlock()
+	notifyAuthChange(r.Context())
+
+	slog.InfoContext(r.Context(), "Created API key", "id", k.ID, "name", k.Name, "roles", k.Roles, "tenant", k.Tenant, "project", k.Project)
+	writeJSON(w, http.StatusCreated, k)
+}
+
+// deleteAPIKeyHandler handles DELETE /api/keys/{id}, revoking the key at once.
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key id", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM api_keys WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, "Could not delete API key", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting API key", "id", id, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	apiKeys.Lock()
+	for hash, k := range apiKeys.byHash {
+		if k.ID == id {
+			delete(apiKeys.byHash, hash)
+		}
+	}
+	apiKeys.Unlock()
+	notifyAuthChange(r.Context())
+
+	slog.InfoContext(r.Context(), "Deleted API key", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateTenantKeys replaces the keys of tenant with new ones of the same names and roles,
+// revoking the old ones at once, and returns the new keys, the only time they are shown.
+func rotateTenantKeys(ctx context.Context, tenant string) ([]APIKey, error) {
+	apiKeys.RLock()
+	var keys []APIKey
+	var old [][sha256.Size]byte
+	for hash, k := range apiKeys.byHash {
+		if k.Tenant == tenant {
+			keys, old = append(keys, k), append(old, hash)
+		}
+	}
+	apiKeys.RUnlock()
+	slices.SortFunc(keys, func(a, b APIKey) int { return int(a.ID - b.ID) })
+
+	hashes := make([][sha256.Size]byte, len(keys))
+	batch := &pgx.Batch{}
+	for i := range keys {
+		hashes[i] = keys[i].generate()
+		batch.Queue(`UPDATE api_keys SET key_hash = $2, hint = $3 WHERE id = $1`, keys[i].ID, hashes[i][:], keys[i].Hint)
+	}
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	// A key revoked meanwhile is left revoked.
+	rotated := make([]bool, len(keys))
+	results := tx.SendBatch(ctx, batch)
+	for i := range keys {
+		tag, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return nil, err
+		}
+		rotated[i] = tag.RowsAffected() > 0
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	apiKeys.Lock()
+	for _, hash := range old {
+		delete(apiKeys.byHash, hash)
+	}
+	var shown []APIKey
+	for i, k := range keys {
+		if !rotated[i] {
+			continue
+		}
+		shown = append(shown, k)
+		k.Key = ""
+		apiKeys.byHash[hashes[i]] = k
+	}
+	apiKeys.Unlock()
+	notifyAuthChange(ctx)
+	return shown, nil
+}
+
+// forgetTenantKeys drops the keys of a deleted tenant from memory.
+func forgetTenantKeys(tenant string) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	for hash, k := range apiKeys.byHash {
+		if k.Tenant == tenant {
+			delete(apiKeys.byHash, hash)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// POST /api/parse/archive takes a zip, tar or gzipped tar archive of log files, or a single
+// gzipped log file, and parses its files concurrently. Files gzipped inside the archive, as
+// rotated logs usually are, are decompressed and named without their .gz. Each file is
+// stored as its own request, with the file's name in its file field, and the response
+// lists every file with its entries, in archive order:
+//
+//	ARCHIVE_CONCURRENCY  files parsed at once per request; default the number of CPUs
+//	ARCHIVE_MAX_FILES    most files in an archive; default 1000
+//
+// The uncompressed files together may not exceed MAX_INGEST_BYTES, like a single payload.
+// A gzipped file is named as recorded in its header, or log if it isn't.
+// Directories and empty files are skipped.
+
+var archiveConfig = struct {
+	concurrency int
+	maxFiles    int
+}{concurrency: runtime.GOMAXPROCS(0), maxFiles: 1000}
+
+var (
+	errArchiveTooLarge = errors.New("archive too large")
+	errNotArchive      = errors.New("not a zip, tar, tar.gz or gz archive")
+)
+
+// setupArchives reads the archive settings.
+func setupArchives() {
+	for _, s := range []struct {
+		env   string
+		value *int
+	}{{"ARCHIVE_CONCURRENCY", &archiveConfig.concurrency}, {"ARCHIVE_MAX_FILES", &archiveConfig.maxFiles}} {
+		if v := setting(s.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				fatalConfig("Invalid "+s.env+": must be a positive number", "value", v)
+			}
+			*s.value = n
+		}
+	}
+}
+
+// archiveMember is a file read from an archive.
+type archiveMember struct {
+	name string
+	data []byte
+}
+
+// ArchiveFile is the parse result of one file of an archive.
+type ArchiveFile struct {
+	Name    string     `json:"name"`
+	Entries []LogEntry `json:"entries"`
+}
+
+// ArchiveResult is the response of POST /api/parse/archive.
+type ArchiveResult struct {
+	Files   []ArchiveFile `json:"files"`
+	Entries int           `json:"entries"` // over all files
+}
+
+// parseArchiveHandler handles POST /api/parse/archive.
+func parseArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readPayload(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Payload too large: the limit is "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read request body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading request body", "err", err)
+		return
+	}
+	defer body.close()
+
+	files, err := readArchive(body)
+	if errors.Is(err, errArchiveTooLarge) {
+		http.Error(w, "Payload too large: the uncompressed files exceed "+strconv.FormatInt(maxIngestBytes, 10)+" bytes",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "Invalid archive: no files", http.StatusBadRequest)
+		return
+	}
+	if !reserveRecords(len(files)) {
+		refuseQueueFull(w, r)
+		return
+	}
+
+	result := ArchiveResult{Files: make([]ArchiveFile, len(files))}
+	sem := make(chan struct{}, archiveConfig.concurrency)
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			result.Files[i] = parseArchiveFile(r, f)
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	for _, f := range result.Files {
+		result.Entries += len(f.Entries)
+	}
+	slog.InfoContext(r.Context(), "Parsed log archive", "files", len(files), "entries", result.Entries)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// parseArchiveFile parses and stores one file of an archive sent by r, in a place reserved
+// in the write queue.
+func parseArchiveFile(r *http.Request, f archiveMember) ArchiveFile {
+	ctx, span := tracer.Start(r.Context(), "parse archive file")
+	defer span.End()
+	span.SetAttributes(attribute.String("delogger.file", f.name), attribute.Int("delogger.bytes", len(f.data)))
+
+	source := sourceName(r.RemoteAddr)
+	fields := maps.Clone(sourceFields(source))
+	fields["file"] = f.name
+	record := LogRecord{
+		Timestamp:  time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		StatusCode: http.StatusOK,
+		Host:       sourceHeader(r, "X-DeLogger-Host"),
+		Service:    sourceHeader(r, "X-DeLogger-Service"),
+		Env:        sourceHeader(r, "X-DeLogger-Env"),
+		Fields:     fields,
+		Tenant:     requestTenant(r.Context()),
+		SourceID:   requestSource(r.Context()).ID,
+	}
+	if id := clientCertIdentity(r); id != "" {
+		record.Host = id
+	}
+
+	text, redactions := requestRedactor(r.Context()).redact(string(f.data))
+	record.RequestBody = anonymizeIPs(text, source)
+	record.Redactions = redactions
+	if len(redactions) > 0 {
+		slog.InfoContext(ctx, "Redacted archive file", "file", f.name, "redactions", redactionReport(redactions))
+	}
+
+	parseStart := time.Now()
+	record.Entries = parseLines(requestParser(r.Context()), record.RequestBody)
+	ingest.record(record.Service, len(f.data), record.Entries, time.Since(parseStart))
+	record.ResponseBody, _ = json.Marshal(record.Entries)
+	if n := len(record.ResponseBody); int64(n) > maxStoredResponse {
+		record.ResponseBody, _ = json.Marshal(truncatedResponse{Truncated: true, Entries: len(record.Entries), Bytes: int64(n)})
+	}
+	recordLog(ctx, record)
+
+	entries := record.Entries
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	return ArchiveFile{Name: f.name, Entries: entries}
+}
+
+// gzipMagic starts gzip streams.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readArchive reads the regular files of a zip, tar or gzipped tar archive, or the file
+// of a gzipped log.
+func readArchive(p *payload) ([]archiveMember, error) {
+	ra := p.readerAt()
+	var magic [262]byte
+	n, _ := ra.ReadAt(magic[:], 0)
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte("PK\x03\x04")):
+		return readZip(ra, p.size)
+	case bytes.HasPrefix(magic[:n], gzipMagic):
+		gz, err := gzip.NewReader(io.NewSectionReader(ra, 0, p.size))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br := bufio.NewReader(gz)
+		if isTar(br) {
+			return readTar(br)
+		}
+		name := "log"
+		if gz.Name != "" {
+			name = path.Base(gz.Name)
+		}
+		var budget archiveBudget
+		f, err := budget.read(name, br)
+		if err != nil {
+			return nil, err
+		}
+		return []archiveMember{f}, nil
+	case n >= 262 && string(magic[257:262]) == "ustar":
+		return readTar(io.NewSectionReader(ra, 0, p.size))
+	}
+	return nil, errNotArchive
+}
+
+// isTar reports whether br starts with a tar header.
+func isTar(br *bufio.Reader) bool {
+	magic, _ := br.Peek(262)
+	return len(magic) == 262 && string(magic[257:262]) == "ustar"
+}
+
+// archiveBudget counts the files and uncompressed bytes read from an archive.
+type archiveBudget struct {
+	files int
+	bytes int64
+}
+
+// read reads one file of at most the remaining bytes, decompressing it if it is gzipped.
+func (b *archiveBudget) read(name string, r io.Reader) (archiveMember, error) {
+	b.files++
+	if b.files > archiveConfig.maxFiles {
+		return archiveMember{}, errors.New("more than " + strconv.Itoa(archiveConfig.maxFiles) + " files")
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return archiveMember{}, fmt.Errorf("%s: %w", name, err)
+		}
+		defer gz.Close()
+		name = strings.TrimSuffix(name, ".gz")
+		r = gz
+	} else {
+		r = br
+	}
+	remaining := maxIngestBytes - b.bytes
+	data, err := io.ReadAll(io.LimitReader(r, remaining+1))
+	if err != nil {
+		return archiveMember{}, err
+	}
+	if int64(len(data)) > remaining {
+		return archiveMember{}, errArchiveTooLarge
+	}
+	b.bytes += int64(len(data))
+	return archiveMember{name: name, data: data}, nil
+}
+
+func readZip(ra io.ReaderAt, size int64) ([]archiveMember, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	var budget archiveBudget
+	var files []archiveMember
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || zf.UncompressedSize64 == 0 {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		f, err := budget.read(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func readTar(r io.Reader) ([]archiveMember, error) {
+	tr := tar.NewReader(r)
+	var budget archiveBudget
+	var files []archiveMember
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		f, err := budget.read(hdr.Name, tr)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+}
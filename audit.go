@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every successful mutating admin operation is recorded in audit_log: who did it, when,
+// with which request, and the row it changed as it was before and after. Routes opt in
+// with apiRoute.Audit, naming the table they change; the row is looked up by the route's
+// path parameter, which is named after the table's key column, or for creates by the id
+// of the returned resource. Snapshots are read just before and after the handler runs, not
+// in its transaction. A trigger makes the table append-only.
+//
+// The actor is the authenticated user, else the name of the client certificate (see tls.go),
+// else the client address.
+
+// AuditEntry is one audited operation.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	At         time.Time       `json:"at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"` // method and route, e.g. PUT /api/alerts/{id}
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"` // absent for creates
+	After      json.RawMessage `json:"after,omitempty"`  // absent for deletes
+}
+
+// recordAudit appends e to the audit log. At defaults to now.
+func recordAudit(ctx context.Context, e AuditEntry) error {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	_, err := dbPool.Exec(ctx, `
+	INSERT INTO audit_log (at, actor, action, resource, resource_id, request_id, before, after)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.At, e.Actor, e.Action, e.Resource, e.ResourceID, e.RequestID, nullJSON(e.Before), nullJSON(e.After))
+	return err
+}
+
+// nullJSON stores an absent snapshot as NULL rather than an empty document.
+func nullJSON(v json.RawMessage) any {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// auditSnapshot returns the row of table whose key column equals id as JSON, or nil if
+// there is none.
+func auditSnapshot(ctx context.Context, table, key, id string) (json.RawMessage, error) {
+	var row json.RawMessage
+	err := dbPool.QueryRow(ctx, fmt.Sprintf(`SELECT to_jsonb(t) FROM %s t WHERE %s::text = $1`,
+		pgx.Identifier{table}.Sanitize(), pgx.Identifier{key}.Sanitize()), id).Scan(&row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return row, err
+}
+
+// routeParam returns the name of the first {parameter} of a route path, or "".
+func routeParam(path string) string {
+	_, rest, ok := strings.Cut(path, "{")
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "}")
+	return name
+}
+
+// requestActor identifies who made r.
+func requestActor(r *http.Request) string {
+	if p, ok := principalFromContext(r.Context()); ok {
+		return p.user
+	}
+	if id := clientCertIdentity(r); id != "" {
+		return id
+	}
+	return sourceName(r.RemoteAddr)
+}
+
+// auditRecorder keeps the response body of creates, to find the id of the new resource.
+type auditRecorder struct {
+	statusRecorder
+	body *bytes.Buffer
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if w.body != nil {
+		w.body.Write(b)
+	}
+	return w.statusRecorder.Write(b)
+}
+
+// auditHandler wraps the handler of rt, recording its successful calls in the audit log.
+func auditHandler(rt apiRoute, h http.HandlerFunc) http.HandlerFunc {
+	action := rt.Method + " " + rt.Path
+	param := routeParam(rt.Path)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key, id := param, ""
+		if key != "" {
+			id = r.PathValue(key)
+		}
+
+		var before json.RawMessage
+		if id != "" {
+			var err error
+			if before, err = auditSnapshot(ctx, rt.Audit, key, id); err != nil {
+				slog.ErrorContext(ctx, "Error reading audit snapshot", "resource", rt.Audit, "id", id, "err", err)
+			}
+		}
+
+		rec := &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		if id == "" {
+			rec.body = &bytes.Buffer{}
+		}
+		h(rec, r)
+		if rec.status >= 300 {
+			return
+		}
+
+		if id == "" {
+			var created struct {
+				ID json.Number `json:"id"`
+			}
+			if err := json.Unmarshal(rec.body.Bytes(), &created); err != nil || created.ID == "" {
+				slog.ErrorContext(ctx, "Created resource has no id to audit", "action", action)
+				return
+			}
+			key, id = "id", created.ID.String()
+		}
+		after, err := auditSnapshot(ctx, rt.Audit, key, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading audit snapshot", "resource", rt.Audit, "id", id, "err", err)
+		}
+
+		info, _ := requestFromContext(ctx)
+		err = recordAudit(context.WithoutCancel(ctx), AuditEntry{
+			Actor:      requestActor(r),
+			Action:     action,
+			Resource:   rt.Audit,
+			ResourceID: id,
+			RequestID:  info.id,
+			Before:     before,
+			After:      after,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error recording audit entry", "action", action, "id", id, "err", err)
+		}
+	}
+}
+
+// AuditPage is the response of GET /api/audit. NextCursor is empty on the last page.
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// listAuditHandler handles GET /api/audit, keyset-paginated by time, newest first.
+func listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, cursor, err := parsePage(query, 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args sqlArgs
+	var conds []string
+	for _, name := range []string{"actor", "resource", "resource_id"} {
+		if query.Has(name) {
+			conds = append(conds, name+" = "+args.add(query.Get(name)))
+		}
+	}
+	if v := query.Get("action"); v != "" {
+		conds = append(conds, "action LIKE "+args.add(v+"%"))
+	}
+	for _, bound := range []struct{ name, op string }{{"from", ">="}, {"to", "<"}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid '"+bound.name+"' timestamp: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, "at "+bound.op+" "+args.add(t))
+		}
+	}
+	if cursor != nil {
+		if cursor.Time == nil {
+			http.Error(w, "invalid 'cursor'", http.StatusBadRequest)
+			return
+		}
+		conds = append(conds, "(at, id) < ("+args.add(*cursor.Time)+", "+args.add(cursor.ID)+")")
+	}
+
+	sql := `SELECT id, at, actor, action, resource, resource_id, request_id, before, after FROM audit_log`
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY at DESC, id DESC LIMIT " + args.add(limit+1)
+
+	rows, err := dbPool.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeAuditError(w, r, err)
+		return
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AuditEntry, error) {
+		var e AuditEntry
+		err := row.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Resource, &e.ResourceID, &e.RequestID, &e.Before, &e.After)
+		return e, err
+	})
+	if err != nil {
+		writeAuditError(w, r, err)
+		return
+	}
+
+	page := AuditPage{Entries: entries}
+	if page.Entries == nil {
+		page.Entries = []AuditEntry{}
+	}
+	if len(page.Entries) > limit {
+		page.Entries = page.Entries[:limit]
+		last := page.Entries[limit-1]
+		page.NextCursor = pageCursor{Time: &last.At, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func writeAuditError(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Could not read audit log", http.StatusInternalServerError)
+	slog.ErrorContext(r.Context(), "Error reading audit log", "err", err)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// The API can require a JWT from an OpenID Connect provider, e.g. the company SSO:
+//
+//	OIDC_ISSUER         issuer URL; authentication is off unless it or ADMIN_API_KEY is set
+//	OIDC_AUDIENCE       required audience (aud), usually the client id registered for DeLogger
+//	OIDC_JWKS_URL       signing keys URL, instead of discovering it from the issuer
+//	OIDC_USER_CLAIM     claim naming the user in the audit log; default sub
+//	OIDC_ROLES_CLAIM    claim holding the user's roles or groups, dotted for nested claims
+//	                    (e.g. realm_access.roles); default roles
+//	OIDC_ROLE_MAP       claim values mapped to roles, e.g. logs-admins=admin,sre=admin;
+//	                    without it the claim values are the roles
+//
+// Tokens are taken from the Authorization: Bearer header, or the access_token query
+// parameter for EventSource and WebSocket clients, which can't set headers. Their
+// signature, issuer, audience and expiry are checked; the signing keys are fetched again
+// when a token names a key not seen before, so key rotation needs no restart.
+//
+// API keys (see apikeys.go) are accepted as tokens too, and authentication can be on with
+// keys alone:
+//
+//	ADMIN_API_KEY       key granting the admin role, to create the first stored keys;
+//	                    authentication is on when it or OIDC_ISSUER is set
+//	AUTH_INGEST         true to require the ingest role on /api/parse too, from a key, a
+//	                    token or a signature (see signing.go); default false
+//
+// Every route requires a role, granted by the token's roles or the key's:
+//
+//	ingest  /api/parse, when AUTH_INGEST is set
+//	read    searching and reading entries, stats, alerts and settings
+//	admin   everything, including changing settings, the audit log and the debug routes
+//
+// The probes, /metrics and /api/openapi.json stay public (apiRoute.Public), as does
+// ingestion unless AUTH_INGEST is set.
+
+// authVerifier checks JWTs, nil unless OIDC_ISSUER is set.
+var authVerifier *oidc.IDTokenVerifier
+
+var authConfig struct {
+	adminKey   string
+	ingest     bool
+	userClaim  string
+	rolesClaim []string // path of the claim
+	roleMap    map[string][]string
+}
+
+// authTimeout bounds fetching the provider's discovery document and keys.
+const authTimeout = 10 * time.Second
+
+// roles are the roles granted by tokens and keys.
+var roles = []string{"ingest", "read", "admin"}
+
+// setupAuth configures token verification if an issuer is set, and the admin key.
+func setupAuth() {
+	authConfig.adminKey = secretEnv("ADMIN_API_KEY")
+	if authConfig.adminKey != "" && len(authConfig.adminKey) < 16 {
+		fatalConfig("ADMIN_API_KEY must be at least 16 characters")
+	}
+	if v := setting("AUTH_INGEST"); v != "" {
+		var err error
+		if authConfig.ingest, err = strconv.ParseBool(v); err != nil {
+			fatalConfig("Invalid AUTH_INGEST", "value", v)
+		}
+	}
+	if authConfig.adminKey != "" {
+		slog.Info("Requiring API keys", "ingest", authConfig.ingest)
+	}
+
+	issuer := setting("OIDC_ISSUER")
+	if issuer == "" {
+		return
+	}
+	audience := setting("OIDC_AUDIENCE")
+	if audience == "" {
+		fatalConfig("OIDC_AUDIENCE is required with OIDC_ISSUER")
+	}
+
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: authTimeout})
+	config := &oidc.Config{ClientID: audience}
+	if jwks := setting("OIDC_JWKS_URL"); jwks != "" {
+		authVerifier = oidc.NewVerifier(issuer, oidc.NewRemoteKeySet(ctx, jwks), config)
+	} else {
+		provider, err := oidc.NewProvider(ctx, issuer)
+		if err != nil {
+			fatal("Failed to discover OIDC provider", "issuer", issuer, "err", err)
+		}
+		authVerifier = provider.Verifier(config)
+	}
+
+	authConfig.userClaim = "sub"
+	if v := setting("OIDC_USER_CLAIM"); v != "" {
+		authConfig.userClaim = v
+	}
+	authConfig.rolesClaim = []string{"roles"}
+	if v := setting("OIDC_ROLES_CLAIM"); v != "" {
+		authConfig.rolesClaim = strings.Split(v, ".")
+	}
+	if v := setting("OIDC_ROLE_MAP"); v != "" {
+		authConfig.roleMap = map[string][]string{}
+		for _, pair := range strings.Split(v, ",") {
+			value, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || value == "" || role == "" {
+				fatalConfig("Invalid OIDC_ROLE_MAP entry: must be claim-value=role", "entry", pair)
+			}
+			authConfig.roleMap[value] = append(authConfig.roleMap[value], role)
+		}
+	}
+	slog.Info("Requiring OIDC tokens", "issuer", issuer, "audience", audience, "ingest", authConfig.ingest)
+}
+
+// authEnabled reports whether requests must authenticate.
+func authEnabled() bool {
+	return authVerifier != nil || authConfig.adminKey != ""
+}
+
+// routeRole returns the role required by rt: ingest for log payloads, admin for the
+// audited mutating routes and the routes marked admin, read for the rest.
+func routeRole(rt apiRoute) string {
+	switch {
+	case rt.RequestType != "":
+		return "ingest"
+	case rt.Audit != "" || rt.Admin:
+		return "admin"
+	}
+	return "read"
+}
+
+// hasRole reports whether roles grant role; admin grants every role.
+func hasRole(roles []string, role string) bool {
+	return slices.Contains(roles, role) || slices.Contains(roles, "admin")
+}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	user    string
+	roles   []string
+	tenant  string // limits the caller to one tenant's data, see tenants.go
+	project string // limits the caller to one project's data, see projects.go
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller stored by authenticate.
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authenticate wraps the handler h of rt to require a valid token or key granting the
+// route's role, or for the ingest role a valid signature (see signing.go). It returns h
+// itself while authentication is off.
+func authenticate(rt apiRoute, h http.HandlerFunc) http.HandlerFunc {
+	role := routeRole(rt)
+	signed := role == "ingest" && signing.keys != nil
+	if !authEnabled() && !signed {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if signed && r.Header.Get(signatureHeader) != "" {
+			p, err := verifySignature(w, r)
+			if err != nil {
+				if bodyErrorStatus(err) == http.StatusRequestEntityTooLarge {
+					http.Error(w, "Payload too large: the limit is "+strconv.FormatInt(maxIngestBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+					recordSecurityEvent(r, "payload_too_large", "body over "+strconv.FormatInt(maxIngestBytes, 10)+" bytes")
+					return
+				}
+				http.Error(w, "Invalid signature", http.StatusUnauthorized)
+				slog.WarnContext(r.Context(), "Rejected signature", "key", r.Header.Get(signatureKeyHeader), "err", err)
+				recordSecurityEvent(r, "auth_failed", "invalid signature: "+err.Error())
+				return
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("access_token")
+		}
+		token = strings.TrimSpace(token)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="delogger"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			recordSecurityEvent(r, "auth_failed", "missing token")
+			return
+		}
+
+		p, err := verifyToken(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="delogger", error="invalid_token"`)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected token", "err", err)
+			recordSecurityEvent(r, "auth_failed", "invalid token: "+err.Error())
+			return
+		}
+		if !hasRole(p.roles, role) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="delogger", error="insufficient_scope"`)
+			http.Error(w, "Forbidden: requires the "+role+" role", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request: missing role", "user", p.user, "role", role, "roles", p.roles)
+			recordSecurityEvent(r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), "forbidden", "requires the "+role+" role")
+			return
+		}
+		if (p.tenant != "" || p.project != "") && !rt.Tenanted {
+			http.Error(w, "Forbidden: not available to tenant and project keys", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request: route not scoped to tenants", "user", p.user, "tenant", p.tenant, "project", p.project)
+			recordSecurityEvent(r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), "forbidden", "tenant or project key on an unscoped route")
+			return
+		}
+		if p.tenant != "" && tenantSuspended(p.tenant) {
+			http.Error(w, "Forbidden: the tenant is suspended", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request: tenant suspended", "user", p.user, "tenant", p.tenant)
+			recordSecurityEvent(r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), "forbidden", "key of suspended tenant "+p.tenant)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// verifyToken returns the caller authenticated by token, an API key or a JWT.
+func verifyToken(ctx context.Context, token string) (principal, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		if k, ok := lookupAPIKey(token); ok {
+			return principal{user: "key:" + k.Name, roles: k.Roles, tenant: k.Tenant, project: k.Project}, nil
+		}
+		return principal{}, errors.New("unknown API key")
+	}
+	if authConfig.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(authConfig.adminKey)) == 1 {
+		return principal{user: "key:ADMIN_API_KEY", roles: []string{"admin"}}, nil
+	}
+	if authVerifier == nil {
+		return principal{}, errors.New("unknown API key")
+	}
+
+	idToken, err := authVerifier.Verify(ctx, token)
+	if err != nil {
+		return principal{}, err
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return principal{}, err
+	}
+	p := principal{roles: claimRoles(claims)}
+	p.user, _ = claims[authConfig.userClaim].(string)
+	if p.user == "" {
+		p.user = idToken.Subject
+	}
+	return p, nil
+}
+
+// claimRoles returns the roles granted by the roles claim of a token.
+func claimRoles(claims map[string]any) []string {
+	var v any = claims
+	for _, key := range authConfig.rolesClaim {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	var values []string
+	switch v := v.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	if authConfig.roleMap == nil {
+		return values
+	}
+	var roles []string
+	for _, value := range values {
+		roles = append(roles, authConfig.roleMap[value]...)
+	}
+	return roles
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The binary runs the server by default, and has commands for work without it:
+//
+//	delogger [serve] [flags]                   run the server
+//	delogger parse [flags] [file ...]          parse log files, or standard input, and
+//	                                           print their entries as NDJSON; archives are
+//	                                           parsed file by file, and nothing is stored
+//	delogger migrate [flags]                   create or update the database schema
+//	delogger export [flags] [name=value ...]   print the stored entries matching the
+//	                                           filter parameters of /api/export
+//
+// Every command takes the flags of the settings and -config (see config.go). The exit
+// status is 0 on success, 1 on a failure, 2 on invalid arguments and 78 on an invalid
+// setting.
+
+// commands are the commands of the binary by name.
+var commands = map[string]struct {
+	run     func(args []string)
+	summary string
+}{
+	"serve":   {serve, "run the server (the default)"},
+	"parse":   {parseCommand, "parse log files or standard input and print the entries as NDJSON"},
+	"migrate": {migrateCommand, "create or update the database schema"},
+	"export":  {exportCommand, "print stored entries matching filter parameters"},
+}
+
+// runCommand runs the command named by the first argument, serve if there is none.
+func runCommand(args []string) {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printCommands(os.Stdout)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "delogger: unknown command %q\n", name)
+		printCommands(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	cmd.run(args)
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: delogger [command] [flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun delogger <command> -help for its flags.")
+}
+
+// newCommandFlags returns the flag set of a command, whose usage lists the command's own
+// flags rather than those of every setting.
+func newCommandFlags(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: delogger %s %s\n", name, synopsis)
+		settings := allSettings()
+		fs.VisitAll(func(f *flag.Flag) {
+			if slices.ContainsFunc(settings, func(s string) bool { return flagName(s) == f.Name }) {
+				return
+			}
+			kind, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(out, "  -%s %s\n    \t%s\n", f.Name, kind, usage)
+		})
+		fmt.Fprintln(out, "Every setting can also be given as a flag, e.g. -log-level debug; see delogger serve -help.")
+	}
+	return fs
+}
+
+// parsedLine is an entry printed by the parse command, with the file it came from.
+type parsedLine struct {
+	File string `json:"file,omitempty"`
+	LogEntry
+}
+
+// parseCommand parses files, or standard input, without a database or server.
+func parseCommand(args []string) {
+	fs := newCommandFlags("parse", "[flags] [file ...]")
+	output := fs.String("o", "", "write the entries to `file` rather than standard output")
+	files := loadConfig(fs, args)
+	setupLogging()
+	setupLimits()
+	setupSpill()
+	setupArchives()
+	setupParsing()
+	setupRedaction()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("Could not create output file", "path", *output, "err", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	failed := false
+	for _, name := range files {
+		n, err := parseFile(name, func(file string, entries []LogEntry) error {
+			for _, e := range entries {
+				if err := enc.Encode(parsedLine{File: file, LogEntry: e}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("Could not parse file", "file", name, "err", err)
+			failed = true
+			continue
+		}
+		slog.Info("Parsed file", "file", name, "entries", n)
+	}
+	if err := w.Flush(); err != nil {
+		fatal("Could not write entries", "err", err)
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// parseFile parses a log file, or the files of an archive, passing their entries to emit,
+// and returns the number of entries. The name - is standard input.
+func parseFile(name string, emit func(file string, entries []LogEntry) error) (int, error) {
+	in := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		in = f
+	}
+	p, err := readPayload(in)
+	if err != nil {
+		return 0, err
+	}
+	defer p.close()
+
+	members, err := readArchive(p)
+	if errors.Is(err, errNotArchive) {
+		var entries []LogEntry
+		_, err := p.redactChunks(redaction.Load(), "", func(text string) {
+			entries = appendEntries(entries, parseLines(lineParser, text))
+		})
+		defer putEntries(entries)
+		if err != nil {
+			return 0, err
+		}
+		file := name
+		if name == "-" {
+			file = ""
+		}
+		return len(entries), emit(file, entries)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, m := range members {
+		text, _ := redaction.Load().redact(string(m.data))
+		entries := parseLines(lineParser, text)
+		total += len(entries)
+		err := emit(name+"/"+m.name, entries)
+		putEntries(entries)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// migrateCommand creates or updates the database schema, then exits.
+func migrateCommand(args []string) {
+	fs := newCommandFlags("migrate", "[flags]")
+	if rest := loadConfig(fs, args); len(rest) > 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	setupLogging()
+	setupDatabase()
+	dbPool.Close()
+}
+
+// exportCommand writes the stored entries matching name=value filter parameters, as
+// /api/export does, to standard output or a file.
+func exportCommand(args []string) {
+	fs := newCommandFlags("export", "[flags] [name=value ...]")
+	output := fs.String("o", "", "write the entries to `file` rather than standard output")
+	format := fs.String("format", "ndjson", "ndjson or parquet")
+	params := loadConfig(fs, args)
+
+	query := url.Values{}
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || name == "" {
+			fmt.Fprintf(os.Stderr, "delogger export: filter parameters must be name=value, got %q\n", param)
+			os.Exit(exitUsage)
+		}
+		query.Add(name, value)
+	}
+	query.Set("format", *format)
+
+	setupLogging()
+	setupEncryption()
+	setupDatabase()
+	defer dbPool.Close()
+	store = postgresStorage{}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("Could not create output file", "path", *output, "err", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "/api/export?"+query.Encode(), nil)
+	w := &commandResponse{out: bufio.NewWriter(out), header: http.Header{}, status: http.StatusOK}
+	exportHandler(w, r)
+	if w.status >= 300 {
+		fatal("Export failed", "err", strings.TrimSpace(w.errBody.String()))
+	}
+	if err := w.out.Flush(); err != nil {
+		fatal("Could not write entries", "err", err)
+	}
+}
+
+// commandResponse writes the body of a handler's successful response to out, keeping an
+// error response aside, so a command can run a handler.
+type commandResponse struct {
+	out     *bufio.Writer
+	header  http.Header
+	status  int
+	errBody bytes.Buffer
+}
+
+func (w *commandResponse) Header() http.Header { return w.header }
+
+func (w *commandResponse) WriteHeader(status int) { w.status = status }
+
+func (w *commandResponse) Write(b []byte) (int, error) {
+	if w.status >= 300 {
+		return w.errBody.Write(b)
+	}
+	return w.out.Write(b)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting documented in these files as an environment variable can also be given in
+// a YAML configuration file or as a command-line flag. A flag takes precedence over the
+// environment, and the environment over the file:
+//
+//	-config path   the configuration file; or DELOGGER_CONFIG
+//	-insert-workers 4, -log-level debug, ...
+//	               a setting, named in lower case with dashes
+//
+// In the file, a setting is named like its variable, in either case, and may be nested
+// under the words it starts with, so these are the same:
+//
+//	insert_workers: 4
+//	insert:
+//	  workers: 4
+//
+// A list is taken as its comma-separated items. Unknown settings in the file or flags stop
+// the server at startup, with the closest known name, so a misspelt setting isn't silently
+// ignored. Secrets are better kept out of flags, which other users of the host can read in
+// the process list. The OTEL_ settings are passed on to the OpenTelemetry SDK, which reads
+// them from the environment itself.
+
+// secretSettings can also be read from the file named by their _FILE setting, see
+// secretenv.go.
+var secretSettings = []string{
+	"DATABASE_URL", "POSTGRES_PASSWORD", "SMTP_PASSWORD", "ADMIN_API_KEY", "IP_ANONYMIZE_KEY", "ENCRYPTION_KEYS",
+	"INGEST_SIGNING_KEYS",
+}
+
+// knownSettings are the other settings, besides secretSettings and their _FILE settings.
+var knownSettings = []string{
+	"ADMIN_ADDR",
+	"ALERT_GROUP_WINDOW", "ALERT_INTERVAL", "ALERT_RULES",
+	"API_ADDR",
+	"ARCHIVE_CONCURRENCY", "ARCHIVE_MAX_FILES",
+	"AUTH_INGEST",
+	"COLLAPSE_REPEATS", "COLLAPSE_REPEATS_MATCH",
+	"DB_HOST", "DB_PORT", "DB_NAME", "DB_USER", "DB_SSLMODE", "DB_SSLROOTCERT", "DB_SSLCERT", "DB_SSLKEY",
+	"DB_CONNECT_TIMEOUT", "DB_HEALTH_CHECK_PERIOD", "DB_MAX_CONNS", "DB_MAX_CONN_IDLE_TIME", "DB_MAX_CONN_LIFETIME",
+	"DB_MIN_CONNS", "DB_RETRY_MAX_INTERVAL",
+	"DEDUP_WINDOW",
+	"DEFAULT_LOG_TIMEZONE", "DEFAULT_SAMPLING",
+	"DISABLE_ENRICHMENTS", "DISABLE_INPUTS", "DISABLE_PARSERS",
+	"ENCRYPT_FIELDS",
+	"GEOIP_ASN_DB", "GEOIP_CITY_DB", "GEOIP_PARSERS",
+	"HTTP_IDLE_TIMEOUT", "HTTP_MAX_HEADER_BYTES", "HTTP_READ_HEADER_TIMEOUT", "HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT",
+	"INGEST_SIGNATURE_WINDOW",
+	"INSERT_BATCH_INTERVAL", "INSERT_BATCH_SIZE", "INSERT_QUEUE_SIZE", "INSERT_WORKERS",
+	"IP_ANONYMIZE",
+	"LOG_FORMAT", "LOG_LEVEL",
+	"MAX_INGEST_BYTES", "MAX_REQUEST_BYTES", "MAX_STORED_RESPONSE",
+	"MEMORY_MAX_ENTRIES",
+	"OIDC_AUDIENCE", "OIDC_ISSUER", "OIDC_JWKS_URL", "OIDC_ROLES_CLAIM", "OIDC_ROLE_MAP", "OIDC_USER_CLAIM",
+	"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+	"OTEL_RESOURCE_ATTRIBUTES", "OTEL_SERVICE_NAME", "OTEL_TRACES_SAMPLER", "OTEL_TRACES_SAMPLER_ARG",
+	"PARSE_CHUNK_LINES", "PARSE_WORKERS",
+	"PII_REDACT", "PII_REDACT_PATTERNS", "SECRET_SCRUB",
+	"PUBLIC_URL",
+	"REQUIRE_SOURCE_TOKEN",
+	"RETENTION", "RETENTION_INTERVAL",
+	"REVERSE_DNS", "REVERSE_DNS_CONCURRENCY", "REVERSE_DNS_TIMEOUT", "REVERSE_DNS_TTL",
+	"SELF_INGEST", "SELF_INGEST_INTERVAL",
+	"SHUTDOWN_DRAIN_PERIOD", "SHUTDOWN_TIMEOUT",
+	"SMTP_BATCH_WINDOW", "SMTP_FROM", "SMTP_HOST", "SMTP_PORT", "SMTP_USERNAME",
+	"SPILL_DIR", "SPILL_THRESHOLD",
+	"STORAGE",
+	"TENANT_ROW_SECURITY",
+	"TLS_ACME_CACHE", "TLS_ACME_DIRECTORY", "TLS_ACME_DOMAINS", "TLS_ACME_EMAIL", "TLS_ACME_HTTP_ADDR",
+	"TLS_CERT_FILE", "TLS_CLIENT_AUTH", "TLS_CLIENT_CA_FILE", "TLS_KEY_FILE",
+	"UNIX_SOCKET", "UNIX_SOCKET_GROUP", "UNIX_SOCKET_MODE",
+	"USAGE_SUMMARY_URL",
+	"VAULT_ADDR", "VAULT_NAMESPACE", "VAULT_TOKEN", "VAULT_TOKEN_FILE",
+}
+
+// config holds the settings given in the configuration file and as flags.
+var config = struct {
+	path  string
+	file  map[string]string
+	flags map[string]string
+}{file: map[string]string{}, flags: map[string]string{}}
+
+// setting returns the value of a setting: its flag, else its environment variable, else
+// its value in the configuration file; empty if it isn't set.
+func setting(name string) string {
+	if v, ok := config.flags[name]; ok {
+		return v
+	}
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return config.file[name]
+}
+
+// allSettings returns the names of every setting.
+func allSettings() []string {
+	names := slices.Clone(knownSettings)
+	for _, name := range secretSettings {
+		names = append(names, name, name+"_FILE")
+	}
+	slices.Sort(names)
+	return names
+}
+
+// flagName is the command-line flag of a setting.
+func flagName(setting string) string {
+	return strings.ReplaceAll(strings.ToLower(setting), "_", "-")
+}
+
+// loadConfig parses the arguments of a command with fs, adding the flags of the settings
+// and -config, and reads the configuration file. It exits if either is invalid, and returns
+// the arguments left after the flags.
+func loadConfig(fs *flag.FlagSet, args []string) []string {
+	names := allSettings()
+	values := map[string]*string{}
+	for _, name := range names {
+		values[name] = fs.String(flagName(name), "", "sets "+name)
+	}
+	configPath := fs.String("config", os.Getenv("DELOGGER_CONFIG"), "YAML configuration `file`")
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if flagName(name) == f.Name {
+				config.flags[name] = *values[name]
+			}
+		}
+	})
+
+	if *configPath != "" {
+		file, err := readConfigFile(*configPath)
+		if err != nil {
+			fatalConfig("Invalid configuration file", "path", *configPath, "err", err)
+		}
+		config.path, config.file = *configPath, file
+	}
+
+	// The SDK reads its settings from the environment.
+	for _, name := range names {
+		if v := setting(name); strings.HasPrefix(name, "OTEL_") && v != "" {
+			os.Setenv(name, v)
+		}
+	}
+	return fs.Args()
+}
+
+// readConfigFile reads the settings of a YAML configuration file.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	settings := map[string]string{}
+	if doc == nil {
+		return settings, nil
+	}
+	if err := flattenConfig("", doc, settings); err != nil {
+		return nil, err
+	}
+
+	names := allSettings()
+	for name := range settings {
+		if !slices.Contains(names, name) {
+			if closest := closestSetting(name, names); closest != "" {
+				return nil, fmt.Errorf("unknown setting %s, did you mean %s?", name, closest)
+			}
+			return nil, fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	return settings, nil
+}
+
+// flattenConfig adds the settings of the YAML value v, nested under prefix, to settings.
+func flattenConfig(prefix string, v any, settings map[string]string) error {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if prefix != "" {
+				name = prefix + "_" + name
+			}
+			if err := flattenConfig(name, value, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case map[string]any, []any:
+				return fmt.Errorf("%s: list items must be plain values", prefix)
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		settings[prefix] = strings.Join(items, ",")
+		return nil
+	case nil:
+		settings[prefix] = ""
+		return nil
+	}
+	if prefix == "" {
+		return fmt.Errorf("must be a mapping of settings")
+	}
+	settings[prefix] = fmt.Sprint(v)
+	return nil
+}
+
+// closestSetting returns the setting whose name is closest to name, if any is close.
+func closestSetting(name string, names []string) string {
+	best, bestDistance := "", 4
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// logConfig logs where the settings came from, once logging is set up.
+func logConfig() {
+	if config.path != "" {
+		slog.Info("Read configuration file", "path", config.path, "settings", len(config.file))
+	}
+	if len(config.flags) > 0 {
+		slog.Debug("Settings given as flags", "settings", len(config.flags))
+	}
+}
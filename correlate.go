@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxCorrelatedEntries caps the number of entries returned for one correlation id.
+const maxCorrelatedEntries = 1000
+
+// Correlation is the response of /api/correlate/{id}.
+type Correlation struct {
+	CorrelationID string        `json:"correlation_id"`
+	Entries       []StoredEntry `json:"entries"`
+}
+
+// correlateHandler handles GET /api/correlate/{id}, returning every stored entry carrying
+// the id as its correlation, trace or request id across all sources, oldest first.
+func correlateHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, "Missing correlation id", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := loadCorrelated(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Could not look up correlation id", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error looking up correlation id", "id", id, "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Correlation{CorrelationID: id, Entries: entries})
+}
+
+// loadCorrelated returns the entries carrying id, oldest first, of the caller's tenant and
+// project.
+func loadCorrelated(ctx context.Context, id string) ([]StoredEntry, error) {
+	rows, err := dbPool.Query(ctx,
+		entrySelectSQL+" WHERE (e.correlation_id = $1 OR e.trace_id = $1 OR e.request_id = $1) AND ($3 = '' OR d.tenant = $3)"+
+			" AND ($4 = '' OR "+projectCond("$4")+") ORDER BY e.received_at, e.id LIMIT $2",
+		id, maxCorrelatedEntries, requestTenant(ctx), requestProject(ctx))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoredEntry, error) {
+		return scanEntry(row)
+	})
+	if entries == nil {
+		entries = []StoredEntry{}
+	}
+	return entries, err
+}
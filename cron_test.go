@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2025, 1, 1, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next string // "" if nothing matches
+	}{
+		{"* * * * *", "2025-01-01 10:31"},
+		{"*/15 * * * *", "2025-01-01 10:45"},
+		{"30 * * * *", "2025-01-01 11:30"},
+		{"5,50 9-11 * * *", "2025-01-01 10:50"},
+		{"0 9-17/4 * * *", "2025-01-01 13:00"},
+		{"@hourly", "2025-01-01 11:00"},
+		{"@daily", "2025-01-02 00:00"},
+		{"@midnight", "2025-01-02 00:00"},
+		{"@weekly", "2025-01-05 00:00"},
+		{"@monthly", "2025-02-01 00:00"},
+		{" @daily ", "2025-01-02 00:00"},
+		{"0 8 * * 1-5", "2025-01-02 08:00"},
+		{"0 8 * * 7", "2025-01-05 08:00"},
+		{"0 8 * * 0", "2025-01-05 08:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		{"0 0 31 * *", "2025-01-31 00:00"},
+		// Either day field may match when both are restricted.
+		{"0 0 15 * 5", "2025-01-03 00:00"},
+		{"0 0 2 * 5", "2025-01-02 00:00"},
+		{"0 0 30 2 *", ""},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		var got string
+		if next := s.next(from); !next.IsZero() {
+			got = next.Format("2006-01-02 15:04")
+		}
+		if got != tt.next {
+			t.Errorf("%q: got next %q, want %q", tt.expr, got, tt.next)
+		}
+	}
+}
+
+func TestCronNextInLocation(t *testing.T) {
+	ams, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := parseCron("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:30 doesn't exist on the day clocks go forward, so that day is skipped.
+	got := s.next(time.Date(2025, 3, 29, 12, 0, 0, 0, ams))
+	if want := time.Date(2025, 3, 31, 2, 30, 0, 0, ams); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseCronRejected(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "schedule must have five fields"},
+		{"* * * *", "schedule must have five fields"},
+		{"* * * * * *", "schedule must have five fields"},
+		{"@yearly", "schedule must have five fields"},
+		{"60 * * * *", `minute: "60" is outside 0-59`},
+		{"* 24 * * *", `hour: "24" is outside 0-23`},
+		{"* * 0 * *", `day of month: "0" is outside 1-31`},
+		{"* * * 13 *", `month: "13" is outside 1-12`},
+		{"* * * * 8", `day of week: "8" is outside 0-7`},
+		{"5-1 * * * *", `minute: "5-1" is outside 0-59`},
+		{"*/0 * * * *", `minute: invalid step "0"`},
+		{"*/x * * * *", `minute: invalid step "x"`},
+		{"a * * * *", `minute: invalid value "a"`},
+		{"1-b * * * *", `minute: invalid value "b"`},
+		{"1,,2 * * * *", `minute: invalid value ""`},
+		{"-5 * * * *", `minute: invalid value ""`},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
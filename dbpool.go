@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The database is the one of DATABASE_URL, a postgres:// URL or a list of key=value
+// parameters, with any of its parts overridden by:
+//
+//	DB_HOST          host name, address or Unix socket directory
+//	DB_PORT          port; default 5432
+//	DB_NAME          database name
+//	DB_USER          user name; the password is set by POSTGRES_PASSWORD
+//	DB_SSLMODE       disable, allow, prefer (default), require, verify-ca or verify-full,
+//	                 which checks the server's certificate and host name
+//	DB_SSLROOTCERT   CA certificate file to verify the server with; default the system's
+//	DB_SSLCERT       client certificate file, for certificate authentication
+//	DB_SSLKEY        key file of the client certificate
+//
+// Without DATABASE_URL they make up the connection; the other parameters and the PG*
+// variables of libpq apply as usual.
+//
+// The connection pool is sized and recycled by:
+//
+//	DB_MAX_CONNS                most connections; default the larger of 4 and the number of CPUs
+//	DB_MIN_CONNS                connections kept open while idle; default 0
+//	DB_MAX_CONN_LIFETIME        age after which a connection is replaced; default 1h
+//	DB_MAX_CONN_IDLE_TIME       idle time after which a connection is closed; default 30m
+//	DB_HEALTH_CHECK_PERIOD      how often idle connections are checked; default 1m
+//
+// They override the pool_* parameters of DATABASE_URL. /api/debug/db tells whether the
+// pool is too small for the load.
+//
+// At startup the server waits for the database to answer, so it can start alongside it,
+// e.g. in Docker Compose. Should the database become unreachable later, the pool opens new
+// connections once it is back, and the record writers keep their records meanwhile,
+// retrying until they are stored; requests are refused with 503 once the queue is full.
+//
+//	DB_CONNECT_TIMEOUT       how long to wait for the database at startup; default 1m,
+//	                         0 to fail at once
+//	DB_RETRY_MAX_INTERVAL    longest wait between attempts; default 30s
+//
+// The waits double from 250ms up to DB_RETRY_MAX_INTERVAL, each shortened by up to half at
+// random, so replicas restarted together don't retry in step.
+
+// dbRetry holds the retry settings, read by waitForDatabase.
+var dbRetry = struct {
+	connectTimeout time.Duration
+	maxInterval    time.Duration
+	outage         atomic.Bool // set while the record writers can't reach the database
+}{connectTimeout: time.Minute, maxInterval: 30 * time.Second}
+
+const (
+	dbRetryInitialInterval = 250 * time.Millisecond
+	dbPingTimeout          = 5 * time.Second // bounds each attempt at startup
+)
+
+// databaseParams are the settings overriding parts of DATABASE_URL, with their parameters.
+var databaseParams = []struct{ env, param string }{
+	{"DB_HOST", "host"}, {"DB_PORT", "port"}, {"DB_NAME", "dbname"}, {"DB_USER", "user"}, {"DB_SSLMODE", "sslmode"},
+	{"DB_SSLROOTCERT", "sslrootcert"}, {"DB_SSLCERT", "sslcert"}, {"DB_SSLKEY", "sslkey"},
+}
+
+// databaseConnString returns DATABASE_URL with the parts set by the DB_ settings, exiting
+// if one is invalid.
+func databaseConnString() string {
+	connStr := secretEnv("DATABASE_URL")
+	if v := setting("DB_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+			fatalConfig("Invalid DB_PORT: must be a port number", "value", v)
+		}
+	}
+	modes := []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+	if v := setting("DB_SSLMODE"); v != "" && !slices.Contains(modes, v) {
+		fatalConfig("Invalid DB_SSLMODE: must be one of "+strings.Join(modes, ", "), "value", v)
+	}
+	if (setting("DB_SSLCERT") == "") != (setting("DB_SSLKEY") == "") {
+		fatalConfig("DB_SSLCERT and DB_SSLKEY must be set together")
+	}
+
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		u, err := url.Parse(connStr)
+		if err != nil {
+			fatalConfig("Invalid DATABASE_URL", "err", err)
+		}
+		// Query parameters take precedence over the other parts of the URL.
+		q := u.Query()
+		for _, p := range databaseParams {
+			if v := setting(p.env); v != "" {
+				q.Set(p.param, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	// Of repeated key=value parameters, the last applies.
+	for _, p := range databaseParams {
+		if v := setting(p.env); v != "" {
+			v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+			connStr += fmt.Sprintf(" %s='%s'", p.param, v)
+		}
+	}
+	return strings.TrimSpace(connStr)
+}
+
+// configurePool applies the pool settings to config, exiting if one is invalid.
+func configurePool(config *pgxpool.Config) {
+	for _, s := range []struct {
+		env   string
+		value *int32
+	}{{"DB_MAX_CONNS", &config.MaxConns}, {"DB_MIN_CONNS", &config.MinConns}} {
+		if v := setting(s.env); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || n < 0 {
+				fatalConfig("Invalid "+s.env+": must be a number of connections", "value", v)
+			}
+			*s.value = int32(n)
+		}
+	}
+	for _, s := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"DB_MAX_CONN_LIFETIME", &config.MaxConnLifetime},
+		{"DB_MAX_CONN_IDLE_TIME", &config.MaxConnIdleTime},
+		{"DB_HEALTH_CHECK_PERIOD", &config.HealthCheckPeriod},
+	} {
+		if v := setting(s.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				fatalConfig("Invalid "+s.env+": must be a positive duration", "value", v)
+			}
+			*s.value = d
+		}
+	}
+
+	if config.MaxConns < 1 {
+		fatalConfig("Invalid DB_MAX_CONNS: must be at least 1", "value", config.MaxConns)
+	}
+	if config.MinConns > config.MaxConns {
+		fatalConfig("Invalid DB_MIN_CONNS: must not exceed DB_MAX_CONNS", "min", config.MinConns, "max", config.MaxConns)
+	}
+	slog.Info("Database pool configured", "max_conns", config.MaxConns, "min_conns", config.MinConns,
+		"max_conn_lifetime", config.MaxConnLifetime, "max_conn_idle_time", config.MaxConnIdleTime,
+		"health_check_period", config.HealthCheckPeriod)
+}
+
+// waitForDatabase pings the database until it answers, for up to DB_CONNECT_TIMEOUT,
+// exiting if a setting is invalid.
+func waitForDatabase(pool *pgxpool.Pool) error {
+	for _, s := range []struct {
+		env   string
+		value *time.Duration
+		min   time.Duration
+	}{
+		{"DB_CONNECT_TIMEOUT", &dbRetry.connectTimeout, 0},
+		{"DB_RETRY_MAX_INTERVAL", &dbRetry.maxInterval, time.Nanosecond},
+	} {
+		if v := setting(s.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < s.min {
+				fatalConfig("Invalid "+s.env+": must be a duration such as 30s", "value", v)
+			}
+			*s.value = d
+		}
+	}
+
+	deadline := time.Now().Add(dbRetry.connectTimeout)
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+		err := pool.Ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		wait := retryInterval(attempt)
+		if !databaseUnavailable(err) || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		slog.Warn("Database not available yet, retrying", "attempt", attempt+1, "retry_in", wait.Round(time.Millisecond), "err", err)
+		time.Sleep(wait)
+	}
+}
+
+// retryInterval returns how long to wait after the failed attempt with the given number,
+// counting from 0.
+func retryInterval(attempt int) time.Duration {
+	d := dbRetry.maxInterval
+	if attempt < 16 {
+		d = min(dbRetryInitialInterval<<attempt, d)
+	}
+	return d - rand.N(d/2+1)
+}
+
+// databaseUnavailable tells whether err is the database being unreachable, rather than it
+// refusing a statement, so that what failed is worth retrying as it is.
+func databaseUnavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection_exception, admin_shutdown, crash_shutdown and cannot_connect_now
+		return strings.HasPrefix(pgErr.Code, "08") || slices.Contains([]string{"57P01", "57P02", "57P03"}, pgErr.Code)
+	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.Timeout(err) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// writeUntilStored writes a group of records, retrying while the database is unreachable
+// rather than failing them, and returns the error of the last attempt.
+func writeUntilStored(group []*pendingRecord) error {
+	err := store.WriteRecords(group)
+	for attempt := 0; err != nil && databaseUnavailable(err); attempt++ {
+		if dbRetry.outage.CompareAndSwap(false, true) {
+			slog.Error("Database unavailable; holding records until it is back", "pending", recordWriter.pending.Load(), "err", err)
+		}
+		time.Sleep(retryInterval(attempt))
+		err = store.WriteRecords(group)
+	}
+	if err == nil && dbRetry.outage.CompareAndSwap(true, false) {
+		slog.Info("Database available again", "pending", recordWriter.pending.Load())
+	}
+	return err
+}
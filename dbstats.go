@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The connection pool's statistics are exposed on /metrics and, with the server's view of
+// our connections, on /api/debug/db, to tell a pool that is too small (acquires waiting
+// while every connection is busy) from a database that is slow or refusing connections.
+
+// dbConnectErrors counts failed attempts to open a pool connection.
+var dbConnectErrors atomic.Int64
+
+func (dbTracer) TraceConnectStart(ctx context.Context, _ pgx.TraceConnectStartData) context.Context {
+	return ctx
+}
+
+func (dbTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	if data.Err != nil {
+		dbConnectErrors.Add(1)
+	}
+}
+
+// DBPoolStats is a snapshot of the connection pool.
+type DBPoolStats struct {
+	MaxConns          int32 `json:"max_conns"`
+	TotalConns        int32 `json:"total_conns"`
+	AcquiredConns     int32 `json:"acquired_conns"`
+	IdleConns         int32 `json:"idle_conns"`
+	ConstructingConns int32 `json:"constructing_conns"`
+	// Counts since the process started.
+	AcquireCount            int64 `json:"acquire_count"`
+	EmptyAcquireCount       int64 `json:"empty_acquire_count"` // acquires that waited for a connection
+	CanceledAcquireCount    int64 `json:"canceled_acquire_count"`
+	ConnectErrors           int64 `json:"connect_errors"`
+	NewConnsCount           int64 `json:"new_conns_count"`
+	MaxLifetimeDestroyCount int64 `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroyCount     int64 `json:"max_idle_destroy_count"`
+	// Total time spent acquiring connections, and waiting because none was idle.
+	AcquireSeconds   float64 `json:"acquire_seconds"`
+	EmptyWaitSeconds float64 `json:"empty_wait_seconds"`
+}
+
+func dbPoolStats(s *pgxpool.Stat) DBPoolStats {
+	return DBPoolStats{
+		MaxConns:                s.MaxConns(),
+		TotalConns:              s.TotalConns(),
+		AcquiredConns:           s.AcquiredConns(),
+		IdleConns:               s.IdleConns(),
+		ConstructingConns:       s.ConstructingConns(),
+		AcquireCount:            s.AcquireCount(),
+		EmptyAcquireCount:       s.EmptyAcquireCount(),
+		CanceledAcquireCount:    s.CanceledAcquireCount(),
+		ConnectErrors:           dbConnectErrors.Load(),
+		NewConnsCount:           s.NewConnsCount(),
+		MaxLifetimeDestroyCount: s.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     s.MaxIdleDestroyCount(),
+		AcquireSeconds:          s.AcquireDuration().Seconds(),
+		EmptyWaitSeconds:        s.EmptyAcquireWaitTime().Seconds(),
+	}
+}
+
+// writeDBPoolMetrics adds the pool statistics to /metrics.
+func writeDBPoolMetrics(m metricsWriter) {
+	s := dbPoolStats(dbPool.Stat())
+	m.value("delogger_db_pool_max_conns", "gauge", "Maximum size of the connection pool.", float64(s.MaxConns))
+	m.value("delogger_db_pool_total_conns", "gauge", "Open connections, including those being opened.", float64(s.TotalConns))
+	m.value("delogger_db_pool_acquired_conns", "gauge", "Connections in use.", float64(s.AcquiredConns))
+	m.value("delogger_db_pool_idle_conns", "gauge", "Idle connections.", float64(s.IdleConns))
+	m.value("delogger_db_pool_acquires_total", "counter", "Connections acquired from the pool.", float64(s.AcquireCount))
+	m.value("delogger_db_pool_empty_acquires_total", "counter", "Acquires that waited because no connection was idle.", float64(s.EmptyAcquireCount))
+	m.value("delogger_db_pool_canceled_acquires_total", "counter", "Acquires canceled before a connection was available.", float64(s.CanceledAcquireCount))
+	m.value("delogger_db_pool_connect_errors_total", "counter", "Failed attempts to open a connection.", float64(s.ConnectErrors))
+	m.value("delogger_db_pool_acquire_seconds_total", "counter", "Time spent acquiring connections.", s.AcquireSeconds)
+	m.value("delogger_db_pool_empty_wait_seconds_total", "counter", "Time spent waiting for a connection to become idle.", s.EmptyWaitSeconds)
+}
+
+// DBDebug is the response of GET /api/debug/db.
+type DBDebug struct {
+	Pool DBPoolStats `json:"pool"`
+	// Server is how PostgreSQL sees the connections to this database, by state (active,
+	// idle, idle in transaction, ...), with the longest running query of each state.
+	Server []DBConnState `json:"server"`
+}
+
+// DBConnState counts the server connections in one state.
+type DBConnState struct {
+	State          string  `json:"state"`
+	Count          int64   `json:"count"`
+	LongestSeconds float64 `json:"longest_seconds"`
+}
+
+// debugDBHandler handles GET /api/debug/db.
+func debugDBHandler(w http.ResponseWriter, r *http.Request) {
+	debug := DBDebug{Pool: dbPoolStats(dbPool.Stat())}
+
+	rows, err := dbPool.Query(r.Context(), `
+	SELECT COALESCE(state, 'unknown'), count(*),
+		COALESCE(EXTRACT(EPOCH FROM max(now() - COALESCE(query_start, backend_start))), 0)::float8
+	FROM pg_stat_activity
+	WHERE datname = current_database() AND backend_type = 'client backend'
+	GROUP BY 1
+	ORDER BY 2 DESC`)
+	if err == nil {
+		debug.Server, err = pgx.CollectRows(rows, pgx.RowToStructByPos[DBConnState])
+	}
+	if err != nil {
+		http.Error(w, "Could not read database activity", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading database activity", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, debug)
+}
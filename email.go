@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email channels are sent through the SMTP server configured in the environment:
+//
+//	SMTP_HOST          server host name; required for email channels
+//	SMTP_PORT          default 587; 465 uses implicit TLS, other ports STARTTLS when offered
+//	SMTP_USERNAME      with SMTP_PASSWORD, authenticates with PLAIN
+//	SMTP_PASSWORD
+//	SMTP_FROM          sender address; required
+//	SMTP_BATCH_WINDOW  events for the same channel within this window go out as one email; default 1m
+//
+// Subject and Template on the channel override the default subject and plain-text body.
+
+// Default email templates.
+const (
+	defaultEmailSubject = `[DeLogger] {{.Rule}} is {{.Status}}`
+	defaultEmailBody    = `Alert rule "{{.Rule}}" is {{.Status}}.
+
+{{.Summary}}.
+Started at {{.StartsAt.Format "2006-01-02 15:04:05 MST"}}, evaluated at {{.EvaluatedAt.Format "2006-01-02 15:04:05 MST"}}.
+{{- if .Samples}}
+
+Recent lines:
+{{range .Samples}}  {{.}}
+{{end}}
+{{- end}}
+{{- if .QueryURL}}
+
+Matching entries: {{.QueryURL}}
+{{- end}}
+`
+)
+
+// smtpConfig is the server email is sent through.
+type smtpConfig struct {
+	host, port         string
+	username, password string
+	from               string
+}
+
+// emailBatcher collects the events of each channel until its batch window ends.
+type emailBatcher struct {
+	smtp   smtpConfig
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*emailBatch // keyed by emailBatchKey
+}
+
+type emailBatch struct {
+	channel AlertChannel
+	events  []AlertEvent
+}
+
+// mailer is nil when SMTP_HOST is not set.
+var mailer *emailBatcher
+
+// setupSMTP reads the SMTP configuration.
+func setupSMTP() {
+	host := setting("SMTP_HOST")
+	if host == "" {
+		return
+	}
+	cfg := smtpConfig{
+		host:     host,
+		port:     "587",
+		username: setting("SMTP_USERNAME"),
+		password: secretEnv("SMTP_PASSWORD"),
+		from:     setting("SMTP_FROM"),
+	}
+	if v := setting("SMTP_PORT"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 16); err != nil {
+			fatalConfig("Invalid SMTP_PORT", "value", v)
+		}
+		cfg.port = v
+	}
+	if _, err := mail.ParseAddress(cfg.from); err != nil {
+		fatalConfig("Invalid SMTP_FROM", "value", cfg.from, "err", err)
+	}
+
+	mailer = &emailBatcher{
+		smtp:    cfg,
+		window:  envDuration("SMTP_BATCH_WINDOW", time.Minute),
+		pending: map[string]*emailBatch{},
+	}
+	slog.Info("Sending alert emails", "smtp", cfg.host+":"+cfg.port)
+}
+
+// emailNotifier sends events to the channel's To addresses.
+type emailNotifier struct{}
+
+func (emailNotifier) validate(c AlertChannel) error {
+	if mailer == nil {
+		return errors.New("email requires SMTP_HOST to be set")
+	}
+	if len(c.To) == 0 {
+		return errors.New("to is required")
+	}
+	for _, addr := range c.To {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+	}
+	if _, err := parseMessageTemplate(c.Subject, ""); err != nil {
+		return fmt.Errorf("invalid subject: %v", err)
+	}
+	return nil
+}
+
+// notify queues event; the batch is sent when the channel's window ends.
+func (emailNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	mailer.add(c, event)
+	return nil
+}
+
+// emailBatchKey identifies a channel by its recipients and templates.
+func emailBatchKey(c AlertChannel) string {
+	return strings.Join(c.To, ",") + "\x00" + c.Subject + "\x00" + c.Template
+}
+
+// add queues event for c, starting a batch window if none is open.
+func (m *emailBatcher) add(c AlertChannel, event AlertEvent) {
+	key := emailBatchKey(c)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.pending[key]; ok {
+		b.events = append(b.events, event)
+		return
+	}
+	m.pending[key] = &emailBatch{channel: c, events: []AlertEvent{event}}
+	time.AfterFunc(m.window, func() { m.flush(key) })
+}
+
+// flush sends the batch queued under key.
+func (m *emailBatcher) flush(key string) {
+	m.mu.Lock()
+	b := m.pending[key]
+	delete(m.pending, key)
+	m.mu.Unlock()
+	if b == nil {
+		return
+	}
+
+	subject, body, err := renderEmail(b.channel, b.events)
+	if err == nil {
+		err = m.send(b.channel.To, subject, body)
+	}
+	if err != nil {
+		slog.Error("Error sending alert emails", "notifications", len(b.events), "to", strings.Join(b.channel.To, ", "), "err", err)
+	}
+}
+
+// renderEmail renders the subject and body of a batch. A single event uses the channel
+// templates as is; several are listed in one body under a summary subject.
+func renderEmail(c AlertChannel, events []AlertEvent) (string, string, error) {
+	bodies := make([]string, len(events))
+	for i, event := range events {
+		var err error
+		bodies[i], err = renderMessage(c, defaultEmailBody, event)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if len(events) > 1 {
+		return fmt.Sprintf("[DeLogger] %d alert notifications", len(events)), strings.Join(bodies, "\n----\n\n"), nil
+	}
+
+	subject, err := renderMessage(AlertChannel{Template: c.Subject}, defaultEmailSubject, events[0])
+	return subject, bodies[0], err
+}
+
+// send delivers one plain-text email.
+func (m *emailBatcher) send(to []string, subject, body string) error {
+	var msg strings.Builder
+	msg.WriteString("From: " + m.smtp.from + "\r\n")
+	msg.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", strings.ReplaceAll(subject, "\n", " ")) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+
+	return m.smtp.sendMail(to, []byte(msg.String()))
+}
+
+// bareAddress strips the display name from a validated address, "Ops <ops@example.com>"
+// becoming "ops@example.com".
+func bareAddress(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
+
+// sendMail is smtp.SendMail with implicit TLS on port 465 and a connection timeout.
+func (cfg smtpConfig) sendMail(to []string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.host, cfg.port)
+	dialer := &net.Dialer{Timeout: notifyClient.Timeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, cfg.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && cfg.port != "465" {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.host}); err != nil {
+			return err
+		}
+	}
+	if cfg.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.username, cfg.password, cfg.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(bareAddress(cfg.from)); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(bareAddress(addr)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
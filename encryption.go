@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Stored payloads can be encrypted at rest with envelope encryption: every value gets its
+// own random data key, which encrypts it with AES-256-GCM and is itself encrypted
+// ("wrapped") with a configured key-encryption key:
+//
+//	ENCRYPTION_KEYS   comma-separated id=key pairs, keys being 32 random bytes in base64,
+//	                  e.g. 2026-10=q3Jd...; the first encrypts, all decrypt, so a key is
+//	                  rotated by prepending a new one
+//	ENCRYPT_FIELDS    columns to encrypt; default request_body,response_body,message,raw.
+//	                  client_ip and client_host can be added, but then no longer match
+//	                  filters and facets
+//
+// The lines of a request body are also stored in the message and raw columns of its
+// entries, so encrypting request_body without them is refused at startup. PostgreSQL can't
+// search encrypted text, so while they are encrypted the contains and regex filters, the
+// msg and raw fields of q= and the top errors are refused rather than matching nothing;
+// the live tail shares the filters and refuses them too. The latest message of an issue is
+// encrypted like message. Template texts are mined from the plaintext and stay readable.
+//
+// A value is stored as enc:v1:<key id>:<wrapped data key>:<ciphertext>, naming the key that
+// wrapped it, so values written before a rotation stay readable. A key kept in a KMS is
+// passed in by the deployment, e.g. decrypted into the environment at start. Reads through
+// the API decrypt transparently; the raw request is served to admins by GET
+// /api/records/{id}. Values stored before encryption was enabled are read as they are.
+
+const encryptedPrefix = "enc:v1:"
+
+// encryptableFields are the columns ENCRYPT_FIELDS may name.
+var encryptableFields = []string{"request_body", "response_body", "message", "raw", "client_ip", "client_host"}
+
+// columnCipher encrypts and decrypts column values, nil while encryption is off.
+type columnCipher struct {
+	current string                 // id of the key encrypting new values
+	keys    map[string]cipher.AEAD // key-encryption keys by id
+	fields  map[string]bool        // columns to encrypt
+}
+
+var encryption *columnCipher
+
+// setupEncryption reads the key-encryption keys and the fields to encrypt.
+func setupEncryption() {
+	v := secretEnv("ENCRYPTION_KEYS")
+	if v == "" {
+		return
+	}
+	c := &columnCipher{keys: map[string]cipher.AEAD{}, fields: map[string]bool{}}
+	for _, pair := range strings.Split(v, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			fatalConfig("Invalid ENCRYPTION_KEYS entry: must be id=base64-key", "id", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			fatalConfig("Invalid ENCRYPTION_KEYS entry: the key must be 32 bytes in base64", "id", id)
+		}
+		c.keys[id] = newGCM(key)
+		if c.current == "" {
+			c.current = id
+		}
+	}
+
+	fields := setting("ENCRYPT_FIELDS")
+	if fields == "" {
+		fields = "request_body,response_body,message,raw"
+	}
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(encryptableFields, f) {
+			fatalConfig("Invalid ENCRYPT_FIELDS: fields must be among "+strings.Join(encryptableFields, ", "), "field", f)
+		}
+		c.fields[f] = true
+	}
+	if c.fields["request_body"] && (!c.fields["message"] || !c.fields["raw"]) {
+		fatalConfig("Invalid ENCRYPT_FIELDS: request_body can't be encrypted without message and raw, which hold its lines", "fields", fields)
+	}
+	encryption = c
+	slog.Info("Encrypting stored fields", "key", c.current, "fields", fields)
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // key lengths are checked by the callers
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+// sealGCM encrypts plain with aead under a random nonce, prepended to the result.
+func sealGCM(aead cipher.AEAD, plain, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, additional)
+}
+
+func openGCM(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// encrypted reports whether values of field are stored encrypted.
+func (c *columnCipher) encrypted(field string) bool {
+	return c != nil && c.fields[field]
+}
+
+// searchable returns an error naming what can't be searched while the message or raw
+// columns are encrypted, nil if both are plaintext.
+func (c *columnCipher) searchable(what string) error {
+	if c.encrypted("message") || c.encrypted("raw") {
+		return errors.New(what + " can't be searched while message and raw are encrypted")
+	}
+	return nil
+}
+
+// encrypt returns value encrypted if field is to be encrypted, else value itself. Empty
+// values are kept empty.
+func (c *columnCipher) encrypt(field, value string) string {
+	if c == nil || !c.fields[field] || value == "" {
+		return value
+	}
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	wrapped := sealGCM(c.keys[c.current], dataKey, []byte(c.current))
+	sealed := sealGCM(newGCM(dataKey), []byte(value), []byte(field))
+	return encryptedPrefix + c.current + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// decrypt returns the plaintext of a value of field stored by encrypt. Values that aren't
+// encrypted are returned as they are.
+func (c *columnCipher) decrypt(field, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("encrypted " + field + " found, but ENCRYPTION_KEYS is not set")
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted " + field)
+	}
+	kek, ok := c.keys[parts[0]]
+	if !ok {
+		return "", errors.New(field + " is encrypted with unknown key " + strconv.Quote(parts[0]))
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openGCM(kek, wrapped, []byte(parts[0]))
+	if err != nil || len(dataKey) != 32 {
+		return "", errors.New("could not unwrap the data key of " + field)
+	}
+	plain, err := openGCM(newGCM(dataKey), sealed, []byte(field))
+	if err != nil {
+		return "", errors.New("could not decrypt " + field)
+	}
+	return string(plain), nil
+}
+
+// encryptJSON encrypts a JSONB value as a JSON string holding the ciphertext.
+func (c *columnCipher) encryptJSON(field string, value json.RawMessage) json.RawMessage {
+	if c == nil || !c.fields[field] || len(value) == 0 {
+		return value
+	}
+	encrypted, _ := json.Marshal(c.encrypt(field, string(value)))
+	return encrypted
+}
+
+// decryptJSON reverses encryptJSON.
+func (c *columnCipher) decryptJSON(field string, value json.RawMessage) (json.RawMessage, error) {
+	var s string
+	if json.Unmarshal(value, &s) != nil || !strings.HasPrefix(s, encryptedPrefix) {
+		return value, nil
+	}
+	plain, err := c.decrypt(field, s)
+	return json.RawMessage(plain), err
+}
+
+// StoredRecord is an ingest request as stored in delogged.
+type StoredRecord struct {
+	ID int64 `json:"id"`
+	LogRecord
+}
+
+// getRecordHandler handles GET /api/records/{id}, returning the request with its body.
+func getRecordHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record id", http.StatusBadRequest)
+		return
+	}
+
+	rec := StoredRecord{ID: id}
+	err = dbPool.QueryRow(r.Context(), `
+	SELECT timestamp, COALESCE(remote_addr, ''), COALESCE(request_body, ''), response_body,
+		COALESCE(status_code, 0), COALESCE(error_msg, ''), host, service, env, redactions, fields
+	FROM delogged WHERE id = $1`, id).Scan(&rec.Timestamp, &rec.RemoteAddr, &rec.RequestBody, &rec.ResponseBody,
+		&rec.StatusCode, &rec.ErrorMsg, &rec.Host, &rec.Service, &rec.Env, &rec.Redactions, &rec.Fields)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		rec.RequestBody, err = encryption.decrypt("request_body", rec.RequestBody)
+	}
+	if err == nil {
+		rec.ResponseBody, err = encryption.decryptJSON("response_body", rec.ResponseBody)
+	}
+	if err != nil {
+		http.Error(w, "Could not read record", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading record", "id", id, "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
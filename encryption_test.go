@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withEncryption sets up encryption from ENCRYPTION_KEYS=keys and ENCRYPT_FIELDS=fields
+// for the duration of the test, and returns the cipher.
+func withEncryption(t *testing.T, keys, fields string) *columnCipher {
+	t.Helper()
+	saved := encryption
+	t.Cleanup(func() { encryption = saved })
+	encryption = nil
+	t.Setenv("ENCRYPTION_KEYS", keys)
+	t.Setenv("ENCRYPT_FIELDS", fields)
+	setupEncryption()
+	return encryption
+}
+
+// testKey returns a base64 key-encryption key made of b.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	c := withEncryption(t, "k1="+testKey('a'), "request_body,message,raw,client_ip")
+
+	tests := []struct {
+		field, value string
+		encrypted    bool
+	}{
+		{"request_body", "[t] [INFO] hello", true},
+		{"request_body", "ünïcödé and \x00 bytes", true},
+		{"request_body", "", false},
+		{"message", "GET /login as alice", true},
+		{"raw", "[t] [INFO] hello", true},
+		{"client_ip", "203.0.113.9", true},
+		{"response_body", "not configured", false},
+		{"client_host", "client.example", false},
+	}
+	for _, tt := range tests {
+		stored := c.encrypt(tt.field, tt.value)
+		if got := strings.HasPrefix(stored, encryptedPrefix+"k1:"); got != tt.encrypted {
+			t.Errorf("%s %q: stored as %q, want encrypted=%v", tt.field, tt.value, stored, tt.encrypted)
+		}
+		if tt.encrypted && strings.Contains(stored, tt.value) {
+			t.Errorf("%s %q: stored value holds the plaintext", tt.field, tt.value)
+		}
+		if got, err := c.decrypt(tt.field, stored); err != nil || got != tt.value {
+			t.Errorf("%s %q: decrypted to %q, %v", tt.field, tt.value, got, err)
+		}
+	}
+	// Every value gets its own data key and nonce.
+	if c.encrypt("request_body", "x") == c.encrypt("request_body", "x") {
+		t.Error("the same value encrypted twice gave the same ciphertext")
+	}
+}
+
+func TestEncryptionJSON(t *testing.T) {
+	c := withEncryption(t, "k1="+testKey('a'), "response_body")
+	value := json.RawMessage(`{"ok":true}`)
+	stored := c.encryptJSON("response_body", value)
+	var s string
+	if err := json.Unmarshal(stored, &s); err != nil || !strings.HasPrefix(s, encryptedPrefix) {
+		t.Fatalf("stored %s, want a JSON string of ciphertext", stored)
+	}
+	if got, err := c.decryptJSON("response_body", stored); err != nil || string(got) != string(value) {
+		t.Errorf("decrypted to %s, %v", got, err)
+	}
+	// Values stored before encryption was enabled, strings included, are read as they are.
+	for _, plain := range []string{`{"ok":true}`, `"a string"`, `null`} {
+		if got, err := c.decryptJSON("response_body", json.RawMessage(plain)); err != nil || string(got) != plain {
+			t.Errorf("%s: decrypted to %s, %v", plain, got, err)
+		}
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	old := withEncryption(t, "2026-01="+testKey('a'), "")
+	before := old.encrypt("request_body", "written before the rotation")
+
+	// Rotated by prepending a new key: it encrypts, and the old one still decrypts.
+	c := withEncryption(t, "2026-10="+testKey('b')+", 2026-01="+testKey('a'), "")
+	after := c.encrypt("request_body", "written after")
+	if !strings.HasPrefix(after, encryptedPrefix+"2026-10:") {
+		t.Errorf("new value stored as %q, want it under the new key", after)
+	}
+	for stored, want := range map[string]string{before: "written before the rotation", after: "written after"} {
+		if got, err := c.decrypt("request_body", stored); err != nil || got != want {
+			t.Errorf("decrypted to %q, %v, want %q", got, err, want)
+		}
+	}
+
+	// Once the old key is dropped, its values can't be read, but aren't mistaken for plaintext.
+	c = withEncryption(t, "2026-10="+testKey('b'), "")
+	if _, err := c.decrypt("request_body", before); err == nil || err.Error() != `request_body is encrypted with unknown key "2026-01"` {
+		t.Errorf("got error %v, want the unknown key reported", err)
+	}
+	if got, err := c.decrypt("request_body", after); err != nil || got != "written after" {
+		t.Errorf("decrypted to %q, %v", got, err)
+	}
+}
+
+func TestDecryptRejected(t *testing.T) {
+	c := withEncryption(t, "k1="+testKey('a')+",k2="+testKey('b'), "request_body,message,raw,client_ip")
+	stored := c.encrypt("request_body", "secret")
+	parts := strings.Split(strings.TrimPrefix(stored, encryptedPrefix), ":")
+	tamper := func(s string) string { // flips a bit of the last byte
+		b, _ := base64.RawStdEncoding.DecodeString(s)
+		b[len(b)-1] ^= 1
+		return base64.RawStdEncoding.EncodeToString(b)
+	}
+
+	tests := []struct {
+		name   string
+		cipher *columnCipher
+		field  string
+		value  string
+		err    string
+	}{
+		{"encryption off", nil, "request_body", stored, "encrypted request_body found, but ENCRYPTION_KEYS is not set"},
+		{"malformed", c, "request_body", encryptedPrefix + "k1:abc", "malformed encrypted request_body"},
+		{"other field", c, "client_ip", stored, "could not decrypt client_ip"},
+		{"key id changed", c, "request_body", encryptedPrefix + "k2:" + parts[1] + ":" + parts[2], "could not unwrap the data key of request_body"},
+		{"wrapped key tampered", c, "request_body", encryptedPrefix + "k1:" + tamper(parts[1]) + ":" + parts[2], "could not unwrap the data key of request_body"},
+		{"ciphertext tampered", c, "request_body", encryptedPrefix + "k1:" + parts[1] + ":" + tamper(parts[2]), "could not decrypt request_body"},
+		{"ciphertext truncated", c, "request_body", encryptedPrefix + "k1:" + parts[1] + ":AAAA", "could not decrypt request_body"},
+		{"not base64", c, "request_body", encryptedPrefix + "k1:" + parts[1] + ":!!", "illegal base64 data"},
+	}
+	for _, tt := range tests {
+		_, err := tt.cipher.decrypt(tt.field, tt.value)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestEncryptedSearchRefused checks that searches PostgreSQL would run on ciphertext are
+// refused while message and raw are encrypted, and allowed otherwise.
+func TestEncryptedSearchRefused(t *testing.T) {
+	searches := []url.Values{
+		{"contains": {"timeout"}},
+		{"regex": {"time(d )?out"}},
+		{"q": {"level=error AND msg~timeout"}},
+		{"q": {"raw=x"}},
+	}
+	withEncryption(t, "k1="+testKey('a'), "response_body")
+	for _, q := range searches {
+		if _, err := parseEntryFilter(q); err != nil {
+			t.Errorf("%v with message and raw in plaintext: %v", q, err)
+		}
+	}
+	withEncryption(t, "k1="+testKey('a'), "")
+	for _, q := range searches {
+		if _, err := parseEntryFilter(q); err == nil || !strings.Contains(err.Error(), "can't be searched while message and raw are encrypted") {
+			t.Errorf("%v: got error %v, want a refusal", q, err)
+		}
+	}
+	if _, err := parseEntryFilter(url.Values{"q": {"level=error"}}); err != nil {
+		t.Errorf("level filter: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Package enrich extracts what DeLogger stores next to a parsed line: the correlation,
+// trace, span and request ids written in it, its canonical severity and its time. Like
+// package parser it needs no database or configuration; what the server configures, such
+// as custom severity aliases and per-source timezones, is passed in.
+//
+//	for _, e := range parser.Parse(text) {
+//		severity, number := enrich.Severity(e.Level, nil)
+//		at, ok := enrich.LogTime(e.Timestamp, time.UTC)
+//		traceID, spanID, requestID := enrich.TraceContext(e.Message)
+//		...
+//	}
+package enrich
+
+import (
+	"regexp"
+	"strings"
+)
+
+// correlationIDRegex finds request and trace ids written as key=value or key: value,
+// e.g. request_id=abc123, "traceId": "4bf92f35", X-Request-ID: 7f1c.
+var correlationIDRegex = regexp.MustCompile(
+	`(?i)\b(?:x-request-id|request[_-]?id|req[_-]?id|trace[_-]?id|correlation[_-]?id)["']?\s*[:=]\s*["']?([A-Za-z0-9][A-Za-z0-9._:-]{3,127})`)
+
+// CorrelationID returns the first request or trace id in line, or "".
+func CorrelationID(line string) string {
+	match := correlationIDRegex.FindStringSubmatch(line)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// traceparentRegex matches a W3C traceparent value, version-traceid-parentid-flags, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+var traceparentRegex = regexp.MustCompile(`\b[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\b`)
+
+// traceIDRegex, spanIDRegex and requestIDRegex find ids written as key=value or key: value
+// under the names used by common tracers and proxies.
+var (
+	traceIDRegex   = regexp.MustCompile(`(?i)\b(?:trace[_.-]?id|x-b3-traceid)["']?\s*[:=]\s*["']?([A-Za-z0-9][A-Za-z0-9._:-]{3,127})`)
+	spanIDRegex    = regexp.MustCompile(`(?i)\b(?:span[_.-]?id|x-b3-spanid)["']?\s*[:=]\s*["']?([A-Za-z0-9][A-Za-z0-9._:-]{3,127})`)
+	requestIDRegex = regexp.MustCompile(`(?i)\b(?:x-request-id|request[_-]?id|req[_-]?id)["']?\s*[:=]\s*["']?([A-Za-z0-9][A-Za-z0-9._:-]{3,127})`)
+)
+
+// TraceContext returns the trace, span and request ids in line, or "" for those not
+// found. A traceparent takes precedence over trace_id and span_id keys.
+func TraceContext(line string) (traceID, spanID, requestID string) {
+	if m := traceparentRegex.FindStringSubmatch(line); m != nil && strings.Trim(m[1], "0") != "" {
+		traceID, spanID = m[1], m[2]
+	}
+	if traceID == "" {
+		traceID = firstSubmatch(traceIDRegex, line)
+	}
+	if spanID == "" {
+		spanID = firstSubmatch(spanIDRegex, line)
+	}
+	return traceID, spanID, firstSubmatch(requestIDRegex, line)
+}
+
+func firstSubmatch(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
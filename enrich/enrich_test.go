@@ -0,0 +1,111 @@
+package enrich
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCorrelationID(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"request_id=abc123 done", "abc123"},
+		{`{"traceId": "4bf92f35", "requestId": "r-1234"}`, "4bf92f35"},
+		{"X-Request-ID: 7f1c-aa", "7f1c-aa"},
+		{"correlation-id=job.42:7", "job.42:7"},
+		{"request_id=abc", ""}, // too short
+		{"myrequest_id=abc123", ""},
+		{"no ids here", ""},
+	}
+	for _, tt := range tests {
+		if got := CorrelationID(tt.line); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	tests := []struct {
+		line                       string
+		traceID, spanID, requestID string
+	}{
+		{"traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 request_id=r123",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", "r123"},
+		// A traceparent wins over the keys, unless its trace id is all zeros, which makes it
+		// invalid as a whole.
+		{"trace_id=t1234 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", ""},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01 trace.id=t1234", "t1234", "", ""},
+		{"X-B3-TraceId: 80f198ee56343ba8 X-B3-SpanId: e457b5a2e4d86bd1", "80f198ee56343ba8", "e457b5a2e4d86bd1", ""},
+		{`"span_id":"s-5678","req_id":"q-9"`, "", "s-5678", ""},
+		{"plain line", "", "", ""},
+	}
+	for _, tt := range tests {
+		traceID, spanID, requestID := TraceContext(tt.line)
+		if traceID != tt.traceID || spanID != tt.spanID || requestID != tt.requestID {
+			t.Errorf("%q: got %q %q %q, want %q %q %q", tt.line, traceID, spanID, requestID, tt.traceID, tt.spanID, tt.requestID)
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	custom := map[string]string{"oops": "error", "info": "debug"}
+	tests := []struct {
+		level  string
+		custom map[string]string
+		name   string
+		number int
+	}{
+		{"ERROR", nil, "error", 17},
+		{" Warning ", nil, "warn", 13},
+		{"3", nil, "error", 17},
+		{"crit", nil, "fatal", 21},
+		{"oops", nil, "", 0},
+		{"OOPS", custom, "error", 17},
+		{"info", custom, "debug", 5},
+		{"", custom, "", 0},
+		{"verbose-ish", nil, "", 0},
+	}
+	for _, tt := range tests {
+		name, number := Severity(tt.level, tt.custom)
+		if name != tt.name || number != tt.number {
+			t.Errorf("%q with %v: got %q %d, want %q %d", tt.level, tt.custom, name, number, tt.name, tt.number)
+		}
+	}
+}
+
+func TestLogTime(t *testing.T) {
+	ams, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		value string
+		loc   *time.Location
+		want  string // in UTC, "" if not recognised
+	}{
+		{"2024-01-02T03:04:05.5+01:00", ams, "2024-01-02T02:04:05.5Z"},
+		{"2024-01-02 03:04:05Z", ams, "2024-01-02T03:04:05Z"},
+		{"10/Oct/2000:13:55:36 -0700", time.UTC, "2000-10-10T20:55:36Z"},
+		{"2024-01-02 03:04:05", time.UTC, "2024-01-02T03:04:05Z"},
+		{"2024-07-02 03:04:05,250", ams, "2024-07-02T01:04:05.25Z"},
+		{" 2024/01/02 03:04:05 ", ams, "2024-01-02T02:04:05Z"},
+		{"yesterday", time.UTC, ""},
+		{"", time.UTC, ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if at, ok := LogTime(tt.value, tt.loc); ok {
+			got = at.Format(time.RFC3339Nano)
+		}
+		if got != tt.want {
+			t.Errorf("%q in %v: got %q, want %q", tt.value, tt.loc, got, tt.want)
+		}
+	}
+
+	// Syslog timestamps have no year, and are taken as the most recent occurrence.
+	at, ok := LogTime(time.Now().UTC().Add(-time.Hour).Format(time.Stamp), time.UTC)
+	if !ok || time.Since(at) < 59*time.Minute || time.Since(at) > 61*time.Minute {
+		t.Errorf("syslog timestamp an hour ago read as %v", at)
+	}
+}
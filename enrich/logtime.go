@@ -0,0 +1,60 @@
+package enrich
+
+import (
+	"strings"
+	"time"
+)
+
+// zonedTimestampLayouts carry their own offset or zone.
+var zonedTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999 -07:00",
+	"02/Jan/2006:15:04:05 -0700", // Common Log Format
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+}
+
+// localTimestampLayouts have no zone and are read in the caller's location.
+// A comma before the fraction, as written by log4j, is accepted for the dot.
+var localTimestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006/01/02 15:04:05.999999999",
+	"02/Jan/2006:15:04:05",
+	time.ANSIC,
+	time.Stamp, // syslog, no year
+}
+
+// LogTime converts a timestamp as written in a line to UTC, reading it in loc if it has
+// no zone. ok is false if the format is not recognised.
+func LogTime(value string, loc *time.Location) (t time.Time, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	for _, layout := range zonedTimestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	for _, layout := range localTimestampLayouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			// The layout has no year: assume the most recent occurrence.
+			now := time.Now().In(loc)
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t.UTC(), true
+	}
+	return time.Time{}, false
+}
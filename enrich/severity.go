@@ -0,0 +1,57 @@
+package enrich
+
+import "strings"
+
+// SeverityLevel is a canonical severity. Numbers follow the OpenTelemetry severity scale,
+// so higher is more severe and ranges compare naturally.
+type SeverityLevel struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+}
+
+// SeverityLevels lists the canonical severities in increasing order.
+var SeverityLevels = []SeverityLevel{
+	{"trace", 1},
+	{"debug", 5},
+	{"info", 9},
+	{"warn", 13},
+	{"error", 17},
+	{"fatal", 21},
+}
+
+// SeverityAliases maps the level spellings seen in common formats, lowercased, to a
+// canonical severity. Digits are syslog priorities.
+var SeverityAliases = map[string]string{
+	"trace": "trace", "trc": "trace", "t": "trace", "finest": "trace", "finer": "trace", "verbose": "trace", "v": "trace",
+	"debug": "debug", "dbg": "debug", "d": "debug", "fine": "debug", "7": "debug",
+	"info": "info", "inf": "info", "i": "info", "information": "info", "informational": "info", "notice": "info", "n": "info", "6": "info", "5": "info",
+	"warn": "warn", "warning": "warn", "wrn": "warn", "w": "warn", "4": "warn",
+	"error": "error", "err": "error", "e": "error", "severe": "error", "3": "error",
+	"fatal": "fatal", "critical": "fatal", "crit": "fatal", "c": "fatal", "f": "fatal", "alert": "fatal",
+	"emerg": "fatal", "emergency": "fatal", "panic": "fatal", "2": "fatal", "1": "fatal", "0": "fatal",
+}
+
+// SeverityNumber returns the number of a canonical severity, or 0.
+func SeverityNumber(name string) int {
+	for _, l := range SeverityLevels {
+		if l.Name == name {
+			return l.Number
+		}
+	}
+	return 0
+}
+
+// Severity maps a level as written in a log line to its canonical severity and number,
+// looking it up, lowercased, in custom before SeverityAliases. Unknown and empty levels
+// map to "" and 0.
+func Severity(level string, custom map[string]string) (string, int) {
+	key := strings.ToLower(strings.TrimSpace(level))
+	if key == "" {
+		return "", 0
+	}
+	name, ok := custom[key]
+	if !ok {
+		name = SeverityAliases[key]
+	}
+	return name, SeverityNumber(name)
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"delogger/storage"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// StoredEntry is a parsed line as read back from delogged_entries.
+type StoredEntry = storage.Entry
+
+// entrySelectSQL is the column list scanned by scanEntry.
+const entrySelectSQL = `
+	SELECT e.id, e.log_id, e.received_at, COALESCE(d.remote_addr, ''), COALESCE(d.status_code, 0), e.line_no,
+		d.host, d.service, d.env, d.tenant, d.source_id, d.fields,
+		e.log_timestamp, e.level, e.message, e.raw, e.correlation_id,
+		e.client_ip, e.geo_country, e.geo_city, e.geo_asn, e.geo_org,
+		e.severity, e.severity_number, e.log_time, e.client_host, e.fingerprint, e.template_id,
+		e.trace_id, e.span_id, e.request_id, e.repeats, e.sample_rate,
+		e.http_method, e.http_path, e.http_status, e.http_bytes, e.http_latency_ms
+	FROM delogged_entries e
+	JOIN delogged d ON d.id = e.log_id`
+
+// exportFetchSize is the number of rows pulled from the server-side cursor per round trip.
+const exportFetchSize = 1000
+
+// scanEntry reads one row produced by entrySelectSQL.
+func scanEntry(rows pgx.Row) (StoredEntry, error) {
+	var e StoredEntry
+	var req HTTPRequest
+	err := rows.Scan(&e.ID, &e.LogID, &e.ReceivedAt, &e.RemoteAddr, &e.StatusCode, &e.LineNo,
+		&e.Host, &e.Service, &e.Env, &e.Tenant, &e.SourceID, &e.Fields,
+		&e.Timestamp, &e.Level, &e.Message, &e.Raw, &e.CorrelationID,
+		&e.ClientIP, &e.GeoCountry, &e.GeoCity, &e.GeoASN, &e.GeoOrg,
+		&e.Severity, &e.SeverityNumber, &e.LogTime, &e.ClientHost, &e.Fingerprint, &e.TemplateID,
+		&e.TraceID, &e.SpanID, &e.RequestID, &e.Repeats, &e.SampleRate,
+		&req.Method, &req.Path, &req.Status, &req.Bytes, &req.LatencyMS)
+	if req.Method != "" {
+		e.HTTP = &req
+	}
+	if err == nil {
+		e.Message, err = encryption.decrypt("message", e.Message)
+	}
+	if err == nil {
+		e.Raw, err = encryption.decrypt("raw", e.Raw)
+	}
+	if err == nil {
+		e.ClientIP, err = encryption.decrypt("client_ip", e.ClientIP)
+	}
+	if err == nil {
+		e.ClientHost, err = encryption.decrypt("client_host", e.ClientHost)
+	}
+	return e, err
+}
+
+// exportHandler handles the /api/export endpoint.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// A saved search supplies defaults; explicit parameters take precedence.
+	if v := query.Get("search"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid search id", http.StatusBadRequest)
+			return
+		}
+		saved, err := loadSavedSearch(r.Context(), id)
+		if err != nil {
+			writeSearchError(w, r, err)
+			return
+		}
+		for k, v := range saved.Filter {
+			if !query.Has(k) {
+				query.Set(k, v)
+			}
+		}
+		if !query.Has("format") {
+			query.Set("format", saved.Format)
+		}
+		if !query.Has("columns") && len(saved.Columns) > 0 {
+			query.Set("columns", strings.Join(saved.Columns, ","))
+		}
+	}
+
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exportEntries(w, r, filter, query)
+}
+
+// exportEntries writes the entries matching filter in the format and with the columns
+// of the format and columns parameters of query.
+func exportEntries(w http.ResponseWriter, r *http.Request, filter entryFilter, query url.Values) {
+	var names []string
+	for _, name := range strings.Split(query.Get("columns"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	columns, err := selectExportColumns(names)
+	if err != nil {
+		http.Error(w, "Invalid 'columns': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := query.Get("format"); format {
+	case "", "ndjson":
+		exportNDJSON(w, r, filter, columns)
+	case "parquet":
+		exportParquet(w, r, filter, columns)
+	default:
+		http.Error(w, "Unsupported export format: "+format, http.StatusBadRequest)
+	}
+}
+
+// postgresCursor walks a filtered entry query through a server-side cursor,
+// so large result sets are read in fixed-size batches instead of all at once.
+type postgresCursor struct {
+	tx pgx.Tx
+}
+
+// OpenEntryCursor starts a read-only transaction and declares the cursor for filter.
+func (postgresStorage) OpenEntryCursor(ctx context.Context, filter entryFilter) (storage.EntryCursor, error) {
+	tx, err := dbPool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each FETCH is its own statement, so a regex search is bounded per batch
+	// rather than across the whole export.
+	if filter.Regex != nil {
+		_, err = tx.Exec(ctx, "SET LOCAL statement_timeout = "+strconv.FormatInt(regexSearchTimeout.Milliseconds(), 10))
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+	}
+
+	var args sqlArgs
+	query := entrySelectSQL + " " + filter.where(&args) + " ORDER BY e.received_at, e.id"
+	_, err = tx.Exec(ctx, "DECLARE export_cursor NO SCROLL CURSOR FOR "+query, args...)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return nil, err
+	}
+	return &postgresCursor{tx: tx}, nil
+}
+
+// Each calls fn for every entry in order and afterBatch once per fetched batch.
+// It returns the number of entries visited.
+func (c *postgresCursor) Each(ctx context.Context, fn func(StoredEntry) error, afterBatch func()) (int, error) {
+	total := 0
+	for {
+		rows, err := c.tx.Query(ctx, "FETCH FORWARD "+strconv.Itoa(exportFetchSize)+" FROM export_cursor")
+		if err != nil {
+			return total, err
+		}
+
+		fetched := 0
+		for rows.Next() {
+			entry, err := scanEntry(rows)
+			if err == nil {
+				err = fn(entry)
+			}
+			if err != nil {
+				rows.Close()
+				return total, err
+			}
+			fetched++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+
+		total += fetched
+		if afterBatch != nil {
+			afterBatch()
+		}
+		if fetched < exportFetchSize {
+			return total, nil
+		}
+	}
+}
+
+// Close ends the cursor's transaction.
+func (c *postgresCursor) Close() {
+	c.tx.Rollback(context.Background())
+}
+
+// exportNDJSON streams every matching entry as one JSON object per line: the whole entry,
+// or only columns, in their order, if columns isn't nil.
+func exportNDJSON(w http.ResponseWriter, r *http.Request, filter entryFilter, columns []exportColumn) {
+	cursor, err := store.OpenEntryCursor(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Could not start export", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error opening export cursor", "err", err)
+		return
+	}
+	defer cursor.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	total, err := cursor.Each(r.Context(), func(entry StoredEntry) error {
+		if columns == nil {
+			return enc.Encode(entry)
+		}
+		return enc.Encode(columnsJSON{columns, &entry})
+	}, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error streaming NDJSON export", "entries", total, "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Exported entries as NDJSON", "entries", total)
+}
+
+// jsonString encodes v as a JSON string for a Parquet JSON column.
+func jsonString(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// exportColumn is a column of an exported entry, as a Parquet column and as a key of the
+// NDJSON objects when columns are selected. value returns an int32, int64, float64,
+// string, time.Time or map[string]string as the Parquet type says, or nil for a null.
+type exportColumn struct {
+	parquetColumn
+	value func(e *StoredEntry) any
+}
+
+// exportColumns are the columns of an exported entry, in the order of the Parquet schema.
+var exportColumns = []exportColumn{
+	{parquetColumn{"id", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.ID }},
+	{parquetColumn{"log_id", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.LogID }},
+	{parquetColumn{"received_at", parquetInt64, parquetConvertedTimestampMicros, false}, func(e *StoredEntry) any { return e.ReceivedAt }},
+	{parquetColumn{"remote_addr", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.RemoteAddr }},
+	{parquetColumn{"status_code", parquetInt32, parquetConvertedNone, false}, func(e *StoredEntry) any { return int32(e.StatusCode) }},
+	{parquetColumn{"line_no", parquetInt32, parquetConvertedNone, false}, func(e *StoredEntry) any { return int32(e.LineNo) }},
+	{parquetColumn{"timestamp", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Timestamp }},
+	{parquetColumn{"level", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Level }},
+	{parquetColumn{"message", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Message }},
+	{parquetColumn{"raw", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Raw }},
+	{parquetColumn{"correlation_id", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.CorrelationID }},
+	{parquetColumn{"client_ip", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.ClientIP }},
+	{parquetColumn{"geo_country", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.GeoCountry }},
+	{parquetColumn{"geo_city", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.GeoCity }},
+	{parquetColumn{"geo_asn", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.GeoASN }},
+	{parquetColumn{"geo_org", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.GeoOrg }},
+	{parquetColumn{"severity", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Severity }},
+	{parquetColumn{"severity_number", parquetInt32, parquetConvertedNone, false}, func(e *StoredEntry) any { return int32(e.SeverityNumber) }},
+	{parquetColumn{"log_time", parquetInt64, parquetConvertedTimestampMicros, true}, func(e *StoredEntry) any {
+		if e.LogTime == nil {
+			return nil
+		}
+		return *e.LogTime
+	}},
+	{parquetColumn{"host", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Host }},
+	{parquetColumn{"service", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Service }},
+	{parquetColumn{"env", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Env }},
+	{parquetColumn{"client_host", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.ClientHost }},
+	{parquetColumn{"fields", parquetByteArray, parquetConvertedJSON, false}, func(e *StoredEntry) any { return e.Fields }},
+	{parquetColumn{"fingerprint", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Fingerprint }},
+	{parquetColumn{"template_id", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.TemplateID }},
+	{parquetColumn{"trace_id", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.TraceID }},
+	{parquetColumn{"span_id", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.SpanID }},
+	{parquetColumn{"request_id", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.RequestID }},
+	{parquetColumn{"http_method", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any {
+		method, _, _, _, _ := httpColumns(e.LogEntry)
+		return method
+	}},
+	{parquetColumn{"http_path", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any {
+		_, path, _, _, _ := httpColumns(e.LogEntry)
+		return path
+	}},
+	{parquetColumn{"http_status", parquetInt32, parquetConvertedNone, false}, func(e *StoredEntry) any {
+		_, _, status, _, _ := httpColumns(e.LogEntry)
+		return int32(status)
+	}},
+	{parquetColumn{"http_bytes", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any {
+		_, _, _, bytes, _ := httpColumns(e.LogEntry)
+		return bytes
+	}},
+	{parquetColumn{"http_latency_ms", parquetDouble, parquetConvertedNone, true}, func(e *StoredEntry) any {
+		if _, _, _, _, latency := httpColumns(e.LogEntry); latency != nil {
+			return *latency
+		}
+		return nil
+	}},
+	{parquetColumn{"tenant", parquetByteArray, parquetConvertedUTF8, false}, func(e *StoredEntry) any { return e.Tenant }},
+	{parquetColumn{"source_id", parquetInt64, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.SourceID }},
+	{parquetColumn{"repeats", parquetInt32, parquetConvertedNone, false}, func(e *StoredEntry) any { return int32(e.Repeats) }},
+	{parquetColumn{"sample_rate", parquetDouble, parquetConvertedNone, false}, func(e *StoredEntry) any { return e.SampleRate }},
+}
+
+// entryColumns lists the names of exportColumns, which the columns of a saved search and
+// of an export are among.
+var entryColumns = func() []string {
+	names := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		names[i] = c.Name
+	}
+	return names
+}()
+
+// legacyColumns are column names saved searches could hold before the columns were those
+// of the Parquet schema, with the columns each stands for now.
+var legacyColumns = map[string][]string{
+	"http": {"http_method", "http_path", "http_status", "http_bytes", "http_latency_ms"},
+}
+
+// selectExportColumns returns the columns named, in order, or nil for none.
+func selectExportColumns(names []string) ([]exportColumn, error) {
+	var columns []exportColumn
+	for _, name := range names {
+		expanded, ok := legacyColumns[name]
+		if !ok {
+			expanded = []string{name}
+		}
+		for _, name := range expanded {
+			i := slices.Index(entryColumns, name)
+			if i < 0 {
+				return nil, fmt.Errorf("unknown column %q", name)
+			}
+			columns = append(columns, exportColumns[i])
+		}
+	}
+	return columns, nil
+}
+
+// columnsJSON marshals the columns of an entry as a JSON object, keyed in their order.
+type columnsJSON struct {
+	columns []exportColumn
+	entry   *StoredEntry
+}
+
+func (c columnsJSON) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, col := range c.columns {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, col.Name)
+		b = append(b, ':')
+		v, err := json.Marshal(col.value(c.entry))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	}
+	return append(b, '}'), nil
+}
+
+// exportParquetRowGroupSize bounds how many entries are buffered before a row group is written.
+const exportParquetRowGroupSize = 50000
+
+// exportParquet writes every matching entry as a Parquet file, with only columns if it
+// isn't nil. Row groups are flushed as they fill, so memory is bounded by
+// exportParquetRowGroupSize.
+func exportParquet(w http.ResponseWriter, r *http.Request, filter entryFilter, columns []exportColumn) {
+	if columns == nil {
+		columns = exportColumns
+	}
+	schema := make([]parquetColumn, len(columns))
+	for i, c := range columns {
+		schema[i] = c.parquetColumn
+	}
+
+	cursor, err := store.OpenEntryCursor(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Could not start export", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error opening export cursor", "err", err)
+		return
+	}
+	defer cursor.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", `attachment; filename="delogger-export.parquet"`)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	pw, err := newParquetWriter(w, schema, exportParquetRowGroupSize)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error writing Parquet header", "err", err)
+		return
+	}
+
+	total, err := cursor.Each(r.Context(), func(entry StoredEntry) error {
+		for i, c := range columns {
+			pw.Value(i, c.value(&entry))
+		}
+		return pw.EndRow()
+	}, nil)
+	if err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error streaming Parquet export", "entries", total, "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Exported entries as Parquet", "entries", total)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"delogger/parser"
+)
+
+// fullEntry returns an entry with every field set, even raw, which parsed entries have
+// only without the others.
+func fullEntry() StoredEntry {
+	logTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	latency := 42.5
+	e := StoredEntry{ID: 7, LogID: 3, ReceivedAt: logTime.Add(time.Second), RemoteAddr: "10.0.0.1:5000",
+		StatusCode: 200, LineNo: 2, Host: "web-1", Service: "api", Env: "prod", Tenant: "acme", SourceID: 4,
+		Fields: map[string]string{"team": "payments"}, CorrelationID: "c1", ClientIP: "203.0.113.9",
+		GeoCountry: "NL", GeoCity: "Amsterdam", GeoASN: 1136, GeoOrg: "KPN", Severity: "ERROR", SeverityNumber: 17,
+		LogTime: &logTime, ClientHost: "client.example", Fingerprint: "f1", TemplateID: 9, TraceID: "t1",
+		SpanID: "s1", RequestID: "r1", Repeats: 2, SampleRate: 0.5}
+	e.LogEntry = LogEntry{Timestamp: "10/Oct/2000:13:55:36 -0700", Level: "ERROR", Message: "GET /x", Raw: "GET /x",
+		HTTP: &parser.HTTPRequest{Method: "GET", Path: "/x", Status: 500, Bytes: 12, LatencyMS: &latency}}
+	return e
+}
+
+// TestEntryColumnsCoverStoredEntry checks that the columns are the fields of an exported
+// entry, with its request flattened into the http_* columns.
+func TestEntryColumnsCoverStoredEntry(t *testing.T) {
+	b, err := json.Marshal(fullEntry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	delete(fields, "http")
+	var want []string
+	for name := range fields {
+		want = append(want, name)
+	}
+	want = append(want, legacyColumns["http"]...)
+	slices.Sort(want)
+	got := slices.Sorted(slices.Values(entryColumns))
+	if !slices.Equal(got, want) {
+		t.Errorf("got columns %q, want %q", got, want)
+	}
+}
+
+func TestExportColumnValues(t *testing.T) {
+	full, empty := fullEntry(), StoredEntry{}
+	for _, c := range exportColumns {
+		for _, e := range []*StoredEntry{&full, &empty} {
+			v := c.value(e)
+			var ok bool
+			switch v.(type) {
+			case nil:
+				ok = c.Optional && e == &empty
+			case int32:
+				ok = c.Type == parquetInt32
+			case int64, time.Time:
+				ok = c.Type == parquetInt64
+			case float64:
+				ok = c.Type == parquetDouble
+			case string, map[string]string:
+				ok = c.Type == parquetByteArray
+			}
+			if !ok {
+				t.Errorf("column %s: value %#v doesn't fit its Parquet column %+v", c.Name, v, c.parquetColumn)
+			}
+		}
+	}
+}
+
+func TestSavedSearchColumns(t *testing.T) {
+	tests := []struct {
+		columns []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{"level", "message", "tenant", "source_id", "repeats", "sample_rate", "http_path"}, true},
+		{[]string{"http"}, true}, // saved before the http_* columns
+		{[]string{"level", "bogus"}, false},
+	}
+	for _, tt := range tests {
+		s := SavedSearch{Name: "s", Columns: tt.columns}
+		if err := s.validate(); (err == nil) != tt.ok {
+			t.Errorf("columns %q: got error %v", tt.columns, err)
+		}
+	}
+}
+
+func TestExportNDJSONColumns(t *testing.T) {
+	saved := store
+	t.Cleanup(func() { store = saved })
+	e := fullEntry()
+	store = &memoryStorage{}
+	if err := store.WriteRecords([]*pendingRecord{{entries: []StoredEntry{e}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		columns string
+		want    string
+	}{
+		{"message,level", `{"message":"GET /x","level":"ERROR"}`},
+		{"http", `{"http_method":"GET","http_path":"/x","http_status":500,"http_bytes":12,"http_latency_ms":42.5}`},
+		{"log_time,fields,received_at", `{"log_time":"2024-01-02T03:04:05Z","fields":{"team":"payments"},"received_at":"2024-01-02T03:04:06Z"}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		exportHandler(w, httptest.NewRequest(http.MethodGet, "/api/export?columns="+tt.columns, nil))
+		if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("columns %s: got %d %s, want %s", tt.columns, w.Code, got, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	exportHandler(w, httptest.NewRequest(http.MethodGet, "/api/export?columns=level,bogus", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown column: got %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Limits for the number of values returned by /api/facets.
+const (
+	defaultFacetLimit = 20
+	maxFacetLimit     = 500
+)
+
+// sourceExpr is the client address of an entry's request without the ephemeral port,
+// as sourceName computes it in Go.
+const sourceExpr = `regexp_replace(COALESCE(d.remote_addr, ''), ':[0-9]+$', '')`
+
+// facetFields maps the fields /api/facets can group by to their SQL expressions.
+var facetFields = map[string]string{
+	"level":       "e.level",
+	"source":      sourceExpr,
+	"status_code": "COALESCE(d.status_code, 0)::text",
+	"country":     "e.geo_country",
+	"severity":    "e.severity",
+	"host":        "d.host",
+	"service":     "d.service",
+	"env":         "d.env",
+	"fingerprint": "e.fingerprint",
+	"template_id": "e.template_id::text",
+	"http_method": "e.http_method",
+	"http_path":   "e.http_path",
+	"http_status": "e.http_status::text",
+}
+
+// FacetValue is one distinct value of a field and the number of entries that have it.
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Facets is the response of /api/facets.
+type Facets struct {
+	Field  string       `json:"field"`
+	Values []FacetValue `json:"values"`
+}
+
+// facetsHandler handles GET /api/facets?field=..., returning the most common values of
+// field among entries matching the usual filter parameters (typically from and to).
+func facetsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	field := query.Get("field")
+	expr, ok := facetFields[field]
+	if !ok {
+		names := make([]string, 0, len(facetFields))
+		for name := range facetFields {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		http.Error(w, "Invalid 'field': must be one of "+strings.Join(names, ", "), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultFacetLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxFacetLimit {
+			http.Error(w, "Invalid 'limit': must be between 1 and "+strconv.Itoa(maxFacetLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	values, err := loadFacets(r.Context(), expr, filter, limit)
+	if err != nil {
+		writeQueryError(w, r, err, "compute "+field+" facets")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Facets{Field: field, Values: values})
+}
+
+// loadFacets returns the most common values of the SQL expression expr among entries matching filter.
+func loadFacets(ctx context.Context, expr string, filter entryFilter, limit int) ([]FacetValue, error) {
+	var args sqlArgs
+	sql := "SELECT " + expr + " AS value, count(*) FROM delogged_entries e JOIN delogged d ON d.id = e.log_id " +
+		filter.where(&args) + " GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT " + args.add(limit)
+
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	values, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (FacetValue, error) {
+		var v FacetValue
+		err := row.Scan(&v.Value, &v.Count)
+		return v, err
+	})
+	if values == nil {
+		values = []FacetValue{}
+	}
+	return values, err
+}
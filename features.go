@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"delogger/parser"
+)
+
+// Parsers, inputs and enrichments a deployment doesn't need can be switched off at startup,
+// so a minimal server neither tries nor serves them:
+//
+//	DISABLE_PARSERS      comma-separated built-in formats lines aren't tried against,
+//	                     bracketed or access; the lines are kept as raw instead
+//	DISABLE_INPUTS       comma-separated routes records aren't accepted on, which answer
+//	                     404: parse (/api/parse), preview (/api/parse/preview and
+//	                     ?dry_run=true) and archive (/api/parse/archive)
+//	DISABLE_ENRICHMENTS  comma-separated enrichments skipped: correlation (correlation
+//	                     ids), trace_context (trace, span and request ids), templates
+//	                     (mining, and so issues), geoip and reverse_dns, even if their
+//	                     settings are set
+//
+// They are read only at startup; a reload leaves them as they are. /api/version lists
+// what is disabled. A tenant can switch off more for itself, see overrides.go.
+
+// inputs and enrichments are the names DISABLE_INPUTS and DISABLE_ENRICHMENTS accept.
+var (
+	inputs      = []string{"parse", "preview", "archive"}
+	enrichments = []string{"correlation", "trace_context", "templates", "geoip", "reverse_dns"}
+)
+
+// lineParser parses the lines of payloads with the formats not in DISABLE_PARSERS.
+var lineParser parser.Parser
+
+// disabled holds the inputs and enrichments switched off, by name.
+var disabled = map[string]bool{}
+
+// disabledParsers are the formats of DISABLE_PARSERS, for /api/version.
+var disabledParsers []string
+
+// setupFeatures reads the DISABLE_ settings.
+func setupFeatures() {
+	disabledParsers = listSetting("DISABLE_PARSERS")
+	var err error
+	if lineParser, err = parser.Without(disabledParsers...); err != nil {
+		fatalConfig("Invalid DISABLE_PARSERS: "+err.Error(), "value", setting("DISABLE_PARSERS"))
+	}
+	for _, s := range []struct {
+		env   string
+		names []string
+	}{{"DISABLE_INPUTS", inputs}, {"DISABLE_ENRICHMENTS", enrichments}} {
+		for _, name := range listSetting(s.env) {
+			if !slices.Contains(s.names, name) {
+				fatalConfig("Invalid "+s.env+": must be a comma-separated list of "+strings.Join(s.names, ", "), "value", setting(s.env))
+			}
+			disabled[name] = true
+		}
+	}
+	apiRoutes = slices.DeleteFunc(apiRoutes, func(rt apiRoute) bool { return disabled[rt.Input] })
+	if list := disabledFeatures(); len(list) > 0 {
+		slog.Info("Features disabled", "features", list)
+	}
+}
+
+// disabledFeatures returns the parsers, inputs and enrichments switched off, sorted.
+func disabledFeatures() []string {
+	list := append([]string{}, disabledParsers...)
+	for name := range disabled {
+		list = append(list, name)
+	}
+	slices.Sort(list)
+	return slices.Compact(list)
+}
+
+// listSetting returns the items of a comma-separated setting, without blanks.
+func listSetting(name string) []string {
+	var items []string
+	for _, item := range strings.Split(setting(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
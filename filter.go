@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryFilter holds the query parameters shared by the endpoints that read stored entries.
+type entryFilter struct {
+	From     time.Time
+	To       time.Time
+	Level    string
+	Contains string
+	Status   int
+	Host     string
+	Service  string
+	Env      string
+	Tenant   string // set from the caller, not the parameters (see tenants.go)
+	Project  string // set from the caller, not the parameters (see projects.go)
+	Query    queryNode
+	Regex    *searchRegex
+}
+
+// sqlArgs collects positional arguments while a WHERE clause is being built.
+type sqlArgs []any
+
+// add appends a value and returns its placeholder.
+func (a *sqlArgs) add(v any) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// parseEntryFilter reads the filter from URL query parameters.
+// from and to are RFC 3339 timestamps, status is an HTTP status code, host, service and env
+// match the source metadata exactly, regex is matched against the original line and q is
+// a query expression.
+func parseEntryFilter(q url.Values) (entryFilter, error) {
+	var f entryFilter
+	var err error
+
+	if v := q.Get("from"); v != "" {
+		f.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid 'from' timestamp: %v", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		f.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid 'to' timestamp: %v", err)
+		}
+	}
+	if v := q.Get("status"); v != "" {
+		status, err := strconv.ParseInt(v, 10, 32) // status_code is an INTEGER
+		if err != nil {
+			return f, fmt.Errorf("invalid 'status': %v", err)
+		}
+		f.Status = int(status)
+	}
+	f.Level = strings.TrimSpace(q.Get("level"))
+	f.Contains = q.Get("contains")
+	if f.Contains != "" {
+		if err := encryption.searchable("'contains'"); err != nil {
+			return f, err
+		}
+	}
+	f.Host = strings.TrimSpace(q.Get("host"))
+	f.Service = strings.TrimSpace(q.Get("service"))
+	f.Env = strings.TrimSpace(q.Get("env"))
+	if v := q.Get("regex"); v != "" {
+		if err := encryption.searchable("'regex'"); err != nil {
+			return f, err
+		}
+		f.Regex, err = compileSearchRegex(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid 'regex': %v", err)
+		}
+	}
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		f.Query, err = parseQuery(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid query: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+// where renders the filter as a WHERE clause over delogged_entries e joined with delogged d.
+func (f entryFilter) where(args *sqlArgs) string {
+	var conds []string
+
+	if !f.From.IsZero() {
+		conds = append(conds, "e.received_at >= "+args.add(f.From))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "e.received_at < "+args.add(f.To))
+	}
+	if f.Level != "" {
+		conds = append(conds, "lower(e.level) = lower("+args.add(f.Level)+")")
+	}
+	if f.Contains != "" {
+		p := args.add("%" + escapeLike(f.Contains) + "%")
+		conds = append(conds, "(e.message ILIKE "+p+" OR e.raw ILIKE "+p+")")
+	}
+	if f.Status != 0 {
+		conds = append(conds, "d.status_code = "+args.add(f.Status))
+	}
+	if f.Host != "" {
+		conds = append(conds, "d.host = "+args.add(f.Host))
+	}
+	if f.Service != "" {
+		conds = append(conds, "d.service = "+args.add(f.Service))
+	}
+	if f.Env != "" {
+		conds = append(conds, "d.env = "+args.add(f.Env))
+	}
+	if f.Tenant != "" {
+		conds = append(conds, "d.tenant = "+args.add(f.Tenant))
+	}
+	if f.Project != "" {
+		conds = append(conds, projectCond(args.add(f.Project)))
+	}
+	if f.Regex != nil {
+		conds = append(conds, "("+entryLineExpr+") ~ "+args.add(f.Regex.sql))
+	}
+	if f.Query != nil {
+		conds = append(conds, f.Query.sql(args))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// Matches evaluates the filter against an entry in memory, with the same semantics as where.
+func (f entryFilter) Matches(e StoredEntry) bool {
+	if !f.From.IsZero() && e.ReceivedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.ReceivedAt.Before(f.To) {
+		return false
+	}
+	if f.Level != "" && !strings.EqualFold(e.Level, f.Level) {
+		return false
+	}
+	if f.Contains != "" && !containsFold(e.Message, f.Contains) && !containsFold(e.Raw, f.Contains) {
+		return false
+	}
+	if f.Status != 0 && e.StatusCode != f.Status {
+		return false
+	}
+	if f.Host != "" && e.Host != f.Host || f.Service != "" && e.Service != f.Service || f.Env != "" && e.Env != f.Env {
+		return false
+	}
+	if f.Tenant != "" && e.Tenant != f.Tenant {
+		return false
+	}
+	if f.Project != "" && sourceProject(e.SourceID) != f.Project {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(entryLine(e.LogEntry)) {
+		return false
+	}
+	if f.Query != nil && !f.Query.match(e) {
+		return false
+	}
+	return true
+}
+
+// andWhere adds cond to a clause produced by entryFilter.where.
+func andWhere(where, cond string) string {
+	if where == "" {
+		return "WHERE " + cond
+	}
+	return where + " AND " + cond
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entryFingerprint identifies entries with the same content from the same source: a hash of
+// the source address and metadata, the level and the message with whitespace collapsed.
+// The timestamp is not part of it, so repeats of a line share a fingerprint.
+func entryFingerprint(e StoredEntry) string {
+	message := e.Message
+	if e.Raw != "" {
+		message = e.Raw
+	}
+
+	h := sha256.New()
+	for _, part := range []string{sourceName(e.RemoteAddr), e.Host, e.Service, e.Env, strings.ToLower(e.Level)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(strings.Join(strings.Fields(message), " ")))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// repeatCollapser collapses runs of consecutive repeated lines of a request into their
+// first entry, counting the others in its Repeats, the way syslog writes "message repeated
+// N times". It is enabled by setting COLLAPSE_REPEATS to a duration such as 10s: a line
+// joins the run if its log time, or the receive time if it has none, is within that
+// duration of the run's first line. COLLAPSE_REPEATS_MATCH chooses which lines are
+// repeats: exact (default) for the same fingerprint, or template for lines that only
+// differ in variables such as numbers, ids and addresses.
+type repeatCollapser struct {
+	window     time.Duration
+	byTemplate bool
+}
+
+// repeats is nil when repeated lines are kept.
+var repeats *repeatCollapser
+
+// setupRepeats enables collapsing repeated lines if COLLAPSE_REPEATS is set.
+func setupRepeats() {
+	v := envDuration("COLLAPSE_REPEATS", 0)
+	if v == 0 {
+		return
+	}
+	repeats = &repeatCollapser{window: v}
+	switch match := setting("COLLAPSE_REPEATS_MATCH"); match {
+	case "", "exact":
+	case "template":
+		repeats.byTemplate = true
+	default:
+		fatalConfig("Invalid COLLAPSE_REPEATS_MATCH: must be exact or template", "value", match)
+	}
+	slog.Info("Collapsing repeated lines", "window", v, "by_template", repeats.byTemplate)
+}
+
+// key returns what repeats of e have in common.
+func (c *repeatCollapser) key(e StoredEntry) string {
+	if !c.byTemplate {
+		return e.Fingerprint
+	}
+	message := e.Message
+	if e.Raw != "" {
+		message = e.Raw
+	}
+	return strings.ToLower(e.Level) + "\x00" + strings.Join(drainTokens(message), " ")
+}
+
+// collapse returns entries with each run of repeats replaced by its first entry, and
+// counts the collapsed entries in the ingest statistics. It is a no-op when disabled.
+func (c *repeatCollapser) collapse(entries []StoredEntry) []StoredEntry {
+	n := len(entries)
+	entries = c.collapseRuns(entries)
+	ingest.repeatsCollapsed.Add(int64(n - len(entries)))
+	return entries
+}
+
+// collapseRuns is collapse without the statistics.
+func (c *repeatCollapser) collapseRuns(entries []StoredEntry) []StoredEntry {
+	if c == nil || len(entries) == 0 {
+		return entries
+	}
+	at := func(e StoredEntry) time.Time {
+		if e.LogTime != nil {
+			return *e.LogTime
+		}
+		return e.ReceivedAt
+	}
+
+	kept := entries[:1]
+	runKey, runStart := c.key(entries[0]), at(entries[0])
+	for _, e := range entries[1:] {
+		k := c.key(e)
+		if d := at(e).Sub(runStart); k == runKey && d >= -c.window && d <= c.window {
+			kept[len(kept)-1].Repeats += e.Repeats
+			continue
+		}
+		kept = append(kept, e)
+		runKey, runStart = k, at(e)
+	}
+	return kept
+}
+
+// duplicateWindow drops entries whose fingerprint was already stored within the window.
+// It is enabled by setting DEDUP_WINDOW to a duration such as 1m.
+type duplicateWindow struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	firstSeen map[string]time.Time
+	lastSweep time.Time
+}
+
+// dedup is nil when duplicates are kept.
+var dedup *duplicateWindow
+
+// setupDedup enables the drop-duplicates mode if DEDUP_WINDOW is set.
+func setupDedup() {
+	if v := envDuration("DEDUP_WINDOW", 0); v > 0 {
+		dedup = &duplicateWindow{window: v, firstSeen: map[string]time.Time{}, lastSweep: time.Now()}
+		slog.Info("Dropping duplicate entries", "window", v)
+	}
+}
+
+// filter returns the entries whose fingerprint was not seen within the window, in order,
+// and counts the others in the ingest statistics. It is a no-op when disabled.
+func (d *duplicateWindow) filter(entries []StoredEntry) []StoredEntry {
+	if d == nil {
+		return entries
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) > d.window {
+		for fp, t := range d.firstSeen {
+			if now.Sub(t) >= d.window {
+				delete(d.firstSeen, fp)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	kept := entries[:0]
+	for _, e := range entries {
+		if t, ok := d.firstSeen[e.Fingerprint]; ok && now.Sub(t) < d.window {
+			continue
+		}
+		d.firstSeen[e.Fingerprint] = now
+		kept = append(kept, e)
+	}
+	ingest.duplicatesDropped.Add(int64(len(entries) - len(kept)))
+	return kept
+}
+
+// unseen returns the entries filter would keep, without recording them as seen.
+func (d *duplicateWindow) unseen(entries []StoredEntry) []StoredEntry {
+	if d == nil {
+		return entries
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := map[string]bool{}
+	kept := entries[:0]
+	for _, e := range entries {
+		if t, ok := d.firstSeen[e.Fingerprint]; ok && now.Sub(t) < d.window || seen[e.Fingerprint] {
+			continue
+		}
+		seen[e.Fingerprint] = true
+		kept = append(kept, e)
+	}
+	return kept
+}
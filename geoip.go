@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP enrichment is configured through the environment:
+//
+//	GEOIP_CITY_DB  path to a GeoLite2-City (or GeoLite2-Country) .mmdb file
+//	GEOIP_ASN_DB   path to a GeoLite2-ASN .mmdb file
+//	GEOIP_PARSERS  comma-separated parser names to enrich (see builtinParsers); default all
+//
+// Enrichment is off when neither database is set.
+
+// geoIPEnricher annotates entries with the location and network of the first IP address in the line.
+type geoIPEnricher struct {
+	city    *maxminddb.Reader
+	asn     *maxminddb.Reader
+	parsers map[string]bool // nil means every parser
+}
+
+// geoip holds nil when enrichment is disabled. It is replaced on reloads.
+var geoip atomic.Pointer[geoIPEnricher]
+
+// geoCityRecord is the subset of a GeoLite2-City record we store.
+type geoCityRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// geoASNRecord is a GeoLite2-ASN record.
+type geoASNRecord struct {
+	Number       int64  `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// setupGeoIP opens the databases named in the environment, if any.
+func setupGeoIP() {
+	g, err := newGeoIPEnricher()
+	if err != nil {
+		fatalConfig("Invalid GeoIP settings", "err", err)
+	}
+	geoip.Store(g)
+	if g != nil {
+		slog.Info("GeoIP enrichment enabled")
+	}
+}
+
+// newGeoIPEnricher opens the databases of the settings, returning nil if none is set.
+func newGeoIPEnricher() (*geoIPEnricher, error) {
+	cityPath, asnPath := setting("GEOIP_CITY_DB"), setting("GEOIP_ASN_DB")
+	if cityPath == "" && asnPath == "" || disabled["geoip"] {
+		return nil, nil
+	}
+
+	g := &geoIPEnricher{}
+	if v := setting("GEOIP_PARSERS"); v != "" {
+		g.parsers = map[string]bool{}
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if parserByName(name) == nil {
+				return nil, fmt.Errorf("unknown parser %q in GEOIP_PARSERS", name)
+			}
+			g.parsers[name] = true
+		}
+	}
+
+	var err error
+	if cityPath != "" {
+		if g.city, err = maxminddb.Open(cityPath); err != nil {
+			return nil, fmt.Errorf("GEOIP_CITY_DB: %w", err)
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			g.close()
+			return nil, fmt.Errorf("GEOIP_ASN_DB: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// close closes the databases. Entries still being enriched with them would fail, so
+// replaced enrichers are closed after a grace period.
+func (g *geoIPEnricher) close() {
+	if g.city != nil {
+		g.city.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
+
+// parserByName returns the built-in parser called name, or nil.
+func parserByName(name string) *ParserInfo {
+	for i := range builtinParsers {
+		if builtinParsers[i].Name == name {
+			return &builtinParsers[i]
+		}
+	}
+	return nil
+}
+
+// entryParser returns the name of the parser that produced e.
+func entryParser(e LogEntry) string {
+	return e.Name()
+}
+
+// enrich sets the client IP and GeoIP fields of e. It is a no-op when enrichment is disabled.
+func (g *geoIPEnricher) enrich(e *StoredEntry) {
+	if g == nil || (g.parsers != nil && !g.parsers[entryParser(e.LogEntry)]) {
+		return
+	}
+
+	addr, ok := extractIP(entryLine(e.LogEntry))
+	if !ok {
+		return
+	}
+	e.ClientIP = addr.String()
+	ip := net.IP(addr.AsSlice())
+
+	if g.city != nil {
+		var rec geoCityRecord
+		if err := g.city.Lookup(ip, &rec); err != nil {
+			slog.Warn("Error looking up address in GeoIP city database", "ip", e.ClientIP, "err", err)
+		}
+		e.GeoCountry = rec.Country.ISOCode
+		e.GeoCity = rec.City.Names["en"]
+	}
+	if g.asn != nil {
+		var rec geoASNRecord
+		if err := g.asn.Lookup(ip, &rec); err != nil {
+			slog.Warn("Error looking up address in GeoIP ASN database", "ip", e.ClientIP, "err", err)
+		}
+		e.GeoASN = rec.Number
+		e.GeoOrg = rec.Organization
+	}
+}
+
+// extractIP returns the first IPv4 or IPv6 address in line, preferring public addresses
+// over private, loopback and link-local ones, which have no location.
+func extractIP(line string) (netip.Addr, bool) {
+	var fallback netip.Addr
+	for _, token := range strings.FieldsFunc(line, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F' || r == '.' || r == ':')
+	}) {
+		token = strings.TrimLeft(strings.TrimRight(token, ".:"), ".")
+		// Strip a trailing :port from IPv4 addresses.
+		if host, _, ok := strings.Cut(token, ":"); ok && strings.Count(token, ":") == 1 {
+			token = host
+		}
+		addr, err := netip.ParseAddr(token)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+			if !fallback.IsValid() {
+				fallback = addr
+			}
+			continue
+		}
+		return addr, true
+	}
+	return fallback, fallback.IsValid()
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"delogger/parser"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// The GraphQL API mirrors the REST endpoints: field names match the REST JSON keys and
+// resolvers call the same loaders, so both APIs always return the same data.
+
+// ParserInfo describes a built-in line parser.
+type ParserInfo = parser.Info
+
+// builtinParsers lists the formats recognised by /api/parse.
+var builtinParsers = parser.Builtin
+
+// longScalar is a 64-bit integer, for ids, counts and byte totals that overflow GraphQL's Int.
+var longScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Long",
+	Description: "A 64-bit signed integer.",
+	Serialize:   coerceLong,
+	ParseValue:  coerceLong,
+	ParseLiteral: func(value ast.Value) any {
+		if v, ok := value.(*ast.IntValue); ok {
+			n, err := strconv.ParseInt(v.Value, 10, 64)
+			if err == nil {
+				return n
+			}
+		}
+		return nil
+	},
+})
+
+func coerceLong(value any) any {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v)
+		}
+	}
+	return nil
+}
+
+// jsonScalar passes arbitrary JSON objects through unchanged.
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:         "JSON",
+	Description:  "An arbitrary JSON value.",
+	Serialize:    func(value any) any { return value },
+	ParseValue:   func(value any) any { return value },
+	ParseLiteral: func(value ast.Value) any { return nil },
+})
+
+// fields builds a field map where every field has the given type.
+func fields(t graphql.Output, names ...string) graphql.Fields {
+	f := graphql.Fields{}
+	for _, name := range names {
+		f[name] = &graphql.Field{Type: t}
+	}
+	return f
+}
+
+// merge combines field maps.
+func merge(maps ...graphql.Fields) graphql.Fields {
+	f := graphql.Fields{}
+	for _, m := range maps {
+		for k, v := range m {
+			f[k] = v
+		}
+	}
+	return f
+}
+
+var httpRequestType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "HTTPRequest",
+	Fields: merge(
+		fields(graphql.String, "method", "path"),
+		fields(graphql.Int, "status"),
+		fields(longScalar, "bytes"),
+		fields(graphql.Float, "latency_ms"),
+	),
+})
+
+var entryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Entry",
+	Fields: merge(
+		fields(longScalar, "id", "log_id"),
+		fields(graphql.Int, "status_code", "line_no", "repeats"),
+		fields(graphql.String, "received_at", "remote_addr", "timestamp", "level", "message", "raw", "correlation_id",
+			"client_ip", "geo_country", "geo_city", "geo_org", "severity", "log_time",
+			"host", "service", "env", "client_host", "fingerprint", "trace_id", "span_id", "request_id"),
+		fields(graphql.Int, "severity_number"),
+		fields(graphql.Float, "sample_rate"),
+		fields(longScalar, "geo_asn", "template_id"),
+		fields(jsonScalar, "fields"),
+		fields(httpRequestType, "http"),
+	),
+})
+
+var logsPageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "LogsPage",
+	Fields: graphql.Fields{
+		"entries":     &graphql.Field{Type: graphql.NewList(entryType)},
+		"next_cursor": &graphql.Field{Type: graphql.String},
+	},
+})
+
+var entryContextType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "EntryContext",
+	Fields: graphql.Fields{
+		"before": &graphql.Field{Type: graphql.NewList(entryType)},
+		"entry":  &graphql.Field{Type: entryType},
+		"after":  &graphql.Field{Type: graphql.NewList(entryType)},
+	},
+})
+
+var sourceType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Source",
+	Fields: merge(
+		fields(graphql.String, "source"),
+		fields(longScalar, "records", "entries", "bytes"),
+	),
+})
+
+var statsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Stats",
+	Fields: graphql.Fields{
+		"stored": &graphql.Field{Type: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "StoredStats",
+			Fields: fields(longScalar, "records", "entries", "bytes", "lines_parsed", "lines_unmatched"),
+		})},
+		"sources": &graphql.Field{Type: graphql.NewList(sourceType)},
+		"since_start": &graphql.Field{Type: graphql.NewObject(graphql.ObjectConfig{
+			Name: "CounterStats",
+			Fields: merge(
+				fields(graphql.String, "started_at"),
+				fields(longScalar, "requests", "bytes", "lines_parsed", "lines_unmatched", "duplicates_dropped", "repeats_collapsed", "sampled_out"),
+			),
+		})},
+		"rate": &graphql.Field{Type: graphql.NewObject(graphql.ObjectConfig{
+			Name: "RateStats",
+			Fields: merge(
+				fields(graphql.Int, "window_seconds"),
+				fields(graphql.Float, "requests_per_second", "lines_per_second", "bytes_per_second"),
+			),
+		})},
+		"distributions": &graphql.Field{Type: graphql.NewObject(graphql.ObjectConfig{
+			Name: "IngestDistributions",
+			Fields: graphql.Fields{
+				"payload_bytes":          &graphql.Field{Type: histogramType},
+				"lines":                  &graphql.Field{Type: histogramType},
+				"parse_seconds_per_line": &graphql.Field{Type: histogramType},
+				"duration_seconds":       &graphql.Field{Type: histogramType},
+			},
+		})},
+		"parsers": &graphql.Field{Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
+			Name: "ParserStats",
+			Fields: merge(
+				fields(graphql.String, "service"),
+				fields(jsonScalar, "lines"),
+				fields(graphql.Float, "unmatched_ratio"),
+			),
+		}))},
+	},
+})
+
+var histogramType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Histogram",
+	Fields: merge(
+		fields(longScalar, "count"),
+		fields(graphql.Float, "sum"),
+		graphql.Fields{"buckets": &graphql.Field{Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
+			Name:   "HistogramBucket",
+			Fields: merge(fields(graphql.Float, "le"), fields(longScalar, "count")),
+		}))}},
+	),
+})
+
+var facetValueType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "FacetValue",
+	Fields: merge(
+		fields(graphql.String, "value"),
+		fields(longScalar, "count"),
+	),
+})
+
+var errorTemplateType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "ErrorTemplate",
+	Fields: merge(
+		fields(graphql.String, "template", "example", "first_seen", "last_seen"),
+		fields(longScalar, "count"),
+	),
+})
+
+var savedSearchType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "SavedSearch",
+	Fields: merge(
+		fields(longScalar, "id"),
+		fields(graphql.String, "name", "format", "created_at", "updated_at"),
+		fields(jsonScalar, "filter"),
+		fields(graphql.NewList(graphql.String), "columns"),
+	),
+})
+
+var parserType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Parser",
+	Fields: merge(
+		fields(graphql.String, "name", "pattern", "description"),
+		fields(graphql.NewList(graphql.String), "fields"),
+	),
+})
+
+// entryFilterInput accepts the same filters as the REST query parameters.
+var entryFilterInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "EntryFilter",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"from":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"to":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"level":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"contains": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"status":   &graphql.InputObjectFieldConfig{Type: graphql.Int},
+		"q":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"regex":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+// toGraphQL converts a result to the map form resolved by graphql-go's default resolver,
+// using the same JSON keys as the REST API.
+func toGraphQL(v any, err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+// graphQLFilter converts the filter argument to an entryFilter.
+func graphQLFilter(args map[string]any) (entryFilter, error) {
+	q := url.Values{}
+	if in, ok := args["filter"].(map[string]any); ok {
+		for k, v := range in {
+			switch v := v.(type) {
+			case string:
+				q.Set(k, v)
+			case int:
+				q.Set(k, strconv.Itoa(v))
+			}
+		}
+	}
+	return parseEntryFilter(q)
+}
+
+// graphQLLimit reads the limit argument, applying a default and an upper bound.
+func graphQLLimit(args map[string]any, def, max int) (int, error) {
+	limit, ok := args["limit"].(int)
+	if !ok {
+		return def, nil
+	}
+	if limit < 1 || limit > max {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(max))
+	}
+	return limit, nil
+}
+
+var filterArg = &graphql.ArgumentConfig{Type: entryFilterInput}
+var limitArg = &graphql.ArgumentConfig{Type: graphql.Int}
+
+var queryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"logs": &graphql.Field{
+			Type: logsPageType,
+			Args: graphql.FieldConfigArgument{
+				"filter": filterArg,
+				"limit":  limitArg,
+				"cursor": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				filter, err := graphQLFilter(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				limit, err := graphQLLimit(p.Args, defaultLogsLimit, maxLogsLimit)
+				if err != nil {
+					return nil, err
+				}
+				var cursor *pageCursor
+				if v, ok := p.Args["cursor"].(string); ok && v != "" {
+					c, err := decodeCursor(v)
+					if err != nil || c.Time == nil {
+						return nil, errors.New("invalid cursor")
+					}
+					cursor = &c
+				}
+
+				entries, err := store.LatestEntries(p.Context, filter, cursor.position(), limit+1)
+				if err != nil {
+					return nil, err
+				}
+				page := LogsPage{Entries: entries}
+				if len(page.Entries) > limit {
+					page.Entries = page.Entries[:limit]
+					last := page.Entries[limit-1]
+					page.NextCursor = pageCursor{Time: &last.ReceivedAt, ID: last.ID}.encode()
+				}
+				return toGraphQL(page, nil)
+			},
+		},
+		"context": &graphql.Field{
+			Type: entryContextType,
+			Args: graphql.FieldConfigArgument{
+				"id":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(longScalar)},
+				"before": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultContextLines},
+				"after":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultContextLines},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				before, after := p.Args["before"].(int), p.Args["after"].(int)
+				if before < 0 || before > maxContextLines || after < 0 || after > maxContextLines {
+					return nil, errors.New("before and after must be between 0 and " + strconv.Itoa(maxContextLines))
+				}
+				return toGraphQL(loadEntryContext(p.Context, p.Args["id"].(int64), before, after))
+			},
+		},
+		"correlate": &graphql.Field{
+			Type: graphql.NewList(entryType),
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				return toGraphQL(loadCorrelated(p.Context, p.Args["id"].(string)))
+			},
+		},
+		"stats": &graphql.Field{
+			Type: statsType,
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				return toGraphQL(currentStats(p.Context))
+			},
+		},
+		"sources": &graphql.Field{
+			Type: graphql.NewList(sourceType),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				stats, err := loadStoredStats(p.Context)
+				return toGraphQL(stats.Sources, err)
+			},
+		},
+		"facets": &graphql.Field{
+			Type: graphql.NewList(facetValueType),
+			Args: graphql.FieldConfigArgument{
+				"field":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"filter": filterArg,
+				"limit":  limitArg,
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				expr, ok := facetFields[p.Args["field"].(string)]
+				if !ok {
+					return nil, errors.New("unknown facet field")
+				}
+				filter, err := graphQLFilter(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				limit, err := graphQLLimit(p.Args, defaultFacetLimit, maxFacetLimit)
+				if err != nil {
+					return nil, err
+				}
+				return toGraphQL(loadFacets(p.Context, expr, filter, limit))
+			},
+		},
+		"top_errors": &graphql.Field{
+			Type: graphql.NewList(errorTemplateType),
+			Args: graphql.FieldConfigArgument{
+				"filter": filterArg,
+				"limit":  limitArg,
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				filter, err := graphQLFilter(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				limit, err := graphQLLimit(p.Args, defaultTopErrors, maxTopErrors)
+				if err != nil {
+					return nil, err
+				}
+				return toGraphQL(loadTopErrors(p.Context, filter, limit))
+			},
+		},
+		"saved_searches": &graphql.Field{
+			Type: graphql.NewList(savedSearchType),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				return toGraphQL(listSavedSearches(p.Context, nil, 1000))
+			},
+		},
+		"parsers": &graphql.Field{
+			Type: graphql.NewList(parserType),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				return toGraphQL(builtinParsers, nil)
+			},
+		},
+	},
+})
+
+var graphQLSchema = func() graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+	if err != nil {
+		fatalConfig("Invalid GraphQL schema", "err", err)
+	}
+	return schema
+}()
+
+// graphQLRequest is the standard GraphQL-over-HTTP request body.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+// graphQLHandler handles GET and POST /api/graphql.
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "Invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid GraphQL request: "+err.Error(), bodyErrorStatus(err))
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphQLSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+	if result.HasErrors() {
+		slog.WarnContext(r.Context(), "GraphQL query returned errors", "errors", result.Errors)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Patterns of pattern alert rules are regular expressions that may use grok references,
+// %{NAME} or %{NAME:field}, to the patterns below, e.g.
+//
+//	%{JAVACLASS}: OutOfMemoryError|segfault at %{BASE16NUM}
+//
+// Field names are accepted for compatibility with grok patterns written elsewhere, but
+// nothing is extracted: rules only need to know whether a line matches.
+
+// grokPatterns are the predefined patterns, a subset of the usual grok library.
+var grokPatterns = map[string]string{
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d+)?|\.\d+)`,
+	"BASE16NUM":         `(?:0[xX])?[0-9A-Fa-f]+`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"IPV4":              `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":              `[0-9A-Fa-f]*:[0-9A-Fa-f:.]*[0-9A-Fa-f]`,
+	"IP":                `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":          `%{IP}|%{HOSTNAME}`,
+	"EMAILADDRESS":      `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+`,
+	"PATH":              `(?:/[^\s]*)+`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"LOGLEVEL":          `(?i:trace|debug|notice|info|warn(?:ing)?|err(?:or)?|crit(?:ical)?|alert|fatal|severe|emerg(?:ency)?)`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"JAVACLASS":         `(?:[A-Za-z$_][A-Za-z$_0-9]*\.)*[A-Za-z$_][A-Za-z$_0-9]*`,
+}
+
+// grokReference matches %{NAME} and %{NAME:field}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::[\w.@\[\]-]+)?\}`)
+
+// grokMaxDepth bounds the expansion of patterns that refer to other patterns.
+const grokMaxDepth = 8
+
+// compilePattern expands the grok references in pattern and compiles it.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	expanded, err := expandGrok(pattern, 0)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(expanded)
+}
+
+// expandGrok replaces every reference in pattern by its definition, in a non-capturing group.
+func expandGrok(pattern string, depth int) (string, error) {
+	if depth > grokMaxDepth {
+		return "", fmt.Errorf("grok patterns nested more than %d deep", grokMaxDepth)
+	}
+	var err error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		name := grokReference.FindStringSubmatch(ref)[1]
+		def, ok := grokPatterns[name]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown grok pattern %q", name)
+			}
+			return ""
+		}
+		if strings.Contains(def, "%{") {
+			var nestedErr error
+			def, nestedErr = expandGrok(def, depth+1)
+			if err == nil {
+				err = nestedErr
+			}
+		}
+		return "(?:" + def + ")"
+	})
+	return expanded, err
+}
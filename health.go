@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// /healthz answers as long as the process serves HTTP, for liveness probes. /readyz also
+// checks what ingestion depends on, for readiness probes and load balancers: it answers
+// 503 while the database can't be reached, every pooled connection is busy or the write
+// queue is full, so traffic moves to other instances instead of being refused here, and
+// once shutdown has begun (see lifecycle.go). With STORAGE=memory there is no database to
+// check.
+
+// readyTimeout bounds the database check of /readyz, below the usual probe timeouts.
+const readyTimeout = 2 * time.Second
+
+// Readiness is the response of GET /readyz. Checks maps each dependency to "ok" or the
+// reason it failed.
+type Readiness struct {
+	Status string            `json:"status"` // ok or unavailable
+	Checks map[string]string `json:"checks"`
+}
+
+// healthzHandler handles GET /healthz.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler handles GET /readyz.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := Readiness{Status: "ok", Checks: map[string]string{"database": "ok", "database_pool": "ok"}}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if inMemory() {
+		ready.Checks = map[string]string{"storage": "memory"}
+	} else {
+		if err := dbPool.Ping(ctx); err != nil {
+			ready.Checks["database"] = err.Error()
+			ready.Status = "unavailable"
+		}
+		if stat := dbPool.Stat(); stat.AcquiredConns() >= stat.MaxConns() {
+			ready.Checks["database_pool"] = "all connections in use"
+			ready.Status = "unavailable"
+		}
+	}
+	// A full queue refuses every record until writes catch up.
+	ready.Checks["write_queue"] = "ok"
+	if recordWriter.pending.Load() >= recordWriter.capacity {
+		ready.Checks["write_queue"] = "full"
+		ready.Status = "unavailable"
+	}
+	if lifecycle.shuttingDown.Load() {
+		ready.Checks["shutdown"] = "shutting down"
+		ready.Status = "unavailable"
+	}
+
+	status := http.StatusOK
+	if ready.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, ready)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzWriteQueue(t *testing.T) {
+	saved := store
+	t.Cleanup(func() { store = saved })
+	store = &memoryStorage{}
+	savedCapacity := recordWriter.capacity
+	t.Cleanup(func() {
+		recordWriter.capacity = savedCapacity
+		recordWriter.pending.Store(0)
+	})
+	recordWriter.capacity = 3
+
+	tests := []struct {
+		pending int64
+		code    int
+		queue   string
+	}{
+		{0, http.StatusOK, "ok"},
+		{2, http.StatusOK, "ok"},
+		{3, http.StatusServiceUnavailable, "full"},
+	}
+	for _, tt := range tests {
+		recordWriter.pending.Store(tt.pending)
+		w := httptest.NewRecorder()
+		readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var ready Readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &ready); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code || ready.Checks["write_queue"] != tt.queue {
+			t.Errorf("%d of 3 pending: got %d %v, want %d with the queue %s", tt.pending, w.Code, ready.Checks, tt.code, tt.queue)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Where no firewall can restrict who reaches the server, address rules can, per scope:
+//
+//	ingest  /api/parse
+//	admin   the mutating admin routes, those recorded in the audit log
+//
+// A request is refused with 403 if its client address matches a deny rule of the route's
+// scope, or if the scope has allow rules and none matches. Without rules a scope is open.
+// Loopback clients are never refused from admin routes, so a wrong rule can be fixed
+// from the host itself. Rules are stored in ip_access_rules, managed through
+// /api/ip-access and take effect immediately. The client address is the peer's: behind a
+// proxy, restrict access at the proxy instead.
+
+// IPAccessRule allows or denies the addresses of CIDR for the routes of Scope.
+type IPAccessRule struct {
+	ID        int64        `json:"id"`
+	Scope     string       `json:"scope"`  // ingest or admin
+	Action    string       `json:"action"` // allow or deny
+	CIDR      netip.Prefix `json:"cidr"`   // a single address is taken as a /32 or /128
+	Comment   string       `json:"comment,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// ipAccessScopes are the scopes rules can apply to.
+var ipAccessScopes = []string{"ingest", "admin"}
+
+// validate normalizes r and checks its scope and action.
+func (r *IPAccessRule) validate() error {
+	if !slices.Contains(ipAccessScopes, r.Scope) {
+		return errors.New("scope must be one of " + strings.Join(ipAccessScopes, ", "))
+	}
+	if r.Action != "allow" && r.Action != "deny" {
+		return errors.New("action must be allow or deny")
+	}
+	if !r.CIDR.IsValid() {
+		return errors.New("cidr is required")
+	}
+	r.CIDR = netip.PrefixFrom(r.CIDR.Addr().Unmap(), r.CIDR.Bits()).Masked()
+	r.Comment = strings.TrimSpace(r.Comment)
+	return nil
+}
+
+// UnmarshalJSON accepts a bare address as well as a CIDR.
+func (r *IPAccessRule) UnmarshalJSON(b []byte) error {
+	type rule IPAccessRule
+	var v struct {
+		rule
+		CIDR string `json:"cidr"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = IPAccessRule(v.rule)
+	if v.CIDR == "" {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(v.CIDR); err == nil {
+		r.CIDR = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		return nil
+	}
+	prefix, err := netip.ParsePrefix(v.CIDR)
+	if err != nil {
+		return errors.New("invalid cidr " + strconv.Quote(v.CIDR))
+	}
+	r.CIDR = prefix
+	return nil
+}
+
+// ipAccess holds the loaded rules by scope.
+var ipAccess struct {
+	sync.RWMutex
+	rules map[string][]IPAccessRule
+}
+
+// loadIPAccessRules reads the address rules into memory.
+func loadIPAccessRules() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rules, err := queryIPAccessRules(ctx)
+	if err != nil {
+		fatal("Failed to load IP access rules", "err", err)
+	}
+	byScope := map[string][]IPAccessRule{}
+	for _, r := range rules {
+		byScope[r.Scope] = append(byScope[r.Scope], r)
+	}
+	ipAccess.Lock()
+	ipAccess.rules = byScope
+	ipAccess.Unlock()
+	if len(rules) > 0 {
+		slog.Info("Restricting client addresses", "rules", len(rules))
+	}
+}
+
+// queryIPAccessRules reads every rule, oldest first.
+func queryIPAccessRules(ctx context.Context) ([]IPAccessRule, error) {
+	rows, err := dbPool.Query(ctx, `SELECT id, scope, action, cidr, comment, created_at FROM ip_access_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (IPAccessRule, error) {
+		var r IPAccessRule
+		err := row.Scan(&r.ID, &r.Scope, &r.Action, &r.CIDR, &r.Comment, &r.CreatedAt)
+		return r, err
+	})
+	if rules == nil {
+		rules = []IPAccessRule{}
+	}
+	return rules, err
+}
+
+// ipAllowed reports whether addr may reach the routes of scope.
+func ipAllowed(scope string, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if scope == "admin" && addr.IsLoopback() {
+		return true
+	}
+	ipAccess.RLock()
+	defer ipAccess.RUnlock()
+	allowed, restricted := false, false
+	for _, r := range ipAccess.rules[scope] {
+		switch {
+		case r.Action == "deny" && r.CIDR.Contains(addr):
+			return false
+		case r.Action == "allow":
+			restricted = true
+			allowed = allowed || r.CIDR.Contains(addr)
+		}
+	}
+	return allowed || !restricted
+}
+
+// routeScope returns the address rule scope of rt, or "" if no rules apply to it.
+func routeScope(rt apiRoute) string {
+	switch {
+	case rt.RequestType != "": // log payloads
+		return "ingest"
+	case rt.Audit != "":
+		return "admin"
+	}
+	return ""
+}
+
+// checkIPAccess wraps h to refuse clients the rules of scope don't let in.
+func checkIPAccess(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(sourceName(r.RemoteAddr))
+		if err == nil && ipAllowed(scope, addr) {
+			h(w, r)
+			return
+		}
+		http.Error(w, "Forbidden: client address not allowed", http.StatusForbidden)
+		slog.WarnContext(r.Context(), "Rejected request: client address not allowed", "scope", scope, "remote_addr", r.RemoteAddr)
+		recordSecurityEvent(r, "ip_denied", "scope "+scope)
+	}
+}
+
+// IPAccessRules is the response of GET /api/ip-access.
+type IPAccessRules struct {
+	Rules []IPAccessRule `json:"rules"`
+}
+
+// listIPAccessHandler handles GET /api/ip-access.
+func listIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := queryIPAccessRules(r.Context())
+	if err != nil {
+		http.Error(w, "Could not list IP access rules", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing IP access rules", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, IPAccessRules{Rules: rules})
+}
+
+// createIPAccessHandler handles POST /api/ip-access.
+func createIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	var rule IPAccessRule
+	if err := readJSON(r, &rule); err != nil {
+		http.Error(w, "Invalid IP access rule: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, "Invalid IP access rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := dbPool.QueryRow(r.Context(), `
+	INSERT INTO ip_access_rules (scope, action, cidr, comment) VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at`,
+		rule.Scope, rule.Action, rule.CIDR, rule.Comment).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		http.Error(w, "Could not save IP access rule", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving IP access rule", "err", err)
+		return
+	}
+	ipAccess.Lock()
+	ipAccess.rules[rule.Scope] = append(ipAccess.rules[rule.Scope], rule)
+	ipAccess.Unlock()
+
+	slog.InfoContext(r.Context(), "Created IP access rule", "id", rule.ID, "scope", rule.Scope, "action", rule.Action, "cidr", rule.CIDR)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// deleteIPAccessHandler handles DELETE /api/ip-access/{id}.
+func deleteIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid IP access rule id", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM ip_access_rules WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, "Could not delete IP access rule", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting IP access rule", "id", id, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "IP access rule not found", http.StatusNotFound)
+		return
+	}
+	ipAccess.Lock()
+	for scope, rules := range ipAccess.rules {
+		ipAccess.rules[scope] = slices.DeleteFunc(rules, func(rule IPAccessRule) bool { return rule.ID == id })
+	}
+	ipAccess.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted IP access rule", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Issues group the error entries of a service by message template (see templates.go), so
+// a failure that logs thousands of lines shows up once with its first and last occurrence
+// and count. An issue is unresolved until it is resolved or ignored through the API; a
+// resolved issue that occurs again is reopened, an ignored one stays ignored.
+
+// issueMinSeverity is the lowest severity number grouped into issues (error).
+const issueMinSeverity = 17
+
+// issueStatuses are the states of an issue.
+var issueStatuses = []string{"unresolved", "resolved", "ignored"}
+
+// Limits for the number of issues returned by /api/issues.
+const (
+	defaultIssueLimit = 100
+	maxIssueLimit     = 1000
+)
+
+// issueEventCount is the number of recent entries returned with an issue.
+const issueEventCount = 10
+
+// Issue is the error entries of one service sharing one template.
+type Issue struct {
+	ID          int64      `json:"id"`
+	Service     string     `json:"service"`
+	TemplateID  int64      `json:"template_id"`
+	Title       string     `json:"title"` // the template
+	Level       string     `json:"level"` // of the latest entry
+	Count       int64      `json:"count"`
+	FirstSeen   time.Time  `json:"first_seen"`
+	LastSeen    time.Time  `json:"last_seen"`
+	LastMessage string     `json:"last_message"`
+	Status      string     `json:"status"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	Query       string     `json:"query"` // q= expression selecting the issue's entries
+}
+
+// issueUpdate is the change to one issue caused by a batch of entries.
+type issueUpdate struct {
+	service     string
+	templateID  int64
+	title       string
+	level       string
+	added       int64
+	firstSeen   time.Time
+	lastSeen    time.Time
+	lastMessage string
+}
+
+// issueUpsertSQL records an issueUpdate, reopening the issue if it was resolved.
+const issueUpsertSQL = `
+	INSERT INTO issues (service, template_id, title, level, count, first_seen, last_seen, last_message)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (service, template_id) DO UPDATE SET
+		title = EXCLUDED.title,
+		level = EXCLUDED.level,
+		count = issues.count + EXCLUDED.count,
+		last_seen = GREATEST(issues.last_seen, EXCLUDED.last_seen),
+		last_message = EXCLUDED.last_message,
+		status = CASE issues.status WHEN 'resolved' THEN 'unresolved' ELSE issues.status END,
+		resolved_at = CASE issues.status WHEN 'resolved' THEN NULL ELSE issues.resolved_at END`
+
+// issueUpdates groups the error entries among entries by service and template. templates
+// are the changes mine returned for the same entries, supplying the template texts.
+func issueUpdates(entries []StoredEntry, templates []templateUpdate) []issueUpdate {
+	titles := make(map[int64]string, len(templates))
+	for _, t := range templates {
+		titles[t.id] = t.template
+	}
+
+	type key struct {
+		service    string
+		templateID int64
+	}
+	var updates []issueUpdate
+	index := map[key]int{}
+	for _, e := range entries {
+		if e.SeverityNumber < issueMinSeverity || e.TemplateID == 0 {
+			continue
+		}
+		k := key{e.Service, e.TemplateID}
+		i, ok := index[k]
+		if !ok {
+			i = len(updates)
+			index[k] = i
+			updates = append(updates, issueUpdate{service: e.Service, templateID: e.TemplateID, title: titles[e.TemplateID], firstSeen: e.ReceivedAt})
+		}
+		u := &updates[i]
+		u.added += int64(e.Repeats)
+		u.level = e.Severity
+		u.lastSeen = e.ReceivedAt
+		u.lastMessage = e.Message
+	}
+	return updates
+}
+
+// issueQuery returns the q= expression selecting the entries of an issue.
+func issueQuery(service string, templateID int64) string {
+	quoted := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(service) + `"`
+	return "template_id=" + strconv.FormatInt(templateID, 10) + " AND service=" + quoted
+}
+
+// issueSelectSQL is the column list scanned by scanIssue.
+const issueSelectSQL = `SELECT id, service, template_id, title, level, count, first_seen, last_seen, last_message, status, resolved_at FROM issues`
+
+func scanIssue(row pgx.Row) (Issue, error) {
+	var i Issue
+	err := row.Scan(&i.ID, &i.Service, &i.TemplateID, &i.Title, &i.Level, &i.Count, &i.FirstSeen, &i.LastSeen, &i.LastMessage,
+		&i.Status, &i.ResolvedAt)
+	if err == nil {
+		i.LastMessage, err = encryption.decrypt("message", i.LastMessage)
+	}
+	i.Query = issueQuery(i.Service, i.TemplateID)
+	return i, err
+}
+
+// writeIssueError maps a storage error to a response.
+func writeIssueError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Issue not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Could not access issues", http.StatusInternalServerError)
+	slog.ErrorContext(r.Context(), "Error accessing issues", "err", err)
+}
+
+// Issues is the response of GET /api/issues.
+type Issues struct {
+	Issues []Issue `json:"issues"`
+}
+
+// listIssuesHandler handles GET /api/issues. status selects unresolved (the default),
+// resolved, ignored or all issues, service narrows them to one service, and sort orders
+// them by last_seen (the default), first_seen or count, descending.
+func listIssuesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var args sqlArgs
+	var conds []string
+	switch status := query.Get("status"); {
+	case status == "":
+		conds = append(conds, "status = 'unresolved'")
+	case status == "all":
+	case slices.Contains(issueStatuses, status):
+		conds = append(conds, "status = "+args.add(status))
+	default:
+		http.Error(w, "Invalid 'status': must be one of "+strings.Join(issueStatuses, ", ")+" or all", http.StatusBadRequest)
+		return
+	}
+	if query.Has("service") {
+		conds = append(conds, "service = "+args.add(query.Get("service")))
+	}
+
+	order := "last_seen DESC, id DESC"
+	switch query.Get("sort") {
+	case "", "last_seen":
+	case "first_seen":
+		order = "first_seen DESC, id DESC"
+	case "count":
+		order = "count DESC, id"
+	default:
+		http.Error(w, "Invalid 'sort': must be last_seen, first_seen or count", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultIssueLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxIssueLimit {
+			http.Error(w, "Invalid 'limit': must be between 1 and "+strconv.Itoa(maxIssueLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sql := issueSelectSQL
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY " + order + " LIMIT " + args.add(limit)
+
+	rows, err := dbPool.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeIssueError(w, r, err)
+		return
+	}
+	issues, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Issue, error) {
+		return scanIssue(row)
+	})
+	if err != nil {
+		writeIssueError(w, r, err)
+		return
+	}
+	if issues == nil {
+		issues = []Issue{}
+	}
+	writeJSON(w, http.StatusOK, Issues{Issues: issues})
+}
+
+// IssueDetail is the response of GET /api/issues/{id}: the issue and its latest entries.
+type IssueDetail struct {
+	Issue
+	Events []StoredEntry `json:"events"`
+}
+
+// issueID parses the {id} path value, writing a 400 response if it is invalid.
+func issueID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid issue id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// getIssueHandler handles GET /api/issues/{id}.
+func getIssueHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := issueID(w, r)
+	if !ok {
+		return
+	}
+	issue, err := scanIssue(dbPool.QueryRow(r.Context(), issueSelectSQL+" WHERE id = $1", id))
+	if err != nil {
+		writeIssueError(w, r, err)
+		return
+	}
+
+	filter, err := parseEntryFilter(url.Values{"q": {issue.Query}})
+	if err != nil {
+		writeIssueError(w, r, err)
+		return
+	}
+	events, err := store.LatestEntries(r.Context(), filter, nil, issueEventCount)
+	if err != nil {
+		writeQueryError(w, r, err, "load issue events")
+		return
+	}
+	writeJSON(w, http.StatusOK, IssueDetail{Issue: issue, Events: events})
+}
+
+// setIssueStatusHandler returns the handler of POST /api/issues/{id}/resolve, /ignore or
+// /unresolve.
+func setIssueStatusHandler(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := issueID(w, r)
+		if !ok {
+			return
+		}
+		issue, err := scanIssue(dbPool.QueryRow(r.Context(), `
+		UPDATE issues SET status = $2, resolved_at = CASE WHEN $2 = 'resolved' THEN now() END
+		WHERE id = $1
+		RETURNING id, service, template_id, title, level, count, first_seen, last_seen, last_message, status, resolved_at`,
+			id, status))
+		if err != nil {
+			writeIssueError(w, r, err)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Marked issue "+status, "id", issue.ID)
+		writeJSON(w, http.StatusOK, issue)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM or SIGINT the server stops in steps, fitting the shutdown of Docker and of a
+// Kubernetes pod:
+//
+//  1. /readyz answers 503, so load balancers and endpoints stop sending requests, while
+//     they are still served for the drain period
+//  2. the listeners are closed and the requests in progress, live tails excepted, are let
+//     finish
+//  3. the records still queued are stored, with the usage metered, and the traces exported
+//
+// Steps 2 and 3 are bounded by the shutdown timeout, after which the server exits anyway.
+// A second signal exits at once.
+//
+//	SHUTDOWN_DRAIN_PERIOD  how long requests are still served once not ready; default 5s,
+//	                       0 with a preStop hook that waits instead
+//	SHUTDOWN_TIMEOUT       the most steps 2 and 3 may take; default 25s, so that with the
+//	                       default drain period the server ends within the 30s
+//	                       terminationGracePeriodSeconds of Kubernetes
+//
+// Docker waits 10s before killing a container unless its stop_grace_period is raised, as
+// docker-compose.yaml does.
+//
+// The exit status is 0 after a shutdown, 1 on a runtime failure and 78 on an invalid
+// setting, see logging.go.
+
+var lifecycle = struct {
+	drainPeriod     time.Duration
+	shutdownTimeout time.Duration
+	shuttingDown    atomic.Bool
+	stopping        chan struct{} // closed when the listeners are closed
+}{drainPeriod: 5 * time.Second, shutdownTimeout: 25 * time.Second, stopping: make(chan struct{})}
+
+// setupLifecycle reads the shutdown settings.
+func setupLifecycle() {
+	for _, s := range []struct {
+		env   string
+		value *time.Duration
+	}{{"SHUTDOWN_DRAIN_PERIOD", &lifecycle.drainPeriod}, {"SHUTDOWN_TIMEOUT", &lifecycle.shutdownTimeout}} {
+		if v := setting(s.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				fatalConfig("Invalid "+s.env+": must be a duration such as 10s", "value", v)
+			}
+			*s.value = d
+		}
+	}
+}
+
+// runServer serves each socket of served with its server, with TLS if the server has a TLS
+// configuration, save Unix sockets, until a signal stops the server as described above,
+// exiting if it fails instead.
+func runServer(served []serving) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	var servers []*http.Server
+	// Serve sets a TLS configuration up for HTTP/2 if there is none, so it is checked first.
+	useTLS := map[*http.Server]bool{}
+	for _, s := range served {
+		if !slices.Contains(servers, s.server) {
+			servers = append(servers, s.server)
+			useTLS[s.server] = s.server.TLSConfig != nil
+		}
+	}
+	failed := make(chan error, len(served))
+	for _, s := range served {
+		go func() {
+			if useTLS[s.server] && s.Addr().Network() != "unix" {
+				failed <- s.server.ServeTLS(s, "", "")
+				return
+			}
+			failed <- s.server.Serve(s)
+		}()
+	}
+	notifySystemd("READY=1\nSTATUS=Serving requests")
+	startWatchdog()
+	select {
+	case err := <-failed:
+		fatal("Server stopped", "err", err)
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "drain_period", lifecycle.drainPeriod,
+			"timeout", lifecycle.shutdownTimeout)
+		notifySystemd("STOPPING=1\nSTATUS=Shutting down")
+	}
+	go func() {
+		sig := <-signals
+		slog.Error("Exiting without finishing the shutdown", "signal", sig.String())
+		os.Exit(exitFailure)
+	}()
+
+	lifecycle.shuttingDown.Store(true)
+	time.Sleep(lifecycle.drainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), lifecycle.shutdownTimeout)
+	defer cancel()
+	close(lifecycle.stopping)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Requests still in progress at shutdown", "err", err)
+		}
+	}
+	if err := drainRecordWriter(ctx); err != nil {
+		slog.Error("Records not stored at shutdown", "pending", recordWriter.pending.Load(), "err", err)
+	}
+	if dbPool != nil {
+		flushUsage(ctx)
+	}
+	if traceProvider != nil {
+		if err := traceProvider.Shutdown(ctx); err != nil {
+			slog.Warn("Traces not exported at shutdown", "err", err)
+		}
+	}
+	if dbPool != nil {
+		dbPool.Close()
+	}
+	slog.Info("Server stopped")
+}
+
+// drainRecordWriter waits until the queued records are written.
+func drainRecordWriter(ctx context.Context) error {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for recordWriter.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.New("shutdown timeout")
+		case <-tick.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Request bodies are bounded, so a client can't exhaust memory with one huge or endless
+// request:
+//
+//	MAX_INGEST_BYTES   largest log payload of /api/parse; default 32MiB
+//	MAX_REQUEST_BYTES  largest JSON body of the other endpoints; default 1MiB
+//
+// Sizes are bytes, or a number with a K, M or G suffix (powers of 1024). A request whose
+// Content-Length exceeds the limit is answered 413 before its body is read; a chunked body
+// is cut off with a 413 once it passes the limit.
+//
+// The response to a payload, the JSON of its entries, is stored with its record:
+//
+//	MAX_STORED_RESPONSE  largest response_body stored; default 1MiB, a longer one being
+//	                     replaced by a summary (see response.go)
+
+var (
+	maxIngestBytes    int64 = 32 << 20
+	maxRequestBytes   int64 = 1 << 20
+	maxStoredResponse int64 = 1 << 20
+)
+
+// setupLimits reads the configured body limits.
+func setupLimits() {
+	for _, l := range []struct {
+		env   string
+		limit *int64
+	}{{"MAX_INGEST_BYTES", &maxIngestBytes}, {"MAX_REQUEST_BYTES", &maxRequestBytes}, {"MAX_STORED_RESPONSE", &maxStoredResponse}} {
+		if v := setting(l.env); v != "" {
+			n, err := parseByteSize(v)
+			if err != nil || n <= 0 {
+				fatalConfig("Invalid "+l.env+": must be a positive size such as 512K or 64M", "value", v)
+			}
+			*l.limit = n
+		}
+	}
+}
+
+// parseByteSize parses a size such as 1048576, 512K, 64M or 1GiB.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<63-1)>>shift {
+		return 0, errors.New("size out of range")
+	}
+	return n << shift, nil
+}
+
+// limitBody wraps h to reject bodies larger than limit bytes.
+func limitBody(h http.HandlerFunc, limit int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Payload too large: the limit is "+strconv.FormatInt(limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			slog.WarnContext(r.Context(), "Rejected request: payload too large", "bytes", r.ContentLength, "limit", limit)
+			recordSecurityEvent(r, "payload_too_large", "Content-Length "+strconv.FormatInt(r.ContentLength, 10)+" over "+strconv.FormatInt(limit, 10)+" bytes")
+			return
+		}
+		r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), r: r}
+		h(w, r)
+	}
+}
+
+// limitedBody records a security event when a body is cut off at its limit.
+type limitedBody struct {
+	io.ReadCloser
+	r        *http.Request
+	recorded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if !b.recorded && errors.As(err, &tooLarge) {
+		b.recorded = true
+		recordSecurityEvent(b.r, "payload_too_large", "body over "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+	}
+	return n, err
+}
+
+// bodyErrorStatus is the status of a request whose body could not be read or decoded:
+// 413 if it was cut off by limitBody, else 400.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
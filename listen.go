@@ -0,0 +1,153 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// The API is served on a TCP address, and the management routes — /metrics, /healthz,
+// /readyz, /api/debug/db and /api/admin/reload — can be moved to another, e.g. one only
+// reachable from the cluster or host, leaving the API address to clients:
+//
+//	API_ADDR           host:port of the API; default :8007, every interface
+//	ADMIN_ADDR         host:port of the management routes, which then answer 404 on the
+//	                   API's sockets; default none, serving them with the API
+//
+// The management address is served with the same TLS and authentication as the API.
+//
+// Besides TCP, the API can be served on a Unix socket, for agents and sidecars on the same
+// host that shouldn't need a network port:
+//
+//	UNIX_SOCKET        path of the socket
+//	UNIX_SOCKET_MODE   its permissions, in octal; default 660
+//	UNIX_SOCKET_GROUP  group owning it, a name or id; default the server's
+//
+// Access to the socket is granted by its permissions, so it is served over plain HTTP
+// even when TLS is on, and its clients count as 127.0.0.1, for IP access rules and as the
+// source of their records. A socket left behind by a server that didn't stop cleanly is
+// replaced.
+
+// serving is a socket and the server of its connections.
+type serving struct {
+	net.Listener
+	server *http.Server
+}
+
+// serverListeners returns the sockets to serve: those passed by systemd, else API_ADDR and
+// UNIX_SOCKET, with api, and ADMIN_ADDR, if set, with admin.
+func serverListeners(api, admin *http.Server) []serving {
+	var served []serving
+	activated, err := activatedListeners()
+	if err != nil {
+		fatal("Could not use the sockets passed by systemd", "err", err)
+	}
+	for _, ln := range activated {
+		served = append(served, serving{ln, api})
+	}
+
+	if activated == nil {
+		addr := cmp.Or(setting("API_ADDR"), ":8007")
+		ln, err := listenTCP("API_ADDR", addr)
+		if err != nil {
+			fatal("Could not listen", "addr", addr, "err", err)
+		}
+		served = append(served, serving{ln, api})
+		if path := setting("UNIX_SOCKET"); path != "" {
+			ln, err := listenUnix(path)
+			if err != nil {
+				fatal("Could not listen on UNIX_SOCKET", "path", path, "err", err)
+			}
+			served = append(served, serving{ln, api})
+		}
+	}
+	if addr := setting("ADMIN_ADDR"); addr != "" {
+		ln, err := listenTCP("ADMIN_ADDR", addr)
+		if err != nil {
+			fatal("Could not listen on ADMIN_ADDR", "addr", addr, "err", err)
+		}
+		served = append(served, serving{ln, admin})
+	}
+	return served
+}
+
+// listenTCP listens on addr, the value of the setting env, exiting if it isn't host:port.
+func listenTCP(env, addr string) (net.Listener, error) {
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		fatalConfig("Invalid "+env+": must be host:port or :port", "value", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on the Unix socket at path, with the permissions of the settings.
+func listenUnix(path string) (net.Listener, error) {
+	mode := fs.FileMode(0o660)
+	if v := setting("UNIX_SOCKET_MODE"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0o777 {
+			fatalConfig("Invalid UNIX_SOCKET_MODE: must be octal permissions such as 660", "value", v)
+		}
+		mode = fs.FileMode(m)
+	}
+	gid := -1
+	if v := setting("UNIX_SOCKET_GROUP"); v != "" {
+		g, err := user.LookupGroup(v)
+		if err != nil {
+			g, err = user.LookupGroupId(v)
+		}
+		if err != nil {
+			fatalConfig("Invalid UNIX_SOCKET_GROUP: no such group", "value", v)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	slog.Debug("Unix socket permissions set", "path", path, "mode", mode, "gid", gid)
+	return localListener{ln}, nil
+}
+
+// localListener accepts connections from the same host, which count as from 127.0.0.1.
+type localListener struct {
+	net.Listener
+}
+
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return localConn{conn}, nil
+}
+
+type localConn struct {
+	net.Conn
+}
+
+func (localConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
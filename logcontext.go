@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Limits for the before and after parameters of the context endpoint.
+const (
+	defaultContextLines = 5
+	maxContextLines     = 100
+)
+
+// EntryContext is the response of /api/logs/{id}/context.
+type EntryContext struct {
+	Before []StoredEntry `json:"before"`
+	Entry  StoredEntry   `json:"entry"`
+	After  []StoredEntry `json:"after"`
+}
+
+// contextHandler handles GET /api/logs/{id}/context, returning the entries stored just
+// before and after the given one from the same source, like grep -C.
+func contextHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid entry id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	before, err := contextLines(query.Get("before"))
+	if err != nil {
+		http.Error(w, "Invalid 'before': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := contextLines(query.Get("after"))
+	if err != nil {
+		http.Error(w, "Invalid 'after': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := loadEntryContext(r.Context(), id, before, after)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load entry context", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error loading context of entry", "id", id, "err", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// contextLines parses a before/after count.
+func contextLines(v string) (int, error) {
+	if v == "" {
+		return defaultContextLines, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxContextLines {
+		return 0, errors.New("must be between 0 and " + strconv.Itoa(maxContextLines))
+	}
+	return n, nil
+}
+
+// loadEntryContext loads entry id and its neighbours from the same source in storage order.
+func loadEntryContext(ctx context.Context, id int64, before, after int) (EntryContext, error) {
+	var result EntryContext
+
+	row := dbPool.QueryRow(ctx, entrySelectSQL+" WHERE e.id = $1", id)
+	entry, err := scanEntry(row)
+	if err != nil {
+		return result, err
+	}
+	if tenant := requestTenant(ctx); tenant != "" && entry.Tenant != tenant {
+		return result, pgx.ErrNoRows
+	}
+	if project := requestProject(ctx); project != "" && sourceProject(entry.SourceID) != project {
+		return result, pgx.ErrNoRows
+	}
+	result.Entry = entry
+
+	sameSource := sourceExpr + " = regexp_replace($1, ':[0-9]+$', '') AND d.tenant = $5 AND ($6 = '' OR " + projectCond("$6") + ")"
+	result.Before, err = neighbourEntries(ctx, sameSource+" AND (e.received_at, e.id) < ($2, $3) ORDER BY e.received_at DESC, e.id DESC", entry, before)
+	if err != nil {
+		return result, err
+	}
+	slices.Reverse(result.Before)
+
+	result.After, err = neighbourEntries(ctx, sameSource+" AND (e.received_at, e.id) > ($2, $3) ORDER BY e.received_at, e.id", entry, after)
+	return result, err
+}
+
+// neighbourEntries runs a context query where $1 is the entry's address, ($2, $3) its
+// position, $5 its tenant and $6 the caller's project.
+func neighbourEntries(ctx context.Context, cond string, entry StoredEntry, limit int) ([]StoredEntry, error) {
+	if limit == 0 {
+		return []StoredEntry{}, nil
+	}
+	rows, err := dbPool.Query(ctx, entrySelectSQL+" WHERE "+cond+" LIMIT $4",
+		entry.RemoteAddr, entry.ReceivedAt, entry.ID, limit, entry.Tenant, requestProject(ctx))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoredEntry, error) {
+		return scanEntry(row)
+	})
+	if entries == nil {
+		entries = []StoredEntry{}
+	}
+	return entries, err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The server's own logs are written with log/slog to stderr, configured by:
+//
+//	LOG_FORMAT  text (default) or json
+//	LOG_LEVEL   debug, info (default), warn or error
+//
+// Every HTTP request is logged once answered, with its method, path, status, duration and
+// sizes. Records logged with the context of a request carry its request_id and client, and
+// its trace_id and span_id while tracing is on (see tracing.go). Requests keep the
+// X-Request-ID they arrive with, if it looks like an id, so ids can be followed across
+// services; the id is returned in the X-Request-ID response header for support requests.
+// The logs can also be stored and searched like any source's, see selfingest.go.
+
+// logLevel is the level of LOG_LEVEL, which can be changed by a reload.
+var logLevel slog.LevelVar
+
+// setupLogging installs the configured handler as the slog and log default.
+func setupLogging() {
+	level, err := logLevelSetting()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	var h slog.Handler
+	switch format := setting("LOG_FORMAT"); format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		log.Fatalf("Invalid LOG_FORMAT %q: must be text or json", format)
+	}
+	setupSelfIngestion()
+	slog.SetDefault(slog.New(requestLogHandler{selfIngest.wrap(h)}))
+}
+
+// logLevelSetting returns the level of LOG_LEVEL, info if it isn't set.
+func logLevelSetting() (slog.Level, error) {
+	var level slog.Level
+	if v := setting("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return 0, fmt.Errorf("invalid LOG_LEVEL %q: must be debug, info, warn or error", v)
+		}
+	}
+	return level, nil
+}
+
+// Exit statuses, besides 0 once stopped by a signal or a command has succeeded, so an
+// orchestrator can tell a setting to fix from a failure worth restarting for.
+const (
+	exitFailure = 1  // a runtime failure, e.g. the database can't be reached
+	exitUsage   = 2  // invalid arguments
+	exitConfig  = 78 // an invalid setting or configuration file, EX_CONFIG of sysexits.h
+)
+
+// fatal logs an error and exits, for startup and runtime failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitFailure)
+}
+
+// fatalConfig logs an error and exits, for invalid settings.
+func fatalConfig(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitConfig)
+}
+
+// requestInfo identifies the request a context belongs to.
+type requestInfo struct {
+	id     string
+	client string
+}
+
+type requestInfoKey struct{}
+
+// requestFromContext returns the request information stored by withRequestLog.
+func requestFromContext(ctx context.Context) (requestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info, ok
+}
+
+// maxRequestIDLength bounds an X-Request-ID accepted from a client.
+const maxRequestIDLength = 128
+
+// quietPaths are logged at debug level, so probes don't flood the access log.
+var quietPaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// withRequestLog stores the request's id and client address in its context, returns the
+// id in the X-Request-ID response header and logs the request once it is answered.
+func withRequestLog(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, requestInfo{id: id, client: r.RemoteAddr})
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case quietPaths[r.URL.Path]:
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"request_bytes", r.ContentLength,
+			"response_bytes", rec.bytes,
+			"user_agent", r.UserAgent())
+	}
+}
+
+// validRequestID reports whether a client-supplied id is short and printable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' })
+}
+
+// newRequestID returns a random 128-bit id in hex.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestLogHandler adds the request and trace of a record's context to it.
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if info, ok := requestFromContext(ctx); ok {
+		rec.AddAttrs(slog.String("request_id", info.id), slog.String("client", info.client))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
+
+// statusRecorder remembers the status code and size of the response written through it.
+// It passes on flushes and hijacks, which streaming and WebSocket handlers need.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	return h.Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
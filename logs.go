@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"delogger/storage"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Page size limits for /api/logs.
+const (
+	defaultLogsLimit = 100
+	maxLogsLimit     = 1000
+)
+
+// LogsPage is the response of /api/logs. NextCursor is empty on the last page.
+type LogsPage struct {
+	Entries    []StoredEntry `json:"entries"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// logsHandler handles GET /api/logs, returning one page of entries matching the filter,
+// newest first. Pages are keyset-paginated on (received_at, id), so results stay stable
+// while new entries arrive and deep pages cost the same as the first.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, cursor, err := parsePage(query, defaultLogsLimit, maxLogsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cursor != nil && cursor.Time == nil {
+		http.Error(w, "invalid 'cursor'", http.StatusBadRequest)
+		return
+	}
+
+	// Fetch one extra row to learn whether another page follows.
+	entries, err := store.LatestEntries(r.Context(), filter, cursor.position(), limit+1)
+	if err != nil {
+		writeQueryError(w, r, err, "query logs")
+		return
+	}
+
+	page := LogsPage{Entries: entries}
+	if len(page.Entries) > limit {
+		page.Entries = page.Entries[:limit]
+		last := page.Entries[limit-1]
+		page.NextCursor = pageCursor{Time: &last.ReceivedAt, ID: last.ID}.encode()
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// LatestEntries returns up to limit entries matching filter, newest first,
+// starting before the position before when it is not nil.
+func (postgresStorage) LatestEntries(ctx context.Context, filter entryFilter, before *storage.Position, limit int) ([]StoredEntry, error) {
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	var args sqlArgs
+	where := filter.where(&args)
+	if before != nil {
+		where = andWhere(where, "(e.received_at, e.id) < ("+args.add(before.ReceivedAt)+", "+args.add(before.ID)+")")
+	}
+	sql := entrySelectSQL + " " + where + " ORDER BY e.received_at DESC, e.id DESC LIMIT " + args.add(limit)
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoredEntry, error) {
+		return scanEntry(row)
+	})
+	if entries == nil {
+		entries = []StoredEntry{}
+	}
+	return entries, err
+}
@@ -3,184 +3,729 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"delogger/enrich"
+	"delogger/parser"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// LogEntry struct to hold the parsed log data. (Same as before)
-type LogEntry struct {
-	Timestamp string `json:"timestamp,omitempty"`
-	Level     string `json:"level,omitempty"`
-	Message   string `json:"message,omitempty"`
-	Raw       string `json:"raw,omitempty"`
-}
+// LogEntry is a parsed log line, see the parser package.
+type LogEntry = parser.Entry
 
 // LogRecord structure for PostgreSQL.
 type LogRecord struct {
-	Timestamp    time.Time       `json:"timestamp"`
-	RemoteAddr   string          `json:"remote_addr"`
-	RequestBody  string          `json:"request_body"`
-	ResponseBody json.RawMessage `json:"response_body"`
-	StatusCode   int             `json:"status_code"`
-	ErrorMsg     string          `json:"error_msg"`
+	Timestamp    time.Time         `json:"timestamp"`
+	RemoteAddr   string            `json:"remote_addr"`
+	RequestBody  string            `json:"request_body"`
+	ResponseBody json.RawMessage   `json:"response_body"`
+	StatusCode   int               `json:"status_code"`
+	ErrorMsg     string            `json:"error_msg"`
+	Host         string            `json:"host"`
+	Service      string            `json:"service"`
+	Env          string            `json:"env"`
+	Tenant       string            `json:"tenant,omitempty"`
+	SourceID     int64             `json:"source_id,omitempty"` // registered source of the payload, see sources.go
+	Redactions   map[string]int    `json:"redactions"`
+	Fields       map[string]string `json:"fields"`
+	Entries      []LogEntry        `json:"-"`
+
+	requestChunks []string    // redacted chunks of a spilled payload, stored in place of RequestBody
+	responseBuf   *jsonBuffer // pooled buffer holding ResponseBody, returned once the record is written
 }
 
 var dbPool *pgxpool.Pool
 
+// schemaStatements creates the tables used by the service. Every statement must be idempotent.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS delogged (
+		id SERIAL PRIMARY KEY,
+		timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+		remote_addr TEXT,
+		request_body TEXT,
+		response_body JSONB,
+		status_code INTEGER,
+		error_msg TEXT
+	)`,
+	// One row per parsed line, so entries can be filtered and exported without unpacking response_body.
+	`CREATE TABLE IF NOT EXISTS delogged_entries (
+		id BIGSERIAL PRIMARY KEY,
+		log_id INTEGER NOT NULL REFERENCES delogged(id) ON DELETE CASCADE,
+		received_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		line_no INTEGER NOT NULL,
+		log_timestamp TEXT NOT NULL DEFAULT '',
+		level TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		raw TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_received_at_idx ON delogged_entries (received_at, id)`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_log_id_idx ON delogged_entries (log_id)`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS correlation_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_correlation_id_idx ON delogged_entries (correlation_id) WHERE correlation_id <> ''`,
+	// GeoIP enrichment, see geoip.go.
+	`ALTER TABLE delogged_entries
+		ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS geo_country TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS geo_city TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS geo_asn BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS geo_org TEXT NOT NULL DEFAULT ''`,
+	// Canonical severity, see severity.go.
+	`ALTER TABLE delogged_entries
+		ADD COLUMN IF NOT EXISTS severity TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS severity_number SMALLINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_severity_number_idx ON delogged_entries (severity_number, received_at)`,
+	`CREATE TABLE IF NOT EXISTS severity_aliases (
+		alias TEXT PRIMARY KEY,
+		severity TEXT NOT NULL
+	)`,
+	// Parsed timestamp in UTC, see timezone.go; NULL when the format is not recognised.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS log_time TIMESTAMP WITH TIME ZONE`,
+	`CREATE TABLE IF NOT EXISTS source_timezones (
+		source TEXT PRIMARY KEY,
+		timezone TEXT NOT NULL
+	)`,
+	// Source metadata from the X-DeLogger-* request headers.
+	`ALTER TABLE delogged
+		ADD COLUMN IF NOT EXISTS host TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS service TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS env TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_host_idx ON delogged (host) WHERE host <> ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_service_env_idx ON delogged (service, env) WHERE service <> '' OR env <> ''`,
+	// Reverse DNS name of client_ip, see rdns.go.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS client_host TEXT NOT NULL DEFAULT ''`,
+	// Number of values masked per redaction rule, see redact.go.
+	`ALTER TABLE delogged ADD COLUMN IF NOT EXISTS redactions JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS source_ip_modes (
+		source TEXT PRIMARY KEY,
+		mode TEXT NOT NULL
+	)`,
+	// Static fields of the source, see staticfields.go.
+	`ALTER TABLE delogged ADD COLUMN IF NOT EXISTS fields JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS source_fields (
+		source TEXT PRIMARY KEY,
+		fields JSONB NOT NULL
+	)`,
+	// Content fingerprint for deduplication, see fingerprint.go.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS fingerprint TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_fingerprint_idx ON delogged_entries (fingerprint, received_at) WHERE fingerprint <> ''`,
+	// Error entries grouped by service and template, see issues.go.
+	`CREATE TABLE IF NOT EXISTS issues (
+		id BIGSERIAL PRIMARY KEY,
+		service TEXT NOT NULL,
+		template_id BIGINT NOT NULL,
+		title TEXT NOT NULL,
+		level TEXT NOT NULL DEFAULT '',
+		count BIGINT NOT NULL,
+		first_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_message TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'unresolved',
+		resolved_at TIMESTAMP WITH TIME ZONE,
+		UNIQUE (service, template_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS issues_status_last_seen_idx ON issues (status, last_seen)`,
+	// Last request of each source, see sourceactivity.go.
+	`CREATE TABLE IF NOT EXISTS source_activity (
+		source TEXT PRIMARY KEY,
+		host TEXT NOT NULL DEFAULT '',
+		service TEXT NOT NULL DEFAULT '',
+		env TEXT NOT NULL DEFAULT '',
+		first_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
+	)`,
+	// Mined message templates, see templates.go.
+	`CREATE TABLE IF NOT EXISTS log_templates (
+		id BIGINT PRIMARY KEY,
+		template TEXT NOT NULL,
+		count BIGINT NOT NULL DEFAULT 0,
+		first_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_templates_first_seen_idx ON log_templates (first_seen)`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS template_id BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_template_id_idx ON delogged_entries (template_id, received_at) WHERE template_id <> 0`,
+	// Trace context found in the line, see correlate.go.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS trace_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS span_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS request_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_trace_id_idx ON delogged_entries (trace_id, span_id) WHERE trace_id <> ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_request_id_idx ON delogged_entries (request_id) WHERE request_id <> ''`,
+	// Request fields of access log lines, see accesslog.go.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS http_method TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS http_path TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS http_status SMALLINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS http_bytes BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS http_latency_ms DOUBLE PRECISION`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_http_path_idx ON delogged_entries (http_path, received_at) INCLUDE (http_method, http_latency_ms) WHERE http_path <> ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_entries_http_status_idx ON delogged_entries (http_status, received_at) WHERE http_status <> 0`,
+	// Consecutive repeats collapsed into an entry, see fingerprint.go.
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS repeats INTEGER NOT NULL DEFAULT 1`,
+	// Per-source sampling policies and the rate each entry was kept at, see sampling.go.
+	`CREATE TABLE IF NOT EXISTS source_sampling (
+		source TEXT PRIMARY KEY,
+		rates JSONB NOT NULL
+	)`,
+	`ALTER TABLE delogged_entries ADD COLUMN IF NOT EXISTS sample_rate DOUBLE PRECISION NOT NULL DEFAULT 1`,
+	`CREATE TABLE IF NOT EXISTS alert_rules (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		filter JSONB NOT NULL DEFAULT '{}',
+		threshold BIGINT NOT NULL,
+		time_window TEXT NOT NULL,
+		channels JSONB NOT NULL DEFAULT '[]',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	// Alert conditions other than a fixed count, see alerts.go.
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS condition TEXT NOT NULL DEFAULT 'threshold'`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS sensitivity DOUBLE PRECISION NOT NULL DEFAULT 0`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS pattern TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS repeat_interval TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS factor DOUBLE PRECISION NOT NULL DEFAULT 0`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS compare_offset TEXT NOT NULL DEFAULT ''`,
+	// Notified alerts with their notifications and acknowledgement, see alerthistory.go.
+	`CREATE TABLE IF NOT EXISTS alert_history (
+		id BIGSERIAL PRIMARY KEY,
+		rule_id BIGINT NOT NULL,
+		rule TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		status TEXT NOT NULL,
+		starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		resolved_at TIMESTAMP WITH TIME ZONE,
+		event JSONB NOT NULL,
+		notifications JSONB NOT NULL DEFAULT '[]',
+		acknowledged_at TIMESTAMP WITH TIME ZONE,
+		acknowledged_by TEXT NOT NULL DEFAULT '',
+		ack_comment TEXT NOT NULL DEFAULT '',
+		UNIQUE (rule_id, starts_at)
+	)`,
+	`CREATE INDEX IF NOT EXISTS alert_history_starts_at_idx ON alert_history (starts_at)`,
+	// Maintenance windows muting alert notifications, see silences.go.
+	`CREATE TABLE IF NOT EXISTS alert_silences (
+		id SERIAL PRIMARY KEY,
+		matchers JSONB NOT NULL,
+		starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS saved_searches (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		filter JSONB NOT NULL DEFAULT '{}',
+		format TEXT NOT NULL DEFAULT 'ndjson',
+		columns TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS reports (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		schedule TEXT NOT NULL,
+		timezone TEXT NOT NULL DEFAULT '',
+		search_id INTEGER,
+		filter JSONB NOT NULL DEFAULT '{}',
+		channels JSONB NOT NULL DEFAULT '[]',
+		last_run_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	// Tenant of records ingested with a tenant key, see tenants.go.
+	`ALTER TABLE delogged ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_tenant_idx ON delogged (tenant) WHERE tenant <> ''`,
+	// Hashed API keys and their roles, see apikeys.go.
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		key_hash BYTEA NOT NULL UNIQUE,
+		roles TEXT[] NOT NULL,
+		hint TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`,
+	// Registered tenants, see tenants.go; those of keys made before the registry are
+	// registered as they are.
+	`CREATE TABLE IF NOT EXISTS tenants (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`INSERT INTO tenants (id) SELECT DISTINCT tenant FROM api_keys WHERE tenant <> '' ON CONFLICT DO NOTHING`,
+	`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP WITH TIME ZONE`,
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS overrides JSONB NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE source_activity ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`,
+	// Registered log sources and their hashed tokens, see sources.go; 0 is no source.
+	`CREATE TABLE IF NOT EXISTS sources (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		token_hash BYTEA NOT NULL UNIQUE,
+		format TEXT NOT NULL DEFAULT '',
+		parser TEXT NOT NULL DEFAULT '',
+		hint TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE delogged ADD COLUMN IF NOT EXISTS source_id INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS delogged_source_id_idx ON delogged (source_id) WHERE source_id <> 0`,
+	// Projects grouping sources, and the projects of sources and API keys, see projects.go.
+	`CREATE TABLE IF NOT EXISTS projects (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE sources ADD COLUMN IF NOT EXISTS project TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS project TEXT NOT NULL DEFAULT ''`,
+	// Retention of the records of tenants and sources, and the cleanup job's index, see
+	// retention.go.
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS retention TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sources ADD COLUMN IF NOT EXISTS retention TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS delogged_timestamp_idx ON delogged (timestamp)`,
+	// Usage by tenant and UTC day, and the months summarized, see usage.go.
+	`CREATE TABLE IF NOT EXISTS tenant_usage (
+		tenant TEXT NOT NULL,
+		day DATE NOT NULL,
+		records BIGINT NOT NULL DEFAULT 0,
+		entries BIGINT NOT NULL DEFAULT 0,
+		bytes BIGINT NOT NULL DEFAULT 0,
+		queries BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (tenant, day)
+	)`,
+	`CREATE INDEX IF NOT EXISTS tenant_usage_day_idx ON tenant_usage (day)`,
+	`CREATE TABLE IF NOT EXISTS usage_summaries (
+		month DATE PRIMARY KEY,
+		summarized_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	// Client address rules of the ingest and admin routes, see ipaccess.go.
+	`CREATE TABLE IF NOT EXISTS ip_access_rules (
+		id SERIAL PRIMARY KEY,
+		scope TEXT NOT NULL,
+		action TEXT NOT NULL,
+		cidr CIDR NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	// Rejected requests, see securityevents.go.
+	`CREATE TABLE IF NOT EXISTS security_events (
+		id BIGSERIAL PRIMARY KEY,
+		at TIMESTAMP WITH TIME ZONE NOT NULL,
+		kind TEXT NOT NULL,
+		remote_addr TEXT NOT NULL,
+		actor TEXT NOT NULL DEFAULT '',
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		request_id TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS security_events_at_idx ON security_events (at)`,
+	// Append-only record of admin operations, see audit.go.
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		at TIMESTAMP WITH TIME ZONE NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		request_id TEXT NOT NULL DEFAULT '',
+		before JSONB,
+		after JSONB
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_at_idx ON audit_log (at)`,
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END $$`,
+	`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log`,
+	`CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+}
+
 // setupDatabase initializes and sets up the PostgreSQL connection pool.
 func setupDatabase() {
 	var err error
 	
 	// Read connection parameters from environment variables
-	connStr := os.Getenv("DATABASE_URL")
+	connStr := databaseConnString()
 
-	// Use context for database setup
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	dbPool, err = pgxpool.New(ctx, connStr)
+	config, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
-		log.Fatalf("Unable to connect to database: %v", err)
+		fatalConfig("Invalid database settings", "err", err)
+	}
+	config.ConnConfig.Tracer = dbTracer{}
+	configurePool(config)
+	if password := secretEnv("POSTGRES_PASSWORD"); password != "" {
+		config.ConnConfig.Password = password
 	}
 
-	// Ping the database to ensure the connection is active
-	err = dbPool.Ping(ctx)
+	dbPool, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+		fatal("Unable to connect to database", "err", err)
+	}
+
+	// The database may still be starting, e.g. alongside the server in Docker Compose
+	if err = waitForDatabase(dbPool); err != nil {
+		fatal("Failed to ping database", "err", err)
 	}
 
-	log.Println("Successfully connected to PostgreSQL.")
+	slog.Info("Successfully connected to PostgreSQL", "host", config.ConnConfig.Host, "port", config.ConnConfig.Port,
+		"database", config.ConnConfig.Database, "tls", config.ConnConfig.TLSConfig != nil)
 
-	// Create table if it doesn't exist. Using JSONB for efficient JSON storage.
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS delogged (
-		id SERIAL PRIMARY KEY,
-		timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
-		remote_addr TEXT,
-		request_body TEXT,
-		response_body JSONB,
-		status_code INTEGER,
-		error_msg TEXT
-	);`
+	// Use context for database setup
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	_, err = dbPool.Exec(ctx, createTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+	// Create tables if they don't exist. Using JSONB for efficient JSON storage.
+	for _, stmt := range schemaStatements {
+		_, err = dbPool.Exec(ctx, stmt)
+		if err != nil {
+			fatal("Failed to create table", "err", err)
+		}
 	}
-	log.Println("Database table 'delogged' ready.")
+	slog.Info("Database schema ready")
 }
 
-// recordLog inserts a new record into the PostgreSQL database.
-func recordLog(record LogRecord) {
-	// Use context for database operation
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// recordLog enriches a record's entries and queues it to be stored with them, in the place
+// reserved by reserveRecord. ctx carries the request's trace; the record is stored even if
+// the client has gone away.
+func recordLog(ctx context.Context, record LogRecord) {
+	p := &pendingRecord{record: record}
+	if len(record.Entries) > 0 {
+		_, span := tracer.Start(ctx, "enrich entries")
+		source := sourceName(record.RemoteAddr)
+		p.entries = dedup.filter(repeats.collapse(sampleEntries(source, enrichEntries(record))))
+		span.SetAttributes(attribute.Int("delogger.entries", len(p.entries)))
+		if len(p.entries) > 0 && !enrichmentOff(record.Tenant, "reverse_dns") {
+			rdns.Load().annotate(p.entries)
+		}
+		span.End()
 
-	insertSQL := `
-	INSERT INTO delogged (timestamp, remote_addr, request_body, response_body, status_code, error_msg) 
-	VALUES ($1, $2, $3, $4, $5, $6)`
-
-	_, err := dbPool.Exec(ctx, insertSQL,
-		record.Timestamp,
-		record.RemoteAddr,
-		record.RequestBody,
-		record.ResponseBody,
-		record.StatusCode,
-		record.ErrorMsg,
-	)
-	if err != nil {
-		log.Printf("Failed to insert log record into PostgreSQL: %v", err)
+		if len(p.entries) > 0 && !enrichmentOff(record.Tenant, "templates") {
+			_, span = tracer.Start(ctx, "mine templates")
+			p.templates = miner.mine(p.entries)
+			p.issues = issueUpdates(p.entries, p.templates)
+			span.End()
+		}
 	}
+
+	// The record and its entries are written in the background, with those of concurrent
+	// requests.
+	p.ctx = context.WithoutCancel(ctx)
+	enqueueRecord(p)
+}
+
+// enrichEntries returns the entries of a record as they are stored, with the metadata of
+// the record and what is extracted from each line, before sampling and deduplication.
+func enrichEntries(record LogRecord) []StoredEntry {
+	geo := geoip.Load()
+	if enrichmentOff(record.Tenant, "geoip") {
+		geo = nil
+	}
+	correlation, traceContext := !enrichmentOff(record.Tenant, "correlation"), !enrichmentOff(record.Tenant, "trace_context")
+	source := sourceName(record.RemoteAddr)
+	stored := make([]StoredEntry, len(record.Entries))
+	for i, entry := range record.Entries {
+		stored[i] = StoredEntry{
+			ReceivedAt: record.Timestamp,
+			RemoteAddr: record.RemoteAddr,
+			StatusCode: record.StatusCode,
+			Host:       record.Host,
+			Service:    record.Service,
+			Env:        record.Env,
+			Tenant:     record.Tenant,
+			SourceID:   record.SourceID,
+			Fields:     record.Fields,
+			LineNo:     i + 1,
+			LogEntry:   entry,
+			Repeats:    1,
+			SampleRate: 1,
+		}
+		if correlation {
+			stored[i].CorrelationID = enrich.CorrelationID(entryLine(entry))
+		}
+		if traceContext {
+			stored[i].TraceID, stored[i].SpanID, stored[i].RequestID = enrich.TraceContext(entryLine(entry))
+		}
+		stored[i].Severity, stored[i].SeverityNumber = normalizeSeverity(entry.Level)
+		if t, ok := parseLogTime(entry.Timestamp, source); ok {
+			stored[i].LogTime = &t
+		}
+		stored[i].Fingerprint = entryFingerprint(stored[i])
+		geo.enrich(&stored[i])
+	}
+	return stored
+}
+
+// parseEachLine parses each non-blank line with the first parser that recognises it, into
+// a pooled slice.
+func parseEachLine(p parser.Parser, lines []string) []LogEntry {
+	parsedData := p.AppendLines(getEntries(len(lines)), lines)
+	if len(parsedData) == 0 {
+		putEntries(parsedData)
+		return nil
+	}
+	return parsedData
 }
 
 // parseHandler handles the /api/parse endpoint.
 func parseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dry_run") == "true" {
+		if disabled["preview"] {
+			http.NotFound(w, r)
+			return
+		}
+		previewHandler(w, r)
+		return
+	}
 	record := LogRecord{
 		Timestamp:  time.Now(),
 		RemoteAddr: r.RemoteAddr,
 		StatusCode: http.StatusOK,
+		Host:       sourceHeader(r, "X-DeLogger-Host"),
+		Service:    sourceHeader(r, "X-DeLogger-Service"),
+		Env:        sourceHeader(r, "X-DeLogger-Env"),
+		Redactions: map[string]int{},
+		Fields:     sourceFields(sourceName(r.RemoteAddr)),
+	}
+	if id := clientCertIdentity(r); id != "" {
+		record.Host = id
+	}
+	record.Tenant = requestTenant(r.Context())
+	record.SourceID = requestSource(r.Context()).ID
+	if !reserveRecord() {
+		refuseQueueFull(w, r)
+		return
 	}
 	
 	// Use a named function for defer to ensure the correct record is captured
 	defer func() {
-		recordLog(record)
+		ctx, span := tracer.Start(r.Context(), "store record")
+		recordLog(ctx, record)
+		span.End()
+		putEntries(record.Entries)
 	}()
 
-	log.Printf("Received request from %s for %s %s", r.RemoteAddr, r.Method, r.URL.Path)
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		record.StatusCode = http.StatusMethodNotAllowed
 		record.ErrorMsg = "Method not allowed"
-		log.Printf("Rejected request from %s: Method %s not allowed", r.RemoteAddr, r.Method)
+		slog.WarnContext(r.Context(), "Rejected request: method not allowed", "method", r.Method)
 		return
 	}
 
 	// Read the request body.
-	body, err := io.ReadAll(r.Body)
+	_, span := tracer.Start(r.Context(), "read body")
+	body, err := readPayload(r.Body)
+	if err == nil {
+		defer body.close()
+		span.SetAttributes(attribute.Int64("delogger.bytes", body.size), attribute.Bool("delogger.spilled", body.spilled()))
+	}
+	span.End()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Payload too large: the limit is "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		record.StatusCode = http.StatusRequestEntityTooLarge
+		record.ErrorMsg = "Payload too large"
+		slog.WarnContext(r.Context(), "Rejected request: payload too large", "limit", tooLarge.Limit)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Could not read request body", http.StatusInternalServerError)
 		record.StatusCode = http.StatusInternalServerError
 		record.ErrorMsg = "Could not read request body"
-		log.Printf("Error reading request body from %s: %v", r.RemoteAddr, err)
+		slog.ErrorContext(r.Context(), "Error reading request body", "err", err)
 		return
 	}
-	logText := string(body)
-	record.RequestBody = logText
+	// A payload held in memory is redacted whole, so the redactions are known before any
+	// entry is sent. A spilled one is redacted as it is parsed, and reports them in a trailer.
+	rd, source := requestRedactor(r.Context()), sourceName(r.RemoteAddr)
+	if body.spilled() {
+		w.Header().Set("Trailer", "X-DeLogger-Redactions")
+	} else {
+		_, span = tracer.Start(r.Context(), "redact")
+		record.RequestBody, record.Redactions = body.redact(rd, source)
+		span.End()
+		reportRedactions(w, r, record.Redactions)
+	}
+
+	slog.DebugContext(r.Context(), "Received log data", "bytes", body.size)
 
-	log.Printf("Received log data of size %d bytes", len(logText))
+	// The entries are sent as they are parsed, so large payloads don't wait for the whole
+	// response to be encoded.
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	record.responseBuf = getJSONBuffer()
+	stream := newEntryStream(w, record.responseBuf)
 
-	// Parsing Logic (Unchanged)
-	lines := strings.Split(logText, "\n")
-	logRegex := regexp.MustCompile(`^\[(.*?)\]\s+\[(.*?)\]\s+(.*)$`)
+	_, span = tracer.Start(r.Context(), "parse lines")
+	p := requestParser(r.Context())
 	var parsedData []LogEntry
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" { continue }
-		match := logRegex.FindStringSubmatch(line)
-		if len(match) == 4 {
-			parsedData = append(parsedData, LogEntry{ Timestamp: match[1], Level: match[2], Message: match[3]})
-		} else {
-			parsedData = append(parsedData, LogEntry{ Raw: line })
+	var parseTime time.Duration
+	parseText := func(text string) {
+		start, sending := time.Now(), stream.elapsed
+		entries := parseLinesFunc(p, text, stream.write)
+		parseTime += time.Since(start) - (stream.elapsed - sending)
+		parsedData = appendEntries(parsedData, entries)
+	}
+	if body.spilled() {
+		var redactions map[string]int
+		redactions, err = body.redactChunks(rd, source, func(text string) {
+			record.requestChunks = append(record.requestChunks, text)
+			parseText(text)
+		})
+		if err == nil {
+			record.Redactions = redactions
 		}
+	} else {
+		parseText(record.RequestBody)
+	}
+	span.SetAttributes(attribute.Int("delogger.entries", len(parsedData)))
+	span.End()
+	if err != nil {
+		putEntries(parsedData)
+		record.requestChunks = nil
+		if !stream.started() {
+			http.Error(w, "Could not read request body", http.StatusInternalServerError)
+		}
+		record.StatusCode = http.StatusInternalServerError
+		record.ErrorMsg = "Could not read request body"
+		slog.ErrorContext(r.Context(), "Error reading spilled request body", "err", err)
+		return
+	}
+	if body.spilled() {
+		reportRedactions(w, r, record.Redactions)
 	}
 
-	// Marshal the JSON response to save it to the database record.
-	responseBody, err := json.Marshal(parsedData)
+	ingest.record(record.Service, int(body.size), parsedData, parseTime)
+
+	// Keep the JSON response to save it to the database record.
+	responseBody, err := stream.close()
 	if err != nil {
-		http.Error(w, "Error creating JSON response", http.StatusInternalServerError)
+		// Once entries are sent, the client can only be left with a truncated response.
+		if !stream.started() {
+			http.Error(w, "Error creating JSON response", http.StatusInternalServerError)
+		}
 		record.StatusCode = http.StatusInternalServerError
 		record.ErrorMsg = "Error creating JSON response"
-		log.Printf("Error marshaling JSON response for %s: %v", r.RemoteAddr, err)
+		slog.ErrorContext(r.Context(), "Error marshaling JSON response", "err", err)
 		return
 	}
 	record.ResponseBody = responseBody // Store the raw byte slice
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	record.Entries = parsedData
+	if stream.writeErr != nil {
+		slog.ErrorContext(r.Context(), "Error writing JSON response", "err", stream.writeErr)
+	}
 
-	// Write the JSON response to the client.
-	_, err = w.Write(responseBody)
-	if err != nil {
-		log.Printf("Error writing JSON response for %s: %v", r.RemoteAddr, err)
+	slog.InfoContext(r.Context(), "Parsed log data", "entries", len(parsedData))
+}
+
+// reportRedactions sets the X-DeLogger-Redactions header of a response to counts, if any
+// text was redacted, and logs them.
+func reportRedactions(w http.ResponseWriter, r *http.Request, counts map[string]int) {
+	if len(counts) > 0 {
+		w.Header().Set("X-DeLogger-Redactions", redactionReport(counts))
+		slog.InfoContext(r.Context(), "Redacted request", "redactions", redactionReport(counts))
 	}
+}
+
+// maxSourceHeaderLength bounds the X-DeLogger-* source metadata values.
+const maxSourceHeaderLength = 255
 
-	log.Printf("Successfully parsed and sent JSON response for request from %s", r.RemoteAddr)
+// sourceHeader returns a source metadata header of the request, trimmed and truncated.
+func sourceHeader(r *http.Request, name string) string {
+	v := strings.TrimSpace(r.Header.Get(name))
+	if len(v) > maxSourceHeaderLength {
+		v = strings.ToValidUTF8(v[:maxSourceHeaderLength], "")
+	}
+	return v
 }
 
 // main function to set up the server.
 func main() {
-	setupDatabase()
+	runCommand(os.Args[1:])
+}
+
+// serve runs the server, the default command.
+func serve(args []string) {
+	fs := newCommandFlags("serve", "[flags]")
+	fs.Usage = nil // list every setting
+	if rest := loadConfig(fs, args); len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "delogger serve: unexpected arguments %q\n", rest)
+		os.Exit(exitUsage)
+	}
+	setupLogging()
+	logConfig()
+	setupLifecycle()
+	setupTracing()
+	setupAuth()
+	setupSigning()
+	setupEncryption()
+	setupLimits()
+	setupServerLimits()
+	setupSpill()
+	setupArchives()
+	setupFeatures()
+	setupParsing()
+	setupStorage()
+	setupRecordWriter()
+	setupSources()
+	setupRetention()
+	setupUsage()
+	setupRowSecurity()
+	loadSourceTimezones()
+	loadSourceSampling()
+	loadIPAnonymization()
+	if !inMemory() {
+		loadSeverityAliases()
+		loadStaticFields()
+		loadIPAccessRules()
+		loadTenants()
+		loadProjects()
+		loadAPIKeys()
+		loadSources()
+		if !disabled["templates"] {
+			loadTemplates()
+		}
+	}
+	setupDedup()
+	setupRepeats()
+	setupRedaction()
+	setupGeoIP()
+	setupReverseDNS()
+	setupSMTP()
+	if !inMemory() {
+		setupAlerts()
+		setupReports()
+		startSecurityEvents()
+		startRetention()
+		startUsage()
+		startRowSecurity()
+		startAuthSync()
+	}
+	startSelfIngestion()
+	reloadOnHangup()
 	
-	log.Println("Starting Go log parser backend...")
-	log.Println("Backend service available at port 8007.")
+	slog.Info("Starting Go log parser backend")
 
-	http.HandleFunc("/api/parse", parseHandler)
-	log.Fatal(http.ListenAndServe(":8007", nil))
+	api, admin := http.DefaultServeMux, http.DefaultServeMux
+	if setting("ADMIN_ADDR") != "" {
+		admin = http.NewServeMux()
+	}
+	registerRoutes(api, admin)
+	tlsConfig := serverTLSConfig()
+	apiServer, adminServer := newServer(withRequestLog(api.ServeHTTP)), newServer(withRequestLog(admin.ServeHTTP))
+	apiServer.TLSConfig, adminServer.TLSConfig = tlsConfig, tlsConfig.Clone()
+	served := serverListeners(apiServer, adminServer)
+	for _, s := range served {
+		slog.Info("Backend service available", "addr", s.Addr().String(), "network", s.Addr().Network(),
+			"management", s.server == adminServer)
+	}
+	runServer(served)
 }
\ No newline at end of file
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /metrics exposes the in-process counters and histograms and the database pool statistics
+// in the Prometheus text format, for scraping; /api/stats and /api/debug/db report the same
+// numbers as JSON.
+
+// histogram counts observations in buckets with fixed upper bounds, as in Prometheus.
+type histogram struct {
+	bounds []float64 // ascending upper bounds; a last, implicit bucket is +Inf
+
+	mu     sync.Mutex
+	counts []int64 // per bucket, not cumulative
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// observe records one value.
+func (h *histogram) observe(v float64) {
+	i := len(h.bounds)
+	for j, b := range h.bounds {
+		if v <= b {
+			i = j
+			break
+		}
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// HistogramStats is a histogram's state. Buckets are cumulative; Count includes the
+// observations above the last bound.
+type HistogramStats struct {
+	Count   int64             `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket counts the observations less than or equal to LE.
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+func (h *histogram) snapshot() HistogramStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := HistogramStats{Sum: h.sum, Buckets: make([]HistogramBucket, len(h.bounds))}
+	for i, b := range h.bounds {
+		s.Count += h.counts[i]
+		s.Buckets[i] = HistogramBucket{LE: b, Count: s.Count}
+	}
+	s.Count += h.counts[len(h.bounds)]
+	return s
+}
+
+// metricsWriter writes metric families in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// header writes the HELP and TYPE lines of a metric family.
+func (m metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// value writes a counter or gauge without labels.
+func (m metricsWriter) value(name, typ, help string, v float64) {
+	m.header(name, typ, help)
+	fmt.Fprintf(m.w, "%s %s\n", name, formatMetric(v))
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes one value of a family with labels, given as name and value pairs, after
+// its header.
+func (m metricsWriter) sample(name string, v float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	fmt.Fprintf(m.w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatMetric(v))
+}
+
+// histogram writes a histogram family.
+func (m metricsWriter) histogram(name, help string, s HistogramStats) {
+	m.header(name, "histogram", help)
+	for _, b := range s.Buckets {
+		fmt.Fprintf(m.w, "%s_bucket{le=%q} %d\n", name, formatMetric(b.LE), b.Count)
+	}
+	fmt.Fprintf(m.w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, s.Count, name, formatMetric(s.Sum), name, s.Count)
+}
+
+func formatMetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler handles GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := metricsWriter{w}
+
+	m.value("delogger_start_time_seconds", "gauge", "Time the process started, in seconds since the epoch.",
+		float64(ingest.startedAt.UnixNano())/float64(time.Second))
+	m.value("delogger_ingest_requests_total", "counter", "Parse requests received.", float64(ingest.requests.Load()))
+	m.value("delogger_ingest_bytes_total", "counter", "Bytes of log text received.", float64(ingest.bytes.Load()))
+	m.value("delogger_ingest_lines_parsed_total", "counter", "Lines matched by a parser.", float64(ingest.linesParsed.Load()))
+	m.value("delogger_ingest_lines_unmatched_total", "counter", "Lines stored raw because no parser matched.", float64(ingest.linesUnmatched.Load()))
+	m.value("delogger_ingest_duplicates_dropped_total", "counter", "Entries dropped as duplicates.", float64(ingest.duplicatesDropped.Load()))
+	m.value("delogger_ingest_sampled_out_total", "counter", "Entries discarded by a sampling policy.", float64(ingest.entriesSampledOut.Load()))
+	m.value("delogger_ingest_repeats_collapsed_total", "counter", "Repeated lines collapsed into a previous entry.", float64(ingest.repeatsCollapsed.Load()))
+
+	m.header("delogger_ingest_parser_lines_total", "counter", "Lines by service and the parser that matched them; parser raw counts unrecognised lines.")
+	for _, p := range ingest.parsers() {
+		for _, parser := range slices.Sorted(maps.Keys(p.Lines)) {
+			m.sample("delogger_ingest_parser_lines_total", float64(p.Lines[parser]), "service", p.Service, "parser", parser)
+		}
+	}
+
+	d := ingest.distributions()
+	m.histogram("delogger_ingest_payload_bytes", "Size of parse request payloads.", d.PayloadBytes)
+	m.histogram("delogger_ingest_lines", "Lines per parse request.", d.Lines)
+	m.histogram("delogger_ingest_parse_seconds_per_line", "Parse time per line of a request.", d.ParseSecondsPerLine)
+	m.histogram("delogger_ingest_duration_seconds", "Time from receiving a parse request to storing its entries.", d.DurationSeconds)
+
+	m.value("delogger_regex_cache_hits_total", "counter", "Searches whose regex was already compiled.", float64(searchRegexes.hits.Load()))
+	m.value("delogger_regex_cache_misses_total", "counter", "Searches whose regex had to be compiled.", float64(searchRegexes.misses.Load()))
+
+	if !inMemory() {
+		writeDBPoolMetrics(m)
+	}
+	writeRecordWriterMetrics(m)
+	writeSecurityEventMetrics(m)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notifier delivers alert events to one type of channel.
+type notifier interface {
+	// validate checks the channel's settings when a rule is loaded.
+	validate(c AlertChannel) error
+	// notify sends one event.
+	notify(ctx context.Context, c AlertChannel, event AlertEvent) error
+}
+
+// notifiers maps AlertChannel.Type to its notifier.
+var notifiers = map[string]notifier{
+	"webhook":      webhookNotifier{},
+	"slack":        slackNotifier{},
+	"email":        emailNotifier{},
+	"pagerduty":    pagerDutyNotifier{},
+	"alertmanager": alertmanagerNotifier{},
+	"teams":        teamsNotifier{},
+	"discord":      discordNotifier{},
+}
+
+// notifyClient sends notifications; a slow endpoint must not hold up the evaluation loop.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// NotificationResult is the outcome of sending an event to one channel.
+type NotificationResult struct {
+	Channel string `json:"channel"` // the channel type
+	Error   string `json:"error,omitempty"`
+}
+
+// notifyChannels sends event to every channel, logging failures, and returns the result
+// of each.
+func notifyChannels(ctx context.Context, channels []AlertChannel, event AlertEvent) []NotificationResult {
+	results := make([]NotificationResult, len(channels))
+	for i, c := range channels {
+		results[i].Channel = c.Type
+		if err := notifiers[c.Type].notify(ctx, c, event); err != nil {
+			slog.ErrorContext(ctx, "Error sending alert", "rule", event.Rule, "channel", c.Type, "err", err)
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
+
+// webhookNotifier POSTs the event as JSON to the channel URL, with the channel headers.
+type webhookNotifier struct{}
+
+func (webhookNotifier) validate(c AlertChannel) error {
+	return validateHTTPURL(c.URL)
+}
+
+func (webhookNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	return postJSON(ctx, c.URL, c.Headers, event)
+}
+
+// Message templates are text/template templates executed with the AlertEvent, e.g.
+//
+//	{{.Rule}} is {{.Status}}: {{.Count}} entries in {{.Window}}
+//
+// They can call slackEscape to escape text for Slack's mrkdwn.
+var messageTemplateFuncs = template.FuncMap{"slackEscape": slackEscape}
+
+// parseMessageTemplate parses text, or def if text is empty.
+func parseMessageTemplate(text, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+	return template.New("message").Funcs(messageTemplateFuncs).Parse(text)
+}
+
+// renderMessage executes the channel's template, or def, with data: an AlertEvent, or a
+// ReportSummary for scheduled reports.
+func renderMessage(c AlertChannel, def string, data any) (string, error) {
+	t, err := parseMessageTemplate(c.Template, def)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// slackAPIURL is the Web API method used with bot tokens.
+const slackAPIURL = "https://slack.com/api/chat.postMessage"
+
+// defaultSlackTemplate lists the sample lines in a code block and links to the query.
+const defaultSlackTemplate = `{{if eq .Status "firing"}}:rotating_light:{{else}}:white_check_mark:{{end}} *{{slackEscape .Rule}}* is {{.Status}}: {{.Summary}}
+{{- if .Samples}}
+` + "```" + `
+{{range .Samples}}{{slackEscape .}}
+{{end}}` + "```" + `
+{{- end}}
+{{- if .QueryURL}}
+<{{.QueryURL}}|View matching entries>
+{{- end}}`
+
+// slackNotifier posts to an incoming webhook URL, or with a bot token to Channel through
+// chat.postMessage.
+type slackNotifier struct{}
+
+func (slackNotifier) validate(c AlertChannel) error {
+	switch {
+	case c.URL != "" && c.Token != "":
+		return errors.New("set either url or token, not both")
+	case c.URL != "":
+		return validateHTTPURL(c.URL)
+	case c.Token == "":
+		return errors.New("url or token is required")
+	case c.Channel == "":
+		return errors.New("channel is required with a token")
+	}
+	return nil
+}
+
+func (slackNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	text, err := renderMessage(c, defaultSlackTemplate, event)
+	if err != nil {
+		return err
+	}
+	return postSlack(ctx, c, text)
+}
+
+// postSlack sends text to the channel's webhook URL, or through chat.postMessage.
+func postSlack(ctx context.Context, c AlertChannel, text string) error {
+	if c.URL != "" {
+		return postJSON(ctx, c.URL, nil, map[string]string{"text": text})
+	}
+
+	// chat.postMessage reports failures in the body with a 200 status.
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	err := postJSONResult(ctx, slackAPIURL, map[string]string{"Authorization": "Bearer " + c.Token},
+		map[string]string{"channel": c.Channel, "text": text}, &result)
+	if err == nil && !result.OK {
+		err = fmt.Errorf("slack: %s", result.Error)
+	}
+	return err
+}
+
+// slackEscape escapes the characters Slack treats as markup in message text.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutySeverities are the severities PagerDuty accepts.
+var pagerDutySeverities = []string{"critical", "error", "warning", "info"}
+
+// pagerDutyNotifier triggers an incident when a rule fires and resolves it when the rule
+// resolves. The dedup key is derived from the rule name, so repeated triggers update the
+// open incident instead of opening new ones.
+type pagerDutyNotifier struct{}
+
+func (pagerDutyNotifier) validate(c AlertChannel) error {
+	if c.RoutingKey == "" {
+		return errors.New("routing_key is required")
+	}
+	if c.Severity != "" && !slices.Contains(pagerDutySeverities, c.Severity) {
+		return fmt.Errorf("severity must be one of %s", strings.Join(pagerDutySeverities, ", "))
+	}
+	return nil
+}
+
+func (pagerDutyNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	type link struct {
+		Href string `json:"href"`
+		Text string `json:"text"`
+	}
+	type payload struct {
+		Summary       string     `json:"summary"`
+		Source        string     `json:"source"`
+		Severity      string     `json:"severity"`
+		Timestamp     time.Time  `json:"timestamp"`
+		CustomDetails AlertEvent `json:"custom_details"`
+	}
+	body := struct {
+		RoutingKey  string   `json:"routing_key"`
+		EventAction string   `json:"event_action"`
+		DedupKey    string   `json:"dedup_key"`
+		Payload     *payload `json:"payload,omitempty"`
+		Links       []link   `json:"links,omitempty"`
+	}{
+		RoutingKey:  c.RoutingKey,
+		EventAction: "resolve",
+		DedupKey:    pagerDutyDedupKey(event.Rule),
+	}
+
+	if event.Status == "firing" {
+		severity := c.Severity
+		if severity == "" {
+			severity = "error"
+		}
+		summary, err := renderMessage(c, `{{.Rule}}: {{.Summary}}`, event)
+		if err != nil {
+			return err
+		}
+		if len(summary) > 1024 {
+			summary = summary[:1024]
+		}
+		body.EventAction = "trigger"
+		body.Payload = &payload{Summary: summary, Source: "delogger", Severity: severity, Timestamp: event.EvaluatedAt, CustomDetails: event}
+		if event.QueryURL != "" {
+			body.Links = []link{{Href: event.QueryURL, Text: "Matching entries"}}
+		}
+	}
+	return postJSON(ctx, pagerDutyEventsURL, nil, body)
+}
+
+// pagerDutyDedupKey returns the incident key of a rule, within PagerDuty's 255 byte limit.
+func pagerDutyDedupKey(rule string) string {
+	key := "delogger/" + rule
+	if len(key) > 255 {
+		sum := sha256.Sum256([]byte(rule))
+		key = "delogger/" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// alertmanagerLabels are the filter keys copied into Alertmanager labels, so its routes
+// and silences can match on them.
+var alertmanagerLabels = []string{"host", "service", "env", "level"}
+
+// alertmanagerNotifier posts the event to an Alertmanager's v2 API, given its base URL,
+// as an alert named after the rule. Alertmanager resolves alerts that are not posted again
+// within its resolve_timeout (5m by default), so rules notifying it should set a shorter
+// repeat_interval to stay firing. Headers are sent as with webhooks, e.g. for a proxy's
+// Authorization.
+type alertmanagerNotifier struct{}
+
+func (alertmanagerNotifier) validate(c AlertChannel) error {
+	return validateHTTPURL(c.URL)
+}
+
+func (alertmanagerNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	summary, err := renderMessage(c, `{{.Summary}}`, event)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{"alertname": event.Rule, "source": "delogger"}
+	if c.Severity != "" {
+		labels["severity"] = c.Severity
+	}
+	for _, k := range alertmanagerLabels {
+		if v := event.Filter[k]; v != "" {
+			labels[k] = v
+		}
+	}
+	annotations := map[string]string{"summary": summary}
+	if len(event.Samples) > 0 {
+		annotations["description"] = strings.Join(event.Samples, "\n")
+	}
+
+	alert := struct {
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		EndsAt       *time.Time        `json:"endsAt,omitempty"`
+		GeneratorURL string            `json:"generatorURL,omitempty"`
+	}{
+		Labels:       labels,
+		Annotations:  annotations,
+		StartsAt:     event.StartsAt,
+		GeneratorURL: event.QueryURL,
+	}
+	if event.Status != "firing" {
+		alert.EndsAt = &event.EvaluatedAt
+	}
+
+	target := strings.TrimRight(c.URL, "/")
+	if !strings.HasSuffix(target, "/api/v2/alerts") {
+		target += "/api/v2/alerts"
+	}
+	return postJSON(ctx, target, c.Headers, []any{alert})
+}
+
+// defaultChatTemplate is the message body of Teams and Discord notifications; the rule,
+// status and links are shown by the card or embed around it.
+const defaultChatTemplate = `{{.Summary}}`
+
+// teamsNotifier posts an Adaptive Card to a Teams incoming webhook or workflow URL.
+type teamsNotifier struct{}
+
+func (teamsNotifier) validate(c AlertChannel) error {
+	return validateHTTPURL(c.URL)
+}
+
+func (teamsNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	text, err := renderMessage(c, defaultChatTemplate, event)
+	if err != nil {
+		return err
+	}
+
+	color, icon := "attention", "🚨"
+	if event.Status != "firing" {
+		color, icon = "good", "✅"
+	}
+	body := []map[string]any{
+		{"type": "TextBlock", "text": icon + " " + event.Rule + " is " + event.Status, "size": "Medium", "weight": "Bolder", "color": color, "wrap": true},
+		{"type": "TextBlock", "text": text, "wrap": true},
+		{"type": "FactSet", "facts": []map[string]string{
+			{"title": "Window", "value": event.Window},
+			{"title": "Started", "value": event.StartsAt.UTC().Format(time.RFC3339)},
+		}},
+	}
+	if len(event.Samples) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": strings.Join(event.Samples, "\n\n"), "fontType": "Monospace", "wrap": true, "isSubtle": true})
+	}
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if event.QueryURL != "" {
+		card["actions"] = []map[string]string{{"type": "Action.OpenUrl", "title": "View matching entries", "url": event.QueryURL}}
+	}
+	return postJSON(ctx, c.URL, nil, map[string]any{
+		"type":        "message",
+		"attachments": []map[string]any{{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}},
+	})
+}
+
+// Discord embed limits.
+const (
+	discordTitleLimit       = 256
+	discordDescriptionLimit = 4096
+)
+
+// discordNotifier posts an embed to a Discord webhook, red while firing and green when resolved.
+type discordNotifier struct{}
+
+func (discordNotifier) validate(c AlertChannel) error {
+	return validateHTTPURL(c.URL)
+}
+
+func (discordNotifier) notify(ctx context.Context, c AlertChannel, event AlertEvent) error {
+	text, err := renderMessage(c, defaultChatTemplate, event)
+	if err != nil {
+		return err
+	}
+	if len(event.Samples) > 0 {
+		text += "\n```\n" + strings.ReplaceAll(strings.Join(event.Samples, "\n"), "```", "'''") + "\n```"
+	}
+
+	color := 0xE01E5A
+	if event.Status != "firing" {
+		color = 0x2EB67D
+	}
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	embed := struct {
+		Title       string    `json:"title"`
+		Description string    `json:"description"`
+		URL         string    `json:"url,omitempty"`
+		Color       int       `json:"color"`
+		Fields      []field   `json:"fields"`
+		Timestamp   time.Time `json:"timestamp"`
+	}{
+		Title:       truncateText(event.Rule+" is "+event.Status, discordTitleLimit),
+		Description: truncateText(text, discordDescriptionLimit),
+		URL:         event.QueryURL,
+		Color:       color,
+		Fields:      []field{{Name: "Window", Value: event.Window, Inline: true}, {Name: "Started", Value: "<t:" + strconv.FormatInt(event.StartsAt.Unix(), 10) + ":R>", Inline: true}},
+		Timestamp:   event.EvaluatedAt,
+	}
+	return postJSON(ctx, c.URL, nil, map[string]any{"username": "DeLogger", "embeds": []any{embed}})
+}
+
+// truncateText cuts s to at most limit characters, marking the cut with an ellipsis.
+func truncateText(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit-1]) + "…"
+}
+
+// validateHTTPURL checks that s is an absolute http or https URL.
+func validateHTTPURL(s string) error {
+	if s == "" {
+		return errors.New("url is required")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// postJSON POSTs v as JSON to target and fails unless the response status is 2xx.
+func postJSON(ctx context.Context, target string, headers map[string]string, v any) error {
+	return postJSONResult(ctx, target, headers, v, nil)
+}
+
+// postJSONResult is postJSON, decoding the response body into result if it is not nil.
+func postJSONResult(ctx context.Context, target string, headers map[string]string, v, result any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
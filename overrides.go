@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"delogger/parser"
+)
+
+// A tenant can change how its payloads are ingested, without affecting the others, with
+// the overrides of its record, set with PUT /api/tenants/{id}:
+//
+//	disable_parsers      built-in formats its lines aren't tried against, besides those of
+//	                     DISABLE_PARSERS and of its source
+//	disable_enrichments  enrichments skipped for its entries, besides DISABLE_ENRICHMENTS:
+//	                     correlation, trace_context, templates, geoip or reverse_dns
+//	redact               built-in redaction rules applied besides those of the settings:
+//	                     email, credit_card, ssn, phone, or all
+//	redact_patterns      custom redaction rules by name, each a regex, applied after those
+//	                     of PII_REDACT_PATTERNS
+//
+// Overrides only add to the deployment's settings, so a tenant can't turn on a parser or
+// enrichment switched off for the server, nor lift its redaction. They apply to payloads
+// ingested with the tenant's keys.
+
+// TenantOverrides change how the payloads of a tenant are ingested.
+type TenantOverrides struct {
+	DisableParsers     []string          `json:"disable_parsers,omitempty"`
+	DisableEnrichments []string          `json:"disable_enrichments,omitempty"`
+	Redact             []string          `json:"redact,omitempty"`
+	RedactPatterns     map[string]string `json:"redact_patterns,omitempty"`
+
+	redaction []redactionRule
+}
+
+// prepare checks o and compiles its redaction rules.
+func (o *TenantOverrides) prepare() error {
+	// Checked by the parser itself, so requestParser can't be refused what was saved.
+	if _, err := parser.Without(o.DisableParsers...); err != nil {
+		return fmt.Errorf("disable_parsers: %w", err)
+	}
+	for _, name := range o.DisableEnrichments {
+		if !slices.Contains(enrichments, name) {
+			return errors.New("disable_enrichments must be among " + strings.Join(enrichments, ", "))
+		}
+	}
+	var err error
+	if o.redaction, err = builtinRedaction(o.Redact); err != nil {
+		return fmt.Errorf("redact: %w", err)
+	}
+	names := make([]string, 0, len(o.RedactPatterns))
+	for name := range o.RedactPatterns {
+		names = append(names, name)
+	}
+	slices.Sort(names) // applied in a stable order
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("redact_patterns: invalid rule name %q", name)
+		}
+		re, err := regexp.Compile(o.RedactPatterns[name])
+		if err != nil {
+			return fmt.Errorf("redact_patterns: %s: %v", name, err)
+		}
+		o.redaction = append(o.redaction, redactionRule{name: name, re: re})
+	}
+	return nil
+}
+
+// tenantOverrides returns the overrides of tenant, none for "".
+func tenantOverrides(tenant string) TenantOverrides {
+	if tenant == "" {
+		return TenantOverrides{}
+	}
+	tenants.RLock()
+	defer tenants.RUnlock()
+	return tenants.byID[tenant].Overrides
+}
+
+// enrichmentOff reports whether enrichment name is skipped for the entries of tenant.
+func enrichmentOff(tenant, name string) bool {
+	return disabled[name] || slices.Contains(tenantOverrides(tenant).DisableEnrichments, name)
+}
+
+// requestRedactor returns the redactor of an ingest request: that of the settings, with
+// the rules of the caller's tenant after its own.
+func requestRedactor(ctx context.Context) *redactor {
+	r := redaction.Load()
+	extra := tenantOverrides(requestTenant(ctx)).redaction
+	if len(extra) == 0 {
+		return r
+	}
+	var rules []redactionRule
+	if r != nil {
+		rules = r.rules
+	}
+	return &redactor{rules: slices.Concat(rules, extra)}
+}
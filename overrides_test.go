@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// withTenants registers list in the tenants registry for the duration of the test,
+// without preparing their overrides.
+func withTenants(t *testing.T, list ...Tenant) {
+	t.Helper()
+	tenants.Lock()
+	saved := tenants.byID
+	tenants.byID = map[string]Tenant{}
+	for _, tenant := range list {
+		tenants.byID[tenant.ID] = tenant
+	}
+	tenants.Unlock()
+	t.Cleanup(func() {
+		tenants.Lock()
+		tenants.byID = saved
+		tenants.Unlock()
+	})
+}
+
+func TestTenantOverridesPrepare(t *testing.T) {
+	tests := []struct {
+		overrides TenantOverrides
+		err       string // "" if valid
+	}{
+		{TenantOverrides{}, ""},
+		{TenantOverrides{DisableParsers: []string{"bracketed", "access"}}, ""},
+		{TenantOverrides{DisableParsers: []string{"json"}}, `disable_parsers: unknown format "json"`},
+		{TenantOverrides{DisableParsers: []string{"raw"}}, "disable_parsers: the raw format can't be left out"},
+		{TenantOverrides{DisableEnrichments: []string{"geoip", "templates"}}, ""},
+		{TenantOverrides{DisableEnrichments: []string{"spelling"}}, "disable_enrichments must be among"},
+		{TenantOverrides{Redact: []string{"email"}}, ""},
+		{TenantOverrides{Redact: []string{"passport"}}, `redact: unknown redaction rule "passport"`},
+		{TenantOverrides{RedactPatterns: map[string]string{"order": `ORD-\d+`}}, ""},
+		{TenantOverrides{RedactPatterns: map[string]string{"order": `ORD-(`}}, "redact_patterns: order:"},
+		{TenantOverrides{RedactPatterns: map[string]string{"an order": `ORD`}}, "redact_patterns: invalid rule name"},
+	}
+	for _, tt := range tests {
+		err := tt.overrides.prepare()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%+v: got error %v, want %q", tt.overrides, err, tt.err)
+		}
+	}
+}
+
+func TestRequestParser(t *testing.T) {
+	withTenants(t,
+		Tenant{ID: "plain"},
+		Tenant{ID: "no-bracketed", Overrides: TenantOverrides{DisableParsers: []string{"bracketed"}}},
+		// Saved before a format was removed, or written to the table by hand.
+		Tenant{ID: "broken", Overrides: TenantOverrides{DisableParsers: []string{"json"}}},
+	)
+	const (
+		bracketed = "[t] [ERROR] boom"
+		access    = `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /x HTTP/1.0" 200 1`
+	)
+	accessOnly := Source{Name: "nginx", Parser: "access"}
+	if err := accessOnly.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tenant string
+		source Source
+		want   [2]string // the formats of bracketed and access
+	}{
+		{"", Source{}, [2]string{"bracketed", "access"}},
+		{"plain", Source{}, [2]string{"bracketed", "access"}},
+		{"no-bracketed", Source{}, [2]string{"raw", "access"}},
+		{"", accessOnly, [2]string{"raw", "access"}},
+		{"broken", Source{}, [2]string{"bracketed", "access"}},
+		// An invalid override keeps the source's parser rather than trying every format.
+		{"broken", accessOnly, [2]string{"raw", "access"}},
+	}
+	for _, tt := range tests {
+		ctx := context.WithValue(context.Background(), principalKey{}, principal{tenant: tt.tenant})
+		ctx = context.WithValue(ctx, sourceKey{}, tt.source)
+		p := requestParser(ctx)
+		got := [2]string{p.ParseLine(bracketed).Name(), p.ParseLine(access).Name()}
+		if got != tt.want {
+			t.Errorf("tenant %q, source %q: got %v, want %v", tt.tenant, tt.source.Name, got, tt.want)
+		}
+	}
+}
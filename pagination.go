@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"delogger/storage"
+)
+
+// pageCursor marks the last row of a page. List endpoints order by a unique key
+// (a timestamp or name, tie-broken by id), so the next page starts strictly after it.
+type pageCursor struct {
+	Time *time.Time `json:"t,omitempty"`
+	Key  string     `json:"k,omitempty"`
+	ID   int64      `json:"id"`
+}
+
+// encode returns the cursor as an opaque URL-safe token.
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a token produced by pageCursor.encode.
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID <= 0 {
+		return c, errors.New("invalid 'cursor'")
+	}
+	return c, nil
+}
+
+// position returns the position of the entry c points to, nil if c is nil.
+func (c *pageCursor) position() *storage.Position {
+	if c == nil {
+		return nil
+	}
+	return &storage.Position{ReceivedAt: *c.Time, ID: c.ID}
+}
+
+// parsePage reads the limit and cursor parameters shared by list endpoints.
+// The returned cursor is nil when the first page is requested.
+func parsePage(q url.Values, defaultLimit, maxLimit int) (int, *pageCursor, error) {
+	limit := defaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return 0, nil, errors.New("invalid 'limit': must be between 1 and " + strconv.Itoa(maxLimit))
+		}
+		limit = n
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		return limit, &c, nil
+	}
+	return limit, nil, nil
+}
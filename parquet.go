@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A minimal Parquet writer: flat schema, required or optional columns, PLAIN encoding, no compression.
+// That is all the export needs, and it keeps the file readable by pandas, DuckDB and Spark.
+// See https://github.com/apache/parquet-format for the layout and Thrift definitions.
+
+// Parquet physical types.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet converted types used for logical annotations.
+const (
+	parquetConvertedNone            = -1
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMicros = 10
+	parquetConvertedJSON            = 19
+)
+
+// parquetColumn describes one top-level column of the file schema.
+type parquetColumn struct {
+	Name      string
+	Type      int32
+	Converted int32
+	Optional  bool
+}
+
+// columnChunkMeta is what the footer needs to know about a written column chunk.
+type columnChunkMeta struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+// rowGroupMeta is what the footer needs to know about a written row group.
+type rowGroupMeta struct {
+	columns []columnChunkMeta
+	size    int64
+	numRows int64
+}
+
+// parquetWriter buffers one row group at a time and writes it to w when full.
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []parquetColumn
+	buffers      []bytes.Buffer
+	defined      [][]byte // per optional column, 1 for each row with a value and 0 for each null
+	rows         int64
+	rowGroupSize int64
+	rowGroups    []rowGroupMeta
+}
+
+// newParquetWriter writes the file header and returns a writer for the given schema.
+func newParquetWriter(w io.Writer, columns []parquetColumn, rowGroupSize int64) (*parquetWriter, error) {
+	pw := &parquetWriter{
+		w:            w,
+		columns:      columns,
+		buffers:      make([]bytes.Buffer, len(columns)),
+		defined:      make([][]byte, len(columns)),
+		rowGroupSize: rowGroupSize,
+	}
+	if err := pw.write([]byte("PAR1")); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// Null appends a null to an optional column.
+func (pw *parquetWriter) Null(col int) {
+	pw.defined[col] = append(pw.defined[col], 0)
+}
+
+// markDefined records that an optional column has a value in the current row.
+func (pw *parquetWriter) markDefined(col int) {
+	if pw.columns[col].Optional {
+		pw.defined[col] = append(pw.defined[col], 1)
+	}
+}
+
+// Int64 appends a value to an INT64 column.
+func (pw *parquetWriter) Int64(col int, v int64) {
+	pw.markDefined(col)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	pw.buffers[col].Write(b[:])
+}
+
+// Int32 appends a value to an INT32 column.
+func (pw *parquetWriter) Int32(col int, v int32) {
+	pw.markDefined(col)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	pw.buffers[col].Write(b[:])
+}
+
+// Double appends a value to a DOUBLE column.
+func (pw *parquetWriter) Double(col int, v float64) {
+	pw.markDefined(col)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	pw.buffers[col].Write(b[:])
+}
+
+// String appends a value to a BYTE_ARRAY column.
+func (pw *parquetWriter) String(col int, v string) {
+	pw.markDefined(col)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(v)))
+	pw.buffers[col].Write(b[:])
+	pw.buffers[col].WriteString(v)
+}
+
+// Value appends v, as returned by exportColumn.value, to column col: nil as a null, a
+// time.Time as microseconds and a map as JSON.
+func (pw *parquetWriter) Value(col int, v any) {
+	switch v := v.(type) {
+	case nil:
+		pw.Null(col)
+	case int32:
+		pw.Int32(col, v)
+	case int64:
+		pw.Int64(col, v)
+	case float64:
+		pw.Double(col, v)
+	case string:
+		pw.String(col, v)
+	case time.Time:
+		pw.Int64(col, v.UnixMicro())
+	case map[string]string:
+		pw.String(col, jsonString(v))
+	default:
+		panic(fmt.Sprintf("parquet: unsupported value %T", v))
+	}
+}
+
+// EndRow marks the current row as complete, flushing the row group once it is full.
+// Every column must have received exactly one value or null since the previous call.
+func (pw *parquetWriter) EndRow() error {
+	pw.rows++
+	if pw.rows >= pw.rowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// flushRowGroup writes each buffered column as a single data page.
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	group := rowGroupMeta{numRows: pw.rows}
+	for i := range pw.columns {
+		data := pw.buffers[i].Bytes()
+		if pw.columns[i].Optional {
+			data = append(encodeDefinitionLevels(pw.defined[i]), data...)
+			pw.defined[i] = pw.defined[i][:0]
+		}
+
+		var header thriftWriter
+		header.fieldI32(1, 0) // DATA_PAGE
+		header.fieldI32(2, int32(len(data)))
+		header.fieldI32(3, int32(len(data)))
+		header.fieldStruct(5)
+		header.fieldI32(1, int32(pw.rows))
+		header.fieldI32(2, 0) // PLAIN
+		header.fieldI32(3, 3) // RLE
+		header.fieldI32(4, 3) // RLE
+		header.endStruct()
+		header.endStruct()
+
+		chunk := columnChunkMeta{offset: pw.offset, numValues: pw.rows}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(data); err != nil {
+			return err
+		}
+		chunk.size = pw.offset - chunk.offset
+		group.size += chunk.size
+		group.columns = append(group.columns, chunk)
+		pw.buffers[i].Reset()
+	}
+
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.rows = 0
+	return nil
+}
+
+// encodeDefinitionLevels encodes 0/1 definition levels as a length-prefixed
+// RLE/bit-packed hybrid run, bit width 1, as data pages of optional columns start with.
+func encodeDefinitionLevels(levels []byte) []byte {
+	groups := (len(levels) + 7) / 8
+	run := binary.AppendUvarint(nil, uint64(groups)<<1|1) // bit-packed run header
+	packed := make([]byte, groups)
+	for i, l := range levels {
+		packed[i/8] |= l << (i % 8)
+	}
+	run = append(run, packed...)
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(run)))
+	return append(out, run...)
+}
+
+// Close flushes the last row group and writes the footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var totalRows int64
+	for _, g := range pw.rowGroups {
+		totalRows += g.numRows
+	}
+
+	var meta thriftWriter
+	meta.fieldI32(1, 1) // version
+
+	meta.fieldList(2, thriftStruct, len(pw.columns)+1)
+	meta.beginStruct()
+	meta.fieldString(4, "schema")
+	meta.fieldI32(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, c := range pw.columns {
+		meta.beginStruct()
+		meta.fieldI32(1, c.Type)
+		if c.Optional {
+			meta.fieldI32(3, 1) // OPTIONAL
+		} else {
+			meta.fieldI32(3, 0) // REQUIRED
+		}
+		meta.fieldString(4, c.Name)
+		if c.Converted != parquetConvertedNone {
+			meta.fieldI32(6, c.Converted)
+		}
+		meta.endStruct()
+	}
+
+	meta.fieldI64(3, totalRows)
+
+	meta.fieldList(4, thriftStruct, len(pw.rowGroups))
+	for _, g := range pw.rowGroups {
+		meta.beginStruct()
+		meta.fieldList(1, thriftStruct, len(g.columns))
+		for i, chunk := range g.columns {
+			meta.beginStruct()
+			meta.fieldI64(2, chunk.offset)
+			meta.fieldStruct(3)
+			meta.fieldI32(1, pw.columns[i].Type)
+			meta.fieldList(2, thriftI32, 1)
+			meta.listI32(0) // PLAIN
+			meta.fieldList(3, thriftBinary, 1)
+			meta.listString(pw.columns[i].Name)
+			meta.fieldI32(4, 0) // UNCOMPRESSED
+			meta.fieldI64(5, chunk.numValues)
+			meta.fieldI64(6, chunk.size)
+			meta.fieldI64(7, chunk.size)
+			meta.fieldI64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.fieldI64(2, g.size)
+		meta.fieldI64(3, g.numRows)
+		meta.endStruct()
+	}
+
+	meta.fieldString(6, "delogger")
+	meta.endStruct()
+
+	if err := pw.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(meta.buf.Len()))
+	if err := pw.write(size[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte("PAR1"))
+}
+
+// Thrift compact protocol type ids.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the subset of the Thrift compact protocol used by Parquet metadata.
+// Structs are implicit at the top level; nested structs push and pop the last field id.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastID  int16
+	idStack []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) fieldString(id int16, v string) {
+	t.fieldHeader(id, thriftBinary)
+	t.listString(v)
+}
+
+// fieldStruct starts a nested struct field; close it with endStruct.
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// fieldList writes a list header; the caller then writes size elements.
+func (t *thriftWriter) fieldList(id int16, elem byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xF0 | elem)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) listString(v string) {
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+// beginStruct starts a struct, either as a list element or after fieldStruct.
+func (t *thriftWriter) beginStruct() {
+	t.idStack = append(t.idStack, t.lastID)
+	t.lastID = 0
+}
+
+// endStruct writes the stop byte and restores the enclosing struct's field id.
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	if n := len(t.idStack); n > 0 {
+		t.lastID = t.idStack[n-1]
+		t.idStack = t.idStack[:n-1]
+	}
+}
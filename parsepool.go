@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"strconv"
+
+	"delogger/parser"
+)
+
+// Large payloads are split into chunks of lines, parsed concurrently by a pool of workers
+// shared by all requests:
+//
+//	PARSE_WORKERS      number of workers; default the number of CPUs, 1 parsing every
+//	                   payload in its request
+//	PARSE_CHUNK_LINES  lines per chunk; smaller payloads are parsed in their request;
+//	                   default 5000
+//
+// Entries keep the order of their lines.
+
+// parseChunk is a run of lines parsed by a worker.
+type parseChunk struct {
+	parser  parser.Parser
+	lines   []string
+	entries []LogEntry
+	done    chan struct{} // closed once entries are set
+}
+
+var parsePool = struct {
+	jobs       chan *parseChunk
+	workers    int // 0 until setupParsing
+	chunkLines int
+}{chunkLines: 5000}
+
+// setupParsing reads the pool settings and starts the workers.
+func setupParsing() {
+	workers := runtime.GOMAXPROCS(0)
+	for _, s := range []struct {
+		env   string
+		value *int
+	}{{"PARSE_WORKERS", &workers}, {"PARSE_CHUNK_LINES", &parsePool.chunkLines}} {
+		if v := setting(s.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				fatalConfig("Invalid "+s.env+": must be a positive number", "value", v)
+			}
+			*s.value = n
+		}
+	}
+	parsePool.jobs = make(chan *parseChunk)
+	for range workers {
+		go func() {
+			for c := range parsePool.jobs {
+				c.entries = parseEachLine(c.parser, c.lines)
+				close(c.done)
+			}
+		}()
+	}
+	parsePool.workers = workers
+	slog.Debug("Parse workers started", "workers", workers, "chunk_lines", parsePool.chunkLines)
+}
+
+// parseLines parses each non-blank line of text with the first format of p that recognises
+// it, in chunks on the worker pool if text is large. The entries are in a pooled slice,
+// which the caller may return with putEntries once it is done with them.
+func parseLines(p parser.Parser, text string) []LogEntry {
+	return parseLinesFunc(p, text, nil)
+}
+
+// parseLinesFunc is parseLines, also passing each chunk's entries to emit, if not nil, in
+// order and as soon as the chunk and those before it are parsed.
+func parseLinesFunc(p parser.Parser, text string, emit func([]LogEntry)) []LogEntry {
+	lines := splitLines(text)
+	defer putLines(lines)
+	if parsePool.workers < 2 || len(lines) <= parsePool.chunkLines {
+		entries := parseEachLine(p, lines)
+		if emit != nil && len(entries) > 0 {
+			emit(entries)
+		}
+		return entries
+	}
+
+	var chunks []*parseChunk
+	for start := 0; start < len(lines); start += parsePool.chunkLines {
+		chunks = append(chunks, &parseChunk{parser: p, lines: lines[start:min(start+parsePool.chunkLines, len(lines))], done: make(chan struct{})})
+	}
+	go func() {
+		for _, c := range chunks {
+			parsePool.jobs <- c
+		}
+	}()
+
+	entries := getEntries(len(lines))
+	for _, c := range chunks {
+		<-c.done
+		if emit != nil && len(c.entries) > 0 {
+			emit(c.entries)
+		}
+		entries = append(entries, c.entries...)
+		putEntries(c.entries)
+	}
+	if len(entries) == 0 {
+		putEntries(entries)
+		return nil
+	}
+	return entries
+}
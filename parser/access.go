@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AccessPattern matches Common and Combined Log Format lines as written by nginx and
+// Apache, optionally followed by the request duration:
+//
+//	203.0.113.9 - bob [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.1" 200 2326 "-" "curl/8.0" 0.042
+//
+// A duration with a decimal point is read as seconds (nginx $request_time), a whole number
+// as microseconds (Apache %D).
+const AccessPattern = `^\S+ \S+ \S+ \[([^\]]+)\] "([A-Z]+) (\S+)(?: [^"]*)?" (\d{3}) (\d+|-)(?: "[^"]*" "[^"]*")?(?: (\d+\.\d+|\d+))?$`
+
+var accessRegex = regexp.MustCompile(AccessPattern)
+
+// HTTPRequest holds the request fields of an access log line, kept apart from the message
+// so aggregations such as latency percentiles per path don't parse messages.
+type HTTPRequest struct {
+	Method    string   `json:"method"`
+	Path      string   `json:"path"`
+	Status    int      `json:"status"`
+	Bytes     int64    `json:"bytes"`
+	LatencyMS *float64 `json:"latency_ms,omitempty"`
+}
+
+// parseAccessLine parses an access log line. The level follows the status: ERROR for 5xx,
+// WARN for 4xx and INFO otherwise. The path is stored without its query string.
+func parseAccessLine(line string) (Entry, bool) {
+	// Every access log line has a bracketed time followed by the quoted request; lines
+	// without one are rejected before the regex runs.
+	if !strings.Contains(line, "] \"") {
+		return Entry{}, false
+	}
+	m := accessRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Entry{}, false
+	}
+
+	req := &HTTPRequest{Method: m[2], Path: m[3]}
+	req.Path, _, _ = strings.Cut(req.Path, "?")
+	req.Status, _ = strconv.Atoi(m[4])
+	if m[5] != "-" {
+		req.Bytes, _ = strconv.ParseInt(m[5], 10, 64)
+	}
+	if m[6] != "" {
+		latency, _ := strconv.ParseFloat(m[6], 64)
+		if strings.Contains(m[6], ".") {
+			latency *= 1000
+		} else {
+			latency /= 1000
+		}
+		req.LatencyMS = &latency
+	}
+
+	level := "INFO"
+	switch {
+	case req.Status >= 500:
+		level = "ERROR"
+	case req.Status >= 400:
+		level = "WARN"
+	}
+	return Entry{Timestamp: m[1], Level: level, Message: line, HTTP: req}, true
+}
@@ -0,0 +1,53 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func latency(ms float64) *float64 { return &ms }
+
+var accessTests = []struct {
+	line string
+	want *Entry // nil if the line isn't an access line
+}{
+	{
+		line: `203.0.113.9 - bob [10/Oct/2000:13:55:36 -0700] "GET /a.gif?x=1 HTTP/1.1" 200 2326`,
+		want: &Entry{Timestamp: "10/Oct/2000:13:55:36 -0700", Level: "INFO",
+			HTTP: &HTTPRequest{Method: "GET", Path: "/a.gif", Status: 200, Bytes: 2326}},
+	},
+	{
+		line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "POST /api HTTP/2.0" 502 - "-" "curl/8.0" 0.042`,
+		want: &Entry{Timestamp: "10/Oct/2000:13:55:36 +0000", Level: "ERROR",
+			HTTP: &HTTPRequest{Method: "POST", Path: "/api", Status: 502, LatencyMS: latency(42)}},
+	},
+	{
+		line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "DELETE /x HTTP/1.0" 404 12 "https://a.example/" "Mozilla/5.0" 1500`,
+		want: &Entry{Timestamp: "10/Oct/2000:13:55:36 +0000", Level: "WARN",
+			HTTP: &HTTPRequest{Method: "DELETE", Path: "/x", Status: 404, Bytes: 12, LatencyMS: latency(1.5)}},
+	},
+	{line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "get /x HTTP/1.0" 200 1`},
+	{line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /x HTTP/1.0" 20 1`},
+	{line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /x HTTP/1.0" 200`},
+	{line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000]"GET /x HTTP/1.0" 200 1`},
+	{line: `10.0.0.1 - [10/Oct/2000:13:55:36 +0000] "GET /x HTTP/1.0" 200 1`},
+	{line: `[2024-01-02T03:04:05Z] [ERROR] "GET /x HTTP/1.0" 200 1`},
+	{line: `plain text`},
+}
+
+func TestParseAccessLine(t *testing.T) {
+	for _, tt := range accessTests {
+		got, ok := parseAccessLine(tt.line)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("%q: parsed as %+v, want no match", tt.line, got)
+			}
+			continue
+		}
+		want := *tt.want
+		want.Message = tt.line
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v (ok=%v), want %+v", tt.line, got, ok, want)
+		}
+	}
+}
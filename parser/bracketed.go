@@ -0,0 +1,78 @@
+package parser
+
+import "strings"
+
+// BracketedPattern matches lines of the form "[timestamp] [level] message". Lines are
+// parsed by scanBracketedLine, which follows it; the pattern documents the format in
+// Builtin.
+const BracketedPattern = `^\[(.*?)\]\s+\[(.*?)\]\s+(.*)$`
+
+// Parsing is on the ingest hot path, so the bracketed format is read by a hand-written
+// scanner rather than a regex, matching exactly what BracketedPattern does: the fields
+// are substrings of the line, with no allocation per line.
+
+// isRegexSpace reports whether c is in the \s class of BracketedPattern.
+func isRegexSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// skipSpace returns the index of the first byte of line at or after i that isn't a space.
+func skipSpace(line string, i int) int {
+	for i < len(line) && isRegexSpace(line[i]) {
+		i++
+	}
+	return i
+}
+
+// scanBracketedLine splits a "[timestamp] [level] message" line as BracketedPattern
+// does: each bracketed field ends at the first "]" that is followed by the rest of the
+// pattern. Like the . of the pattern, no field spans a newline; the spaces between them
+// may.
+func scanBracketedLine(line string) (timestamp, level, message string, ok bool) {
+	if len(line) == 0 || line[0] != '[' {
+		return "", "", "", false
+	}
+	// The timestamp ends at the first "]" followed by spaces and "[" that leaves a level
+	// and message. If the first such "]" doesn't, a later one only can if the spaces after
+	// it cross the newline the level stopped at, and only one "]" is followed by those.
+	tried := false
+	for i := 1; i < len(line) && line[i] != '\n'; i++ {
+		if line[i] != ']' {
+			continue
+		}
+		j := skipSpace(line, i+1)
+		if j == i+1 || j == len(line) || line[j] != '[' {
+			continue
+		}
+		if tried && strings.IndexByte(line[i+1:j], '\n') < 0 {
+			continue
+		}
+		tried = true
+		if level, message, ok := scanLevel(line, j+1); ok {
+			return line[1:i], level, message, true
+		}
+	}
+	return "", "", "", false
+}
+
+// scanLevel splits the rest of a bracketed line from start into the level, which ends at
+// the first "]" followed by spaces and a message without a newline, and the message.
+func scanLevel(line string, start int) (level, message string, ok bool) {
+	lastNewline := -2 // not looked for yet
+	for k := start; k < len(line) && line[k] != '\n'; k++ {
+		if line[k] != ']' || k+1 == len(line) || !isRegexSpace(line[k+1]) {
+			continue
+		}
+		m := skipSpace(line, k+1)
+		if lastNewline == -2 {
+			if strings.IndexByte(line[m:], '\n') < 0 {
+				return line[start:k], line[m:], true
+			}
+			lastNewline = strings.LastIndexByte(line, '\n')
+		}
+		if m > lastNewline {
+			return line[start:k], line[m:], true
+		}
+	}
+	return "", "", false
+}
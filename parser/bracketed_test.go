@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var bracketedRegex = regexp.MustCompile(BracketedPattern)
+
+// bracketedCorpus holds well-formed lines and the malformed ones the scanner must reject
+// or split exactly as BracketedPattern does.
+var bracketedCorpus = []string{
+	"[2024-01-02T03:04:05Z] [ERROR] disk full",
+	"[2024-01-02 03:04:05] [INFO] started in 42ms",
+	"[t] [l] ",
+	"[t] [l]  ",
+	"[t]\t[l]\tmessage",
+	"[t]  \t [l] \t message with [brackets] inside",
+	"[] [] empty fields",
+	"[t] [] empty level",
+	"[] [l] empty timestamp",
+	"[a] b] [c] nested end in timestamp",
+	"[a] [b] c] d",
+	"[a] [b]] c",
+	"[a]] [b] c",
+	"[[a]] [[b]] c",
+	"[a][b] c",
+	"[a] [b]c",
+	"[a] [b]",
+	"[a] [b",
+	"[a] b",
+	"[a]",
+	"[",
+	"]",
+	"",
+	" [a] [b] c",
+	"a [b] [c] d",
+	"[a] [b] c\n",
+	"[a]\n[b] c",
+	"[a] [b]\nc",
+	"[a] [b] x]\ny",
+	"[a] [b\n] c",
+	"[a\n] [b] c",
+	"[a] [b] c\nd",
+	"[a] [b] c\n[d] [e] f",
+	"[a] [b] \n",
+	"[a] [b]\r\nc",
+	"[a]\r[b]\rc",
+	"[a] [b] café — \xff\xfe",
+	"[\xff] [\xfe] bytes",
+}
+
+func scanMatches(t *testing.T, line string) {
+	t.Helper()
+	timestamp, level, message, ok := scanBracketedLine(line)
+	m := bracketedRegex.FindStringSubmatch(line)
+	if ok != (m != nil) {
+		t.Fatalf("%q: scanner ok=%v, regex matched=%v", line, ok, m != nil)
+	}
+	if ok && (timestamp != m[1] || level != m[2] || message != m[3]) {
+		t.Fatalf("%q: scanner got %q %q %q, regex %q %q %q", line, timestamp, level, message, m[1], m[2], m[3])
+	}
+}
+
+func TestScanBracketedLineMatchesPattern(t *testing.T) {
+	for _, line := range bracketedCorpus {
+		scanMatches(t, line)
+	}
+}
+
+func TestScanBracketedLineMatchesPatternOnRandomLines(t *testing.T) {
+	// Lines made of the bytes the pattern cares about, so most are malformed in some way.
+	const alphabet = "[[[]]]   \t\n\rab"
+	r := rand.New(rand.NewPCG(1, 2))
+	var b strings.Builder
+	for range 200000 {
+		b.Reset()
+		b.WriteByte('[')
+		for range r.IntN(24) {
+			b.WriteByte(alphabet[r.IntN(len(alphabet))])
+		}
+		scanMatches(t, b.String())
+	}
+}
+
+func TestAccessPrefilterMatchesPattern(t *testing.T) {
+	lines := slices.Clone(bracketedCorpus)
+	for _, tt := range accessTests {
+		lines = append(lines, tt.line)
+	}
+	for _, line := range lines {
+		_, ok := parseAccessLine(line)
+		if want := accessRegex.MatchString(line); ok != want {
+			t.Errorf("%q: parsed=%v, pattern matched=%v", line, ok, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package parser is the log line parsing engine of DeLogger, usable on its own: it splits
+// text into lines and parses each with the first built-in format that recognises it, with
+// no database or configuration.
+//
+//	entries := parser.Parse(text)
+//
+// Lines no format recognises are kept whole as Raw entries, and blank lines are skipped.
+// Package enrich extracts ids, severities and times from the entries, package storage
+// defines how they are stored and keeps them in memory, and package api serves and
+// documents an HTTP API from a table of routes.
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Entry is a parsed log line.
+type Entry struct {
+	Timestamp string       `json:"timestamp,omitempty"`
+	Level     string       `json:"level,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	Raw       string       `json:"raw,omitempty"`
+	HTTP      *HTTPRequest `json:"http,omitempty"`
+}
+
+// Name returns the name of the format that produced e, as in Builtin.
+func (e Entry) Name() string {
+	if e.Raw != "" {
+		return "raw"
+	}
+	if e.HTTP != nil {
+		return "access"
+	}
+	return "bracketed"
+}
+
+// Info describes a built-in format.
+type Info struct {
+	Name        string   `json:"name"`
+	Pattern     string   `json:"pattern"`
+	Description string   `json:"description"`
+	Fields      []string `json:"fields"`
+}
+
+// Builtin lists the formats, in the order lines are tried against them.
+var Builtin = []Info{
+	{
+		Name:        "bracketed",
+		Pattern:     BracketedPattern,
+		Description: "Lines of the form [timestamp] [level] message.",
+		Fields:      []string{"timestamp", "level", "message"},
+	},
+	{
+		Name:        "access",
+		Pattern:     AccessPattern,
+		Description: "Common and Combined Log Format access lines, optionally followed by the request duration.",
+		Fields:      []string{"timestamp", "level", "message", "http"},
+	},
+	{
+		Name:        "raw",
+		Description: "Fallback for lines no other parser recognises; the whole line is kept as raw.",
+		Fields:      []string{"raw"},
+	},
+}
+
+// Parse parses each non-blank line of text.
+func Parse(text string) []Entry {
+	return Parser{}.AppendText(nil, text)
+}
+
+// ParseBytes parses each non-blank line of data.
+func ParseBytes(data []byte) []Entry {
+	return Parser{}.AppendBytes(nil, data)
+}
+
+// AppendLines appends the entries of the non-blank lines to dst, so the caller can reuse
+// its slices.
+func AppendLines(dst []Entry, lines []string) []Entry {
+	return Parser{}.AppendLines(dst, lines)
+}
+
+// ParseLine parses a line without surrounding space.
+func ParseLine(line string) Entry {
+	return Parser{}.ParseLine(line)
+}
+
+// Parser parses lines with the built-in formats it wasn't made without. The zero Parser
+// tries them all, as the functions of the package do.
+type Parser struct {
+	noBracketed, noAccess bool
+}
+
+// Without returns a Parser that doesn't try the named formats, so their lines are kept as
+// raw. The raw fallback can't be left out.
+func Without(names ...string) (Parser, error) {
+	var p Parser
+	for _, name := range names {
+		switch name {
+		case "bracketed":
+			p.noBracketed = true
+		case "access":
+			p.noAccess = true
+		case "raw":
+			return Parser{}, fmt.Errorf("the raw format can't be left out")
+		default:
+			return Parser{}, fmt.Errorf("unknown format %q", name)
+		}
+	}
+	return p, nil
+}
+
+// AppendLines appends the entries of the non-blank lines to dst.
+func (p Parser) AppendLines(dst []Entry, lines []string) []Entry {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		dst = append(dst, p.ParseLine(line))
+	}
+	return dst
+}
+
+// AppendText appends the entries of the non-blank lines of text to dst, reading the lines
+// in place rather than splitting text first.
+func (p Parser) AppendText(dst []Entry, text string) []Entry {
+	for text != "" {
+		line, rest, _ := strings.Cut(text, "\n")
+		text = rest
+		if line = strings.TrimSpace(line); line != "" {
+			dst = append(dst, p.ParseLine(line))
+		}
+	}
+	return dst
+}
+
+// AppendBytes appends the entries of the non-blank lines of data to dst. data is copied
+// once, and the fields of every entry are substrings of the copy, so parsing allocates
+// nothing per line but the entries themselves.
+func (p Parser) AppendBytes(dst []Entry, data []byte) []Entry {
+	return p.AppendText(dst, string(data))
+}
+
+// ParseLine parses a line without surrounding space.
+func (p Parser) ParseLine(line string) Entry {
+	if !p.noBracketed {
+		if timestamp, level, message, ok := scanBracketedLine(line); ok {
+			return Entry{Timestamp: timestamp, Level: level, Message: message}
+		}
+	}
+	if !p.noAccess {
+		if entry, ok := parseAccessLine(line); ok {
+			return entry
+		}
+	}
+	return Entry{Raw: line}
+}
@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	text := "[t1] [ERROR] disk full\n\n  \r\n" +
+		`203.0.113.9 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 5` + "\n" +
+		"  just text  \n[t2] [INFO] done"
+	want := []Entry{
+		{Timestamp: "t1", Level: "ERROR", Message: "disk full"},
+		{Timestamp: "10/Oct/2000:13:55:36 -0700", Level: "INFO",
+			Message: `203.0.113.9 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 5`,
+			HTTP:    &HTTPRequest{Method: "GET", Path: "/", Status: 200, Bytes: 5}},
+		{Raw: "just text"},
+		{Timestamp: "t2", Level: "INFO", Message: "done"},
+	}
+	for name, got := range map[string][]Entry{
+		"Parse":       Parse(text),
+		"ParseBytes":  ParseBytes([]byte(text)),
+		"AppendLines": AppendLines(nil, strings.Split(text, "\n")),
+	} {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestWithout(t *testing.T) {
+	bracketed := "[t] [WARN] slow"
+	access := `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /x HTTP/1.0" 500 1`
+	tests := []struct {
+		names   []string
+		formats []string // of bracketed and access, or the error
+	}{
+		{nil, []string{"bracketed", "access"}},
+		{[]string{"bracketed"}, []string{"raw", "access"}},
+		{[]string{"access"}, []string{"bracketed", "raw"}},
+		{[]string{"bracketed", "access"}, []string{"raw", "raw"}},
+		{[]string{"raw"}, []string{`the raw format can't be left out`}},
+		{[]string{"access", "json"}, []string{`unknown format "json"`}},
+	}
+	for _, tt := range tests {
+		p, err := Without(tt.names...)
+		var got []string
+		if err != nil {
+			got = []string{err.Error()}
+			if p != (Parser{}) {
+				t.Errorf("Without(%q) returned a parser with its error", tt.names)
+			}
+		} else {
+			got = []string{p.ParseLine(bracketed).Name(), p.ParseLine(access).Name()}
+		}
+		if !reflect.DeepEqual(got, tt.formats) {
+			t.Errorf("Without(%q): got %q, want %q", tt.names, got, tt.formats)
+		}
+	}
+}
+
+// Lines of each format for the benchmarks.
+const (
+	benchBracketed = "[2024-01-02T03:04:05.123Z] [ERROR] request failed: upstream timed out after 30s (attempt 3/3)"
+	benchAccess    = `203.0.113.9 - bob [10/Oct/2000:13:55:36 -0700] "GET /api/v1/items?page=2 HTTP/1.1" 200 2326 "-" "curl/8.0" 0.042`
+	benchRaw       = "goroutine 17 [running]: main.handler(0xc000123456) /src/app/main.go:42 +0x1d"
+)
+
+func benchmarkLine(b *testing.B, p Parser, line, want string) {
+	if got := p.ParseLine(line).Name(); got != want {
+		b.Fatalf("parsed as %s, want %s", got, want)
+	}
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+	for range b.N {
+		p.ParseLine(line)
+	}
+}
+
+func BenchmarkBracketed(b *testing.B) { benchmarkLine(b, Parser{}, benchBracketed, "bracketed") }
+
+// BenchmarkBracketedRegex is the baseline the scanner of BenchmarkBracketed replaces.
+func BenchmarkBracketedRegex(b *testing.B) {
+	b.SetBytes(int64(len(benchBracketed)))
+	b.ReportAllocs()
+	for range b.N {
+		m := bracketedRegex.FindStringSubmatch(benchBracketed)
+		_ = Entry{Timestamp: m[1], Level: m[2], Message: m[3]}
+	}
+}
+
+func BenchmarkAccess(b *testing.B) { benchmarkLine(b, Parser{}, benchAccess, "access") }
+
+// BenchmarkRaw measures a line every format is tried against before the fallback.
+func BenchmarkRaw(b *testing.B) { benchmarkLine(b, Parser{}, benchRaw, "raw") }
+
+// benchText is a payload mixing the formats as a typical deployment would.
+var benchText = strings.Repeat(benchBracketed+"\n"+benchBracketed+"\n"+benchAccess+"\n"+benchRaw+"\n", 2500)
+
+func BenchmarkParse(b *testing.B) {
+	b.SetBytes(int64(len(benchText)))
+	b.ReportAllocs()
+	dst := make([]Entry, 0, 10000)
+	b.ResetTimer()
+	for range b.N {
+		dst = Parser{}.AppendText(dst[:0], benchText)
+	}
+}
+
+func BenchmarkParseBytes(b *testing.B) {
+	data := []byte(benchText)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	dst := make([]Entry, 0, 10000)
+	b.ResetTimer()
+	for range b.N {
+		dst = Parser{}.AppendBytes(dst[:0], data)
+	}
+}
+
+// BenchmarkParseSplit is the baseline of BenchmarkParse, splitting the text first.
+func BenchmarkParseSplit(b *testing.B) {
+	b.SetBytes(int64(len(benchText)))
+	b.ReportAllocs()
+	dst := make([]Entry, 0, 10000)
+	b.ResetTimer()
+	for range b.N {
+		dst = AppendLines(dst[:0], strings.Split(benchText, "\n"))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// The buffers every ingest request needs — the split lines, the parsed entries, the JSON
+// of the response and the chunks of spilled payloads — are reused across requests, so a
+// steady stream of payloads doesn't keep the garbage collector busy. Buffers grown by an
+// unusually large payload are dropped rather than kept.
+
+// maxPooledItems bounds the slices kept in the pools.
+const maxPooledItems = 64 << 10
+
+var (
+	lineSlices  = sync.Pool{New: func() any { return new([]string) }}
+	entrySlices = sync.Pool{New: func() any { return new([]LogEntry) }}
+	jsonBuffers = sync.Pool{New: func() any {
+		b := &jsonBuffer{}
+		b.enc = json.NewEncoder(&b.buf)
+		return b
+	}}
+	spillBuffers = sync.Pool{New: func() any {
+		return &spillBuffer{reader: bufio.NewReaderSize(nil, spillChunkBytes), chunk: make([]byte, 0, 2*spillChunkBytes)}
+	}}
+)
+
+// splitLines splits text at line breaks into a pooled slice, to be returned with putLines.
+func splitLines(text string) []string {
+	lines := (*lineSlices.Get().(*[]string))[:0]
+	for {
+		i := 0
+		for i < len(text) && text[i] != '\n' {
+			i++
+		}
+		lines = append(lines, text[:i])
+		if i == len(text) {
+			return lines
+		}
+		text = text[i+1:]
+	}
+}
+
+func putLines(lines []string) {
+	if cap(lines) > maxPooledItems {
+		return
+	}
+	clear(lines)
+	lines = lines[:0]
+	lineSlices.Put(&lines)
+}
+
+// getEntries returns an empty pooled slice with room for n entries, to be returned with
+// putEntries once nothing refers to it.
+func getEntries(n int) []LogEntry {
+	entries := (*entrySlices.Get().(*[]LogEntry))[:0]
+	if cap(entries) < n {
+		return make([]LogEntry, 0, n)
+	}
+	return entries
+}
+
+func putEntries(entries []LogEntry) {
+	if entries == nil || cap(entries) > maxPooledItems {
+		return
+	}
+	clear(entries)
+	entries = entries[:0]
+	entrySlices.Put(&entries)
+}
+
+// appendEntries appends the pooled slice src to dst, returning src to the pool, and
+// returns the result, itself pooled.
+func appendEntries(dst, src []LogEntry) []LogEntry {
+	if dst == nil {
+		return src
+	}
+	dst = append(dst, src...)
+	putEntries(src)
+	return dst
+}
+
+// jsonBuffer is a pooled buffer with an encoder writing to it.
+type jsonBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+func getJSONBuffer() *jsonBuffer {
+	return jsonBuffers.Get().(*jsonBuffer)
+}
+
+// encode returns the JSON of v, which is valid until the buffer is returned.
+func (b *jsonBuffer) encode(v any) ([]byte, error) {
+	b.buf.Reset()
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte("\n")), nil
+}
+
+func putJSONBuffer(b *jsonBuffer) {
+	if b == nil || b.buf.Cap() > maxPooledItems<<4 {
+		return
+	}
+	b.buf.Reset()
+	jsonBuffers.Put(b)
+}
+
+// spillBuffer is the reader and chunk used to redact a spilled payload.
+type spillBuffer struct {
+	reader *bufio.Reader
+	chunk  []byte
+}
+
+func putSpillBuffer(b *spillBuffer) {
+	if cap(b.chunk) > 4*spillChunkBytes {
+		return
+	}
+	b.reader.Reset(nil)
+	spillBuffers.Put(b)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// POST /api/parse/preview, or /api/parse?dry_run=true, runs a payload through the ingest
+// pipeline — redaction, IP anonymization, parsing and enrichment, sampling, collapsing of
+// repeats and deduplication — and answers the entries as they would be stored, for trying
+// parsers and settings against sample data. Nothing is stored or queued, and the state the
+// pipeline keeps is left as it is: the entries aren't remembered by DEDUP_WINDOW, nor
+// learnt as templates, so an entry is only given a template that already exists. The
+// ingest statistics, alerts and live tails don't see them either.
+
+// ParsePreview is the response of POST /api/parse/preview.
+type ParsePreview struct {
+	Entries    []StoredEntry  `json:"entries"`    // as they would be stored, without ids
+	Parsed     int            `json:"parsed"`     // entries parsed from the lines
+	Sampled    int            `json:"sampled"`    // dropped by sampling
+	Collapsed  int            `json:"collapsed"`  // counted in the repeats of an entry before them
+	Duplicates int            `json:"duplicates"` // dropped as stored within DEDUP_WINDOW
+	Redactions map[string]int `json:"redactions"` // by rule
+}
+
+// previewHandler handles POST /api/parse/preview.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readPayload(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Payload too large: the limit is "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read request body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading request body", "err", err)
+		return
+	}
+	defer body.close()
+
+	source := sourceName(r.RemoteAddr)
+	p := requestParser(r.Context())
+	var parsed []LogEntry
+	redactions, err := body.redactChunks(requestRedactor(r.Context()), source, func(text string) {
+		parsed = appendEntries(parsed, parseLines(p, text))
+	})
+	if err != nil {
+		putEntries(parsed)
+		http.Error(w, "Could not read request body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading spilled request body", "err", err)
+		return
+	}
+
+	record := LogRecord{
+		Timestamp:  time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		StatusCode: http.StatusOK,
+		Host:       sourceHeader(r, "X-DeLogger-Host"),
+		Service:    sourceHeader(r, "X-DeLogger-Service"),
+		Env:        sourceHeader(r, "X-DeLogger-Env"),
+		Fields:     sourceFields(source),
+		Tenant:     requestTenant(r.Context()),
+		SourceID:   requestSource(r.Context()).ID,
+	}
+	if id := clientCertIdentity(r); id != "" {
+		record.Host = id
+	}
+	record.Entries = parsed
+	defer putEntries(record.Entries)
+
+	result := ParsePreview{Entries: []StoredEntry{}, Parsed: len(record.Entries), Redactions: redactions}
+	if len(record.Entries) > 0 {
+		entries := sampleEntries(source, enrichEntries(record))
+		result.Sampled = result.Parsed - len(entries)
+		n := len(entries)
+		entries = repeats.collapseRuns(entries)
+		result.Collapsed = n - len(entries)
+		n = len(entries)
+		entries = dedup.unseen(entries)
+		result.Duplicates = n - len(entries)
+
+		if len(entries) > 0 && !enrichmentOff(record.Tenant, "reverse_dns") {
+			rdns.Load().annotate(entries)
+		}
+		if !enrichmentOff(record.Tenant, "templates") {
+			for i := range entries {
+				message := entries[i].Message
+				if entries[i].Raw != "" {
+					message = entries[i].Raw
+				}
+				entries[i].TemplateID = miner.match(message)
+			}
+		}
+		result.Entries = entries
+	}
+
+	slog.DebugContext(r.Context(), "Previewed log data", "parsed", result.Parsed, "entries", len(result.Entries))
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Sources can be grouped in projects, registered with PUT /api/projects/{id}, so that a
+// project's records are those of its sources (see sources.go). Entries can be queried by
+// project with the project field of the query language. An API key can be bound to a
+// project (see apikeys.go): like a tenant key, it is refused from the routes that aren't
+// scoped, and it only sees the entries of its project's sources. It can only ingest with
+// the token of one of its project's sources. A project key bound to no tenant still can't
+// see usage, which is metered by tenant.
+
+// Project is a registered project.
+type Project struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// projects holds the registered projects by id.
+var projects struct {
+	sync.RWMutex
+	byID map[string]Project
+}
+
+// loadProjects reads the registered projects into memory.
+func loadProjects() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, `SELECT id, name, created_at FROM projects`)
+	if err != nil {
+		fatal("Failed to load projects", "err", err)
+	}
+	byID := map[string]Project{}
+	var p Project
+	_, err = pgx.ForEachRow(rows, []any{&p.ID, &p.Name, &p.CreatedAt}, func() error {
+		byID[p.ID] = p
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to load projects", "err", err)
+	}
+
+	projects.Lock()
+	projects.byID = byID
+	projects.Unlock()
+}
+
+// projectExists reports whether id is a registered project.
+func projectExists(id string) bool {
+	projects.RLock()
+	defer projects.RUnlock()
+	_, ok := projects.byID[id]
+	return ok
+}
+
+// requestProject returns the project of the caller, or "" if it isn't bound to one.
+func requestProject(ctx context.Context) string {
+	p, _ := principalFromContext(ctx)
+	return p.project
+}
+
+// sourceProject returns the project of source id, "" if it has none or isn't registered.
+func sourceProject(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	sources.RLock()
+	defer sources.RUnlock()
+	for _, s := range sources.byHash {
+		if s.ID == id {
+			return s.Project
+		}
+	}
+	return ""
+}
+
+// projectCond is the SQL condition on delogged d of the records of the project given by
+// the placeholder.
+func projectCond(placeholder string) string {
+	return "d.source_id IN (SELECT id FROM sources WHERE project = " + placeholder + ")"
+}
+
+// Projects is the response of GET /api/projects.
+type Projects struct {
+	Projects []Project `json:"projects"`
+}
+
+// listProjectsHandler handles GET /api/projects.
+func listProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	projects.RLock()
+	list := []Project{}
+	for _, p := range projects.byID {
+		list = append(list, p)
+	}
+	projects.RUnlock()
+	slices.SortFunc(list, func(a, b Project) int { return strings.Compare(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, Projects{Projects: list})
+}
+
+// putProjectHandler handles PUT /api/projects/{id}, registering a project or renaming it.
+func putProjectHandler(w http.ResponseWriter, r *http.Request) {
+	var p Project
+	if err := readJSON(r, &p); err != nil {
+		http.Error(w, "Invalid project: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	p.ID, p.Name = r.PathValue("id"), strings.TrimSpace(p.Name)
+	// Project ids follow the syntax of tenant ids.
+	if !tenantPattern.MatchString(p.ID) {
+		http.Error(w, "Invalid project: the id must be lowercase letters, digits, - and _", http.StatusBadRequest)
+		return
+	}
+
+	err := dbPool.QueryRow(r.Context(), `
+	INSERT INTO projects (id, name) VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name
+	RETURNING created_at`,
+		p.ID, p.Name).Scan(&p.CreatedAt)
+	if err != nil {
+		http.Error(w, "Could not save project", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving project", "project", p.ID, "err", err)
+		return
+	}
+
+	projects.Lock()
+	projects.byID[p.ID] = p
+	projects.Unlock()
+
+	slog.InfoContext(r.Context(), "Saved project", "project", p.ID, "name", p.Name)
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query language accepted by the q= parameter, e.g.
+//
+//	level=error AND msg~"timeout" AND status>=500
+//	(level=warn OR level=error) AND NOT addr~"10.0."
+//
+// Comparisons are field op value, where op is one of = != ~ !~ > >= < <=.
+// ~ and !~ are case-insensitive substring matches; = and != on text fields ignore case.
+// Expressions combine with AND, OR and NOT (case-insensitive) and parentheses;
+// AND binds tighter than OR. Values containing spaces or operators must be double-quoted.
+// Static fields of a source are referenced as fields.<name>, e.g. fields.team=payments.
+// Numeric fields take integers that fit their column, except latency, which takes any
+// number and is false in every comparison for entries that weren't HTTP requests.
+
+// fieldKind determines which operators a field accepts and how its value is parsed.
+type fieldKind int
+
+const (
+	textField  fieldKind = iota
+	int16Field           // SMALLINT
+	int32Field           // INTEGER
+	int64Field           // BIGINT
+	floatField           // DOUBLE PRECISION, NULL when the entry has no value
+	timeField
+)
+
+// intBits returns the size of an integer field's column, or 0 for other kinds.
+func (k fieldKind) intBits() int {
+	switch k {
+	case int16Field:
+		return 16
+	case int32Field:
+		return 32
+	case int64Field:
+		return 64
+	}
+	return 0
+}
+
+// queryField maps a query language field to its SQL column.
+type queryField struct {
+	name   string
+	column string
+	kind   fieldKind
+}
+
+// queryFields lists every field a query may reference, keyed by name and alias.
+var queryFields = map[string]queryField{
+	"level":          {"level", "e.level", textField},
+	"msg":            {"message", "e.message", textField},
+	"message":        {"message", "e.message", textField},
+	"raw":            {"raw", "e.raw", textField},
+	"timestamp":      {"timestamp", "e.log_timestamp", textField},
+	"addr":           {"remote_addr", "d.remote_addr", textField},
+	"remote_addr":    {"remote_addr", "d.remote_addr", textField},
+	"status":         {"status", "COALESCE(d.status_code, 0)", int32Field},
+	"line":           {"line_no", "e.line_no", int32Field},
+	"log_id":         {"log_id", "e.log_id", int32Field},
+	"received":       {"received_at", "e.received_at", timeField},
+	"received_at":    {"received_at", "e.received_at", timeField},
+	"request_id":     {"request_id", "e.request_id", textField},
+	"trace":          {"trace_id", "e.trace_id", textField},
+	"trace_id":       {"trace_id", "e.trace_id", textField},
+	"span":           {"span_id", "e.span_id", textField},
+	"span_id":        {"span_id", "e.span_id", textField},
+	"method":         {"http_method", "e.http_method", textField},
+	"path":           {"http_path", "e.http_path", textField},
+	"http_status":    {"http_status", "e.http_status", int16Field},
+	"bytes":          {"http_bytes", "e.http_bytes", int64Field},
+	"latency":        {"http_latency_ms", "e.http_latency_ms", floatField},
+	"correlation_id": {"correlation_id", "e.correlation_id", textField},
+	"client_ip":      {"client_ip", "e.client_ip", textField},
+	"client_host":    {"client_host", "e.client_host", textField},
+	"fingerprint":    {"fingerprint", "e.fingerprint", textField},
+	"template":       {"template_id", "e.template_id", int64Field},
+	"template_id":    {"template_id", "e.template_id", int64Field},
+	"country":        {"geo_country", "e.geo_country", textField},
+	"city":           {"geo_city", "e.geo_city", textField},
+	"asn":            {"geo_asn", "e.geo_asn", int64Field},
+	"org":            {"geo_org", "e.geo_org", textField},
+	"severity":       {"severity", "e.severity", textField},
+	"sev":            {"severity_number", "e.severity_number", int16Field},
+	"host":           {"host", "d.host", textField},
+	"service":        {"service", "d.service", textField},
+	"env":            {"env", "d.env", textField},
+	"tenant":         {"tenant", "d.tenant", textField},
+	"source_id":      {"source_id", "d.source_id", int32Field},
+	"project":        {"project", "(SELECT project FROM sources WHERE id = d.source_id)", textField},
+}
+
+// queryNode is a node of a parsed query expression.
+type queryNode interface {
+	// sql renders the node as a boolean SQL expression over delogged_entries e joined with delogged d.
+	sql(args *sqlArgs) string
+	// match evaluates the node against an entry in memory, with the same semantics as sql.
+	match(e StoredEntry) bool
+}
+
+type queryAnd struct{ left, right queryNode }
+type queryOr struct{ left, right queryNode }
+type queryNot struct{ node queryNode }
+
+// queryCmp compares a field with a literal. value is a string, int, float64 or time.Time
+// depending on field.kind.
+type queryCmp struct {
+	field queryField
+	op    string
+	value any
+}
+
+func (n queryAnd) sql(args *sqlArgs) string {
+	return "(" + n.left.sql(args) + " AND " + n.right.sql(args) + ")"
+}
+
+func (n queryOr) sql(args *sqlArgs) string {
+	return "(" + n.left.sql(args) + " OR " + n.right.sql(args) + ")"
+}
+
+func (n queryNot) sql(args *sqlArgs) string {
+	return "NOT (" + n.node.sql(args) + ")"
+}
+
+func (n queryCmp) sql(args *sqlArgs) string {
+	col := "COALESCE(" + n.field.column + ", '')"
+	if n.field.kind != textField {
+		col = n.field.column
+	}
+
+	switch n.op {
+	case "~":
+		return col + " ILIKE " + args.add("%"+escapeLike(n.value.(string))+"%")
+	case "!~":
+		return col + " NOT ILIKE " + args.add("%"+escapeLike(n.value.(string))+"%")
+	}
+	if n.field.kind == textField {
+		return "lower(" + col + ") " + n.op + " lower(" + args.add(n.value) + ")"
+	}
+	if n.field.kind == floatField {
+		// An entry without a value matches no comparison, and so every NOT of one, as in match.
+		return "COALESCE(" + col + " " + n.op + " " + args.add(n.value) + ", false)"
+	}
+	return col + " " + n.op + " " + args.add(n.value)
+}
+
+func (n queryAnd) match(e StoredEntry) bool { return n.left.match(e) && n.right.match(e) }
+func (n queryOr) match(e StoredEntry) bool  { return n.left.match(e) || n.right.match(e) }
+func (n queryNot) match(e StoredEntry) bool { return !n.node.match(e) }
+
+func (n queryCmp) match(e StoredEntry) bool {
+	switch n.field.kind {
+	case textField:
+		v, want := entryText(e, n.field.name), n.value.(string)
+		switch n.op {
+		case "=":
+			return strings.EqualFold(v, want)
+		case "!=":
+			return !strings.EqualFold(v, want)
+		case "~":
+			return containsFold(v, want)
+		case "!~":
+			return !containsFold(v, want)
+		}
+	case int16Field, int32Field, int64Field:
+		return compareOrdered(entryInt(e, n.field.name), n.value.(int), n.op)
+	case floatField:
+		v, ok := entryFloat(e, n.field.name)
+		return ok && compareOrdered(v, n.value.(float64), n.op)
+	case timeField:
+		return compareOrdered(e.ReceivedAt.Compare(n.value.(time.Time)), 0, n.op)
+	}
+	return false
+}
+
+// entryText returns the text field of e named by queryField.name.
+func entryText(e StoredEntry, name string) string {
+	switch name {
+	case "level":
+		return e.Level
+	case "message":
+		return e.Message
+	case "raw":
+		return e.Raw
+	case "timestamp":
+		return e.Timestamp
+	case "remote_addr":
+		return e.RemoteAddr
+	case "correlation_id":
+		return e.CorrelationID
+	case "client_ip":
+		return e.ClientIP
+	case "client_host":
+		return e.ClientHost
+	case "fingerprint":
+		return e.Fingerprint
+	case "trace_id":
+		return e.TraceID
+	case "span_id":
+		return e.SpanID
+	case "request_id":
+		return e.RequestID
+	case "http_method":
+		method, _, _, _, _ := httpColumns(e.LogEntry)
+		return method
+	case "http_path":
+		_, path, _, _, _ := httpColumns(e.LogEntry)
+		return path
+	case "geo_country":
+		return e.GeoCountry
+	case "geo_city":
+		return e.GeoCity
+	case "geo_org":
+		return e.GeoOrg
+	case "severity":
+		return e.Severity
+	case "host":
+		return e.Host
+	case "service":
+		return e.Service
+	case "env":
+		return e.Env
+	case "tenant":
+		return e.Tenant
+	case "project":
+		return sourceProject(e.SourceID)
+	}
+	if key, ok := strings.CutPrefix(name, "fields."); ok {
+		return e.Fields[key]
+	}
+	return ""
+}
+
+// entryInt returns the integer field of e named by queryField.name.
+func entryInt(e StoredEntry, name string) int {
+	switch name {
+	case "status":
+		return e.StatusCode
+	case "line_no":
+		return e.LineNo
+	case "log_id":
+		return int(e.LogID)
+	case "geo_asn":
+		return int(e.GeoASN)
+	case "severity_number":
+		return e.SeverityNumber
+	case "template_id":
+		return int(e.TemplateID)
+	case "source_id":
+		return int(e.SourceID)
+	case "http_status":
+		_, _, status, _, _ := httpColumns(e.LogEntry)
+		return status
+	case "http_bytes":
+		_, _, _, bytes, _ := httpColumns(e.LogEntry)
+		return int(bytes)
+	}
+	return 0
+}
+
+// entryFloat returns the float field of e named by queryField.name, and whether e has it.
+func entryFloat(e StoredEntry, name string) (float64, bool) {
+	if name == "http_latency_ms" {
+		if _, _, _, _, latency := httpColumns(e.LogEntry); latency != nil {
+			return *latency, true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T cmp.Ordered](a, b T, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+// containsFold reports whether substr is within s, ignoring case like ILIKE.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// queryToken is a lexical token. kind is one of "word", "string", "op", "(" and ")".
+type queryToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+// queryOps lists the comparison operators, longest first so "!=" wins over "=".
+var queryOps = []string{"!=", "!~", ">=", "<=", "=", "~", ">", "<"}
+
+// lexQuery splits a query string into tokens.
+func lexQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case isQuerySpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{kind: string(c), text: string(c), pos: i})
+			i++
+		case c == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+				i++
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, queryToken{kind: "string", text: b.String(), pos: start})
+		default:
+			if op := matchQueryOp(s[i:]); op != "" {
+				tokens = append(tokens, queryToken{kind: "op", text: op, pos: i})
+				i += len(op)
+				continue
+			}
+			start := i
+			for i < len(s) && !isQueryDelimiter(s[i]) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, start)
+			}
+			tokens = append(tokens, queryToken{kind: "word", text: s[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+func matchQueryOp(s string) string {
+	for _, op := range queryOps {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isQueryDelimiter(c byte) bool {
+	return isQuerySpace(c) || strings.IndexByte(`()"=!~<>`, c) >= 0
+}
+
+// queryParser is a recursive descent parser over the token stream.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// parseQuery parses a query string into an expression tree.
+func parseQuery(s string) (queryNode, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword reports whether the next token is the given keyword and consumes it if so.
+func (p *queryParser) keyword(kw string) bool {
+	tok, ok := p.peek()
+	if ok && tok.kind == "word" && strings.EqualFold(tok.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.keyword("NOT") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{node}, nil
+	}
+
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	if tok.kind == "(" {
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := p.peek(); !ok || next.kind != ")" {
+			return nil, fmt.Errorf("missing ')' for '(' at position %d", tok.pos)
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryNode, error) {
+	if p.pos+3 > len(p.tokens) {
+		return nil, fmt.Errorf("incomplete comparison at position %d", p.tokens[p.pos].pos)
+	}
+	name, op, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	if name.kind != "word" {
+		return nil, fmt.Errorf("expected field name at position %d, got %q", name.pos, name.text)
+	}
+	field, ok := queryFields[strings.ToLower(name.text)]
+	if key, isStatic := strings.CutPrefix(name.text, "fields."); isStatic && staticFieldNameRegex.MatchString(key) {
+		// The key is restricted to [A-Za-z0-9_-], so it is safe to inline as a literal.
+		field, ok = queryField{name: name.text, column: "d.fields->>'" + key + "'", kind: textField}, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", name.text, name.pos)
+	}
+	if field.name == "message" || field.name == "raw" {
+		if err := encryption.searchable("field " + field.name); err != nil {
+			return nil, err
+		}
+	}
+	if op.kind != "op" {
+		return nil, fmt.Errorf("expected operator after %q at position %d", name.text, op.pos)
+	}
+	if value.kind != "word" && value.kind != "string" {
+		return nil, fmt.Errorf("expected value after %s%s at position %d", name.text, op.text, value.pos)
+	}
+	p.pos += 3
+
+	cmp := queryCmp{field: field, op: op.text}
+	switch {
+	case op.text == "~" || op.text == "!~":
+		if field.kind != textField {
+			return nil, fmt.Errorf("operator %s is not supported for field %s", op.text, field.name)
+		}
+		cmp.value = value.text
+	case field.kind == textField:
+		if op.text != "=" && op.text != "!=" {
+			return nil, fmt.Errorf("operator %s is not supported for field %s", op.text, field.name)
+		}
+		cmp.value = value.text
+	case field.kind.intBits() != 0:
+		// Checked against the column's type, which would otherwise fail the query.
+		bits := field.kind.intBits()
+		n, err := strconv.ParseInt(value.text, 10, bits)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("field %s expects a number from %d to %d, got %q",
+				field.name, int64(-1)<<(bits-1), int64(1)<<(bits-1)-1, value.text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s expects a number, got %q", field.name, value.text)
+		}
+		cmp.value = int(n)
+	case field.kind == floatField:
+		f, err := strconv.ParseFloat(value.text, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("field %s expects a number, got %q", field.name, value.text)
+		}
+		cmp.value = f
+	case field.kind == timeField:
+		t, err := time.Parse(time.RFC3339, value.text)
+		if err != nil {
+			return nil, fmt.Errorf("field %s expects an RFC 3339 timestamp, got %q", field.name, value.text)
+		}
+		cmp.value = t
+	}
+	return cmp, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQueryFieldsMatchEntry checks that match reads every field from the part of the
+// entry its column is exported from, so the two sides of a comparison are the same value.
+func TestQueryFieldsMatchEntry(t *testing.T) {
+	withSources(t, Source{ID: 4, Name: "api", Project: "shop"})
+	e := fullEntry()
+	exported := map[string]any{"project": "shop"}
+	for _, c := range exportColumns {
+		exported[c.Name] = c.value(&e)
+	}
+	exported["status"] = exported["status_code"]
+
+	for alias, field := range queryFields {
+		v, ok := exported[field.name]
+		if !ok {
+			t.Errorf("field %s: no exported column to compare with", alias)
+			continue
+		}
+		var value string
+		switch v := v.(type) {
+		case time.Time:
+			value = v.Format(time.RFC3339Nano)
+		default:
+			value = fmt.Sprint(v)
+		}
+		q := fmt.Sprintf("%s=%q", alias, value)
+		node, err := parseQuery(q)
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		if !node.match(e) {
+			t.Errorf("%s: doesn't match the entry it was taken from", q)
+		}
+		var args sqlArgs
+		if sql := node.sql(&args); !strings.Contains(sql, field.column) {
+			t.Errorf("%s: got %s, want a comparison of %s", q, sql, field.column)
+		}
+	}
+}
+
+func TestQuerySQLAndMatch(t *testing.T) {
+	withSources(t, Source{ID: 4, Name: "api", Project: "shop"})
+	full := fullEntry() // latency 42.5, status 200, http_status 500
+	plain := StoredEntry{LogEntry: LogEntry{Level: "INFO", Message: "started"}}
+
+	tests := []struct {
+		query string
+		sql   string
+		args  []any
+		full  bool // whether the query matches full
+		plain bool // and plain, which has no request and a NULL status_code
+	}{
+		{`level=error`, `lower(COALESCE(e.level, '')) = lower($1)`, []any{"error"}, true, false},
+		{`level!=error`, `lower(COALESCE(e.level, '')) != lower($1)`, []any{"error"}, false, true},
+		{`msg~"GET /"`, `COALESCE(e.message, '') ILIKE $1`, []any{"%GET /%"}, true, false},
+		{`msg!~100%`, `COALESCE(e.message, '') NOT ILIKE $1`, []any{`%100\%%`}, true, true},
+		{`fields.team=PAYMENTS`, `lower(COALESCE(d.fields->>'team', '')) = lower($1)`, []any{"PAYMENTS"}, true, false},
+		{`project=shop`, `lower(COALESCE((SELECT project FROM sources WHERE id = d.source_id), '')) = lower($1)`, []any{"shop"}, true, false},
+		{`status=0`, `COALESCE(d.status_code, 0) = $1`, []any{0}, false, true},
+		{`status!=200`, `COALESCE(d.status_code, 0) != $1`, []any{200}, false, true},
+		{`http_status>=500`, `e.http_status >= $1`, []any{500}, true, false},
+		{`http_status<500`, `e.http_status < $1`, []any{500}, false, true},
+		{`bytes>10000000000`, `e.http_bytes > $1`, []any{10000000000}, false, false},
+		{`latency>42`, `COALESCE(e.http_latency_ms > $1, false)`, []any{42.0}, true, false},
+		{`latency<=42.5`, `COALESCE(e.http_latency_ms <= $1, false)`, []any{42.5}, true, false},
+		{`latency=0`, `COALESCE(e.http_latency_ms = $1, false)`, []any{0.0}, false, false},
+		{`latency<100`, `COALESCE(e.http_latency_ms < $1, false)`, []any{100.0}, true, false},
+		{`NOT latency<100`, `NOT (COALESCE(e.http_latency_ms < $1, false))`, []any{100.0}, false, true},
+		{`received<2024-01-02T03:04:06Z`, `e.received_at < $1`, []any{time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)}, false, true},
+		{`level=error AND (sev>=17 OR asn=0)`, `(lower(COALESCE(e.level, '')) = lower($1) AND (e.severity_number >= $2 OR e.geo_asn = $3))`,
+			[]any{"error", 17, 0}, true, false},
+	}
+	for _, tt := range tests {
+		node, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var args sqlArgs
+		if sql := node.sql(&args); sql != tt.sql || !slices.Equal(args, tt.args) {
+			t.Errorf("%s: got %s %v, want %s %v", tt.query, sql, args, tt.sql, tt.args)
+		}
+		if got := node.match(full); got != tt.full {
+			t.Errorf("%s: match(full) = %v, want %v", tt.query, got, tt.full)
+		}
+		if got := node.match(plain); got != tt.plain {
+			t.Errorf("%s: match(plain) = %v, want %v", tt.query, got, tt.plain)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		sql   string // the tree, as rendered by sql
+		args  []any
+	}{
+		{`level=a OR level=b AND level=c`, `(L = lower($1) OR (L = lower($2) AND L = lower($3)))`, []any{"a", "b", "c"}},
+		{`(level=a OR level=b) AND level=c`, `((L = lower($1) OR L = lower($2)) AND L = lower($3))`, []any{"a", "b", "c"}},
+		{`level=a and not level=b or NOT NOT level=c`, `((L = lower($1) AND NOT (L = lower($2))) OR NOT (NOT (L = lower($3))))`, []any{"a", "b", "c"}},
+		{`NOT (level=a OR level=b)`, `NOT ((L = lower($1) OR L = lower($2)))`, []any{"a", "b"}},
+		{` LEVEL = "and" `, `L = lower($1)`, []any{"and"}},
+		{`level="a \"quoted\" \\ value"`, `L = lower($1)`, []any{`a "quoted" \ value`}},
+		{`level="x=y (z)"`, `L = lower($1)`, []any{"x=y (z)"}},
+		{"level=a\tAND\nlevel=b", `(L = lower($1) AND L = lower($2))`, []any{"a", "b"}},
+	}
+	for _, tt := range tests {
+		node, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		var args sqlArgs
+		sql := strings.ReplaceAll(node.sql(&args), "lower(COALESCE(e.level, ''))", "L")
+		if sql != tt.sql || !slices.Equal(args, tt.args) {
+			t.Errorf("%q: got %s %q, want %s %q", tt.query, sql, args, tt.sql, tt.args)
+		}
+	}
+}
+
+func TestParseQueryRejected(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{``, "empty query"},
+		{`level=`, "incomplete comparison at position 0"},
+		{`level error x`, "expected operator after"},
+		{`(level=error`, "missing ')' for '(' at position 0"},
+		{`level=error)`, `unexpected ")" at position 11`},
+		{`level=error OR`, "unexpected end of query"},
+		{`msg="timeout`, "unterminated string at position 4"},
+		{`colour=red`, `unknown field "colour"`},
+		{`fields.a.b=1`, `unknown field "fields.a.b"`},
+		{`level>error`, "operator > is not supported for field level"},
+		{`status~50`, "operator ~ is not supported for field status"},
+		{`status=ok`, `field status expects a number, got "ok"`},
+		{`http_status=70000`, `field http_status expects a number from -32768 to 32767, got "70000"`},
+		{`sev<-40000`, `field severity_number expects a number from -32768 to 32767`},
+		{`line=3000000000`, `field line_no expects a number from -2147483648 to 2147483647`},
+		{`bytes=99999999999999999999`, `field http_bytes expects a number from -9223372036854775808 to 9223372036854775807`},
+		{`latency>NaN`, `field http_latency_ms expects a number, got "NaN"`},
+		{`latency>Inf`, `field http_latency_ms expects a number, got "Inf"`},
+		{`received>yesterday`, "field received_at expects an RFC 3339 timestamp"},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.query)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
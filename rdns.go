@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reverse DNS enrichment is configured through the environment:
+//
+//	REVERSE_DNS              set to true to annotate entries with the PTR name of their client IP
+//	REVERSE_DNS_TTL          how long answers, including failures, are cached (default 1h)
+//	REVERSE_DNS_CONCURRENCY  maximum lookups in flight across all requests (default 8)
+//	REVERSE_DNS_TIMEOUT      time budget for the lookups of one ingest request (default 2s)
+
+// maxReverseDNSCacheEntries bounds the memory used by the cache.
+const maxReverseDNSCacheEntries = 50000
+
+// reverseDNSResolver looks up hostnames for client IPs with a TTL cache in front of the resolver.
+type reverseDNSResolver struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	timeout  time.Duration
+	slots    chan struct{} // limits concurrent lookups
+
+	mu    sync.Mutex
+	cache map[string]reverseDNSAnswer
+}
+
+// reverseDNSAnswer is a cached lookup result; an empty name records a failed lookup.
+type reverseDNSAnswer struct {
+	name    string
+	expires time.Time
+}
+
+// rdns holds nil when reverse DNS enrichment is disabled. It is replaced on reloads.
+var rdns atomic.Pointer[reverseDNSResolver]
+
+// setupReverseDNS enables reverse DNS enrichment if REVERSE_DNS is set.
+func setupReverseDNS() {
+	d, err := newReverseDNSResolver()
+	if err != nil {
+		fatalConfig("Invalid reverse DNS settings", "err", err)
+	}
+	rdns.Store(d)
+	if d != nil {
+		slog.Info("Reverse DNS enrichment enabled", "ttl", d.ttl, "concurrency", cap(d.slots))
+	}
+}
+
+// newReverseDNSResolver returns the resolver of the settings, or nil if it is disabled.
+func newReverseDNSResolver() (*reverseDNSResolver, error) {
+	if enabled, _ := strconv.ParseBool(setting("REVERSE_DNS")); !enabled || disabled["reverse_dns"] {
+		return nil, nil
+	}
+
+	ttl, err := durationSetting("REVERSE_DNS_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := durationSetting("REVERSE_DNS_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := 8
+	if v := setting("REVERSE_DNS_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("REVERSE_DNS_CONCURRENCY %q must be a positive number", v)
+		}
+		concurrency = n
+	}
+
+	return &reverseDNSResolver{
+		resolver: net.DefaultResolver,
+		ttl:      ttl,
+		timeout:  timeout,
+		slots:    make(chan struct{}, concurrency),
+		cache:    map[string]reverseDNSAnswer{},
+	}, nil
+}
+
+// envDuration reads a time.Duration from the environment, exiting on an invalid value.
+func envDuration(name string, def time.Duration) time.Duration {
+	d, err := durationSetting(name, def)
+	if err != nil {
+		fatalConfig("Invalid "+name+": must be a positive duration such as 30s", "value", setting(name))
+	}
+	return d
+}
+
+// durationSetting reads a positive time.Duration setting, def if it isn't set.
+func durationSetting(name string, def time.Duration) (time.Duration, error) {
+	v := setting(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive duration such as 30s", name, v)
+	}
+	return d, nil
+}
+
+// annotate sets ClientHost on the entries, extracting their client IP first if no other
+// enrichment has. Distinct addresses are looked up in parallel; lookups that do not finish
+// within the time budget leave the hostname empty. It is a no-op when disabled.
+func (d *reverseDNSResolver) annotate(entries []StoredEntry) {
+	if d == nil {
+		return
+	}
+
+	names := map[string]string{}
+	for i := range entries {
+		e := &entries[i]
+		if e.ClientIP == "" {
+			if addr, ok := extractIP(entryLine(e.LogEntry)); ok {
+				e.ClientIP = addr.String()
+			}
+		}
+		if e.ClientIP != "" {
+			names[e.ClientIP] = ""
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for ip := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := d.lookup(ctx, ip)
+			mu.Lock()
+			names[ip] = name
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for i := range entries {
+		if ip := entries[i].ClientIP; ip != "" {
+			entries[i].ClientHost = names[ip]
+		}
+	}
+}
+
+// lookup returns the first PTR name of ip without the trailing dot, or "" if there is none.
+func (d *reverseDNSResolver) lookup(ctx context.Context, ip string) string {
+	now := time.Now()
+	d.mu.Lock()
+	answer, ok := d.cache[ip]
+	d.mu.Unlock()
+	if ok && now.Before(answer.expires) {
+		return answer.name
+	}
+
+	select {
+	case d.slots <- struct{}{}:
+		defer func() { <-d.slots }()
+	case <-ctx.Done():
+		return ""
+	}
+
+	names, err := d.resolver.LookupAddr(ctx, ip)
+	if ctx.Err() != nil {
+		// Out of time: don't cache, a later request may get an answer.
+		return ""
+	}
+	name := ""
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	d.mu.Lock()
+	if len(d.cache) >= maxReverseDNSCacheEntries {
+		d.evictExpired(now)
+	}
+	d.cache[ip] = reverseDNSAnswer{name: name, expires: now.Add(d.ttl)}
+	d.mu.Unlock()
+	return name
+}
+
+// evictExpired drops expired answers, or an arbitrary half of the cache if none have expired.
+// d.mu must be held.
+func (d *reverseDNSResolver) evictExpired(now time.Time) {
+	for ip, answer := range d.cache {
+		if now.After(answer.expires) {
+			delete(d.cache, ip)
+		}
+	}
+	if len(d.cache) < maxReverseDNSCacheEntries {
+		return
+	}
+	n := len(d.cache) / 2
+	for ip := range d.cache {
+		if n == 0 {
+			break
+		}
+		delete(d.cache, ip)
+		n--
+	}
+}
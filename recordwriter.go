@@ -0,0 +1,321 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Records are stored in the background by a pool of writers, in groups: while a writer is
+// busy, the records that arrive queue up, and are then written together. Each group is one
+// transaction, copying the requests into delogged and their entries into delogged_entries
+// with COPY, and sending the template, issue and source upserts in one round trip:
+//
+//	INSERT_WORKERS         number of writers; default 2
+//	INSERT_QUEUE_SIZE      most records waiting to be written; default 10000
+//	INSERT_BATCH_SIZE      most records written at once; default 500
+//	INSERT_BATCH_INTERVAL  how long a writer waits for more records once it has one;
+//	                       default 0, writing only those already waiting
+//
+// A parse request is answered once its record is queued, not stored. When the queue is
+// full, requests are refused with 503 and a Retry-After header until the writers catch up,
+// rather than holding connections open or losing records. If a group fails, its records
+// are retried one by one, so one bad record doesn't lose the others; while the database is
+// unreachable, groups are retried as they are, see dbpool.go.
+
+const (
+	recordWriteTimeout = 30 * time.Second // bounds the writing of one group
+	queueRetryAfter    = "5"              // seconds, answered when the queue is full
+)
+
+// pendingRecord is a record with its enriched entries, waiting to be written. ctx carries
+// the request's trace and log attributes. The writer sets the ids of the entries.
+type pendingRecord struct {
+	ctx       context.Context
+	record    LogRecord
+	entries   []StoredEntry
+	templates []templateUpdate
+	issues    []issueUpdate
+}
+
+// Entries returns the entries of p, for package storage.
+func (p *pendingRecord) Entries() []StoredEntry {
+	return p.entries
+}
+
+var recordWriter = struct {
+	queue    chan *pendingRecord
+	workers  int
+	capacity int64
+	size     int
+	interval time.Duration
+
+	pending  atomic.Int64 // reserved slots: records queued, being parsed or being written
+	rejected atomic.Int64 // requests refused because the queue was full
+	records  *histogram   // records per group
+}{workers: 2, capacity: 10000, size: 500, records: newHistogram(1, 2, 5, 10, 25, 50, 100, 250, 500, 1000)}
+
+// setupRecordWriter reads the queue settings and starts the writers.
+func setupRecordWriter() {
+	var capacity int
+	for _, s := range []struct {
+		env   string
+		value *int
+	}{{"INSERT_WORKERS", &recordWriter.workers}, {"INSERT_QUEUE_SIZE", &capacity}, {"INSERT_BATCH_SIZE", &recordWriter.size}} {
+		if v := setting(s.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				fatalConfig("Invalid "+s.env+": must be a positive number", "value", v)
+			}
+			*s.value = n
+		}
+	}
+	if capacity > 0 {
+		recordWriter.capacity = int64(capacity)
+	}
+	if v := setting("INSERT_BATCH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			fatalConfig("Invalid INSERT_BATCH_INTERVAL", "value", v)
+		}
+		recordWriter.interval = d
+	}
+	if !inMemory() {
+		if maxConns := dbPool.Config().MaxConns; int32(recordWriter.workers) >= maxConns {
+			slog.Warn("INSERT_WORKERS leaves no database connections for queries; raise DB_MAX_CONNS",
+				"workers", recordWriter.workers, "max_conns", maxConns)
+		}
+	}
+	recordWriter.queue = make(chan *pendingRecord, recordWriter.capacity)
+	for range recordWriter.workers {
+		go runRecordWriter()
+	}
+}
+
+// reserveRecord reserves a place in the queue for a record, reporting false if it is full.
+// A reserved place is released once the record is written, so every reservation must be
+// followed by a call to recordLog.
+func reserveRecord() bool {
+	return reserveRecords(1)
+}
+
+// reserveRecords reserves places for n records at once, or none.
+func reserveRecords(n int) bool {
+	for {
+		pending := recordWriter.pending.Load()
+		if pending+int64(n) > recordWriter.capacity {
+			recordWriter.rejected.Add(1)
+			return false
+		}
+		if recordWriter.pending.CompareAndSwap(pending, pending+int64(n)) {
+			return true
+		}
+	}
+}
+
+// refuseQueueFull answers a request for which no place could be reserved.
+func refuseQueueFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", queueRetryAfter)
+	http.Error(w, "Service unavailable: too many records waiting to be stored", http.StatusServiceUnavailable)
+	slog.WarnContext(r.Context(), "Rejected request: write queue full", "pending", recordWriter.pending.Load())
+}
+
+// enqueueRecord queues p in its reserved place.
+func enqueueRecord(p *pendingRecord) {
+	recordWriter.queue <- p
+}
+
+func runRecordWriter() {
+	for p := range recordWriter.queue {
+		group := gatherRecords(p)
+		recordWriter.records.observe(float64(len(group)))
+		err := writeUntilStored(group)
+		if err != nil && len(group) > 1 {
+			for _, p := range group {
+				finishRecord(p, store.WriteRecords([]*pendingRecord{p}))
+			}
+			continue
+		}
+		for _, p := range group {
+			finishRecord(p, err)
+		}
+	}
+}
+
+// finishRecord releases the place of a written record and passes its entries on to the
+// alerts and live tails.
+func finishRecord(p *pendingRecord, err error) {
+	recordWriter.pending.Add(-1)
+	putJSONBuffer(p.record.responseBuf)
+	if err != nil {
+		slog.ErrorContext(p.ctx, "Failed to insert log record into PostgreSQL", "entries", len(p.entries), "err", err)
+		return
+	}
+	if p.record.Entries != nil {
+		ingest.duration.observe(time.Since(p.record.Timestamp).Seconds())
+	}
+	meterRecord(&p.record, len(p.entries))
+	if len(p.entries) > 0 {
+		alerts.matchPatterns(p.entries)
+		tail.publish(p.entries)
+	}
+}
+
+// gatherRecords returns first with the records queued behind it, waiting up to the
+// interval for more.
+func gatherRecords(first *pendingRecord) []*pendingRecord {
+	group := []*pendingRecord{first}
+	if recordWriter.interval == 0 {
+		for len(group) < recordWriter.size {
+			select {
+			case p := <-recordWriter.queue:
+				group = append(group, p)
+			default:
+				return group
+			}
+		}
+		return group
+	}
+
+	timer := time.NewTimer(recordWriter.interval)
+	defer timer.Stop()
+	for len(group) < recordWriter.size {
+		select {
+		case p := <-recordWriter.queue:
+			group = append(group, p)
+		case <-timer.C:
+			return group
+		}
+	}
+	return group
+}
+
+// WriteRecords stores a group of records in one transaction.
+func (postgresStorage) WriteRecords(group []*pendingRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), recordWriteTimeout)
+	defer cancel()
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// COPY can't return the generated ids, so they are drawn from the sequences first.
+	var entries []*StoredEntry
+	for _, p := range group {
+		for i := range p.entries {
+			entries = append(entries, &p.entries[i])
+		}
+	}
+	logIDs, err := reserveIDs(ctx, tx, "delogged", len(group))
+	if err != nil {
+		return err
+	}
+	entryIDs, err := reserveIDs(ctx, tx, "delogged_entries", len(entries))
+	if err != nil {
+		return err
+	}
+	for i, p := range group {
+		for j := range p.entries {
+			p.entries[j].LogID = logIDs[i]
+		}
+	}
+	for i, e := range entries {
+		e.ID = entryIDs[i]
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"delogged"},
+		[]string{"id", "timestamp", "remote_addr", "request_body", "response_body", "status_code", "error_msg", "host",
+			"service", "env", "redactions", "fields", "tenant", "source_id"},
+		pgx.CopyFromSlice(len(group), func(i int) ([]any, error) {
+			r := group[i].record
+			return []any{logIDs[i], r.Timestamp, r.RemoteAddr, encryption.encrypt("request_body", r.requestBody()),
+				encryption.encryptJSON("response_body", r.ResponseBody), r.StatusCode, r.ErrorMsg, r.Host, r.Service, r.Env,
+				r.Redactions, r.Fields, r.Tenant, r.SourceID}, nil
+		}))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"delogged_entries"},
+		[]string{"id", "log_id", "received_at", "line_no", "log_timestamp", "level", "message", "raw", "correlation_id",
+			"client_ip", "geo_country", "geo_city", "geo_asn", "geo_org", "severity", "severity_number", "log_time",
+			"client_host", "fingerprint", "template_id", "trace_id", "span_id", "request_id", "http_method", "http_path",
+			"http_status", "http_bytes", "http_latency_ms", "repeats", "sample_rate"},
+		pgx.CopyFromSlice(len(entries), func(i int) ([]any, error) {
+			e := entries[i]
+			method, path, status, bytes, latency := httpColumns(e.LogEntry)
+			return []any{e.ID, e.LogID, e.ReceivedAt, e.LineNo, e.Timestamp, e.Level,
+				encryption.encrypt("message", e.Message), encryption.encrypt("raw", e.Raw), e.CorrelationID,
+				encryption.encrypt("client_ip", e.ClientIP), e.GeoCountry, e.GeoCity, e.GeoASN, e.GeoOrg, e.Severity,
+				e.SeverityNumber, e.LogTime, encryption.encrypt("client_host", e.ClientHost), e.Fingerprint, e.TemplateID,
+				e.TraceID, e.SpanID, e.RequestID, method, path, status, bytes, latency, e.Repeats, e.SampleRate}, nil
+		}))
+	if err != nil {
+		return err
+	}
+
+	// The upserts are sent in key order, so concurrent writers touching the same rows can't
+	// deadlock.
+	var templates []templateUpdate
+	var issues []issueUpdate
+	for _, p := range group {
+		templates = append(templates, p.templates...)
+		issues = append(issues, p.issues...)
+	}
+	sources := slices.Clone(group)
+	slices.SortStableFunc(sources, func(a, b *pendingRecord) int {
+		return strings.Compare(sourceName(a.record.RemoteAddr), sourceName(b.record.RemoteAddr))
+	})
+	slices.SortStableFunc(templates, func(a, b templateUpdate) int { return cmp.Compare(a.id, b.id) })
+	slices.SortStableFunc(issues, func(a, b issueUpdate) int {
+		return cmp.Or(strings.Compare(a.service, b.service), cmp.Compare(a.templateID, b.templateID))
+	})
+
+	batch := &pgx.Batch{}
+	for _, p := range sources {
+		r := p.record
+		batch.Queue(sourceActivitySQL, sourceName(r.RemoteAddr), r.Host, r.Service, r.Env, r.Tenant, r.Timestamp)
+	}
+	for _, t := range templates {
+		batch.Queue(templateUpsertSQL, t.id, t.template, t.added, t.firstSeen, t.lastSeen)
+	}
+	for _, u := range issues {
+		batch.Queue(issueUpsertSQL, u.service, u.templateID, u.title, u.level, u.added, u.firstSeen, u.lastSeen, encryption.encrypt("message", u.lastMessage))
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// reserveIDs draws n values from the sequence of table's id column.
+func reserveIDs(ctx context.Context, tx pgx.Tx, table string, n int) ([]int64, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	rows, err := tx.Query(ctx, `SELECT nextval(pg_get_serial_sequence($1, 'id')) FROM generate_series(1, $2)`, table, n)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+// writeRecordWriterMetrics adds the group sizes and the queue state to /metrics.
+func writeRecordWriterMetrics(m metricsWriter) {
+	m.histogram("delogger_insert_batch_records", "Records written per insert batch.", recordWriter.records.snapshot())
+	m.value("delogger_insert_queue_records", "gauge", "Records reserved in the write queue and not yet written.",
+		float64(recordWriter.pending.Load()))
+	m.value("delogger_insert_queue_capacity", "gauge", "Size of the write queue.", float64(recordWriter.capacity))
+	m.value("delogger_insert_rejected_total", "counter", "Records refused because the write queue was full.",
+		float64(recordWriter.rejected.Load()))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Redaction is configured through the environment:
+//
+//	SECRET_SCRUB         set to false to keep secrets and tokens (see secretRedactionRules); default on
+//	PII_REDACT           comma-separated built-in rules to apply: email, credit_card, ssn, phone, or all
+//	PII_REDACT_PATTERNS  path to a file of custom rules, one "name regex" per line; # starts a comment
+//
+// Redaction runs on the request body before it is parsed, so neither request_body, the parsed
+// entries nor the response contain the original values. Matches become [REDACTED:<rule>].
+
+// redactionRule replaces the matches of re that pass valid, if set. If group is non-zero only
+// that submatch is replaced, so the key of a key=value pair stays readable.
+type redactionRule struct {
+	name  string
+	re    *regexp.Regexp
+	group int
+	valid func(match string) bool
+}
+
+// builtinRedactionRules are applied in this order, so longer digit runs such as card
+// numbers are masked before the phone rule can match part of them.
+var builtinRedactionRules = []redactionRule{
+	{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	{name: "credit_card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{name: "phone", re: regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)\s?|\b\d{3}[\s.-])\d{3}[\s.-]\d{4}\b`)},
+}
+
+// redactor applies an ordered list of rules.
+type redactor struct {
+	rules []redactionRule
+}
+
+// redaction holds nil when no rules are configured. It is replaced on reloads.
+var redaction atomic.Pointer[redactor]
+
+// setupRedaction builds the redactor from SECRET_SCRUB, PII_REDACT and PII_REDACT_PATTERNS.
+func setupRedaction() {
+	r, err := newRedactor()
+	if err != nil {
+		fatalConfig("Invalid redaction settings", "err", err)
+	}
+	redaction.Store(r)
+	if r != nil {
+		slog.Info("Redacting before storage", "rules", strings.Join(r.names(), ", "))
+	}
+}
+
+// newRedactor returns the redactor of the settings, or nil if they configure no rules.
+func newRedactor() (*redactor, error) {
+	var rules []redactionRule
+
+	scrub := true
+	if v := setting("SECRET_SCRUB"); v != "" {
+		var err error
+		scrub, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_SCRUB %q must be true or false", v)
+		}
+	}
+	if scrub {
+		rules = append(rules, secretRedactionRules...)
+	}
+
+	if v := setting("PII_REDACT"); v != "" {
+		builtin, err := builtinRedaction(strings.Split(v, ","))
+		if err != nil {
+			return nil, fmt.Errorf("%w in PII_REDACT", err)
+		}
+		rules = append(rules, builtin...)
+	}
+
+	if path := setting("PII_REDACT_PATTERNS"); path != "" {
+		custom, err := loadRedactionPatterns(path)
+		if err != nil {
+			return nil, fmt.Errorf("PII_REDACT_PATTERNS: %w", err)
+		}
+		rules = append(rules, custom...)
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return &redactor{rules: rules}, nil
+}
+
+// builtinRedaction returns the built-in rules named, or all of them for "all".
+func builtinRedaction(names []string) ([]redactionRule, error) {
+	var rules []redactionRule
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, rule := range builtinRedactionRules {
+			if name == "all" || rule.name == name {
+				rules = append(rules, rule)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redaction rule %q", name)
+		}
+	}
+	return rules, nil
+}
+
+// names returns the names of the rules, in order.
+func (r *redactor) names() []string {
+	names := make([]string, len(r.rules))
+	for i, rule := range r.rules {
+		names[i] = rule.name
+	}
+	return names
+}
+
+// loadRedactionPatterns reads custom rules from a file of "name regex" lines.
+func loadRedactionPatterns(path string) ([]redactionRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []redactionRule
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, ok := strings.Cut(line, " ")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("%s:%d: expected a name and a regex", path, lineNo)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		rules = append(rules, redactionRule{name: name, re: re})
+	}
+	return rules, scanner.Err()
+}
+
+// redact masks every rule match in text and returns the number of matches per rule.
+// It is a no-op when redaction is disabled.
+func (r *redactor) redact(text string) (string, map[string]int) {
+	counts := map[string]int{}
+	if r == nil {
+		return text, counts
+	}
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(text, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[2*rule.group], m[2*rule.group+1]
+			if start < 0 || rule.valid != nil && !rule.valid(text[start:end]) {
+				continue
+			}
+			b.WriteString(text[last:start])
+			b.WriteString("[REDACTED:" + rule.name + "]")
+			last = end
+			counts[rule.name]++
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text, counts
+}
+
+// redactionReport formats redaction counts for the X-DeLogger-Redactions header,
+// e.g. "email=2, password=1".
+func redactionReport(counts map[string]int) string {
+	parts := make([]string, 0, len(counts))
+	for name, n := range counts {
+		parts = append(parts, name+"="+strconv.Itoa(n))
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ", ")
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum used by card numbers.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
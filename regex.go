@@ -0,0 +1,364 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Guards for user-supplied regex= patterns. PostgreSQL's regex engine backtracks, so
+// patterns are restricted to what RE2 accepts and bounded in size and nesting.
+// Patterns are written in RE2 syntax and translated for PostgreSQL (see postgresRegex).
+const (
+	maxRegexLength      = 512
+	maxRegexNodes       = 256
+	maxRegexRepeatDepth = 2
+	regexSearchTimeout  = 5 * time.Second
+	regexCacheSize      = 256 // compiled patterns kept for reuse
+	maxPostgresRepeat   = 255 // the largest {n,m} count PostgreSQL accepts
+)
+
+// searchRegex is a regex= pattern compiled for in-memory matching, with its translation
+// for PostgreSQL's ~ operator.
+type searchRegex struct {
+	*regexp.Regexp
+	sql string
+}
+
+// regexCache keeps the most recently used regex= patterns compiled, or their error, so a
+// dashboard polling the same search doesn't validate and compile it on every request.
+type regexCache struct {
+	mu      sync.Mutex
+	order   *list.List // of *cachedRegex, most recently used first
+	entries map[string]*list.Element
+
+	hits, misses atomic.Int64
+}
+
+type cachedRegex struct {
+	pattern string
+	re      *searchRegex
+	err     error
+}
+
+var searchRegexes = &regexCache{order: list.New(), entries: map[string]*list.Element{}}
+
+// get returns the compiled pattern from the cache, compiling and adding it if missing.
+func (c *regexCache) get(pattern string, compile func(string) (*searchRegex, error)) (*searchRegex, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		entry := el.Value.(*cachedRegex)
+		return entry.re, entry.err
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	re, err := compile(pattern)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[pattern]; !ok {
+		c.entries[pattern] = c.order.PushFront(&cachedRegex{pattern: pattern, re: re, err: err})
+		if c.order.Len() > regexCacheSize {
+			oldest := c.order.Remove(c.order.Back()).(*cachedRegex)
+			delete(c.entries, oldest.pattern)
+		}
+	}
+	return re, err
+}
+
+// entryLineExpr rebuilds the original log line of an entry: raw for unmatched lines, the
+// message for access log lines, otherwise the "[timestamp] [level] message" form the parser consumed.
+const entryLineExpr = `CASE WHEN e.raw <> '' THEN e.raw WHEN e.http_method <> '' THEN e.message ELSE '[' || e.log_timestamp || '] [' || e.level || '] ' || e.message END`
+
+// entryLine is the in-memory equivalent of entryLineExpr.
+func entryLine(e LogEntry) string {
+	if e.Raw != "" {
+		return e.Raw
+	}
+	if e.HTTP != nil {
+		return e.Message
+	}
+	return "[" + e.Timestamp + "] [" + e.Level + "] " + e.Message
+}
+
+// compileSearchRegex validates a regex= pattern and compiles it for in-memory matching and
+// for PostgreSQL, reusing the result for a recently seen pattern.
+func compileSearchRegex(pattern string) (*searchRegex, error) {
+	return searchRegexes.get(pattern, validateSearchRegex)
+}
+
+func validateSearchRegex(pattern string) (*searchRegex, error) {
+	if len(pattern) > maxRegexLength {
+		return nil, fmt.Errorf("pattern longer than %d characters", maxRegexLength)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := 0
+	var walk func(re *syntax.Regexp, depth int) error
+	walk = func(re *syntax.Regexp, depth int) error {
+		nodes++
+		if nodes > maxRegexNodes {
+			return fmt.Errorf("pattern is too complex")
+		}
+		switch re.Op {
+		case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+			depth++
+			if depth > maxRegexRepeatDepth {
+				return fmt.Errorf("pattern nests repetition more than %d levels deep", maxRegexRepeatDepth)
+			}
+		}
+		for _, sub := range re.Sub {
+			if err := walk(sub, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(re, 0); err != nil {
+		return nil, err
+	}
+
+	sql, err := postgresRegex(re)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &searchRegex{Regexp: compiled, sql: sql}, nil
+}
+
+// postgresRegex writes a parsed RE2 pattern as a PostgreSQL advanced regular expression
+// matching the same lines. Passing the pattern through unchanged isn't enough: the two
+// syntaxes disagree on ., $, \b, (?i), \z, escapes inside brackets and the classes behind
+// \d, \w and [[:alpha:]]. The parser has already spelled out every class and flag, so the
+// tree is written back with only literals, explicit bracket ranges, groups and
+// lookaround constraints, which both engines read the same way.
+func postgresRegex(re *syntax.Regexp) (string, error) {
+	var b strings.Builder
+	if err := writePostgresRegex(&b, re); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// postgresWordChar is the class behind RE2's \b, which PostgreSQL's \y would widen to
+// every Unicode letter and digit.
+const postgresWordChar = "[0-9A-Za-z_]"
+
+func writePostgresRegex(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return fmt.Errorf("pattern can never match")
+	case syntax.OpEmptyMatch:
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == 0 {
+				return fmt.Errorf("log lines can't contain NUL characters")
+			}
+			if re.Flags&syntax.FoldCase == 0 {
+				writePostgresRune(b, r)
+				continue
+			}
+			// Each rune with every case of it, as RE2 folds them.
+			b.WriteByte('[')
+			writePostgresRune(b, r)
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				writePostgresRune(b, f)
+			}
+			b.WriteByte(']')
+		}
+	case syntax.OpCharClass:
+		return writePostgresClass(b, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		b.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		// . matches newlines in PostgreSQL unless the newline-sensitive flag is set.
+		b.WriteByte('.')
+	case syntax.OpBeginText:
+		b.WriteByte('^')
+	case syntax.OpEndText:
+		b.WriteByte('$')
+	case syntax.OpBeginLine:
+		b.WriteString(`(?:^|(?<=\n))`)
+	case syntax.OpEndLine:
+		b.WriteString(`(?:$|(?=\n))`)
+	case syntax.OpWordBoundary:
+		b.WriteString("(?:(?<=" + postgresWordChar + ")(?!" + postgresWordChar + ")|(?<!" + postgresWordChar + ")(?=" + postgresWordChar + "))")
+	case syntax.OpNoWordBoundary:
+		b.WriteString("(?:(?<=" + postgresWordChar + ")(?=" + postgresWordChar + ")|(?<!" + postgresWordChar + ")(?!" + postgresWordChar + "))")
+	case syntax.OpCapture:
+		return writePostgresGroup(b, re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		switch re.Sub[0].Op {
+		case syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine,
+			syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+			return fmt.Errorf("can't repeat an assertion")
+		}
+		if err := writePostgresGroup(b, re.Sub[0]); err != nil {
+			return err
+		}
+		// Laziness changes what a match covers but not whether there is one, and ~ only
+		// asks the latter.
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteByte('*')
+		case syntax.OpPlus:
+			b.WriteByte('+')
+		case syntax.OpQuest:
+			b.WriteByte('?')
+		default:
+			if re.Min > maxPostgresRepeat || re.Max > maxPostgresRepeat {
+				return fmt.Errorf("repetition count above %d", maxPostgresRepeat)
+			}
+			b.WriteString("{" + strconv.Itoa(re.Min))
+			if re.Max != re.Min {
+				b.WriteByte(',')
+				if re.Max >= 0 {
+					b.WriteString(strconv.Itoa(re.Max))
+				}
+			}
+			b.WriteByte('}')
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writePostgresRegex(b, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		b.WriteString("(?:")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			if err := writePostgresRegex(b, sub); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(')')
+	default:
+		return fmt.Errorf("unsupported construct %s", re)
+	}
+	return nil
+}
+
+func writePostgresGroup(b *strings.Builder, re *syntax.Regexp) error {
+	if re.Op == syntax.OpAlternate {
+		return writePostgresRegex(b, re) // already grouped
+	}
+	b.WriteString("(?:")
+	if err := writePostgresRegex(b, re); err != nil {
+		return err
+	}
+	b.WriteByte(')')
+	return nil
+}
+
+// writePostgresClass writes the ranges of a class as a bracket expression, negated when
+// that is shorter. NUL is left out of both forms since no line contains it.
+func writePostgresClass(b *strings.Builder, ranges []rune) error {
+	negated := len(ranges) > 0 && ranges[0] == 0 && ranges[len(ranges)-1] == unicode.MaxRune
+	if negated {
+		// The gaps between the ranges, which RE2 keeps sorted and apart.
+		var gaps []rune
+		for i := 1; i+1 < len(ranges); i += 2 {
+			gaps = append(gaps, ranges[i]+1, ranges[i+1]-1)
+		}
+		ranges = gaps
+	}
+	if len(ranges) > 0 && ranges[0] == 0 {
+		if ranges[1] == 0 {
+			ranges = ranges[2:]
+		} else {
+			ranges = append([]rune{1}, ranges[1:]...)
+		}
+	}
+	if len(ranges) == 0 {
+		if negated {
+			b.WriteByte('.')
+			return nil
+		}
+		return fmt.Errorf("pattern can never match")
+	}
+
+	b.WriteByte('[')
+	if negated {
+		b.WriteByte('^')
+	}
+	for i := 0; i < len(ranges); i += 2 {
+		writePostgresRune(b, ranges[i])
+		if ranges[i+1] != ranges[i] {
+			b.WriteByte('-')
+			writePostgresRune(b, ranges[i+1])
+		}
+	}
+	b.WriteByte(']')
+	return nil
+}
+
+// writePostgresRune writes r so it stands for itself both outside and inside brackets:
+// ASCII letters, digits and spaces as they are, other printable ASCII behind a backslash, and
+// anything else as a \u or \U escape.
+func writePostgresRune(b *strings.Builder, r rune) {
+	switch {
+	case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' '):
+		b.WriteRune(r)
+	case r < utf8.RuneSelf && unicode.IsPrint(r):
+		b.WriteByte('\\')
+		b.WriteRune(r)
+	case r <= 0xFFFF:
+		fmt.Fprintf(b, `\u%04x`, r)
+	default:
+		fmt.Fprintf(b, `\U%08x`, r)
+	}
+}
+
+// withTimeout bounds ctx by regexSearchTimeout when the filter runs a regex search.
+func (f entryFilter) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.Regex == nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, regexSearchTimeout)
+}
+
+// isQueryTimeout reports whether err came from a query cancelled for running too long.
+func isQueryTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "57014" {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
+
+// writeQueryError reports a failed entry query, telling the client when a regex search
+// was too slow rather than reporting a server error.
+func writeQueryError(w http.ResponseWriter, r *http.Request, err error, what string) {
+	if isQueryTimeout(err) && r.Context().Err() == nil {
+		http.Error(w, "Search timed out; narrow the time range or simplify the regex", http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, "Could not "+what, http.StatusInternalServerError)
+	slog.ErrorContext(r.Context(), "Error trying to "+what, "err", err)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSearchRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		line    string
+		match   bool   // what matches, and so PostgreSQL, must say
+		sql     string // the pattern where hands to PostgreSQL
+	}{
+		{`disk full`, "[t] [ERROR] disk full", true, `disk full`},
+		{`a.c`, "a\nc", false, `a[^\n]c`},
+		{`(?s)a.c`, "a\nc", true, `a.c`},
+		{`^\[t\]`, "[t] [ERROR] x", true, `^\[t\]`},
+		{`x$`, "x\n", false, `x$`},
+		{`x\z`, "x", true, `x$`},
+		{`(?m)^b$`, "a\nb\nc", true, `(?:^|(?<=\n))b(?:$|(?=\n))`},
+		{`ERROR (?i)disk`, "ERROR DISK", true, `ERROR [Dd][Ii][Ss\u017f][Kk\u212a]`},
+		{`(?i)error`, "Error", true, `[Ee][Rr][Rr][Oo][Rr]`},
+		{`\d+ms`, "took 42ms", true, `(?:[0-9])+ms`},
+		{`\d`, "٣", false, `[0-9]`},
+		{`\w`, "é", false, `[0-9A-Z\_a-z]`},
+		{`[[:alpha:]]`, "é", false, `[A-Za-z]`},
+		{`[\d.]+`, "1.5", true, `(?:[\.0-9])+`},
+		{`[^a]`, "\n", true, `[^a]`},
+		{`\bid\b`, "café id", true, `(?:(?<=[0-9A-Za-z_])(?![0-9A-Za-z_])|(?<![0-9A-Za-z_])(?=[0-9A-Za-z_]))id(?:(?<=[0-9A-Za-z_])(?![0-9A-Za-z_])|(?<![0-9A-Za-z_])(?=[0-9A-Za-z_]))`},
+		{`\bf\b`, "éfé", true, `(?:(?<=[0-9A-Za-z_])(?![0-9A-Za-z_])|(?<![0-9A-Za-z_])(?=[0-9A-Za-z_]))f(?:(?<=[0-9A-Za-z_])(?![0-9A-Za-z_])|(?<![0-9A-Za-z_])(?=[0-9A-Za-z_]))`},
+		{`time(out|d out)`, "timed out", true, `time(?:out|d out)`},
+		{`a{2,3}?b`, "aab", true, `(?:a){2,3}b`},
+		{`é`, "café", true, `\u00e9`},
+		{`\x{1F600}`, "\U0001F600", true, `\U0001f600`},
+	}
+	for _, tt := range tests {
+		f, err := parseEntryFilter(url.Values{"regex": {tt.pattern}})
+		if err != nil {
+			t.Errorf("%s: %v", tt.pattern, err)
+			continue
+		}
+		if got := f.Matches(StoredEntry{LogEntry: LogEntry{Raw: tt.line}}); got != tt.match {
+			t.Errorf("%s on %q: matches = %v, want %v", tt.pattern, tt.line, got, tt.match)
+		}
+		var args sqlArgs
+		if where := f.where(&args); !strings.Contains(where, ") ~ $1") || len(args) != 1 || args[0] != tt.sql {
+			t.Errorf("%s: where = %s %q, want the pattern %q", tt.pattern, where, args, tt.sql)
+		}
+	}
+}
+
+func TestSearchRegexRejected(t *testing.T) {
+	tests := []struct {
+		pattern string
+		err     string
+	}{
+		{`a(`, "missing closing )"},
+		{strings.Repeat("a", maxRegexLength+1), "pattern longer than"},
+		{`((a*)*)*`, "pattern nests repetition"},
+		{`a{256}`, "repetition count above 255"},
+		{`\x00`, "log lines can't contain NUL characters"},
+		{`[^\x00-\x{10FFFF}]`, "pattern can never match"},
+		{`(?:\b)+`, "can't repeat an assertion"},
+	}
+	for _, tt := range tests {
+		_, err := parseEntryFilter(url.Values{"regex": {tt.pattern}})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%.20s: got error %v, want %q", tt.pattern, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Part of the configuration can be changed without a restart, by sending the server SIGHUP
+// or calling POST /api/admin/reload. The configuration file is read again (the environment
+// and flags of a running process can't change), and these are rebuilt from the settings
+// and the files they name:
+//
+//	LOG_LEVEL
+//	redaction     SECRET_SCRUB, PII_REDACT and the rules of PII_REDACT_PATTERNS
+//	GeoIP         GEOIP_CITY_DB and GEOIP_ASN_DB, reopened to pick up updated databases,
+//	              and GEOIP_PARSERS
+//	reverse DNS   REVERSE_DNS and its settings; the cache starts empty
+//	alert rules   the rules of ALERT_RULES, saved over the stored rules of the same name;
+//	              not with STORAGE=memory, which has no alerts
+//
+// Everything is read and validated before anything is applied, so an invalid setting
+// fails the reload and leaves the running configuration as it was; only the saving of the
+// alert rules comes after, and if it fails the rest stays applied. Requests being ingested
+// finish with the configuration they started with, and the listener stays open. Other
+// settings are read at startup only. Per-source settings such as timezones and sampling
+// are changed through their API, without a reload; SIGHUP also reloads the TLS files, see
+// tls.go.
+
+// geoIPGracePeriod is how long a replaced GeoIP enricher stays open for the requests
+// still using it.
+const geoIPGracePeriod = time.Minute
+
+// reloadMu serialises reloads.
+var reloadMu sync.Mutex
+
+// ReloadResult is the response of POST /api/admin/reload: the configuration now in effect.
+type ReloadResult struct {
+	ConfigFile string    `json:"config_file,omitempty"`
+	LogLevel   string    `json:"log_level"`
+	Redaction  []string  `json:"redaction"`   // rule names, in order
+	GeoIP      bool      `json:"geoip"`       // enabled
+	ReverseDNS bool      `json:"reverse_dns"` // enabled
+	AlertRules int       `json:"alert_rules"` // read from ALERT_RULES
+	ReloadedAt time.Time `json:"reloaded_at"`
+}
+
+// reloadConfig reloads the configuration, keeping the running one if it fails.
+func reloadConfig(ctx context.Context) (ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	file := config.file
+	if config.path != "" {
+		var err error
+		if file, err = readConfigFile(config.path); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+	previous := config.file
+	config.file = file
+	restore := func() { config.file = previous }
+
+	level, err := logLevelSetting()
+	if err != nil {
+		restore()
+		return ReloadResult{}, err
+	}
+	redactor, err := newRedactor()
+	if err != nil {
+		restore()
+		return ReloadResult{}, err
+	}
+	geo, err := newGeoIPEnricher()
+	if err != nil {
+		restore()
+		return ReloadResult{}, err
+	}
+	resolver, err := newReverseDNSResolver()
+	if err != nil {
+		restore()
+		geo.closeIfSet()
+		return ReloadResult{}, err
+	}
+	var rules []AlertRule
+	if path := setting("ALERT_RULES"); path != "" && !inMemory() {
+		if rules, err = loadAlertRules(path); err != nil {
+			restore()
+			geo.closeIfSet()
+			return ReloadResult{}, fmt.Errorf("ALERT_RULES: %w", err)
+		}
+	}
+
+	logLevel.Set(level)
+	redaction.Store(redactor)
+	if old := geoip.Swap(geo); old != nil {
+		time.AfterFunc(geoIPGracePeriod, old.close)
+	}
+	rdns.Store(resolver)
+	result := ReloadResult{
+		ConfigFile: config.path,
+		LogLevel:   level.String(),
+		Redaction:  []string{},
+		GeoIP:      geo != nil,
+		ReverseDNS: resolver != nil,
+		AlertRules: len(rules),
+		ReloadedAt: time.Now(),
+	}
+	if redactor != nil {
+		result.Redaction = redactor.names()
+	}
+	// The rules are saved last: they are the only part that can fail once applied.
+	if err := applyAlertRules(ctx, rules); err != nil {
+		return result, fmt.Errorf("saving ALERT_RULES: %w", err)
+	}
+	return result, nil
+}
+
+// closeIfSet closes g unless it is nil, for enrichers built by a failed reload.
+func (g *geoIPEnricher) closeIfSet() {
+	if g != nil {
+		g.close()
+	}
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP from now on.
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			result, err := reloadConfig(ctx)
+			cancel()
+			if err != nil {
+				slog.Error("Failed to reload configuration", "err", err)
+				continue
+			}
+			slog.Info("Reloaded configuration", "log_level", result.LogLevel, "redaction", len(result.Redaction),
+				"geoip", result.GeoIP, "reverse_dns", result.ReverseDNS, "alert_rules", result.AlertRules)
+		}
+	}()
+}
+
+// reloadHandler handles POST /api/admin/reload, recording the reload in the audit log.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := reloadConfig(r.Context())
+	if err != nil {
+		http.Error(w, "Could not reload configuration: "+err.Error(), http.StatusUnprocessableEntity)
+		slog.ErrorContext(r.Context(), "Failed to reload configuration", "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Reloaded configuration", "log_level", result.LogLevel,
+		"redaction", len(result.Redaction), "geoip", result.GeoIP, "reverse_dns", result.ReverseDNS,
+		"alert_rules", result.AlertRules)
+
+	after, _ := json.Marshal(result)
+	info, _ := requestFromContext(r.Context())
+	err = recordAudit(context.WithoutCancel(r.Context()), AuditEntry{
+		Actor:     requestActor(r),
+		Action:    "POST /api/admin/reload",
+		Resource:  "configuration",
+		RequestID: info.id,
+		After:     after,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error recording audit entry", "action", "POST /api/admin/reload", "err", err)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
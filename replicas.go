@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Several replicas can share one database behind a load balancer. Each keeps the tenants
+// and API keys in memory for authentication, so the replica that saves, suspends, resumes
+// or deletes a tenant, rotates its keys, or creates or revokes a key tells the others with
+// a notification on the delogger_auth channel, and every replica reloads both when
+// notified. Notifications are received on a connection taken out of the pool; when it is
+// lost the replica reconnects and reloads, since it may have missed some meanwhile. It
+// also reloads every authReloadInterval, bounding how long a notification that failed to
+// be sent leaves it behind. A replica that can't reach the database keeps what it has.
+//
+// The other caches loaded at startup, such as sources, projects and per-source settings,
+// are only updated on the replica changing them.
+
+const (
+	authChannel        = "delogger_auth"
+	authReloadInterval = 5 * time.Minute
+)
+
+// notifyAuthChange tells every replica, this one included, to reload the tenants and API
+// keys. The change is already saved, so a failure is only logged.
+func notifyAuthChange(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if _, err := dbPool.Exec(ctx, `SELECT pg_notify($1, '')`, authChannel); err != nil {
+		slog.ErrorContext(ctx, "Error notifying the replicas of a tenant or key change", "err", err)
+	}
+}
+
+// startAuthSync starts listening for changes to the tenants and API keys.
+func startAuthSync() {
+	go func() {
+		attempt := 0
+		for {
+			listened, err := listenAuthChanges()
+			if listened {
+				attempt = 0
+			}
+			wait := retryInterval(attempt)
+			attempt++
+			slog.Warn("Stopped listening for tenant and key changes, reconnecting", "retry_in", wait.Round(time.Millisecond), "err", err)
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// listenAuthChanges reloads the tenants and API keys when notified, and at least every
+// authReloadInterval, until its connection fails. It reports whether it got to listen.
+func listenAuthChanges() (bool, error) {
+	ctx := context.Background()
+	pooled, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// A listening connection mustn't go back to the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "LISTEN "+authChannel); err != nil {
+		return false, err
+	}
+
+	for {
+		reloadAuth()
+		waitCtx, cancel := context.WithTimeout(ctx, authReloadInterval)
+		_, err := conn.WaitForNotification(waitCtx)
+		timedOut := waitCtx.Err() != nil
+		cancel()
+		if err != nil && !timedOut {
+			return true, err
+		}
+	}
+}
+
+// reloadAuth reloads the tenants and API keys, keeping those in memory if it fails.
+func reloadAuth() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := reloadTenants(ctx); err != nil {
+		slog.Error("Error reloading tenants", "err", err)
+	}
+	if err := reloadAPIKeys(ctx); err != nil {
+		slog.Error("Error reloading API keys", "err", err)
+	}
+}
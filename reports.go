@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Scheduled reports summarize the entries received since the report last ran: their
+// volume by level, the most frequent error templates and the message templates seen for
+// the first time. They are sent on a cron schedule (see cron.go) to email, Slack or
+// webhook channels, e.g. every Monday at 08:00 Berlin time:
+//
+//	{"name": "weekly api", "schedule": "0 8 * * 1", "timezone": "Europe/Berlin",
+//	 "filter": {"service": "api"},
+//	 "channels": [{"type": "email", "to": ["ops@example.com"]}]}
+//
+// search_id may name a saved search whose filter is used instead. Reports are stored in
+// reports and managed through /api/reports.
+
+// reportTopN is the number of error and new templates listed in a report.
+const reportTopN = 10
+
+// reportChannelTypes are the channel types a report can be sent to.
+var reportChannelTypes = []string{"email", "slack", "webhook"}
+
+// Report is a summary sent on Schedule, a cron expression evaluated in Timezone (UTC if
+// empty).
+type Report struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Enabled   bool              `json:"enabled"`
+	Schedule  string            `json:"schedule"`
+	Timezone  string            `json:"timezone,omitempty"`
+	SearchID  *int64            `json:"search_id,omitempty"`
+	Filter    map[string]string `json:"filter"`
+	Channels  []AlertChannel    `json:"channels"`
+	LastRunAt *time.Time        `json:"last_run_at,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+
+	schedule cronSchedule
+	loc      *time.Location
+}
+
+// validate normalizes r and checks its schedule, filter and channels.
+func (r *Report) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+
+	var err error
+	r.schedule, err = parseCron(r.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule: %v", err)
+	}
+	if r.schedule.next(time.Now()).IsZero() {
+		return errors.New("invalid schedule: it never matches")
+	}
+	r.loc, err = time.LoadLocation(r.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+
+	if r.Filter == nil {
+		r.Filter = map[string]string{}
+	}
+	if r.SearchID != nil && len(r.Filter) > 0 {
+		return errors.New("set either search_id or filter, not both")
+	}
+	if _, err := reportFilter(r.Filter); err != nil {
+		return err
+	}
+
+	if len(r.Channels) == 0 {
+		return errors.New("at least one channel is required")
+	}
+	for i, c := range r.Channels {
+		if !slices.Contains(reportChannelTypes, c.Type) {
+			return fmt.Errorf("channel %d: type must be one of %s", i+1, strings.Join(reportChannelTypes, ", "))
+		}
+		if err := notifiers[c.Type].validate(c); err != nil {
+			return fmt.Errorf("channel %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// reportFilter parses a report's filter. The time range is set when the report runs.
+func reportFilter(m map[string]string) (entryFilter, error) {
+	q := url.Values{}
+	for k, v := range m {
+		if k == "from" || k == "to" {
+			continue
+		}
+		q.Set(k, v)
+	}
+	return parseEntryFilter(q)
+}
+
+// ReportSummary is what a report sends, and the data its channel templates are executed with.
+type ReportSummary struct {
+	Report       string          `json:"report"`
+	From         time.Time       `json:"from"`
+	To           time.Time       `json:"to"`
+	Total        int64           `json:"total"`
+	Levels       []FacetValue    `json:"levels"`
+	TopErrors    []ErrorTemplate `json:"top_errors"`
+	NewTemplates []LogTemplate   `json:"new_templates"` // across all sources, not only the filtered ones
+	QueryURL     string          `json:"query_url,omitempty"`
+}
+
+// Default report templates.
+const (
+	defaultReportSubject = `[DeLogger] {{.Report}} report`
+	defaultReportBody    = `Report "{{.Report}}" from {{.From.Format "2006-01-02 15:04 MST"}} to {{.To.Format "2006-01-02 15:04 MST"}}.
+
+{{.Total}} entries{{range .Levels}}, {{.Count}} {{or .Value "without level"}}{{end}}.
+
+Top errors:
+{{range .TopErrors}}  {{.Count}}  {{.Template}}
+{{else}}  none
+{{end}}
+New message templates:
+{{range .NewTemplates}}  {{.Count}}  {{.Template}}
+{{else}}  none
+{{end}}
+{{- if .QueryURL}}
+Matching entries: {{.QueryURL}}
+{{- end}}
+`
+	defaultSlackReportTemplate = `:bar_chart: *{{slackEscape .Report}}* from {{.From.Format "Jan 2 15:04"}} to {{.To.Format "Jan 2 15:04 MST"}}: {{.Total}} entries{{range .Levels}}, {{.Count}} {{or .Value "without level"}}{{end}}
+{{- if .TopErrors}}
+*Top errors*
+{{range .TopErrors}}• {{.Count}} ` + "`" + `{{slackEscape .Template}}` + "`" + `
+{{end}}
+{{- end}}
+{{- if .NewTemplates}}
+*New message templates*
+{{range .NewTemplates}}• {{.Count}} ` + "`" + `{{slackEscape .Template}}` + "`" + `
+{{end}}
+{{- end}}
+{{- if .QueryURL}}
+<{{.QueryURL}}|View matching entries>
+{{- end}}`
+)
+
+// reporter runs the reports when they are due.
+type reporter struct {
+	mu      sync.Mutex
+	reports map[int64]Report
+	next    map[int64]time.Time
+}
+
+// reports holds the reports, set up by setupReports.
+var reports = &reporter{reports: map[int64]Report{}, next: map[int64]time.Time{}}
+
+// setupReports loads the stored reports and starts running them.
+func setupReports() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stored, err := listReports(ctx, nil, math.MaxInt32)
+	if err != nil {
+		fatal("Failed to load reports", "err", err)
+	}
+	for _, rep := range stored {
+		if err := rep.validate(); err != nil {
+			slog.Warn("Skipping invalid report", "id", rep.ID, "name", rep.Name, "err", err)
+			continue
+		}
+		reports.put(rep)
+	}
+
+	go reports.run()
+	slog.Info("Scheduled reports", "reports", len(reports.reports))
+}
+
+// put adds or replaces a validated report and schedules its next run.
+func (rp *reporter) put(rep Report) {
+	rp.mu.Lock()
+	rp.reports[rep.ID] = rep
+	rp.next[rep.ID] = rep.schedule.next(time.Now().In(rep.loc))
+	rp.mu.Unlock()
+}
+
+// remove forgets a deleted report.
+func (rp *reporter) remove(id int64) {
+	rp.mu.Lock()
+	delete(rp.reports, id)
+	delete(rp.next, id)
+	rp.mu.Unlock()
+}
+
+// run sends the due reports at the start of every minute. Runs missed while the server
+// was down are skipped; the next report covers their period.
+func (rp *reporter) run() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		now = time.Now()
+		var due []Report
+		rp.mu.Lock()
+		for id, rep := range rp.reports {
+			next := rp.next[id]
+			if next.IsZero() || now.Before(next) {
+				continue
+			}
+			rp.next[id] = rep.schedule.next(now.In(rep.loc))
+			if rep.Enabled {
+				due = append(due, rep)
+			}
+		}
+		rp.mu.Unlock()
+
+		for _, rep := range due {
+			rp.send(rep, now)
+		}
+	}
+}
+
+// send runs rep for the period since its last run and records the run.
+func (rp *reporter) send(rep Report, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	summary, err := runReport(ctx, rep, now)
+	if err != nil {
+		slog.Error("Error running report", "report", rep.Name, "err", err)
+		return
+	}
+	sendReport(ctx, rep, summary)
+
+	if _, err := dbPool.Exec(ctx, `UPDATE reports SET last_run_at = $2 WHERE id = $1`, rep.ID, now); err != nil {
+		slog.Error("Error recording run of report", "report", rep.Name, "err", err)
+	}
+	rp.mu.Lock()
+	if current, ok := rp.reports[rep.ID]; ok {
+		current.LastRunAt = &now
+		rp.reports[rep.ID] = current
+	}
+	rp.mu.Unlock()
+}
+
+// runReport summarizes the entries matching rep from its last run, or its creation, to now.
+func runReport(ctx context.Context, rep Report, now time.Time) (ReportSummary, error) {
+	from := rep.CreatedAt
+	if rep.LastRunAt != nil {
+		from = *rep.LastRunAt
+	}
+	summary := ReportSummary{Report: rep.Name, From: from.In(rep.loc), To: now.In(rep.loc)}
+
+	filterMap := rep.Filter
+	if rep.SearchID != nil {
+		search, err := loadSavedSearch(ctx, *rep.SearchID)
+		if err != nil {
+			return summary, fmt.Errorf("loading saved search %d: %w", *rep.SearchID, err)
+		}
+		filterMap = search.Filter
+	}
+	filter, err := reportFilter(filterMap)
+	if err != nil {
+		return summary, err
+	}
+	filter.From, filter.To = from, now
+
+	if summary.Total, err = countEntries(ctx, filter); err != nil {
+		return summary, err
+	}
+	if summary.Levels, err = loadFacets(ctx, facetFields["level"], filter, reportTopN); err != nil {
+		return summary, err
+	}
+	if summary.TopErrors, err = loadTopErrors(ctx, filter, reportTopN); err != nil {
+		return summary, err
+	}
+	if summary.NewTemplates, err = listTemplates(ctx, from, "count DESC, id", reportTopN); err != nil {
+		return summary, err
+	}
+	if alerts.publicURL != "" {
+		summary.QueryURL = alerts.publicURL + "/api/logs?" + filterQuery(filterMap, from, now).Encode()
+	}
+	return summary, nil
+}
+
+// sendReport sends summary to every channel of rep, logging failures. Emails are sent
+// immediately rather than batched with alert notifications.
+func sendReport(ctx context.Context, rep Report, summary ReportSummary) {
+	for _, c := range rep.Channels {
+		var err error
+		switch c.Type {
+		case "email":
+			var subject, body string
+			subject, err = renderMessage(AlertChannel{Template: c.Subject}, defaultReportSubject, summary)
+			if err == nil {
+				body, err = renderMessage(c, defaultReportBody, summary)
+			}
+			if err == nil {
+				err = mailer.send(c.To, subject, body)
+			}
+		case "slack":
+			var text string
+			text, err = renderMessage(c, defaultSlackReportTemplate, summary)
+			if err == nil {
+				err = postSlack(ctx, c, text)
+			}
+		default:
+			err = postJSON(ctx, c.URL, c.Headers, summary)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error sending report", "report", rep.Name, "channel", c.Type, "err", err)
+		}
+	}
+}
+
+// reportSelectSQL is the column list scanned by scanReport.
+const reportSelectSQL = `SELECT id, name, enabled, schedule, timezone, search_id, filter, channels, last_run_at, created_at, updated_at FROM reports`
+
+// reportReturning is reportSelectSQL's column list for RETURNING clauses.
+const reportReturning = `RETURNING id, name, enabled, schedule, timezone, search_id, filter, channels, last_run_at, created_at, updated_at`
+
+func scanReport(row pgx.Row) (Report, error) {
+	var r Report
+	err := row.Scan(&r.ID, &r.Name, &r.Enabled, &r.Schedule, &r.Timezone, &r.SearchID, &r.Filter, &r.Channels, &r.LastRunAt,
+		&r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+// reportID parses the {id} path value, writing a 400 response if it is invalid.
+func reportID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid report id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeReportError maps a storage error to a response.
+func writeReportError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Report not found", http.StatusNotFound)
+	case isUniqueViolation(err):
+		http.Error(w, "A report with that name already exists", http.StatusConflict)
+	default:
+		http.Error(w, "Could not access reports", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error accessing reports", "err", err)
+	}
+}
+
+// readReport decodes and validates a report from the request body, writing an error
+// response if it is invalid. Enabled defaults to true.
+func readReport(w http.ResponseWriter, r *http.Request) (Report, bool) {
+	rep := Report{Enabled: true}
+	if err := readJSON(r, &rep); err != nil {
+		http.Error(w, "Invalid report: "+err.Error(), bodyErrorStatus(err))
+		return rep, false
+	}
+	if err := rep.validate(); err != nil {
+		http.Error(w, "Invalid report: "+err.Error(), http.StatusBadRequest)
+		return rep, false
+	}
+	if rep.SearchID != nil {
+		if _, err := loadSavedSearch(r.Context(), *rep.SearchID); errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Invalid report: saved search "+strconv.FormatInt(*rep.SearchID, 10)+" not found", http.StatusBadRequest)
+			return rep, false
+		} else if err != nil {
+			writeSearchError(w, r, err)
+			return rep, false
+		}
+	}
+	return rep, true
+}
+
+// ReportsPage is the response of GET /api/reports. NextCursor is empty on the last page.
+type ReportsPage struct {
+	Reports    []Report `json:"reports"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// listReportsHandler handles GET /api/reports, keyset-paginated by name.
+func listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parsePage(r.URL.Query(), 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := listReports(r.Context(), cursor, limit+1)
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+
+	page := ReportsPage{Reports: list}
+	if len(page.Reports) > limit {
+		page.Reports = page.Reports[:limit]
+		last := page.Reports[limit-1]
+		page.NextCursor = pageCursor{Key: last.Name, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// getReportHandler handles GET /api/reports/{id}.
+func getReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := reportID(w, r)
+	if !ok {
+		return
+	}
+	rep, err := scanReport(dbPool.QueryRow(r.Context(), reportSelectSQL+" WHERE id = $1", id))
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// createReportHandler handles POST /api/reports.
+func createReportHandler(w http.ResponseWriter, r *http.Request) {
+	rep, ok := readReport(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := scanReport(dbPool.QueryRow(r.Context(), `
+	INSERT INTO reports (name, enabled, schedule, timezone, search_id, filter, channels)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`+reportReturning,
+		rep.Name, rep.Enabled, rep.Schedule, rep.Timezone, rep.SearchID, rep.Filter, rep.Channels))
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+	saved.schedule, saved.loc = rep.schedule, rep.loc
+	reports.put(saved)
+
+	slog.InfoContext(r.Context(), "Created report", "id", saved.ID, "name", saved.Name)
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+// updateReportHandler handles PUT /api/reports/{id}, replacing the whole report.
+func updateReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := reportID(w, r)
+	if !ok {
+		return
+	}
+	rep, ok := readReport(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := scanReport(dbPool.QueryRow(r.Context(), `
+	UPDATE reports SET name = $2, enabled = $3, schedule = $4, timezone = $5, search_id = $6, filter = $7, channels = $8,
+		updated_at = now()
+	WHERE id = $1
+	`+reportReturning,
+		id, rep.Name, rep.Enabled, rep.Schedule, rep.Timezone, rep.SearchID, rep.Filter, rep.Channels))
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+	saved.schedule, saved.loc = rep.schedule, rep.loc
+	reports.put(saved)
+
+	slog.InfoContext(r.Context(), "Updated report", "id", saved.ID, "name", saved.Name)
+	writeJSON(w, http.StatusOK, saved)
+}
+
+// deleteReportHandler handles DELETE /api/reports/{id}.
+func deleteReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := reportID(w, r)
+	if !ok {
+		return
+	}
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM reports WHERE id = $1`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+	reports.remove(id)
+
+	slog.InfoContext(r.Context(), "Deleted report", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runReportHandler handles POST /api/reports/{id}/run, sending the report now and
+// returning what was sent. The run is not recorded, so the next scheduled report still
+// covers the whole period since the last one.
+func runReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := reportID(w, r)
+	if !ok {
+		return
+	}
+	rep, err := scanReport(dbPool.QueryRow(r.Context(), reportSelectSQL+" WHERE id = $1", id))
+	if err != nil {
+		writeReportError(w, r, err)
+		return
+	}
+	if err := rep.validate(); err != nil {
+		http.Error(w, "Report is no longer valid: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	summary, err := runReport(r.Context(), rep, time.Now())
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Report is no longer valid: its saved search was deleted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeQueryError(w, r, err, "run report")
+		return
+	}
+	sendReport(r.Context(), rep, summary)
+
+	slog.InfoContext(r.Context(), "Sent report", "id", rep.ID, "name", rep.Name)
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// listReports returns up to limit reports ordered by name, starting after cursor when it is not nil.
+func listReports(ctx context.Context, cursor *pageCursor, limit int) ([]Report, error) {
+	var args sqlArgs
+	sql := reportSelectSQL
+	if cursor != nil {
+		sql += " WHERE (name, id) > (" + args.add(cursor.Key) + ", " + args.add(cursor.ID) + ")"
+	}
+	sql += " ORDER BY name, id LIMIT " + args.add(limit)
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Report, error) {
+		return scanReport(row)
+	})
+	if list == nil {
+		list = []Report{}
+	}
+	return list, err
+}
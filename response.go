@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// writeJSON sends v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing JSON response", "err", err)
+	}
+}
+
+// readJSON decodes the request body into v, rejecting unknown fields.
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// entryStream writes a JSON array of entries to a response as they are parsed, rather than
+// once the whole payload is, keeping the JSON in buf to store with the record. The JSON is
+// that of json.Marshal, null if there are no entries. Once it is longer than
+// maxStoredResponse, what is sent is dropped from buf, so a large response is never held
+// whole, and a truncatedResponse is stored instead; the entries themselves are stored in
+// delogged_entries either way.
+type entryStream struct {
+	w        http.ResponseWriter
+	buf      *jsonBuffer
+	sent     int   // bytes of buf written to w, or past a write error
+	dropped  int64 // bytes sent, then dropped from buf
+	entries  int
+	err      error // of encoding
+	writeErr error // of writing to the client, after which the JSON is only kept
+	elapsed  time.Duration
+}
+
+// truncatedResponse is stored as the response_body of a record in place of JSON longer
+// than maxStoredResponse.
+type truncatedResponse struct {
+	Truncated bool  `json:"truncated"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"` // of the JSON sent
+}
+
+func newEntryStream(w http.ResponseWriter, buf *jsonBuffer) *entryStream {
+	buf.buf.Reset()
+	return &entryStream{w: w, buf: buf}
+}
+
+// write encodes entries and sends them.
+func (s *entryStream) write(entries []LogEntry) {
+	start := time.Now()
+	defer func() { s.elapsed += time.Since(start) }()
+	if s.err != nil {
+		return
+	}
+	b := &s.buf.buf
+	for _, e := range entries {
+		if s.entries == 0 {
+			b.WriteByte('[')
+		} else {
+			b.WriteByte(',')
+		}
+		if err := s.buf.enc.Encode(e); err != nil {
+			s.err = err
+			return
+		}
+		b.Truncate(b.Len() - 1) // the encoder's newline
+		s.entries++
+	}
+	s.flush()
+}
+
+// close ends the array and returns the JSON to store: that of the entries, or a
+// truncatedResponse if it was too long to keep.
+func (s *entryStream) close() ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.entries == 0 {
+		s.buf.buf.WriteString("null")
+	} else {
+		s.buf.buf.WriteByte(']')
+	}
+	s.flush()
+	if s.dropped == 0 {
+		return s.buf.buf.Bytes(), nil
+	}
+	return s.buf.encode(truncatedResponse{Truncated: true, Entries: s.entries, Bytes: s.dropped + int64(s.buf.buf.Len())})
+}
+
+// started reports whether some of the JSON was written to w.
+func (s *entryStream) started() bool {
+	return s.sent > 0 || s.dropped > 0
+}
+
+// flush sends what buf holds past sent, then drops it if the JSON is too long to store.
+func (s *entryStream) flush() {
+	if s.writeErr == nil {
+		_, s.writeErr = s.w.Write(s.buf.buf.Bytes()[s.sent:])
+		if f, ok := s.w.(http.Flusher); ok && s.writeErr == nil {
+			f.Flush()
+		}
+	}
+	s.sent = s.buf.buf.Len()
+	if s.dropped+int64(s.sent) > maxStoredResponse {
+		s.dropped += int64(s.sent)
+		s.buf.buf.Reset()
+		s.sent = 0
+	}
+}
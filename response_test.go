@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEntryStream(t *testing.T) {
+	saved := maxStoredResponse
+	t.Cleanup(func() { maxStoredResponse = saved })
+	maxStoredResponse = 1000
+
+	batch := func(from, n int) []LogEntry {
+		var entries []LogEntry
+		for i := from; i < from+n; i++ {
+			entries = append(entries, LogEntry{Level: "INFO", Message: fmt.Sprintf("line %d", i)})
+		}
+		return entries
+	}
+	tests := []struct {
+		batches   int // of 5 entries, about 200 bytes
+		truncated bool
+	}{
+		{0, false},
+		{1, false},
+		{3, false},
+		{20, true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		stream := newEntryStream(w, getJSONBuffer())
+		var all []LogEntry
+		held := 0
+		for i := range tt.batches {
+			stream.write(batch(5*i, 5))
+			all = append(all, batch(5*i, 5)...)
+			held = max(held, stream.buf.buf.Len())
+		}
+		stored, err := stream.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := json.Marshal(all)
+		if w.Body.String() != string(want) {
+			t.Errorf("%d batches: sent %s, want %s", tt.batches, w.Body, want)
+		}
+		if held > int(maxStoredResponse)+300 {
+			t.Errorf("%d batches: held %d bytes of JSON, want at most the limit and a batch", tt.batches, held)
+		}
+		if !tt.truncated {
+			if string(stored) != string(want) {
+				t.Errorf("%d batches: stored %s, want the response", tt.batches, stored)
+			}
+			continue
+		}
+		var summary truncatedResponse
+		if err := json.Unmarshal(stored, &summary); err != nil || summary != (truncatedResponse{true, len(all), int64(len(want))}) {
+			t.Errorf("%d batches: stored %s, want a summary of %d entries in %d bytes", tt.batches, stored, len(all), len(want))
+		}
+	}
+}
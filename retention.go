@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Stored records are deleted once older than their retention, by a cleanup job that runs
+// periodically. The retention of a record is that of its source if the source sets one,
+// else that of its tenant if the tenant sets one, else RETENTION:
+//
+//	RETENTION           how long records are kept, such as 720h; default forever
+//	RETENTION_INTERVAL  how often expired records are deleted; default 1h
+//
+// Tenants and sources set theirs in the retention field of PUT /api/tenants/{id} and of
+// POST or PUT /api/sources; "0s" keeps their records forever whatever RETENTION is. Records
+// are deleted with their entries, in batches, so the job doesn't hold long locks. It only
+// runs with PostgreSQL: with STORAGE=memory, MEMORY_MAX_ENTRIES bounds what is kept.
+
+// minRetention is the shortest retention, guarding against a unit mistaken for another.
+const minRetention = time.Hour
+
+// retentionBatch is the number of records deleted per statement.
+const retentionBatch = 5000
+
+var retention = struct {
+	global   string // RETENTION, "" to keep records forever
+	interval time.Duration
+}{interval: time.Hour}
+
+// parseRetention reads a retention: a duration of at least an hour, or 0 for forever.
+func parseRetention(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d != 0 && d < minRetention {
+		return 0, errors.New("retention must be 0 or a duration of at least 1h, such as 720h")
+	}
+	return d, nil
+}
+
+// setupRetention reads the retention settings.
+func setupRetention() {
+	if v := setting("RETENTION"); v != "" {
+		if _, err := parseRetention(v); err != nil {
+			fatalConfig("Invalid RETENTION: "+err.Error(), "value", v)
+		}
+		if inMemory() {
+			fatalConfig("Invalid RETENTION: records in memory are bounded by MEMORY_MAX_ENTRIES instead", "value", v)
+		}
+		retention.global = v
+	}
+	retention.interval = envDuration("RETENTION_INTERVAL", retention.interval)
+}
+
+// startRetention starts the cleanup job.
+func startRetention() {
+	go func() {
+		ticker := time.NewTicker(retention.interval)
+		defer ticker.Stop()
+		for {
+			deleteExpiredRecords()
+			<-ticker.C
+		}
+	}()
+	slog.Info("Deleting expired records", "retention", retention.global, "interval", retention.interval)
+}
+
+// retentionPolicy is the retention of the records matched by a condition on delogged.
+type retentionPolicy struct {
+	scope     string // for the logs, e.g. "tenant acme"
+	retention time.Duration
+	cond      string
+	args      []any
+}
+
+// retentionPolicies returns the policies of the sources, then of the tenants, then the
+// global one, each excluding the records of the policies before it.
+func retentionPolicies() []retentionPolicy {
+	var policies []retentionPolicy
+	// Not nil, which <> ALL would take as NULL, matching no record.
+	sourceIDs, tenantIDs := []int64{}, []string{}
+	sources.RLock()
+	for _, s := range sources.byHash {
+		if s.Retention == "" {
+			continue
+		}
+		d, _ := parseRetention(s.Retention)
+		policies = append(policies, retentionPolicy{scope: "source " + s.Name, retention: d,
+			cond: "source_id = $2", args: []any{s.ID}})
+		sourceIDs = append(sourceIDs, s.ID)
+	}
+	sources.RUnlock()
+
+	tenants.RLock()
+	for _, t := range tenants.byID {
+		if t.Retention == "" {
+			continue
+		}
+		d, _ := parseRetention(t.Retention)
+		policies = append(policies, retentionPolicy{scope: "tenant " + t.ID, retention: d,
+			cond: "tenant = $2 AND source_id <> ALL($3)", args: []any{t.ID, sourceIDs}})
+		tenantIDs = append(tenantIDs, t.ID)
+	}
+	tenants.RUnlock()
+
+	if retention.global != "" {
+		d, _ := parseRetention(retention.global)
+		policies = append(policies, retentionPolicy{scope: "global", retention: d,
+			cond: "tenant <> ALL($2) AND source_id <> ALL($3)", args: []any{tenantIDs, sourceIDs}})
+	}
+	return policies
+}
+
+// deleteExpiredRecords deletes the records older than their retention.
+func deleteExpiredRecords() {
+	for _, p := range retentionPolicies() {
+		if p.retention == 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-p.retention)
+		deleted, err := deleteRecords("timestamp < $1 AND "+p.cond, append([]any{cutoff}, p.args...)...)
+		if err != nil {
+			slog.Error("Failed to delete expired records", "scope", p.scope, "err", err)
+		}
+		if deleted > 0 {
+			slog.Info("Deleted expired records", "scope", p.scope, "records", deleted, "before", cutoff)
+		}
+	}
+}
+
+// deleteRecords deletes the records matching cond, a condition on delogged, with their
+// entries, in batches, and returns how many it deleted.
+func deleteRecords(cond string, args ...any) (int64, error) {
+	var deleted int64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		tag, err := dbPool.Exec(ctx, `
+		DELETE FROM delogged WHERE id IN (
+			SELECT id FROM delogged WHERE `+cond+` LIMIT `+strconv.Itoa(retentionBatch)+`)`, args...)
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < retentionBatch {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PostgreSQL can enforce the tenancy of records itself, for direct SQL access to the
+// database, such as a tenant's analysts querying it or a reporting tool:
+//
+//	TENANT_ROW_SECURITY  true to enable row-level security on delogged and
+//	                     delogged_entries; default false
+//
+// Each registered tenant then has a role, delogger_tenant_<id>, that can read both tables
+// but only sees the records of its tenant and their entries, as does any role it is
+// granted to (GRANT delogger_tenant_acme TO analyst). Roles without one see no rows. The
+// server creates the roles of the tenants at startup and as they are registered, and
+// drops them with their tenant; tenants whose ids are too long for a role name get none.
+// It needs CREATEROLE, and must own the tables, which exempts it from the policies, as it
+// enforces tenancy itself. Setting it back to false disables the policies at the next
+// start, keeping the roles.
+
+// tenantRolePrefix is the prefix of the names of the tenant roles.
+const tenantRolePrefix = "delogger_tenant_"
+
+// maxRoleName is the longest role name, in bytes, PostgreSQL doesn't truncate.
+const maxRoleName = 63
+
+// rowSecurity is whether TENANT_ROW_SECURITY is set.
+var rowSecurity bool
+
+// setupRowSecurity reads TENANT_ROW_SECURITY.
+func setupRowSecurity() {
+	if v := setting("TENANT_ROW_SECURITY"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			fatalConfig("Invalid TENANT_ROW_SECURITY: must be true or false", "value", v)
+		}
+		if enabled && inMemory() {
+			fatalConfig("Invalid TENANT_ROW_SECURITY: records in memory aren't in PostgreSQL", "value", v)
+		}
+		rowSecurity = enabled
+	}
+}
+
+// rowSecurityStatements enable the policies. Every row of delogged_entries is visible
+// if its record is, which the policy of delogged decides.
+var rowSecurityStatements = []string{
+	`ALTER TABLE delogged ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE delogged_entries ENABLE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS delogger_tenant ON delogged`,
+	`CREATE POLICY delogger_tenant ON delogged FOR SELECT USING (tenant IN (
+		SELECT substr(rolname, ` + strconv.Itoa(len(tenantRolePrefix)+1) + `) FROM pg_roles
+		WHERE starts_with(rolname, '` + tenantRolePrefix + `') AND pg_has_role(current_user, oid, 'MEMBER')))`,
+	`DROP POLICY IF EXISTS delogger_tenant ON delogged_entries`,
+	`CREATE POLICY delogger_tenant ON delogged_entries FOR SELECT USING (
+		EXISTS (SELECT 1 FROM delogged d WHERE d.id = delogged_entries.log_id))`,
+}
+
+// startRowSecurity enables or disables the policies as TENANT_ROW_SECURITY says, and
+// creates the roles of the registered tenants.
+func startRowSecurity() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if !rowSecurity {
+		// Only when enabled, so a server that doesn't own the tables still starts.
+		var enabled bool
+		err := dbPool.QueryRow(ctx, `SELECT relrowsecurity FROM pg_class WHERE oid = 'delogged'::regclass`).Scan(&enabled)
+		if err != nil {
+			fatal("Failed to check row-level security", "err", err)
+		}
+		if !enabled {
+			return
+		}
+		for _, stmt := range []string{
+			`ALTER TABLE delogged DISABLE ROW LEVEL SECURITY`,
+			`ALTER TABLE delogged_entries DISABLE ROW LEVEL SECURITY`,
+		} {
+			if _, err := dbPool.Exec(ctx, stmt); err != nil {
+				fatal("Failed to disable row-level security", "err", err)
+			}
+		}
+		slog.Info("Disabled row-level security")
+		return
+	}
+
+	err := pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		for _, stmt := range rowSecurityStatements {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to enable row-level security", "err", err)
+	}
+
+	tenants.RLock()
+	ids := make([]string, 0, len(tenants.byID))
+	for id := range tenants.byID {
+		ids = append(ids, id)
+	}
+	tenants.RUnlock()
+	for _, id := range ids {
+		if err := createTenantRole(ctx, id); err != nil {
+			fatal("Failed to create tenant role", "tenant", id, "err", err)
+		}
+	}
+	slog.Info("Enforcing tenancy with row-level security", "tenants", len(ids))
+}
+
+// tenantRole returns the role of tenant, and false if its name would be too long.
+func tenantRole(tenant string) (string, bool) {
+	name := tenantRolePrefix + tenant
+	return name, len(name) <= maxRoleName
+}
+
+// createTenantRole creates the role of tenant unless it exists, granting it the reading
+// of the tables, if row-level security is enabled.
+func createTenantRole(ctx context.Context, tenant string) error {
+	if !rowSecurity {
+		return nil
+	}
+	name, ok := tenantRole(tenant)
+	if !ok {
+		slog.Warn("Tenant id too long for a role; its records can't be read with direct SQL access", "tenant", tenant)
+		return nil
+	}
+	// Tenant ids are lowercase letters, digits, - and _, so the name is safe in a literal.
+	role := pgx.Identifier{name}.Sanitize()
+	return pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, fmt.Sprintf(`
+		DO $$ BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '%s') THEN
+				CREATE ROLE %s NOLOGIN;
+			END IF;
+		END $$`, name, role))
+		if err == nil {
+			_, err = tx.Exec(ctx, `GRANT SELECT ON delogged, delogged_entries TO `+role)
+		}
+		return err
+	})
+}
+
+// dropTenantRole drops the role of tenant in tx, if row-level security is enabled and the
+// role exists.
+func dropTenantRole(ctx context.Context, tx pgx.Tx, tenant string) error {
+	name, ok := tenantRole(tenant)
+	if !rowSecurity || !ok {
+		return nil
+	}
+	role := pgx.Identifier{name}.Sanitize()
+	_, err := tx.Exec(ctx, fmt.Sprintf(`
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '%s') THEN
+			REVOKE ALL ON delogged, delogged_entries FROM %s;
+			DROP ROLE %s;
+		END IF;
+	END $$`, name, role, role))
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"delogger/enrich"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// High-volume sources can be sampled before storage: a sampling policy gives the fraction
+// of entries to keep per severity, e.g. {"debug": 0.01, "info": 0.1} keeps one debug entry
+// in a hundred, one info entry in ten and every warning and error. The key unknown applies
+// to entries without a recognised severity. Policies are set per source through
+// /api/sampling, and DEFAULT_SAMPLING (e.g. debug=0.01,info=0.1) applies to the other
+// sources. Each kept entry records the rate it was sampled at in sample_rate, so counts
+// can be scaled back up.
+
+// samplingUnknown is the policy key of entries without a severity.
+const samplingUnknown = "unknown"
+
+// sourceSampling holds the policies from source_sampling.
+var sourceSampling = struct {
+	sync.RWMutex
+	bySource      map[string]map[string]float64
+	defaultPolicy map[string]float64
+}{bySource: map[string]map[string]float64{}}
+
+// validateSamplingRates checks the severities and fractions of a policy.
+func validateSamplingRates(rates map[string]float64) error {
+	for severity, rate := range rates {
+		if severity != samplingUnknown && enrich.SeverityNumber(severity) == 0 {
+			return fmt.Errorf("unknown severity %q", severity)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("rate of %s must be between 0 and 1", severity)
+		}
+	}
+	return nil
+}
+
+// loadSourceSampling reads DEFAULT_SAMPLING and the per-source policies into memory.
+func loadSourceSampling() {
+	defaultPolicy := map[string]float64{}
+	if v := setting("DEFAULT_SAMPLING"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			severity, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			f, err := strconv.ParseFloat(rate, 64)
+			if !ok || err != nil {
+				fatalConfig("Invalid DEFAULT_SAMPLING: must be severity=rate pairs such as debug=0.01", "value", v)
+			}
+			defaultPolicy[strings.ToLower(severity)] = f
+		}
+		if err := validateSamplingRates(defaultPolicy); err != nil {
+			fatalConfig("Invalid DEFAULT_SAMPLING", "err", err)
+		}
+	}
+
+	bySource := map[string]map[string]float64{}
+	if !inMemory() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		rows, err := dbPool.Query(ctx, `SELECT source, rates FROM source_sampling`)
+		if err != nil {
+			fatal("Failed to load sampling policies", "err", err)
+		}
+		var source string
+		var rates map[string]float64
+		_, err = pgx.ForEachRow(rows, []any{&source, &rates}, func() error {
+			bySource[source] = rates
+			rates = nil
+			return nil
+		})
+		if err != nil {
+			fatal("Failed to load sampling policies", "err", err)
+		}
+	}
+
+	sourceSampling.Lock()
+	sourceSampling.bySource = bySource
+	sourceSampling.defaultPolicy = defaultPolicy
+	sourceSampling.Unlock()
+}
+
+// sampleEntries returns the entries of source kept by its policy, with their SampleRate
+// set, and counts the others in the ingest statistics.
+func sampleEntries(source string, entries []StoredEntry) []StoredEntry {
+	sourceSampling.RLock()
+	policy, ok := sourceSampling.bySource[source]
+	if !ok {
+		policy = sourceSampling.defaultPolicy
+	}
+	sourceSampling.RUnlock()
+	if len(policy) == 0 {
+		return entries
+	}
+
+	kept := entries[:0]
+	for _, e := range entries {
+		severity := e.Severity
+		if severity == "" {
+			severity = samplingUnknown
+		}
+		rate, ok := policy[severity]
+		if !ok {
+			kept = append(kept, e)
+			continue
+		}
+		if rate > 0 && (rate >= 1 || rand.Float64() < rate) {
+			e.SampleRate = rate
+			kept = append(kept, e)
+		}
+	}
+	ingest.entriesSampledOut.Add(int64(len(entries) - len(kept)))
+	return kept
+}
+
+// SamplingPolicy is the fraction of entries kept per severity for a source.
+type SamplingPolicy struct {
+	Source string             `json:"source"`
+	Rates  map[string]float64 `json:"rates"`
+}
+
+// SamplingPolicies is the response of GET /api/sampling.
+type SamplingPolicies struct {
+	Default  map[string]float64 `json:"default"`
+	Policies []SamplingPolicy   `json:"policies"`
+}
+
+// listSamplingHandler handles GET /api/sampling.
+func listSamplingHandler(w http.ResponseWriter, r *http.Request) {
+	sourceSampling.RLock()
+	result := SamplingPolicies{Default: sourceSampling.defaultPolicy, Policies: []SamplingPolicy{}}
+	for source, rates := range sourceSampling.bySource {
+		result.Policies = append(result.Policies, SamplingPolicy{Source: source, Rates: rates})
+	}
+	sourceSampling.RUnlock()
+
+	slices.SortFunc(result.Policies, func(a, b SamplingPolicy) int { return strings.Compare(a.Source, b.Source) })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// putSamplingHandler handles PUT /api/sampling/{source}, setting the policy of a source.
+// It applies to entries ingested from then on.
+func putSamplingHandler(w http.ResponseWriter, r *http.Request) {
+	var policy SamplingPolicy
+	if err := readJSON(r, &policy); err != nil {
+		http.Error(w, "Invalid sampling policy: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	policy.Source = r.PathValue("source")
+	if policy.Rates == nil {
+		policy.Rates = map[string]float64{}
+	}
+	if err := validateSamplingRates(policy.Rates); err != nil {
+		http.Error(w, "Invalid sampling policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rates, _ := json.Marshal(policy.Rates)
+	_, err := dbPool.Exec(r.Context(), `
+	INSERT INTO source_sampling (source, rates) VALUES ($1, $2)
+	ON CONFLICT (source) DO UPDATE SET rates = EXCLUDED.rates`,
+		policy.Source, rates)
+	if err != nil {
+		http.Error(w, "Could not save sampling policy", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving sampling policy of source", "source", policy.Source, "err", err)
+		return
+	}
+
+	sourceSampling.Lock()
+	sourceSampling.bySource[policy.Source] = policy.Rates
+	sourceSampling.Unlock()
+
+	slog.InfoContext(r.Context(), "Set sampling policy of source", "source", policy.Source, "rates", policy.Rates)
+	writeJSON(w, http.StatusOK, policy)
+}
+
+// deleteSamplingHandler handles DELETE /api/sampling/{source}, reverting the source to the
+// default policy.
+func deleteSamplingHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM source_sampling WHERE source = $1`, source)
+	if err != nil {
+		http.Error(w, "Could not delete sampling policy", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting sampling policy of source", "source", source, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Sampling policy not found", http.StatusNotFound)
+		return
+	}
+
+	sourceSampling.Lock()
+	delete(sourceSampling.bySource, source)
+	sourceSampling.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted sampling policy of source", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SavedSearch is a named export query shared between users.
+type SavedSearch struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Filter    map[string]string `json:"filter"`
+	Format    string            `json:"format"`
+	Columns   []string          `json:"columns"` // exported, in order; every field if empty
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// exportFormats lists the values accepted by /api/export?format=.
+var exportFormats = []string{"ndjson", "parquet"}
+
+// validate normalizes s and checks that its filter, format and columns are usable by the export.
+func (s *SavedSearch) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if s.Filter == nil {
+		s.Filter = map[string]string{}
+	}
+	q := url.Values{}
+	for k, v := range s.Filter {
+		q.Set(k, v)
+	}
+	if _, err := parseEntryFilter(q); err != nil {
+		return err
+	}
+
+	if s.Format == "" {
+		s.Format = "ndjson"
+	}
+	if !slices.Contains(exportFormats, s.Format) {
+		return fmt.Errorf("unsupported format %q", s.Format)
+	}
+
+	if s.Columns == nil {
+		s.Columns = []string{}
+	}
+	_, err := selectExportColumns(s.Columns)
+	return err
+}
+
+// savedSearchSelectSQL is the column list scanned by scanSavedSearch.
+const savedSearchSelectSQL = `SELECT id, name, filter, format, columns, created_at, updated_at FROM saved_searches`
+
+func scanSavedSearch(row pgx.Row) (SavedSearch, error) {
+	var s SavedSearch
+	err := row.Scan(&s.ID, &s.Name, &s.Filter, &s.Format, &s.Columns, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+// searchID parses the {id} path value, writing a 400 response if it is invalid.
+func searchID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid search id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeSearchError maps a storage error to a response.
+func writeSearchError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+	case isUniqueViolation(err):
+		http.Error(w, "A saved search with that name already exists", http.StatusConflict)
+	default:
+		http.Error(w, "Could not access saved searches", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error accessing saved searches", "err", err)
+	}
+}
+
+// SearchesPage is the response of GET /api/searches. NextCursor is empty on the last page.
+type SearchesPage struct {
+	Searches   []SavedSearch `json:"searches"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// listSearchesHandler handles GET /api/searches, keyset-paginated by name.
+func listSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parsePage(r.URL.Query(), 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	searches, err := listSavedSearches(r.Context(), cursor, limit+1)
+	if err != nil {
+		writeSearchError(w, r, err)
+		return
+	}
+
+	page := SearchesPage{Searches: searches}
+	if len(page.Searches) > limit {
+		page.Searches = page.Searches[:limit]
+		last := page.Searches[limit-1]
+		page.NextCursor = pageCursor{Key: last.Name, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// getSearchHandler handles GET /api/searches/{id}.
+func getSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := searchID(w, r)
+	if !ok {
+		return
+	}
+	s, err := loadSavedSearch(r.Context(), id)
+	if err != nil {
+		writeSearchError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// createSearchHandler handles POST /api/searches.
+func createSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var s SavedSearch
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid saved search: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := dbPool.QueryRow(r.Context(), `
+	INSERT INTO saved_searches (name, filter, format, columns)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, name, filter, format, columns, created_at, updated_at`,
+		s.Name, s.Filter, s.Format, s.Columns)
+	s, err := scanSavedSearch(row)
+	if err != nil {
+		writeSearchError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Created saved search", "id", s.ID, "name", s.Name)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// updateSearchHandler handles PUT /api/searches/{id}, replacing the whole search.
+func updateSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := searchID(w, r)
+	if !ok {
+		return
+	}
+	var s SavedSearch
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid saved search: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := dbPool.QueryRow(r.Context(), `
+	UPDATE saved_searches SET name = $2, filter = $3, format = $4, columns = $5, updated_at = now()
+	WHERE id = $1
+	RETURNING id, name, filter, format, columns, created_at, updated_at`,
+		id, s.Name, s.Filter, s.Format, s.Columns)
+	s, err := scanSavedSearch(row)
+	if err != nil {
+		writeSearchError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Updated saved search", "id", s.ID, "name", s.Name)
+	writeJSON(w, http.StatusOK, s)
+}
+
+// deleteSearchHandler handles DELETE /api/searches/{id}.
+func deleteSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := searchID(w, r)
+	if !ok {
+		return
+	}
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM saved_searches WHERE id = $1`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		writeSearchError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted saved search", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSavedSearches returns up to limit saved searches ordered by name, starting after cursor when it is not nil.
+func listSavedSearches(ctx context.Context, cursor *pageCursor, limit int) ([]SavedSearch, error) {
+	var args sqlArgs
+	sql := savedSearchSelectSQL
+	if cursor != nil {
+		sql += " WHERE (name, id) > (" + args.add(cursor.Key) + ", " + args.add(cursor.ID) + ")"
+	}
+	sql += " ORDER BY name, id LIMIT " + args.add(limit)
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	searches, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SavedSearch, error) {
+		return scanSavedSearch(row)
+	})
+	if searches == nil {
+		searches = []SavedSearch{}
+	}
+	return searches, err
+}
+
+// loadSavedSearch fetches a saved search by id.
+func loadSavedSearch(ctx context.Context, id int64) (SavedSearch, error) {
+	return scanSavedSearch(dbPool.QueryRow(ctx, savedSearchSelectSQL+" WHERE id = $1", id))
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Credentials don't have to be written into the environment. For each secret setting,
+// i.e. DATABASE_URL, POSTGRES_PASSWORD, SMTP_PASSWORD, ADMIN_API_KEY, IP_ANONYMIZE_KEY,
+// ENCRYPTION_KEYS and INGEST_SIGNING_KEYS:
+//
+//	NAME_FILE  path of a file holding the value, such as a Docker or Kubernetes secret
+//	           mount (/run/secrets/...); a trailing newline is ignored
+//
+// and a value of the form vault:<path>#<key> is looked up in HashiCorp Vault, e.g.
+// vault:secret/data/delogger#db_password for the db_password key of a KV version 2 secret:
+//
+//	VAULT_ADDR        address of the Vault server, e.g. https://vault.internal:8200
+//	VAULT_TOKEN       token to read the secrets with; or VAULT_TOKEN_FILE
+//	VAULT_NAMESPACE   namespace, for Vault Enterprise
+//
+// The database password can be set apart from DATABASE_URL, in POSTGRES_PASSWORD or
+// POSTGRES_PASSWORD_FILE, like the official postgres image takes it.
+
+// vaultTimeout bounds each Vault lookup.
+const vaultTimeout = 10 * time.Second
+
+// secretEnv returns the value of the secret setting name, read from the environment, the
+// file named by name_FILE or Vault. It exits if the file or secret can't be read.
+func secretEnv(name string) string {
+	value := setting(name)
+	if path := setting(name + "_FILE"); path != "" {
+		if value != "" {
+			fatal(name + " and " + name + "_FILE are exclusive")
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			fatalConfig("Failed to read "+name+"_FILE", "path", path, "err", err)
+		}
+		value = strings.TrimRight(string(b), "\r\n")
+	}
+	if ref, ok := strings.CutPrefix(value, "vault:"); ok {
+		var err error
+		if value, err = readVaultSecret(ref); err != nil {
+			fatal("Failed to read "+name+" from Vault", "ref", ref, "err", err)
+		}
+	}
+	return value
+}
+
+// readVaultSecret reads the key of a secret referenced as path#key, from the KV version 1
+// or version 2 secrets engine.
+func readVaultSecret(ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", errors.New("must be vault:<path>#<key>")
+	}
+	addr := setting("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token := setting("VAULT_TOKEN")
+	if file := setting("VAULT_TOKEN_FILE"); file != "" && token == "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	u := strings.TrimRight(addr, "/") + "/v1/" + (&url.URL{Path: strings.Trim(path, "/")}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := setting("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s", resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	// KV version 2 nests the secret under data.data, with its metadata beside it.
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, hasMeta := data["metadata"]; hasMeta {
+			data = nested
+		}
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string key %q", key)
+	}
+	return value, nil
+}
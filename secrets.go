@@ -0,0 +1,18 @@
+package main
+
+import "regexp"
+
+// secretRedactionRules mask credentials that end up in logs by accident. They run before the
+// PII rules. Rules for key=value pairs only mask the value.
+var secretRedactionRules = []redactionRule{
+	{name: "private_key", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{name: "aws_access_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[0-9A-Z]{16}\b`)},
+	{name: "aws_secret_key", re: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`), group: 1},
+	{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	{name: "bearer_token", re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]+=*)`), group: 1},
+	{name: "basic_auth", re: regexp.MustCompile(`(?i)\bbasic\s+([A-Za-z0-9+/]{8,}=*)`), group: 1},
+	{name: "url_password", re: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:([^\s@/]+)@`), group: 1},
+	{name: "api_key", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|xox[abprs]-[A-Za-z0-9-]{10,}|[sr]k_(?:live|test)_[A-Za-z0-9]{16,}|AIza[0-9A-Za-z_-]{35}|glpat-[A-Za-z0-9_-]{20,})`)},
+	{name: "api_key", re: regexp.MustCompile(`(?i)\b(?:api[_-]?key|x-api-key|access[_-]?token|auth[_-]?token|refresh[_-]?token|client[_-]?secret|secret[_-]?key|secret)["']?\s*[:=]\s*["']?([^\s"'&,;]{6,})`), group: 1},
+	{name: "password", re: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|pass)["']?\s*[:=]\s*["']?([^\s"'&,;]+)`), group: 1},
+}
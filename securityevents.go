@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Rejected requests are recorded in security_events, so abuse such as password spraying
+// against the API or a misbehaving agent stands out:
+//
+//	auth_failed        missing or invalid token, key or signature (401)
+//	forbidden          valid credentials without the route's role, or a tenant key on an
+//	                   unscoped route (403)
+//	ip_denied          client address refused by the address rules (403, see ipaccess.go)
+//	payload_too_large  body over the size limit (413, see limits.go)
+//
+// Events are written in the background through a bounded buffer, so a flood of bad
+// requests costs the database batched inserts rather than one per request; events that
+// don't fit are only counted, in delogger_security_events_dropped_total. They are listed by
+// GET /api/security-events and summed per client by /api/security-events/summary.
+
+// securityEventKinds are the kinds of recorded events.
+var securityEventKinds = []string{"auth_failed", "forbidden", "ip_denied", "payload_too_large"}
+
+const (
+	securityEventBuffer = 1000 // events waiting to be written
+	securityEventBatch  = 100  // events written at once
+)
+
+// SecurityEvent is one rejected request.
+type SecurityEvent struct {
+	ID         int64     `json:"id"`
+	At         time.Time `json:"at"`
+	Kind       string    `json:"kind"`
+	RemoteAddr string    `json:"remote_addr"`
+	Actor      string    `json:"actor,omitempty"` // the authenticated caller, if any
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Detail     string    `json:"detail,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+var securityEvents = struct {
+	queue   chan SecurityEvent
+	counts  map[string]*atomic.Int64 // by kind
+	dropped atomic.Int64
+}{queue: make(chan SecurityEvent, securityEventBuffer), counts: map[string]*atomic.Int64{}}
+
+func init() {
+	for _, kind := range securityEventKinds {
+		securityEvents.counts[kind] = &atomic.Int64{}
+	}
+}
+
+// recordSecurityEvent queues an event of kind about r.
+func recordSecurityEvent(r *http.Request, kind, detail string) {
+	securityEvents.counts[kind].Add(1)
+	e := SecurityEvent{
+		At:         time.Now(),
+		Kind:       kind,
+		RemoteAddr: sourceName(r.RemoteAddr),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Detail:     detail,
+	}
+	if p, ok := principalFromContext(r.Context()); ok {
+		e.Actor = p.user
+	}
+	if info, ok := requestFromContext(r.Context()); ok {
+		e.RequestID = info.id
+	}
+	select {
+	case securityEvents.queue <- e:
+	default:
+		securityEvents.dropped.Add(1)
+	}
+}
+
+// startSecurityEvents starts writing the queued events.
+func startSecurityEvents() {
+	go func() {
+		for e := range securityEvents.queue {
+			batch := []SecurityEvent{e}
+		drain:
+			for len(batch) < securityEventBatch {
+				select {
+				case e := <-securityEvents.queue:
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+			if err := storeSecurityEvents(batch); err != nil {
+				slog.Error("Failed to store security events", "events", len(batch), "err", err)
+			}
+		}
+	}()
+}
+
+func storeSecurityEvents(batch []SecurityEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dbPool.CopyFrom(ctx, pgx.Identifier{"security_events"},
+		[]string{"at", "kind", "remote_addr", "actor", "method", "path", "detail", "request_id"},
+		pgx.CopyFromSlice(len(batch), func(i int) ([]any, error) {
+			e := batch[i]
+			return []any{e.At, e.Kind, e.RemoteAddr, e.Actor, e.Method, e.Path, e.Detail, e.RequestID}, nil
+		}))
+	return err
+}
+
+// writeSecurityEventMetrics adds the event counters to /metrics.
+func writeSecurityEventMetrics(m metricsWriter) {
+	m.header("delogger_security_events_total", "counter", "Rejected requests by kind of security event.")
+	for _, kind := range securityEventKinds {
+		m.sample("delogger_security_events_total", float64(securityEvents.counts[kind].Load()), "kind", kind)
+	}
+	m.value("delogger_security_events_dropped_total", "counter", "Security events not stored because the buffer was full.",
+		float64(securityEvents.dropped.Load()))
+}
+
+// securityEventConds renders the filter parameters shared by the security event routes.
+func securityEventConds(w http.ResponseWriter, r *http.Request, args *sqlArgs) ([]string, bool) {
+	query := r.URL.Query()
+	var conds []string
+	for _, name := range []string{"kind", "remote_addr", "actor", "path"} {
+		if query.Has(name) {
+			conds = append(conds, name+" = "+args.add(query.Get(name)))
+		}
+	}
+	for _, bound := range []struct{ name, op string }{{"from", ">="}, {"to", "<"}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid '"+bound.name+"' timestamp: "+err.Error(), http.StatusBadRequest)
+				return nil, false
+			}
+			conds = append(conds, "at "+bound.op+" "+args.add(t))
+		}
+	}
+	return conds, true
+}
+
+// SecurityEventsPage is the response of GET /api/security-events. NextCursor is empty on
+// the last page.
+type SecurityEventsPage struct {
+	Events     []SecurityEvent `json:"events"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// listSecurityEventsHandler handles GET /api/security-events, keyset-paginated by time,
+// newest first.
+func listSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parsePage(r.URL.Query(), 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var args sqlArgs
+	conds, ok := securityEventConds(w, r, &args)
+	if !ok {
+		return
+	}
+	if cursor != nil {
+		if cursor.Time == nil {
+			http.Error(w, "invalid 'cursor'", http.StatusBadRequest)
+			return
+		}
+		conds = append(conds, "(at, id) < ("+args.add(*cursor.Time)+", "+args.add(cursor.ID)+")")
+	}
+
+	sql := `SELECT id, at, kind, remote_addr, actor, method, path, detail, request_id FROM security_events`
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY at DESC, id DESC LIMIT " + args.add(limit+1)
+
+	rows, err := dbPool.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeSecurityEventsError(w, r, err)
+		return
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SecurityEvent, error) {
+		var e SecurityEvent
+		err := row.Scan(&e.ID, &e.At, &e.Kind, &e.RemoteAddr, &e.Actor, &e.Method, &e.Path, &e.Detail, &e.RequestID)
+		return e, err
+	})
+	if err != nil {
+		writeSecurityEventsError(w, r, err)
+		return
+	}
+
+	page := SecurityEventsPage{Events: events}
+	if page.Events == nil {
+		page.Events = []SecurityEvent{}
+	}
+	if len(page.Events) > limit {
+		page.Events = page.Events[:limit]
+		last := page.Events[limit-1]
+		page.NextCursor = pageCursor{Time: &last.At, ID: last.ID}.encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// SecurityEventSource sums the events of one client address.
+type SecurityEventSource struct {
+	RemoteAddr string           `json:"remote_addr"`
+	Total      int64            `json:"total"`
+	Kinds      map[string]int64 `json:"kinds"`
+	FirstAt    time.Time        `json:"first_at"`
+	LastAt     time.Time        `json:"last_at"`
+}
+
+// SecurityEventSummary is the response of GET /api/security-events/summary.
+type SecurityEventSummary struct {
+	Sources []SecurityEventSource `json:"sources"`
+}
+
+// securityEventSummaryHandler handles GET /api/security-events/summary, returning the
+// client addresses with the most events, by default over the last 24 hours.
+func securityEventSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !query.Has("from") {
+		query.Set("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+		r.URL.RawQuery = query.Encode()
+	}
+	limit, _, err := parsePage(query, 50, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var args sqlArgs
+	conds, ok := securityEventConds(w, r, &args)
+	if !ok {
+		return
+	}
+
+	sql := `SELECT remote_addr, sum(n)::bigint, jsonb_object_agg(kind, n), min(first_at), max(last_at) FROM (
+		SELECT remote_addr, kind, count(*) AS n, min(at) AS first_at, max(at) AS last_at FROM security_events`
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += ` GROUP BY remote_addr, kind) k GROUP BY remote_addr ORDER BY sum(n) DESC LIMIT ` + args.add(limit)
+
+	rows, err := dbPool.Query(r.Context(), sql, args...)
+	if err != nil {
+		writeSecurityEventsError(w, r, err)
+		return
+	}
+	sources, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SecurityEventSource, error) {
+		var s SecurityEventSource
+		err := row.Scan(&s.RemoteAddr, &s.Total, &s.Kinds, &s.FirstAt, &s.LastAt)
+		return s, err
+	})
+	if err != nil {
+		writeSecurityEventsError(w, r, err)
+		return
+	}
+	if sources == nil {
+		sources = []SecurityEventSource{}
+	}
+	writeJSON(w, http.StatusOK, SecurityEventSummary{Sources: sources})
+}
+
+func writeSecurityEventsError(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Could not read security events", http.StatusInternalServerError)
+	slog.ErrorContext(r.Context(), "Error reading security events", "err", err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With SELF_INGEST=true the server stores its own logs, so they can be searched like any
+// other source's:
+//
+//	SELF_INGEST           true to enable; default false
+//	SELF_INGEST_INTERVAL  how often buffered lines are stored; default 10s
+//
+// Records are rendered as bracketed lines, "[time] [LEVEL] message key=value ...", and go
+// through redaction, parsing and storage as if posted to /api/parse by the source
+// "delogger". Records logged while storing them are not ingested again, and the buffer is
+// bounded, dropping lines rather than blocking or growing when the database can't keep up.
+
+// selfIngestSource is the remote address of self-ingested records.
+const selfIngestSource = "delogger"
+
+const (
+	selfIngestBuffer = 10000 // lines waiting to be stored
+	selfIngestBatch  = 1000  // lines stored at once; a full batch is stored without waiting
+)
+
+// selfIngestion buffers the lines of the server's log records, nil unless enabled.
+type selfIngestion struct {
+	lines    chan string
+	dropped  atomic.Int64
+	interval time.Duration
+
+	mu  sync.Mutex   // guards buf, the output of the attrs handlers
+	buf bytes.Buffer // one record's attributes
+}
+
+var selfIngest *selfIngestion
+
+// selfIngestKey marks the context of storing self-ingested lines; records logged with it
+// are not ingested again.
+type selfIngestKey struct{}
+
+// setupSelfIngestion reads the configuration. It runs before the database is set up, so
+// the lines of startup are buffered until startSelfIngestion.
+func setupSelfIngestion() {
+	enabled, err := strconv.ParseBool(setting("SELF_INGEST"))
+	if err != nil || !enabled {
+		if v := setting("SELF_INGEST"); v != "" && err != nil {
+			fatalConfig("Invalid SELF_INGEST", "value", v)
+		}
+		return
+	}
+	interval := 10 * time.Second
+	if v := setting("SELF_INGEST_INTERVAL"); v != "" {
+		interval, err = time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			fatalConfig("Invalid SELF_INGEST_INTERVAL", "value", v)
+		}
+	}
+	selfIngest = &selfIngestion{lines: make(chan string, selfIngestBuffer), interval: interval}
+}
+
+// wrap returns h, also ingesting the records it handles. It returns h itself when
+// self-ingestion is disabled.
+func (s *selfIngestion) wrap(h slog.Handler) slog.Handler {
+	if s == nil {
+		return h
+	}
+	attrs := slog.NewTextHandler(&s.buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return selfIngestHandler{Handler: h, attrs: attrs, sink: s}
+}
+
+// selfIngestHandler passes records to its Handler and buffers them as lines.
+type selfIngestHandler struct {
+	slog.Handler
+	attrs slog.Handler // renders the record's attributes into sink.buf
+	sink  *selfIngestion
+}
+
+func (h selfIngestHandler) Handle(ctx context.Context, rec slog.Record) error {
+	err := h.Handler.Handle(ctx, rec)
+	if ctx != nil && ctx.Value(selfIngestKey{}) != nil {
+		return err
+	}
+
+	h.sink.mu.Lock()
+	h.sink.buf.Reset()
+	h.attrs.Handle(ctx, rec)
+	attrs := strings.TrimSpace(h.sink.buf.String())
+	h.sink.mu.Unlock()
+
+	line := "[" + rec.Time.UTC().Format(time.RFC3339Nano) + "] [" + rec.Level.String() + "] " + rec.Message
+	if attrs != "" {
+		line += " " + attrs
+	}
+	select {
+	case h.sink.lines <- line:
+	default:
+		h.sink.dropped.Add(1)
+	}
+	return err
+}
+
+func (h selfIngestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return selfIngestHandler{Handler: h.Handler.WithAttrs(attrs), attrs: h.attrs.WithAttrs(attrs), sink: h.sink}
+}
+
+func (h selfIngestHandler) WithGroup(name string) slog.Handler {
+	return selfIngestHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs.WithGroup(name), sink: h.sink}
+}
+
+// startSelfIngestion starts storing the buffered lines. It is a no-op when disabled.
+func startSelfIngestion() {
+	if selfIngest == nil {
+		return
+	}
+	go selfIngest.run()
+	slog.Info("Ingesting own logs", "interval", selfIngest.interval)
+}
+
+func (s *selfIngestion) run() {
+	ctx := context.WithValue(context.Background(), selfIngestKey{}, true)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var batch []string
+	for {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+			if len(batch) < selfIngestBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if n := s.dropped.Swap(0); n > 0 {
+			slog.WarnContext(ctx, "Dropped own log lines: self-ingestion buffer or write queue full", "lines", n)
+		}
+		if len(batch) > 0 {
+			s.store(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// store parses and stores lines like a request to /api/parse.
+// Lines are dropped while the write queue is full.
+func (s *selfIngestion) store(ctx context.Context, lines []string) {
+	if !reserveRecord() {
+		s.dropped.Add(int64(len(lines)))
+		return
+	}
+	text := strings.Join(lines, "\n")
+	logText, redactions := redaction.Load().redact(text)
+	record := LogRecord{
+		Timestamp:   time.Now(),
+		RemoteAddr:  selfIngestSource,
+		RequestBody: logText,
+		StatusCode:  200,
+		Service:     selfIngestSource,
+		Redactions:  redactions,
+		Fields:      sourceFields(selfIngestSource),
+	}
+	record.Host, _ = os.Hostname()
+
+	parseStart := time.Now()
+	record.Entries = parseLines(lineParser, logText)
+	ingest.record(record.Service, len(text), record.Entries, time.Since(parseStart))
+	record.responseBuf = getJSONBuffer()
+	record.ResponseBody, _ = record.responseBuf.encode(record.Entries)
+
+	recordLog(ctx, record)
+	putEntries(record.Entries)
+}
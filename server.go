@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// The HTTP servers bound how long a client may take, so slow or stalled clients, such as a
+// slowloris sending its headers a byte at a time, can't hold connections open:
+//
+//	HTTP_READ_HEADER_TIMEOUT  to send the headers of a request; default 10s
+//	HTTP_READ_TIMEOUT         to send a whole request, body included; default 5m, for large
+//	                          payloads over slow links
+//	HTTP_WRITE_TIMEOUT        to receive a response, from the end of its request's headers;
+//	                          default 5m
+//	HTTP_IDLE_TIMEOUT         between requests on a kept-alive connection; default 2m
+//	HTTP_MAX_HEADER_BYTES     largest headers of a request; default 64K
+//
+// 0 disables a timeout. The live tails and exports stream for as long as the client wants,
+// so once their request is read they are exempt from the read and write timeouts; the
+// WebSocket tail has its own pings instead.
+
+var serverLimits = struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int64
+}{
+	readHeaderTimeout: 10 * time.Second,
+	readTimeout:       5 * time.Minute,
+	writeTimeout:      5 * time.Minute,
+	idleTimeout:       2 * time.Minute,
+	maxHeaderBytes:    64 << 10,
+}
+
+// setupServerLimits reads the timeouts and header limit of the servers.
+func setupServerLimits() {
+	for _, s := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", &serverLimits.readHeaderTimeout}, {"HTTP_READ_TIMEOUT", &serverLimits.readTimeout},
+		{"HTTP_WRITE_TIMEOUT", &serverLimits.writeTimeout}, {"HTTP_IDLE_TIMEOUT", &serverLimits.idleTimeout},
+	} {
+		if v := setting(s.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				fatalConfig("Invalid "+s.env+": must be a duration such as 30s", "value", v)
+			}
+			*s.value = d
+		}
+	}
+	if v := setting("HTTP_MAX_HEADER_BYTES"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil || n <= 0 || n > 1<<30 {
+			fatalConfig("Invalid HTTP_MAX_HEADER_BYTES: must be a positive size such as 64K", "value", v)
+		}
+		serverLimits.maxHeaderBytes = n
+	}
+}
+
+// newServer returns a server of handler with the limits of the settings.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverLimits.readHeaderTimeout,
+		ReadTimeout:       serverLimits.readTimeout,
+		WriteTimeout:      serverLimits.writeTimeout,
+		IdleTimeout:       serverLimits.idleTimeout,
+		MaxHeaderBytes:    int(serverLimits.maxHeaderBytes),
+	}
+}
+
+// withoutTimeouts lifts the read and write timeouts of a streaming route's connection.
+// Without the read deadline lifted, its expiry would also cancel the request's context.
+func withoutTimeouts(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			slog.WarnContext(r.Context(), "Could not lift the read timeout", "err", err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			slog.WarnContext(r.Context(), "Could not lift the write timeout", "err", err)
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"delogger/enrich"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SeverityLevel is a canonical severity (see package enrich).
+type SeverityLevel = enrich.SeverityLevel
+
+// severityAliases holds the user-defined aliases from severity_aliases, which take
+// precedence over the built-in ones.
+var severityAliases = struct {
+	sync.RWMutex
+	custom map[string]string
+}{custom: map[string]string{}}
+
+// normalizeSeverity maps a level as written in a log line to its canonical severity and
+// number, with the user-defined aliases. Unknown and empty levels map to "" and 0.
+func normalizeSeverity(level string) (string, int) {
+	severityAliases.RLock()
+	defer severityAliases.RUnlock()
+	return enrich.Severity(level, severityAliases.custom)
+}
+
+// loadSeverityAliases reads the user-defined aliases into memory.
+func loadSeverityAliases() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, `SELECT alias, severity FROM severity_aliases`)
+	if err != nil {
+		fatal("Failed to load severity aliases", "err", err)
+	}
+	custom := map[string]string{}
+	var alias, severity string
+	_, err = pgx.ForEachRow(rows, []any{&alias, &severity}, func() error {
+		custom[alias] = severity
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to load severity aliases", "err", err)
+	}
+
+	severityAliases.Lock()
+	severityAliases.custom = custom
+	severityAliases.Unlock()
+}
+
+// SeverityAlias maps a level spelling to a canonical severity.
+type SeverityAlias struct {
+	Alias    string `json:"alias"`
+	Severity string `json:"severity"`
+	Builtin  bool   `json:"builtin"`
+}
+
+// SeverityMappings is the response of GET /api/severities.
+type SeverityMappings struct {
+	Levels  []SeverityLevel `json:"levels"`
+	Aliases []SeverityAlias `json:"aliases"`
+}
+
+// listSeveritiesHandler handles GET /api/severities, returning the canonical levels and
+// every alias in effect.
+func listSeveritiesHandler(w http.ResponseWriter, r *http.Request) {
+	severityAliases.RLock()
+	aliases := make([]SeverityAlias, 0, len(enrich.SeverityAliases)+len(severityAliases.custom))
+	for alias, severity := range severityAliases.custom {
+		aliases = append(aliases, SeverityAlias{Alias: alias, Severity: severity})
+	}
+	for alias, severity := range enrich.SeverityAliases {
+		if _, overridden := severityAliases.custom[alias]; !overridden {
+			aliases = append(aliases, SeverityAlias{Alias: alias, Severity: severity, Builtin: true})
+		}
+	}
+	severityAliases.RUnlock()
+
+	slices.SortFunc(aliases, func(a, b SeverityAlias) int { return strings.Compare(a.Alias, b.Alias) })
+	writeJSON(w, http.StatusOK, SeverityMappings{Levels: enrich.SeverityLevels, Aliases: aliases})
+}
+
+// putSeverityHandler handles PUT /api/severities/{alias}, adding or replacing a user-defined
+// alias. It applies to entries ingested from then on.
+func putSeverityHandler(w http.ResponseWriter, r *http.Request) {
+	alias := strings.ToLower(strings.TrimSpace(r.PathValue("alias")))
+	if alias == "" {
+		http.Error(w, "Missing alias", http.StatusBadRequest)
+		return
+	}
+	var a SeverityAlias
+	if err := readJSON(r, &a); err != nil {
+		http.Error(w, "Invalid severity alias: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	a.Alias, a.Builtin = alias, false
+	a.Severity = strings.ToLower(strings.TrimSpace(a.Severity))
+	if enrich.SeverityNumber(a.Severity) == 0 {
+		http.Error(w, "Invalid severity alias: unknown severity "+strconv.Quote(a.Severity), http.StatusBadRequest)
+		return
+	}
+
+	_, err := dbPool.Exec(r.Context(), `
+	INSERT INTO severity_aliases (alias, severity) VALUES ($1, $2)
+	ON CONFLICT (alias) DO UPDATE SET severity = EXCLUDED.severity`,
+		a.Alias, a.Severity)
+	if err != nil {
+		http.Error(w, "Could not save severity alias", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving severity alias", "alias", a.Alias, "err", err)
+		return
+	}
+
+	severityAliases.Lock()
+	severityAliases.custom[a.Alias] = a.Severity
+	severityAliases.Unlock()
+
+	slog.InfoContext(r.Context(), "Mapped severity alias", "alias", a.Alias, "severity", a.Severity)
+	writeJSON(w, http.StatusOK, a)
+}
+
+// deleteSeverityHandler handles DELETE /api/severities/{alias}, removing a user-defined alias.
+// Built-in aliases cannot be deleted, only overridden.
+func deleteSeverityHandler(w http.ResponseWriter, r *http.Request) {
+	alias := strings.ToLower(strings.TrimSpace(r.PathValue("alias")))
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM severity_aliases WHERE alias = $1`, alias)
+	if err != nil {
+		http.Error(w, "Could not delete severity alias", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting severity alias", "alias", alias, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Severity alias not found", http.StatusNotFound)
+		return
+	}
+
+	severityAliases.Lock()
+	delete(severityAliases.custom, alias)
+	severityAliases.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted severity alias", "alias", alias)
+	w.WriteHeader(http.StatusNoContent)
+}
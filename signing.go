@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agents can sign their ingest requests with a shared secret instead of sending a key,
+// which an eavesdropper on a hostile network could reuse:
+//
+//	INGEST_SIGNING_KEYS      comma-separated id=secret pairs, e.g. edge-1=4f9c...,edge-2=...
+//	INGEST_SIGNATURE_WINDOW  how far a request's timestamp may be from the server's clock;
+//	                         default 5m
+//
+// A signed request names its key and time, and carries the hex HMAC-SHA256 of the
+// timestamp, method, path and body, each followed by a newline except the body:
+//
+//	X-DeLogger-Key-Id: edge-1
+//	X-DeLogger-Timestamp: 1767225600
+//	X-DeLogger-Signature: hex(HMAC-SHA256(secret, "1767225600\nPOST\n/api/parse\n" + body))
+//
+// Requests outside the window are refused, and so is a signature seen before within it,
+// so a captured request can't be replayed. A valid signature grants the ingest role (see
+// auth.go); signatures are checked where /api/parse requires authentication, i.e. with
+// AUTH_INGEST=true.
+
+const (
+	signatureKeyHeader       = "X-DeLogger-Key-Id"
+	signatureTimestampHeader = "X-DeLogger-Timestamp"
+	signatureHeader          = "X-DeLogger-Signature"
+)
+
+// signing holds the configured secrets and the signatures seen within the window.
+var signing struct {
+	keys   map[string][]byte // nil unless INGEST_SIGNING_KEYS is set
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signature -> when it leaves the window
+	nextSweep time.Time
+}
+
+// setupSigning reads the signing keys.
+func setupSigning() {
+	v := secretEnv("INGEST_SIGNING_KEYS")
+	if v == "" {
+		return
+	}
+	signing.keys = map[string][]byte{}
+	for _, pair := range strings.Split(v, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || len(secret) < 16 {
+			fatalConfig("Invalid INGEST_SIGNING_KEYS entry: must be id=secret with a secret of at least 16 characters", "id", id)
+		}
+		signing.keys[id] = []byte(secret)
+	}
+	signing.window = 5 * time.Minute
+	if v := setting("INGEST_SIGNATURE_WINDOW"); v != "" {
+		var err error
+		signing.window, err = time.ParseDuration(v)
+		if err != nil || signing.window <= 0 {
+			fatalConfig("Invalid INGEST_SIGNATURE_WINDOW", "value", v)
+		}
+	}
+	signing.seen = map[string]time.Time{}
+	slog.Info("Accepting signed ingest requests", "keys", len(signing.keys), "window", signing.window)
+}
+
+// verifySignature checks the signature of r, which is read and replaced so the handler
+// can read it again. It returns the caller, the key id with the ingest role.
+func verifySignature(w http.ResponseWriter, r *http.Request) (principal, error) {
+	id := r.Header.Get(signatureKeyHeader)
+	secret, ok := signing.keys[id]
+	if !ok {
+		return principal{}, errors.New("unknown signing key " + strconv.Quote(id))
+	}
+	unix, err := strconv.ParseInt(r.Header.Get(signatureTimestampHeader), 10, 64)
+	if err != nil {
+		return principal{}, errors.New("invalid " + signatureTimestampHeader)
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > signing.window || skew < -signing.window {
+		return principal{}, errors.New("timestamp outside the signature window")
+	}
+	sig, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		return principal{}, errors.New("invalid " + signatureHeader)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBytes))
+	if err != nil {
+		return principal{}, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, strconv.FormatInt(unix, 10)+"\n"+r.Method+"\n"+r.URL.Path+"\n")
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return principal{}, errors.New("signature mismatch")
+	}
+
+	signing.mu.Lock()
+	defer signing.mu.Unlock()
+	if now.After(signing.nextSweep) {
+		for s, expiry := range signing.seen {
+			if now.After(expiry) {
+				delete(signing.seen, s)
+			}
+		}
+		signing.nextSweep = now.Add(time.Minute)
+	}
+	key := string(sig)
+	if _, replayed := signing.seen[key]; replayed {
+		return principal{}, errors.New("replayed signature")
+	}
+	// The timestamp is accepted until window after it, so that is when it can be forgotten.
+	signing.seen[key] = time.Unix(unix, 0).Add(signing.window)
+	return principal{user: "signed:" + id, roles: []string{"ingest"}}, nil
+}
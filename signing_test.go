@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSigning configures the signing keys for the duration of the test.
+func withSigning(t *testing.T, keys map[string]string, window time.Duration) {
+	t.Helper()
+	saved := signing.keys
+	signing.keys = map[string][]byte{}
+	for id, secret := range keys {
+		signing.keys[id] = []byte(secret)
+	}
+	signing.window = window
+	signing.seen = map[string]time.Time{}
+	t.Cleanup(func() { signing.keys = saved })
+}
+
+// signedRequest returns an ingest request signed as an agent would.
+func signedRequest(id, secret string, at time.Time, body string) (method, path string, headers map[string]string) {
+	unix := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, unix+"\nPOST\n/api/parse\n"+body)
+	return "POST", "/api/parse", map[string]string{
+		signatureKeyHeader:       id,
+		signatureTimestampHeader: unix,
+		signatureHeader:          hex.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const secret = "0123456789abcdef0123"
+	withSigning(t, map[string]string{"edge-1": secret}, 5*time.Minute)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		at     time.Time
+		body   string
+		edit   func(method, path string, headers map[string]string) (string, string) // "" if unchanged
+		err    string                                                                // "" if accepted
+	}{
+		{"valid", "edge-1", secret, now, "[t] [INFO] one", nil, ""},
+		{"empty body", "edge-1", secret, now, "", nil, ""},
+		{"at the edge of the window", "edge-1", secret, now.Add(-4 * time.Minute), "[t] [INFO] two", nil, ""},
+		{"from the future within the window", "edge-1", secret, now.Add(4 * time.Minute), "[t] [INFO] three", nil, ""},
+		{"unknown key", "edge-2", secret, now, "x", nil, `unknown signing key "edge-2"`},
+		{"no key", "", secret, now, "x", nil, `unknown signing key ""`},
+		{"too old", "edge-1", secret, now.Add(-6 * time.Minute), "x", nil, "timestamp outside the signature window"},
+		{"too new", "edge-1", secret, now.Add(6 * time.Minute), "x", nil, "timestamp outside the signature window"},
+		{"wrong secret", "edge-1", "fedcba9876543210fedc", now, "x", nil, "signature mismatch"},
+		{"other path", "edge-1", secret, now, "x", func(method, path string, h map[string]string) (string, string) {
+			return method, "/api/parse/preview"
+		}, "signature mismatch"},
+		{"other method", "edge-1", secret, now, "x", func(method, path string, h map[string]string) (string, string) {
+			return "PUT", path
+		}, "signature mismatch"},
+		{"invalid timestamp", "edge-1", secret, now, "x", func(method, path string, h map[string]string) (string, string) {
+			h[signatureTimestampHeader] = "yesterday"
+			return method, path
+		}, "invalid " + signatureTimestampHeader},
+		{"timestamp changed", "edge-1", secret, now, "x", func(method, path string, h map[string]string) (string, string) {
+			h[signatureTimestampHeader] = strconv.FormatInt(now.Unix()+1, 10)
+			return method, path
+		}, "signature mismatch"},
+		{"invalid signature", "edge-1", secret, now, "x", func(method, path string, h map[string]string) (string, string) {
+			h[signatureHeader] = "not hex"
+			return method, path
+		}, "invalid " + signatureHeader},
+	}
+	for _, tt := range tests {
+		method, path, headers := signedRequest(tt.id, tt.secret, tt.at, tt.body)
+		if tt.edit != nil {
+			method, path = tt.edit(method, path, headers)
+		}
+		r := httptest.NewRequest(method, path, strings.NewReader(tt.body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		p, err := verifySignature(httptest.NewRecorder(), r)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.user != "signed:"+tt.id || !slices.Equal(p.roles, []string{"ingest"}) {
+			t.Errorf("%s: got caller %+v, want the key with the ingest role", tt.name, p)
+		}
+		// The handler reads the body again.
+		if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+			t.Errorf("%s: handler got body %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestVerifySignatureRejectsReplay(t *testing.T) {
+	const secret = "0123456789abcdef0123"
+	withSigning(t, map[string]string{"edge-1": secret}, 5*time.Minute)
+	now := time.Now()
+
+	send := func(at time.Time, body string) error {
+		method, path, headers := signedRequest("edge-1", secret, at, body)
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		_, err := verifySignature(httptest.NewRecorder(), r)
+		return err
+	}
+	if err := send(now, "[t] [INFO] once"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(now, "[t] [INFO] once"); err == nil || err.Error() != "replayed signature" {
+		t.Errorf("replay: got error %v, want replayed signature", err)
+	}
+	// The same body at another time, or another body at the same time, is a new request.
+	if err := send(now.Add(-time.Second), "[t] [INFO] once"); err != nil {
+		t.Errorf("same body, other time: %v", err)
+	}
+	if err := send(now, "[t] [INFO] twice"); err != nil {
+		t.Errorf("other body, same time: %v", err)
+	}
+
+	// Signatures are forgotten once their timestamp leaves the window, by when a replay
+	// is refused for its age instead.
+	signing.nextSweep = time.Time{}
+	for sig := range signing.seen {
+		signing.seen[sig] = now.Add(-time.Second)
+	}
+	if err := send(now.Add(time.Second), "[t] [INFO] later"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(signing.seen); got != 1 {
+		t.Errorf("got %d signatures remembered after the sweep, want 1", got)
+	}
+}
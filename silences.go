@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Silences mute the notifications of matching alert rules for a time range, e.g. during
+// maintenance of web-1:
+//
+//	{"matchers": {"host": "web-1"}, "starts_at": "2026-05-02T22:00:00Z",
+//	 "ends_at": "2026-05-03T02:00:00Z", "comment": "kernel upgrade"}
+//
+// Matchers compare shell patterns (see path.Match) with a rule's "rule" name, its
+// "condition" or the values of its filter; a silence applies to the rules matched by all
+// of them. Silenced rules are still evaluated, and notify when the silence ends if they
+// are still firing. Silences are stored in alert_silences and managed through /api/silences.
+
+// Silence mutes the rules its Matchers match between StartsAt and EndsAt.
+type Silence struct {
+	ID        int64             `json:"id"`
+	Matchers  map[string]string `json:"matchers"`
+	StartsAt  time.Time         `json:"starts_at"`
+	EndsAt    time.Time         `json:"ends_at"`
+	Comment   string            `json:"comment,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// validate normalizes s and checks its matchers and time range. StartsAt defaults to now.
+func (s *Silence) validate() error {
+	if len(s.Matchers) == 0 {
+		return errors.New("at least one matcher is required")
+	}
+	for k, v := range s.Matchers {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid pattern for %q: %v", k, err)
+		}
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = time.Now()
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	s.Comment = strings.TrimSpace(s.Comment)
+	return nil
+}
+
+// matches reports whether s applies to rule.
+func (s Silence) matches(rule AlertRule) bool {
+	for k, pattern := range s.Matchers {
+		value := rule.Filter[k]
+		switch k {
+		case "rule":
+			value = rule.Name
+		case "condition":
+			value = rule.Condition
+		}
+		if ok, _ := path.Match(pattern, value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// silenced reports whether an active silence applies to rule. Silences that ended are
+// forgotten. a.mu must be held.
+func (a *alerter) silenced(rule AlertRule, now time.Time) bool {
+	muted := false
+	for id, s := range a.silences {
+		if !now.Before(s.EndsAt) {
+			delete(a.silences, id)
+			continue
+		}
+		if !now.Before(s.StartsAt) && s.matches(rule) {
+			muted = true
+		}
+	}
+	return muted
+}
+
+// loadSilences reads the silences that have not ended yet.
+func loadSilences(ctx context.Context) ([]Silence, error) {
+	rows, err := dbPool.Query(ctx, silenceSelectSQL+" WHERE ends_at > now() ORDER BY starts_at, id")
+	if err != nil {
+		return nil, err
+	}
+	silences, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Silence, error) {
+		return scanSilence(row)
+	})
+	if silences == nil {
+		silences = []Silence{}
+	}
+	return silences, err
+}
+
+// silenceSelectSQL is the column list scanned by scanSilence.
+const silenceSelectSQL = `SELECT id, matchers, starts_at, ends_at, comment, created_at FROM alert_silences`
+
+func scanSilence(row pgx.Row) (Silence, error) {
+	var s Silence
+	err := row.Scan(&s.ID, &s.Matchers, &s.StartsAt, &s.EndsAt, &s.Comment, &s.CreatedAt)
+	return s, err
+}
+
+// Silences is the response of GET /api/silences.
+type Silences struct {
+	Silences []Silence `json:"silences"`
+}
+
+// listSilencesHandler handles GET /api/silences, listing the silences that have not ended.
+func listSilencesHandler(w http.ResponseWriter, r *http.Request) {
+	silences, err := loadSilences(r.Context())
+	if err != nil {
+		http.Error(w, "Could not list silences", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing silences", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Silences{Silences: silences})
+}
+
+// createSilenceHandler handles POST /api/silences.
+func createSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	var s Silence
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid silence: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid silence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	saved, err := scanSilence(dbPool.QueryRow(r.Context(), `
+	INSERT INTO alert_silences (matchers, starts_at, ends_at, comment)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, matchers, starts_at, ends_at, comment, created_at`,
+		s.Matchers, s.StartsAt, s.EndsAt, s.Comment))
+	if err != nil {
+		http.Error(w, "Could not save silence", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving silence", "err", err)
+		return
+	}
+
+	alerts.mu.Lock()
+	alerts.silences[saved.ID] = saved
+	alerts.mu.Unlock()
+
+	slog.InfoContext(r.Context(), "Created silence", "id", saved.ID, "ends_at", saved.EndsAt)
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+// deleteSilenceHandler handles DELETE /api/silences/{id}, ending a silence early.
+func deleteSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid silence id", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM alert_silences WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, "Could not delete silence", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting silence", "id", id, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+
+	alerts.mu.Lock()
+	delete(alerts.silences, id)
+	alerts.mu.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted silence", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every source that sends to /api/parse is registered in source_activity with the time of
+// its last request. Alert rules with condition "absence" fire when more than threshold of
+// the registered sources have sent nothing for longer than the rule's window, e.g. when
+// any web host has been quiet for 15 minutes:
+//
+//	{"name": "web hosts silent", "condition": "absence", "filter": {"service": "web"},
+//	 "threshold": 0, "window": "15m", "channels": [...]}
+//
+// Their filter can only match the host, service and env of a source's last request.
+// Decommissioned sources are removed with DELETE /api/source-activity/{source}.
+
+// absenceFilterKeys are the filter keys accepted by absence rules.
+var absenceFilterKeys = []string{"host", "service", "env"}
+
+// sourceActivitySQL registers a request from a source.
+const sourceActivitySQL = `
+INSERT INTO source_activity (source, host, service, env, tenant, first_seen, last_seen)
+VALUES ($1, $2, $3, $4, $5, $6, $6)
+ON CONFLICT (source) DO UPDATE SET host = EXCLUDED.host, service = EXCLUDED.service, env = EXCLUDED.env,
+	tenant = EXCLUDED.tenant, last_seen = GREATEST(source_activity.last_seen, EXCLUDED.last_seen)`
+
+// SourceActivity is a registered source and when it last sent a request.
+type SourceActivity struct {
+	Source    string    `json:"source"`
+	Host      string    `json:"host"`
+	Service   string    `json:"service"`
+	Env       string    `json:"env"`
+	Tenant    string    `json:"tenant,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// SourceActivities is the response of /api/source-activity.
+type SourceActivities struct {
+	Sources []SourceActivity `json:"sources"`
+}
+
+// loadSourceActivity returns the registered sources matching filter's host, service, env
+// and tenant that sent nothing after before, or all of them if before is zero, quietest first.
+func loadSourceActivity(ctx context.Context, filter entryFilter, before time.Time) ([]SourceActivity, error) {
+	var args sqlArgs
+	sql := `SELECT source, host, service, env, tenant, first_seen, last_seen FROM source_activity WHERE true`
+	if !before.IsZero() {
+		sql += " AND last_seen < " + args.add(before)
+	}
+	if filter.Host != "" {
+		sql += " AND host = " + args.add(filter.Host)
+	}
+	if filter.Service != "" {
+		sql += " AND service = " + args.add(filter.Service)
+	}
+	if filter.Env != "" {
+		sql += " AND env = " + args.add(filter.Env)
+	}
+	if filter.Tenant != "" {
+		sql += " AND tenant = " + args.add(filter.Tenant)
+	}
+	sql += " ORDER BY last_seen, source"
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := pgx.CollectRows(rows, pgx.RowToStructByPos[SourceActivity])
+	if sources == nil {
+		sources = []SourceActivity{}
+	}
+	return sources, err
+}
+
+// listSourceActivityHandler handles GET /api/source-activity, listing the registered
+// sources, quietest first.
+func listSourceActivityHandler(w http.ResponseWriter, r *http.Request) {
+	sources, err := loadSourceActivity(r.Context(), entryFilter{}, time.Time{})
+	if err != nil {
+		http.Error(w, "Could not list source activity", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing source activity", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, SourceActivities{Sources: sources})
+}
+
+// deleteSourceActivityHandler handles DELETE /api/source-activity/{source}, forgetting a
+// source until it sends again.
+func deleteSourceActivityHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM source_activity WHERE source = $1`, source)
+	if err != nil {
+		http.Error(w, "Could not delete source activity", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting activity of source", "source", source, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Source is not registered", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Deleted activity of source", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
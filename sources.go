@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"delogger/parser"
+)
+
+// Log sources can be registered with POST /api/sources, each given a token it sends its
+// payloads with, in the X-DeLogger-Source-Token header. Records ingested with a token are
+// stored with the id of its source, in delogged.source_id and the source_id field of their
+// entries, and their lines are parsed with the source's parser if it names one, the other
+// formats being kept as raw. The token is shown once, when the source is created; only its
+// SHA-256 hash is stored.
+//
+//	REQUIRE_SOURCE_TOKEN  true to refuse payloads without a token with 401; default false
+//
+// A token that isn't a source's is refused even when tokens aren't required. Sources are
+// kept in PostgreSQL, so with STORAGE=memory there are none and tokens can't be required.
+// A source can only be deleted once it has no stored records, so that every record's
+// source stays resolvable.
+
+// sourceTokenPrefix starts every source token, telling them from API keys.
+const sourceTokenPrefix = "dls_"
+
+// sourceTokenHeader carries the token of a payload's source.
+const sourceTokenHeader = "X-DeLogger-Source-Token"
+
+// Source is a registered source. Token is only set in the response of its creation.
+type Source struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Project   string    `json:"project,omitempty"`   // the project it belongs to, see projects.go
+	Format    string    `json:"format,omitempty"`    // the format its lines are expected in, e.g. "nginx combined"
+	Parser    string    `json:"parser,omitempty"`    // the built-in parser of its lines; all in turn if empty
+	Retention string    `json:"retention,omitempty"` // how long its records are kept, see retention.go
+	Hint      string    `json:"hint"`                // first characters of the token, to tell tokens apart
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	without []string // the parsers not tried on its lines, besides DISABLE_PARSERS
+}
+
+// validate normalizes s, checks its name and parser and sets the parser up.
+func (s *Source) validate() error {
+	s.Name, s.Format = strings.TrimSpace(s.Name), strings.TrimSpace(s.Format)
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.Retention != "" {
+		if _, err := parseRetention(s.Retention); err != nil {
+			return err
+		}
+	}
+	if s.Project != "" && !projectExists(s.Project) {
+		return errors.New("unknown project " + strconv.Quote(s.Project) + ": register it with PUT /api/projects/{id}")
+	}
+	s.without = nil
+	if s.Parser == "" {
+		return nil
+	}
+	if s.Parser == "raw" || parserByName(s.Parser) == nil {
+		return errors.New("parser must be a built-in parser other than raw")
+	}
+	if slices.Contains(disabledParsers, s.Parser) {
+		return errors.New("parser " + strconv.Quote(s.Parser) + " is disabled by DISABLE_PARSERS")
+	}
+	for _, p := range builtinParsers {
+		if p.Name != s.Parser && p.Name != "raw" {
+			s.without = append(s.without, p.Name)
+		}
+	}
+	return nil
+}
+
+// sources holds the registered sources by the hash of their token.
+var sources struct {
+	sync.RWMutex
+	byHash        map[[sha256.Size]byte]Source
+	tokenRequired bool
+}
+
+// setupSources reads REQUIRE_SOURCE_TOKEN.
+func setupSources() {
+	if v := setting("REQUIRE_SOURCE_TOKEN"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			fatalConfig("Invalid REQUIRE_SOURCE_TOKEN: must be true or false", "value", v)
+		}
+		if required && inMemory() {
+			fatalConfig("Invalid REQUIRE_SOURCE_TOKEN: sources can't be registered with STORAGE=memory", "value", v)
+		}
+		sources.tokenRequired = required
+	}
+}
+
+// loadSources reads the registered sources into memory.
+func loadSources() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, `SELECT token_hash, id, name, project, format, parser, retention, hint, created_at FROM sources`)
+	if err != nil {
+		fatal("Failed to load sources", "err", err)
+	}
+	byHash := map[[sha256.Size]byte]Source{}
+	var hash []byte
+	var s Source
+	_, err = pgx.ForEachRow(rows, []any{&hash, &s.ID, &s.Name, &s.Project, &s.Format, &s.Parser, &s.Retention, &s.Hint, &s.CreatedAt}, func() error {
+		// A source whose parser was disabled since parses with the others.
+		if err := s.validate(); err != nil {
+			slog.Warn("Source parser unavailable, trying every parser", "source", s.Name, "err", err)
+			s.without = nil
+		}
+		byHash[[sha256.Size]byte(hash)] = s
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to load sources", "err", err)
+	}
+
+	sources.Lock()
+	sources.byHash = byHash
+	sources.Unlock()
+}
+
+type sourceKey struct{}
+
+// requestSource returns the source of an ingest request, the zero Source if it has none.
+func requestSource(ctx context.Context) Source {
+	s, _ := ctx.Value(sourceKey{}).(Source)
+	return s
+}
+
+// requestParser returns the parser of an ingest request's lines: the formats of its source,
+// if it names one, less those disabled for its tenant (see overrides.go). The names were
+// checked when the source and tenant were saved; should one still be refused, what it
+// would have disabled is logged and ignored, keeping the parser of the level above.
+func requestParser(ctx context.Context) parser.Parser {
+	source, tenant := requestSource(ctx), requestTenant(ctx)
+	overrides := tenantOverrides(tenant).DisableParsers
+	p := lineParser
+	if len(source.without) > 0 {
+		sp, err := parser.Without(slices.Concat(disabledParsers, source.without)...)
+		if err != nil {
+			slog.ErrorContext(ctx, "Invalid parser of source, trying the others", "source", source.Name, "err", err)
+			return p
+		}
+		p = sp
+	}
+	if len(overrides) == 0 {
+		return p
+	}
+	tp, err := parser.Without(slices.Concat(disabledParsers, source.without, overrides)...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid disable_parsers override, ignoring it", "tenant", tenant, "err", err)
+		return p
+	}
+	return tp
+}
+
+// identifySource wraps the handler of an ingest route to find the source of the request
+// from its token, refusing it if the token is invalid, or missing and required, or if the
+// caller is bound to a project the source isn't in.
+func identifySource(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(r.Header.Get(sourceTokenHeader))
+		project := requestProject(r.Context())
+		if token == "" {
+			if project != "" {
+				http.Error(w, "Forbidden: project keys ingest with the token of a source of their project", http.StatusForbidden)
+				recordSecurityEvent(r, "forbidden", "project key without a source token")
+				return
+			}
+			if sources.tokenRequired {
+				http.Error(w, "Source token required in "+sourceTokenHeader, http.StatusUnauthorized)
+				recordSecurityEvent(r, "auth_failed", "missing source token")
+				return
+			}
+			h(w, r)
+			return
+		}
+
+		sources.RLock()
+		s, ok := sources.byHash[sha256.Sum256([]byte(token))]
+		sources.RUnlock()
+		if !ok {
+			http.Error(w, "Invalid source token", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected source token")
+			recordSecurityEvent(r, "auth_failed", "invalid source token")
+			return
+		}
+		if project != "" && s.Project != project {
+			http.Error(w, "Forbidden: the source isn't in the key's project", http.StatusForbidden)
+			recordSecurityEvent(r, "forbidden", "source "+strconv.Quote(s.Name)+" outside project "+strconv.Quote(project))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), sourceKey{}, s)))
+	}
+}
+
+// Sources is the response of GET /api/sources.
+type Sources struct {
+	Sources []Source `json:"sources"`
+}
+
+// listSourcesHandler handles GET /api/sources.
+func listSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	sources.RLock()
+	list := []Source{}
+	for _, s := range sources.byHash {
+		list = append(list, s)
+	}
+	sources.RUnlock()
+	slices.SortFunc(list, func(a, b Source) int { return int(a.ID - b.ID) })
+	writeJSON(w, http.StatusOK, Sources{Sources: list})
+}
+
+// getSourceHandler handles GET /api/sources/{id}.
+func getSourceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid source id", http.StatusBadRequest)
+		return
+	}
+	sources.RLock()
+	defer sources.RUnlock()
+	for _, s := range sources.byHash {
+		if s.ID == id {
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	http.Error(w, "Source not found", http.StatusNotFound)
+}
+
+// createSourceHandler handles POST /api/sources, generating the token.
+func createSourceHandler(w http.ResponseWriter, r *http.Request) {
+	var s Source
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid source: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	s.Token = sourceTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	s.Hint = s.Token[:len(sourceTokenPrefix)+6]
+	hash := sha256.Sum256([]byte(s.Token))
+
+	err := dbPool.QueryRow(r.Context(), `
+	INSERT INTO sources (name, token_hash, project, format, parser, retention, hint) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at`,
+		s.Name, hash[:], s.Project, s.Format, s.Parser, s.Retention, s.Hint).Scan(&s.ID, &s.CreatedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "A source with that name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not save source", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving source", "err", err)
+		return
+	}
+
+	stored := s
+	stored.Token = ""
+	sources.Lock()
+	sources.byHash[hash] = stored
+	sources.Unlock()
+
+	slog.InfoContext(r.Context(), "Registered source", "id", s.ID, "name", s.Name, "project", s.Project, "parser", s.Parser)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// updateSourceHandler handles PUT /api/sources/{id}, changing a source but for its token.
+func updateSourceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid source id", http.StatusBadRequest)
+		return
+	}
+	var s Source
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid source: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var hash []byte
+	s.ID, s.Token = id, ""
+	err = dbPool.QueryRow(r.Context(), `
+	UPDATE sources SET name = $2, project = $3, format = $4, parser = $5, retention = $6 WHERE id = $1
+	RETURNING token_hash, hint, created_at`,
+		id, s.Name, s.Project, s.Format, s.Parser, s.Retention).Scan(&hash, &s.Hint, &s.CreatedAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	case isUniqueViolation(err):
+		http.Error(w, "A source with that name already exists", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Could not save source", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error updating source", "id", id, "err", err)
+		return
+	}
+
+	sources.Lock()
+	sources.byHash[[sha256.Size]byte(hash)] = s
+	sources.Unlock()
+
+	slog.InfoContext(r.Context(), "Updated source", "id", s.ID, "name", s.Name, "project", s.Project, "parser", s.Parser, "retention", s.Retention)
+	writeJSON(w, http.StatusOK, s)
+}
+
+// deleteSourceHandler handles DELETE /api/sources/{id}, revoking its token at once. A
+// source with stored records is kept, answering 409.
+func deleteSourceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid source id", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := dbPool.Exec(r.Context(), `
+	DELETE FROM sources WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM delogged WHERE source_id = $1)`, id)
+	if err != nil {
+		http.Error(w, "Could not delete source", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting source", "id", id, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		dbPool.QueryRow(r.Context(), `SELECT EXISTS (SELECT 1 FROM sources WHERE id = $1)`, id).Scan(&exists)
+		if exists {
+			http.Error(w, "Source has stored records", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+
+	sources.Lock()
+	for hash, s := range sources.byHash {
+		if s.ID == id {
+			delete(sources.byHash, hash)
+		}
+	}
+	sources.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted source", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Large payloads don't have to be held in memory whole while they are read and redacted.
+// A body larger than the spill threshold is streamed to a temporary file, then read back,
+// redacted, anonymized and parsed a chunk of lines at a time, its entries being sent as
+// each chunk is parsed. The record keeps the redacted chunks, which its entries refer to,
+// in place of one copy of the whole text; they are only joined to be written:
+//
+//	SPILL_THRESHOLD  size above which a body is spilled; default 8M, in the format of
+//	                 MAX_INGEST_BYTES
+//	SPILL_DIR        directory of the temporary files; default the system's
+//
+// Chunks end at a line break, and never inside a PEM block, so redaction matches the same
+// text as for a payload read at once. The matches are only counted once the entries are
+// sent, so X-DeLogger-Redactions is a trailer of the response to a spilled payload.
+
+// spillChunkBytes is the least size of a chunk read back from a spilled body.
+const spillChunkBytes = 1 << 20
+
+var spill = struct {
+	threshold int64
+	dir       string
+}{threshold: 8 << 20}
+
+// setupSpill reads the spill settings.
+func setupSpill() {
+	if v := setting("SPILL_THRESHOLD"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil || n <= 0 {
+			fatalConfig("Invalid SPILL_THRESHOLD: must be a positive size such as 512K or 64M", "value", v)
+		}
+		spill.threshold = n
+	}
+	spill.dir = setting("SPILL_DIR")
+	if spill.dir != "" {
+		if info, err := os.Stat(spill.dir); err != nil || !info.IsDir() {
+			fatalConfig("Invalid SPILL_DIR: not a directory", "path", spill.dir)
+		}
+	}
+}
+
+// payload is a request body, in memory or spilled to a file.
+type payload struct {
+	data []byte
+	file *os.File // nil unless spilled
+	size int64
+}
+
+// readPayload reads body, spilling it to a file once it passes the threshold. The payload
+// must be closed.
+func readPayload(body io.Reader) (*payload, error) {
+	data, err := io.ReadAll(io.LimitReader(body, spill.threshold+1))
+	if err != nil || int64(len(data)) <= spill.threshold {
+		return &payload{data: data, size: int64(len(data))}, err
+	}
+
+	f, err := os.CreateTemp(spill.dir, "delogger-payload-*")
+	if err != nil {
+		return nil, err
+	}
+	p := &payload{file: f}
+	n, err := f.Write(data)
+	p.size = int64(n)
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(f, body)
+		p.size += rest
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// close removes the spill file, if any.
+func (p *payload) close() {
+	if p.file == nil {
+		return
+	}
+	p.file.Close()
+	if err := os.Remove(p.file.Name()); err != nil {
+		slog.Warn("Failed to remove spilled payload", "path", p.file.Name(), "err", err)
+	}
+}
+
+// readerAt returns p's contents for random access.
+func (p *payload) readerAt() io.ReaderAt {
+	if p.file != nil {
+		return p.file
+	}
+	return bytes.NewReader(p.data)
+}
+
+// spilled reports whether p was written to a file.
+func (p *payload) spilled() bool {
+	return p.file != nil
+}
+
+// redact returns the text of p, which must not be spilled, redacted by rd and with the
+// addresses of source anonymized, and the number of matches per redaction rule.
+func (p *payload) redact(rd *redactor, source string) (string, map[string]int) {
+	text, counts := rd.redact(string(p.data))
+	return anonymizeIPs(text, source), counts
+}
+
+// redactChunks passes the text of p to fn redacted and anonymized like redact does, in one
+// piece, or a chunk of lines at a time as it is read back if p is spilled. It returns the
+// number of matches per redaction rule.
+func (p *payload) redactChunks(rd *redactor, source string, fn func(text string)) (map[string]int, error) {
+	if p.file == nil {
+		text, counts := p.redact(rd, source)
+		fn(text)
+		return counts, nil
+	}
+
+	counts := map[string]int{}
+	buf := spillBuffers.Get().(*spillBuffer)
+	defer putSpillBuffer(buf)
+	r := buf.reader
+	r.Reset(p.file)
+	chunk := buf.chunk
+	for {
+		chunk = chunk[:spillChunkBytes]
+		n, err := io.ReadFull(r, chunk)
+		chunk = chunk[:n]
+		if err == nil {
+			// Complete the last line, and any PEM block left open.
+			open := pemOpen(chunk, false)
+			for {
+				line, lineErr := r.ReadSlice('\n')
+				chunk = append(chunk, line...)
+				if lineErr == bufio.ErrBufferFull {
+					continue
+				}
+				open = pemOpen(line, open)
+				if lineErr != nil || !open {
+					break
+				}
+			}
+		} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		text, chunkCounts := rd.redact(string(chunk))
+		fn(anonymizeIPs(text, source))
+		for rule, n := range chunkCounts {
+			counts[rule] += n
+		}
+		if err != nil {
+			break
+		}
+	}
+	buf.chunk = chunk[:0]
+	return counts, nil
+}
+
+// requestBody returns the request body to store, joining the chunks of a spilled payload.
+func (r *LogRecord) requestBody() string {
+	if r.requestChunks != nil {
+		return strings.Join(r.requestChunks, "")
+	}
+	return r.RequestBody
+}
+
+// requestBodySize returns the length of the request body to store.
+func (r *LogRecord) requestBodySize() int {
+	n := len(r.RequestBody)
+	for _, chunk := range r.requestChunks {
+		n += len(chunk)
+	}
+	return n
+}
+
+// pemOpen reports whether a PEM block is open after b, given whether one was before it.
+func pemOpen(b []byte, open bool) bool {
+	begin, end := bytes.LastIndex(b, []byte("-----BEGIN ")), bytes.LastIndex(b, []byte("-----END "))
+	if begin < 0 && end < 0 {
+		return open
+	}
+	return begin > end
+}
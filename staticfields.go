@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Static fields are constant key/value pairs, such as team or datacenter, configured per
+// source and attached to every request from it, so queries don't depend on clients
+// sending them. They are stored in delogged.fields and queried as fields.<name>.
+
+// Limits on the static fields of one source.
+const (
+	maxStaticFields           = 32
+	maxStaticFieldValueLength = 255
+)
+
+// staticFieldNameRegex restricts field names to what the query language can reference.
+var staticFieldNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// staticFields holds the per-source fields from source_fields.
+var staticFields = struct {
+	sync.RWMutex
+	bySource map[string]map[string]string
+}{bySource: map[string]map[string]string{}}
+
+// sourceFields returns the static fields of source. The map must not be modified.
+func sourceFields(source string) map[string]string {
+	staticFields.RLock()
+	defer staticFields.RUnlock()
+	if fields, ok := staticFields.bySource[source]; ok {
+		return fields
+	}
+	return map[string]string{}
+}
+
+// loadStaticFields reads the per-source fields into memory.
+func loadStaticFields() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, `SELECT source, fields FROM source_fields`)
+	if err != nil {
+		fatal("Failed to load static fields", "err", err)
+	}
+	bySource := map[string]map[string]string{}
+	var source string
+	var fields map[string]string
+	_, err = pgx.ForEachRow(rows, []any{&source, &fields}, func() error {
+		bySource[source] = fields
+		fields = nil
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to load static fields", "err", err)
+	}
+
+	staticFields.Lock()
+	staticFields.bySource = bySource
+	staticFields.Unlock()
+}
+
+// SourceFields is the set of static fields attached to a source's requests.
+type SourceFields struct {
+	Source string            `json:"source"`
+	Fields map[string]string `json:"fields"`
+}
+
+// validate checks the field names and values.
+func (s *SourceFields) validate() error {
+	if len(s.Fields) == 0 {
+		return fmt.Errorf("fields must not be empty")
+	}
+	if len(s.Fields) > maxStaticFields {
+		return fmt.Errorf("at most %d fields are allowed", maxStaticFields)
+	}
+	for name, value := range s.Fields {
+		if !staticFieldNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid field name %q: use letters, digits, _ and -", name)
+		}
+		if len(value) > maxStaticFieldValueLength {
+			return fmt.Errorf("value of field %q is longer than %d bytes", name, maxStaticFieldValueLength)
+		}
+	}
+	return nil
+}
+
+// listStaticFieldsHandler handles GET /api/source-fields.
+func listStaticFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	staticFields.RLock()
+	result := make([]SourceFields, 0, len(staticFields.bySource))
+	for source, fields := range staticFields.bySource {
+		result = append(result, SourceFields{Source: source, Fields: fields})
+	}
+	staticFields.RUnlock()
+
+	slices.SortFunc(result, func(a, b SourceFields) int { return strings.Compare(a.Source, b.Source) })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// putStaticFieldsHandler handles PUT /api/source-fields/{source}, replacing the static fields
+// of a source. They apply to requests received from then on.
+func putStaticFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	var s SourceFields
+	if err := readJSON(r, &s); err != nil {
+		http.Error(w, "Invalid static fields: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	s.Source = r.PathValue("source")
+	if err := s.validate(); err != nil {
+		http.Error(w, "Invalid static fields: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := dbPool.Exec(r.Context(), `
+	INSERT INTO source_fields (source, fields) VALUES ($1, $2)
+	ON CONFLICT (source) DO UPDATE SET fields = EXCLUDED.fields`,
+		s.Source, s.Fields)
+	if err != nil {
+		http.Error(w, "Could not save static fields", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving static fields", "source", s.Source, "err", err)
+		return
+	}
+
+	staticFields.Lock()
+	staticFields.bySource[s.Source] = s.Fields
+	staticFields.Unlock()
+
+	slog.InfoContext(r.Context(), "Set static fields", "source", s.Source, "fields", len(s.Fields))
+	writeJSON(w, http.StatusOK, s)
+}
+
+// deleteStaticFieldsHandler handles DELETE /api/source-fields/{source}.
+func deleteStaticFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM source_fields WHERE source = $1`, source)
+	if err != nil {
+		http.Error(w, "Could not delete static fields", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting static fields", "source", source, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Source has no static fields", http.StatusNotFound)
+		return
+	}
+
+	staticFields.Lock()
+	delete(staticFields.bySource, source)
+	staticFields.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted static fields", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// rateWindow is the number of one-second buckets the ingest rate is averaged over.
+const rateWindow = 60
+
+// maxStatsSources caps the per-source breakdown in /api/stats.
+const maxStatsSources = 50
+
+// maxParserServices caps the services counted separately by parser; lines of further
+// services are counted under otherService.
+const (
+	maxParserServices = 200
+	otherService      = "(other)"
+)
+
+// rateMeter counts events in one-second buckets over the last rateWindow seconds.
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [rateWindow]int64
+	seconds [rateWindow]int64
+}
+
+// add records n events at now.
+func (m *rateMeter) add(now time.Time, n int64) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	m.mu.Lock()
+	if m.seconds[i] != sec {
+		m.seconds[i] = sec
+		m.buckets[i] = 0
+	}
+	m.buckets[i] += n
+	m.mu.Unlock()
+}
+
+// perSecond returns the average rate over the window ending at now.
+func (m *rateMeter) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+	var total int64
+	m.mu.Lock()
+	for i := range m.buckets {
+		if sec-m.seconds[i] < rateWindow {
+			total += m.buckets[i]
+		}
+	}
+	m.mu.Unlock()
+	return float64(total) / rateWindow
+}
+
+// ingestCounters tracks ingestion since the process started.
+type ingestCounters struct {
+	startedAt      time.Time
+	requests       atomic.Int64
+	bytes          atomic.Int64
+	linesParsed    atomic.Int64
+	linesUnmatched atomic.Int64
+	// duplicatesDropped counts entries discarded by the DEDUP_WINDOW mode.
+	duplicatesDropped atomic.Int64
+	// repeatsCollapsed counts entries folded into a previous one by COLLAPSE_REPEATS.
+	repeatsCollapsed atomic.Int64
+	// entriesSampledOut counts entries discarded by a sampling policy.
+	entriesSampledOut atomic.Int64
+
+	requestRate rateMeter
+	lineRate    rateMeter
+	byteRate    rateMeter
+
+	payloadBytes *histogram
+	lines        *histogram
+	parsePerLine *histogram // seconds
+	duration     *histogram // seconds from receipt to storage
+
+	// parserLines counts lines by service and by the parser that matched them, so a
+	// source whose format changed shows up as lines moving to the raw fallback.
+	parserMu    sync.Mutex
+	parserLines map[string]map[string]int64
+}
+
+var ingest = &ingestCounters{
+	startedAt:    time.Now(),
+	parserLines:  map[string]map[string]int64{},
+	payloadBytes: newHistogram(1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20),
+	lines:        newHistogram(1, 10, 100, 1000, 10000, 100000, 1000000),
+	parsePerLine: newHistogram(1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 1e-3),
+	duration:     newHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+}
+
+// record accounts for one payload of service, parsed in parseTime.
+func (c *ingestCounters) record(service string, size int, entries []LogEntry, parseTime time.Duration) {
+	byParser := map[string]int64{}
+	for _, e := range entries {
+		byParser[entryParser(e)]++
+	}
+	unmatched := byParser["raw"]
+	lines := int64(len(entries))
+
+	c.requests.Add(1)
+	c.bytes.Add(int64(size))
+	c.linesParsed.Add(lines - unmatched)
+	c.linesUnmatched.Add(unmatched)
+
+	now := time.Now()
+	c.requestRate.add(now, 1)
+	c.lineRate.add(now, lines)
+	c.byteRate.add(now, int64(size))
+
+	c.payloadBytes.observe(float64(size))
+	c.lines.observe(float64(lines))
+	if lines > 0 {
+		c.parsePerLine.observe(parseTime.Seconds() / float64(lines))
+	}
+
+	c.parserMu.Lock()
+	counts, ok := c.parserLines[service]
+	if !ok {
+		if len(c.parserLines) >= maxParserServices {
+			service = otherService
+		}
+		if counts = c.parserLines[service]; counts == nil {
+			counts = map[string]int64{}
+			c.parserLines[service] = counts
+		}
+	}
+	for parser, n := range byParser {
+		counts[parser] += n
+	}
+	c.parserMu.Unlock()
+}
+
+// ParserStats counts the lines of one service by the parser that matched them; "raw"
+// counts the lines no parser recognised.
+type ParserStats struct {
+	Service        string           `json:"service"`
+	Lines          map[string]int64 `json:"lines"`
+	UnmatchedRatio float64          `json:"unmatched_ratio"`
+}
+
+// parsers returns the per-service parser counts, ordered by service.
+func (c *ingestCounters) parsers() []ParserStats {
+	c.parserMu.Lock()
+	defer c.parserMu.Unlock()
+
+	stats := make([]ParserStats, 0, len(c.parserLines))
+	for service, counts := range c.parserLines {
+		s := ParserStats{Service: service, Lines: maps.Clone(counts)}
+		var total int64
+		for _, n := range counts {
+			total += n
+		}
+		if total > 0 {
+			s.UnmatchedRatio = float64(counts["raw"]) / float64(total)
+		}
+		stats = append(stats, s)
+	}
+	slices.SortFunc(stats, func(a, b ParserStats) int { return strings.Compare(a.Service, b.Service) })
+	return stats
+}
+
+// IngestDistributions are the histograms of parse requests.
+type IngestDistributions struct {
+	PayloadBytes        HistogramStats `json:"payload_bytes"`
+	Lines               HistogramStats `json:"lines"`
+	ParseSecondsPerLine HistogramStats `json:"parse_seconds_per_line"`
+	DurationSeconds     HistogramStats `json:"duration_seconds"` // from receipt to storage
+}
+
+func (c *ingestCounters) distributions() IngestDistributions {
+	return IngestDistributions{
+		PayloadBytes:        c.payloadBytes.snapshot(),
+		Lines:               c.lines.snapshot(),
+		ParseSecondsPerLine: c.parsePerLine.snapshot(),
+		DurationSeconds:     c.duration.snapshot(),
+	}
+}
+
+// IngestStats is the response of /api/stats.
+type IngestStats struct {
+	Stored        StoredStats         `json:"stored"`
+	Sources       []SourceStats       `json:"sources"`
+	SinceStart    CounterStats        `json:"since_start"`
+	Rate          RateStats           `json:"rate"`
+	Distributions IngestDistributions `json:"distributions"`
+	Parsers       []ParserStats       `json:"parsers"` // since the process started
+}
+
+// StoredStats summarizes everything in the database.
+type StoredStats struct {
+	Records        int64 `json:"records"`
+	Entries        int64 `json:"entries"`
+	Bytes          int64 `json:"bytes"`
+	LinesParsed    int64 `json:"lines_parsed"`
+	LinesUnmatched int64 `json:"lines_unmatched"`
+}
+
+// SourceStats counts what one client address has sent.
+type SourceStats struct {
+	Source  string `json:"source"`
+	Records int64  `json:"records"`
+	Entries int64  `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// CounterStats reports the in-process counters.
+type CounterStats struct {
+	StartedAt         time.Time `json:"started_at"`
+	Requests          int64     `json:"requests"`
+	Bytes             int64     `json:"bytes"`
+	LinesParsed       int64     `json:"lines_parsed"`
+	LinesUnmatched    int64     `json:"lines_unmatched"`
+	DuplicatesDropped int64     `json:"duplicates_dropped"`
+	RepeatsCollapsed  int64     `json:"repeats_collapsed"`
+	SampledOut        int64     `json:"sampled_out"`
+}
+
+// RateStats is the current ingest rate averaged over the last WindowSeconds.
+type RateStats struct {
+	WindowSeconds     int     `json:"window_seconds"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	LinesPerSecond    float64 `json:"lines_per_second"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+}
+
+// statsHandler handles GET /api/stats.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := currentStats(r.Context())
+	if err != nil {
+		http.Error(w, "Could not compute statistics", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error computing statistics", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// currentStats combines the database totals with the in-process counters.
+func currentStats(ctx context.Context) (IngestStats, error) {
+	stats, err := loadStoredStats(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	now := time.Now()
+	stats.SinceStart = CounterStats{
+		StartedAt:         ingest.startedAt,
+		Requests:          ingest.requests.Load(),
+		Bytes:             ingest.bytes.Load(),
+		LinesParsed:       ingest.linesParsed.Load(),
+		LinesUnmatched:    ingest.linesUnmatched.Load(),
+		DuplicatesDropped: ingest.duplicatesDropped.Load(),
+		RepeatsCollapsed:  ingest.repeatsCollapsed.Load(),
+		SampledOut:        ingest.entriesSampledOut.Load(),
+	}
+	stats.Rate = RateStats{
+		WindowSeconds:     rateWindow,
+		RequestsPerSecond: ingest.requestRate.perSecond(now),
+		LinesPerSecond:    ingest.lineRate.perSecond(now),
+		BytesPerSecond:    ingest.byteRate.perSecond(now),
+	}
+	stats.Distributions = ingest.distributions()
+	stats.Parsers = ingest.parsers()
+	return stats, nil
+}
+
+// loadStoredStats computes the database totals and the per-source breakdown.
+func loadStoredStats(ctx context.Context) (IngestStats, error) {
+	var stats IngestStats
+
+	err := dbPool.QueryRow(ctx, `
+	SELECT
+		(SELECT count(*) FROM delogged),
+		(SELECT COALESCE(sum(octet_length(request_body)), 0) FROM delogged),
+		count(*),
+		count(*) FILTER (WHERE raw = ''),
+		count(*) FILTER (WHERE raw <> '')
+	FROM delogged_entries`).Scan(
+		&stats.Stored.Records,
+		&stats.Stored.Bytes,
+		&stats.Stored.Entries,
+		&stats.Stored.LinesParsed,
+		&stats.Stored.LinesUnmatched,
+	)
+	if err != nil {
+		return stats, err
+	}
+
+	// Sources are client addresses without the ephemeral port.
+	rows, err := dbPool.Query(ctx, `
+	SELECT source, count(*), COALESCE(sum(entries), 0)::bigint, COALESCE(sum(bytes), 0)::bigint
+	FROM (
+		SELECT `+sourceExpr+` AS source,
+			(SELECT count(*) FROM delogged_entries e WHERE e.log_id = d.id) AS entries,
+			COALESCE(octet_length(d.request_body), 0) AS bytes
+		FROM delogged d
+	) s
+	GROUP BY source
+	ORDER BY count(*) DESC
+	LIMIT $1`, maxStatsSources)
+	if err != nil {
+		return stats, err
+	}
+	stats.Sources, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (SourceStats, error) {
+		var s SourceStats
+		err := row.Scan(&s.Source, &s.Records, &s.Entries, &s.Bytes)
+		return s, err
+	})
+	if stats.Sources == nil {
+		stats.Sources = []SourceStats{}
+	}
+	return stats, err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"delogger/storage"
+)
+
+// Records are stored in PostgreSQL, or with STORAGE=memory in the process itself, so the
+// server can run for development and integration tests without a database:
+//
+//	STORAGE              postgres (default) or memory
+//	MEMORY_MAX_ENTRIES   most entries kept in memory, the oldest dropped first;
+//	                     default 1000000
+//
+// In memory, ingestion (/api/parse, its preview and archives), /api/logs, /api/export, the
+// live tails, /api/version, /metrics and the health checks behave as with PostgreSQL, and
+// everything is lost on exit. The endpoints that only exist as SQL — statistics, issues,
+// searches, alerts, reports, the per-source settings, keys and the audit and security
+// logs — answer 501. The settings they manage keep their defaults from the environment,
+// and API keys are limited to ADMIN_API_KEY.
+
+// store is set by setupStorage. The interface and the memory implementation are in package
+// storage; postgresStorage, below, has its methods in recordwriter.go, logs.go and export.go.
+var store storage.Storage[*pendingRecord, entryFilter]
+
+// memoryStorage is the storage of STORAGE=memory.
+type memoryStorage = storage.Memory[*pendingRecord, entryFilter]
+
+// setupStorage sets up the storage chosen by STORAGE.
+func setupStorage() {
+	switch v := setting("STORAGE"); v {
+	case "", "postgres":
+		setupDatabase()
+		store = postgresStorage{}
+	case "memory":
+		maxEntries := 1000000
+		if v := setting("MEMORY_MAX_ENTRIES"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				fatalConfig("Invalid MEMORY_MAX_ENTRIES: must be a positive number", "value", v)
+			}
+			maxEntries = n
+		}
+		store = storage.NewMemory[*pendingRecord, entryFilter](maxEntries)
+		slog.Warn("Storing records in memory only; they are lost on exit", "max_entries", maxEntries)
+	default:
+		fatalConfig("Invalid STORAGE: must be postgres or memory", "value", v)
+	}
+}
+
+// inMemory tells whether records are stored in memory rather than in PostgreSQL.
+func inMemory() bool {
+	_, ok := store.(*memoryStorage)
+	return ok
+}
+
+// postgresStorage stores records in the database of dbPool.
+type postgresStorage struct{}
+
+// notInMemory answers the routes that need PostgreSQL when records are stored in memory.
+func notInMemory(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Not implemented with STORAGE=memory", http.StatusNotImplemented)
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+)
+
+// memoryBatchSize is the number of entries a memory cursor visits between calls of
+// afterBatch.
+const memoryBatchSize = 1000
+
+// Memory keeps the entries of the records in memory, ordered by Position. Once it holds
+// more than MaxEntries, the oldest are dropped, a tenth of MaxEntries at once so a full
+// store doesn't move its entries on every write. The zero value keeps no limit.
+type Memory[R Record, F Filter] struct {
+	MaxEntries int
+
+	mu          sync.RWMutex
+	entries     []Entry
+	nextLogID   int64
+	nextEntryID int64
+}
+
+// NewMemory returns a Memory keeping up to maxEntries entries.
+func NewMemory[R Record, F Filter](maxEntries int) *Memory[R, F] {
+	return &Memory[R, F]{MaxEntries: maxEntries}
+}
+
+func compareEntries(a, b Entry) int {
+	return cmp.Or(a.ReceivedAt.Compare(b.ReceivedAt), cmp.Compare(a.ID, b.ID))
+}
+
+func (s *Memory[R, F]) WriteRecords(group []R) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range group {
+		s.nextLogID++
+		entries := r.Entries()
+		for j := range entries {
+			s.nextEntryID++
+			entries[j].LogID, entries[j].ID = s.nextLogID, s.nextEntryID
+			e := entries[j]
+			// Groups mostly arrive in order, so entries are mostly appended.
+			if n := len(s.entries); n == 0 || compareEntries(s.entries[n-1], e) < 0 {
+				s.entries = append(s.entries, e)
+				continue
+			}
+			i, _ := slices.BinarySearchFunc(s.entries, e, compareEntries)
+			s.entries = slices.Insert(s.entries, i, e)
+		}
+	}
+	if s.MaxEntries > 0 && len(s.entries) > s.MaxEntries {
+		s.entries = slices.Delete(s.entries, 0, len(s.entries)-s.MaxEntries+s.MaxEntries/10)
+	}
+	return nil
+}
+
+func (s *Memory[R, F]) LatestEntries(ctx context.Context, filter F, before *Position, limit int) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := s.entries[i]
+		if before != nil && compareEntries(e, Entry{ReceivedAt: before.ReceivedAt, ID: before.ID}) >= 0 {
+			continue
+		}
+		if filter.Matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, ctx.Err()
+}
+
+func (s *Memory[R, F]) OpenEntryCursor(ctx context.Context, filter F) (EntryCursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := &memoryCursor{}
+	for _, e := range s.entries {
+		if filter.Matches(e) {
+			c.entries = append(c.entries, e)
+		}
+	}
+	return c, nil
+}
+
+// memoryCursor walks the entries matching a filter when the cursor was opened.
+type memoryCursor struct {
+	entries []Entry
+}
+
+func (c *memoryCursor) Each(ctx context.Context, fn func(Entry) error, afterBatch func()) (int, error) {
+	for start := 0; start < len(c.entries); start += memoryBatchSize {
+		if err := ctx.Err(); err != nil {
+			return start, err
+		}
+		for i, e := range c.entries[start:min(start+memoryBatchSize, len(c.entries))] {
+			if err := fn(e); err != nil {
+				return start + i, err
+			}
+		}
+		if afterBatch != nil {
+			afterBatch()
+		}
+	}
+	return len(c.entries), nil
+}
+
+func (c *memoryCursor) Close() {}
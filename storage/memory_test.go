@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testRecord is a record of nothing but its entries.
+type testRecord []Entry
+
+func (r testRecord) Entries() []Entry {
+	return r
+}
+
+type testMemory = Memory[testRecord, FilterFunc]
+
+// writeAt stores one record per time in s, with an entry received at each of them.
+func writeAt(t *testing.T, s *testMemory, level string, times ...time.Time) {
+	t.Helper()
+	var group []testRecord
+	for _, at := range times {
+		e := Entry{ReceivedAt: at}
+		e.Level = level
+		group = append(group, testRecord{e})
+	}
+	if err := s.WriteRecords(group); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func entryIDs(entries []Entry) []int64 {
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+// cursorIDs returns the ids of the entries a cursor over filter visits.
+func cursorIDs(t *testing.T, s *testMemory, filter FilterFunc) []int64 {
+	t.Helper()
+	c, err := s.OpenEntryCursor(context.Background(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var ids []int64
+	if _, err := c.Each(context.Background(), func(e Entry) error {
+		ids = append(ids, e.ID)
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// all, level and between are filters.
+func all(Entry) bool { return true }
+
+func level(l string) FilterFunc {
+	return func(e Entry) bool { return e.Level == l }
+}
+
+func between(from, to time.Time) FilterFunc {
+	return func(e Entry) bool { return !e.ReceivedAt.Before(from) && e.ReceivedAt.Before(to) }
+}
+
+func TestMemoryStorageOrder(t *testing.T) {
+	at := func(sec int) time.Time { return time.Unix(1700000000+int64(sec), 0) }
+	t30 := at(30)
+	s := NewMemory[testRecord, FilterFunc](100)
+	writeAt(t, s, "INFO", at(10), at(20), at(30)) // ids 1-3
+	writeAt(t, s, "ERROR", at(15), at(30), at(5)) // late and tied entries, ids 4-6
+
+	tests := []struct {
+		name   string
+		filter FilterFunc
+		before *Position
+		limit  int
+		latest []int64
+	}{
+		{"all", all, nil, 10, []int64{5, 3, 2, 4, 1, 6}},
+		{"first 2", all, nil, 2, []int64{5, 3}},
+		{"before 5", all, &Position{t30, 5}, 10, []int64{3, 2, 4, 1, 6}},
+		{"2 before 3", all, &Position{t30, 3}, 2, []int64{2, 4}},
+		{"ERROR", level("ERROR"), nil, 10, []int64{5, 4, 6}},
+		{"15s to 30s", between(at(15), at(30)), nil, 10, []int64{2, 4}},
+		{"DEBUG", level("DEBUG"), nil, 10, nil},
+	}
+	for _, tt := range tests {
+		entries, err := s.LatestEntries(context.Background(), tt.filter, tt.before, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entryIDs(entries); !slices.Equal(got, tt.latest) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.latest)
+		}
+		// Cursors walk the same entries oldest first.
+		if tt.before == nil && tt.limit >= len(s.entries) {
+			want := slices.Clone(tt.latest)
+			slices.Reverse(want)
+			if got := cursorIDs(t, s, tt.filter); !slices.Equal(got, want) {
+				t.Errorf("%s: cursor got %v, want %v", tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestMemoryStorageEviction(t *testing.T) {
+	at := func(sec int) time.Time { return time.Unix(1700000000+int64(sec), 0) }
+	s := NewMemory[testRecord, FilterFunc](10)
+	for i := range 10 {
+		writeAt(t, s, "INFO", at(100+i))
+	}
+	if got := len(s.entries); got != 10 {
+		t.Fatalf("got %d entries, want the 10 that fit", got)
+	}
+
+	// One more drops the oldest tenth of the limit, whatever order they arrived in: the
+	// new entry 11, which is older than the others, and entry 1.
+	writeAt(t, s, "INFO", at(0))
+	want := []int64{2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if got := cursorIDs(t, s, all); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	writeAt(t, s, "INFO", at(200))
+	if got := len(s.entries); got != 10 {
+		t.Errorf("got %d entries after writing up to the limit, want 10", got)
+	}
+	if s.nextLogID != 12 || s.nextEntryID != 12 {
+		t.Errorf("got next ids %d and %d, want ids to keep counting past evicted entries", s.nextLogID, s.nextEntryID)
+	}
+}
@@ -0,0 +1,106 @@
+// Package storage defines how DeLogger stores parsed entries and reads them back, and
+// implements it in memory, so programs embedding the parser can keep entries the way the
+// server does, or test against the interface without a database.
+//
+//	store := storage.NewMemory[*myRecord, storage.FilterFunc](100000)
+//	err := store.WriteRecords(records)
+//	latest, err := store.LatestEntries(ctx, func(e storage.Entry) bool {
+//		return e.SeverityNumber >= 17
+//	}, nil, 50)
+//
+// The server's PostgreSQL implementation is not part of the package: it depends on the
+// server's schema, configuration and encryption keys.
+package storage
+
+import (
+	"context"
+	"time"
+
+	"delogger/parser"
+)
+
+// LogEntry is a parsed line, as embedded in an Entry.
+type LogEntry = parser.Entry
+
+// Entry is a parsed line with the metadata of its request and what enrichment extracted
+// from it, as stored.
+type Entry struct {
+	ID         int64             `json:"id"`
+	LogID      int64             `json:"log_id"`
+	ReceivedAt time.Time         `json:"received_at"`
+	RemoteAddr string            `json:"remote_addr"`
+	StatusCode int               `json:"status_code"`
+	LineNo     int               `json:"line_no"`
+	Host       string            `json:"host,omitempty"`
+	Service    string            `json:"service,omitempty"`
+	Env        string            `json:"env,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	SourceID   int64             `json:"source_id,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	LogEntry
+	CorrelationID  string     `json:"correlation_id,omitempty"`
+	ClientIP       string     `json:"client_ip,omitempty"`
+	GeoCountry     string     `json:"geo_country,omitempty"`
+	GeoCity        string     `json:"geo_city,omitempty"`
+	GeoASN         int64      `json:"geo_asn,omitempty"`
+	GeoOrg         string     `json:"geo_org,omitempty"`
+	Severity       string     `json:"severity,omitempty"`
+	SeverityNumber int        `json:"severity_number,omitempty"`
+	LogTime        *time.Time `json:"log_time,omitempty"`
+	ClientHost     string     `json:"client_host,omitempty"`
+	Fingerprint    string     `json:"fingerprint,omitempty"`
+	TemplateID     int64      `json:"template_id,omitempty"`
+	TraceID        string     `json:"trace_id,omitempty"`
+	SpanID         string     `json:"span_id,omitempty"`
+	RequestID      string     `json:"request_id,omitempty"`
+	Repeats        int        `json:"repeats"`     // lines collapsed into the entry, 1 unless repeats are collapsed
+	SampleRate     float64    `json:"sample_rate"` // fraction of such entries kept, 1 unless sampled
+}
+
+// Record is an ingest request to store with its entries. Implementations store what they
+// know of the record's type besides the entries.
+type Record interface {
+	// Entries returns the entries of the record, whose IDs and LogIDs are set when it is
+	// written.
+	Entries() []Entry
+}
+
+// Filter selects entries. Implementations may translate their own filter type, e.g. to
+// SQL, but every filter must be able to match an entry in memory.
+type Filter interface {
+	Matches(e Entry) bool
+}
+
+// FilterFunc is a Filter calling the function.
+type FilterFunc func(e Entry) bool
+
+func (f FilterFunc) Matches(e Entry) bool {
+	return f(e)
+}
+
+// Position is where an entry sorts: entries are ordered by the time they were received,
+// then by ID.
+type Position struct {
+	ReceivedAt time.Time
+	ID         int64
+}
+
+// Storage stores records and reads back their entries.
+type Storage[R Record, F Filter] interface {
+	// WriteRecords stores a group of records with their entries, setting the ids of the
+	// entries.
+	WriteRecords(group []R) error
+	// LatestEntries returns up to limit entries matching filter, newest first, starting
+	// before the position before when it is not nil.
+	LatestEntries(ctx context.Context, filter F, before *Position, limit int) ([]Entry, error)
+	// OpenEntryCursor returns a cursor over the entries matching filter, oldest first.
+	OpenEntryCursor(ctx context.Context, filter F) (EntryCursor, error)
+}
+
+// EntryCursor walks the entries matching a filter.
+type EntryCursor interface {
+	// Each calls fn for every entry in order and afterBatch, if not nil, once per batch.
+	// It returns the number of entries visited.
+	Each(ctx context.Context, fn func(Entry) error, afterBatch func()) (int, error)
+	Close()
+}
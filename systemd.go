@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// When run as a systemd service, the server takes its sockets from socket activation and
+// tells the service manager how it is doing. These variables are set by systemd, not
+// configured:
+//
+//	LISTEN_PID, LISTEN_FDS  sockets passed by a .socket unit, served instead of API_ADDR
+//	                        and UNIX_SOCKET; Unix sockets as described in listen.go, and
+//	                        ADMIN_ADDR still listened on by the server
+//	NOTIFY_SOCKET           with Type=notify, READY=1 is sent once requests are served and
+//	                        STOPPING=1 when shutdown begins, with a STATUS= line
+//	WATCHDOG_USEC           with WatchdogSec=, WATCHDOG=1 is sent at half the interval, so
+//	                        systemd restarts a server that stops being scheduled
+//
+// For example:
+//
+//	# /etc/systemd/system/delogger.socket
+//	[Socket]
+//	ListenStream=8007
+//
+//	# /etc/systemd/system/delogger.service
+//	[Service]
+//	Type=notify
+//	ExecStart=/usr/local/bin/delogger -config /etc/delogger.yaml
+//	ExecReload=/bin/kill -HUP $MAINPID
+//	WatchdogSec=30s
+//
+// With socket activation, connections made while the server starts or restarts wait in the
+// socket's backlog rather than being refused.
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedListeners returns the sockets passed by systemd, none if it passed none.
+func activatedListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// They aren't meant for the processes the server starts.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d from systemd: %w", fd, err)
+		}
+		if ln.Addr().Network() == "unix" {
+			ln = localListener{ln}
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// notifySystemd sends state, lines such as READY=1, to the service manager, if the server
+// runs under one that asked for it.
+func notifySystemd(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Could not notify systemd", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Could not notify systemd", "err", err)
+	}
+}
+
+// startWatchdog pings the systemd watchdog, if it is enabled for the server.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		for range time.Tick(interval) {
+			notifySystemd("WATCHDOG=1")
+		}
+	}()
+	slog.Info("Pinging the systemd watchdog", "interval", interval)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tailBufferSize is how many entries a subscriber may fall behind before entries are dropped for it.
+const tailBufferSize = 256
+
+// tailHeartbeat keeps idle SSE connections open through proxies.
+const tailHeartbeat = 15 * time.Second
+
+// tailSubscriber receives newly stored entries that match its filter.
+type tailSubscriber struct {
+	filter  atomic.Pointer[entryFilter]
+	ch      chan StoredEntry
+	dropped atomic.Int64
+}
+
+// tailHub fans stored entries out to live tail subscribers.
+type tailHub struct {
+	mu   sync.RWMutex
+	subs map[*tailSubscriber]struct{}
+}
+
+var tail = &tailHub{subs: make(map[*tailSubscriber]struct{})}
+
+// subscribe registers a subscriber for entries matching filter.
+func (h *tailHub) subscribe(filter entryFilter) *tailSubscriber {
+	sub := &tailSubscriber{ch: make(chan StoredEntry, tailBufferSize)}
+	sub.filter.Store(&filter)
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// unsubscribe removes a subscriber.
+func (h *tailHub) unsubscribe(sub *tailSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// publish delivers entries to every matching subscriber without blocking.
+// A subscriber whose buffer is full misses the entry and is told how many it missed.
+func (h *tailHub) publish(entries []StoredEntry) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		for _, e := range entries {
+			if !sub.filter.Load().Matches(e) {
+				continue
+			}
+			select {
+			case sub.ch <- e:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// tailHandler handles GET /api/tail, streaming newly stored entries as Server-Sent Events.
+// It accepts the same filter parameters as /api/logs.
+func tailHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := requestFilter(r, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := tail.subscribe(filter)
+	defer tail.unsubscribe(sub)
+	slog.InfoContext(r.Context(), "Live tail started")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "Live tail ended")
+			return
+		case <-lifecycle.stopping:
+			// The client reconnects, to another instance.
+			slog.InfoContext(r.Context(), "Live tail ended by shutdown")
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-sub.ch:
+			if n := sub.dropped.Swap(0); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+			}
+			var data []byte
+			data, err = json.Marshal(e)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "id: %d\nevent: entry\ndata: %s\n\n", e.ID, data)
+			}
+		}
+		if err != nil {
+			slog.InfoContext(r.Context(), "Live tail stopped", "err", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Backfill limits for the WebSocket tail.
+const (
+	defaultTailBackfill = 100
+	maxTailBackfill     = 1000
+)
+
+// WebSocket keepalive timing: the server pings every tailWSPingPeriod and drops
+// clients that have not answered within tailWSPongWait.
+const (
+	tailWSPongWait   = 60 * time.Second
+	tailWSPingPeriod = 30 * time.Second
+	tailWSWriteWait  = 10 * time.Second
+)
+
+var tailUpgrader = websocket.Upgrader{
+	// The API is served with Access-Control-Allow-Origin: *, so any origin may tail.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// tailWSRequest is a message from the client replacing the tail filter.
+// Filter takes the same keys as the /api/logs query parameters. When Backfill is
+// positive, the last Backfill matching entries are replayed before live entries resume.
+type tailWSRequest struct {
+	Type     string            `json:"type"`
+	Filter   map[string]string `json:"filter"`
+	Backfill int               `json:"backfill"`
+
+	err error
+}
+
+// tailWSMessage is a message to the client. Type is one of "entry", "backfill_done",
+// "filter_ok", "dropped" and "error".
+type tailWSMessage struct {
+	Type  string       `json:"type"`
+	Entry *StoredEntry `json:"entry,omitempty"`
+	Count int64        `json:"count,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// tailWSHandler handles GET /api/tail/ws. The initial filter and backfill size come from
+// the query string (backfill defaults to 100); clients may send tailWSRequest messages
+// at any time to change the filter.
+func tailWSHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backfill := defaultTailBackfill
+	if v := query.Get("backfill"); v != "" {
+		backfill, err = strconv.Atoi(v)
+		if err != nil || backfill < 0 || backfill > maxTailBackfill {
+			http.Error(w, "Invalid 'backfill': must be between 0 and "+strconv.Itoa(maxTailBackfill), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := tailUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "WebSocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	slog.InfoContext(r.Context(), "WebSocket tail started")
+
+	// Subscribe before the backfill query so nothing stored in between is missed;
+	// live entries already covered by the backfill are skipped by id.
+	sub := tail.subscribe(filter)
+	defer tail.unsubscribe(sub)
+
+	requests := make(chan tailWSRequest)
+	done := make(chan struct{})
+	defer close(done)
+	go readTailRequests(conn, requests, done)
+
+	send := func(msg tailWSMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(tailWSWriteWait))
+		return conn.WriteJSON(msg)
+	}
+
+	lastBackfilled, err := sendBackfill(r, filter, backfill, send)
+	ping := time.NewTicker(tailWSPingPeriod)
+	defer ping.Stop()
+
+	for err == nil {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				slog.InfoContext(r.Context(), "WebSocket tail ended")
+				return
+			}
+			next, perr := parseTailRequest(req)
+			if perr != nil {
+				err = send(tailWSMessage{Type: "error", Error: perr.Error()})
+				continue
+			}
+			filter = scopeFilter(r.Context(), next)
+			sub.filter.Store(&filter)
+			if err = send(tailWSMessage{Type: "filter_ok"}); err == nil && req.Backfill > 0 {
+				lastBackfilled, err = sendBackfill(r, filter, req.Backfill, send)
+			}
+		case e := <-sub.ch:
+			if e.ID <= lastBackfilled {
+				continue
+			}
+			if n := sub.dropped.Swap(0); n > 0 {
+				if err = send(tailWSMessage{Type: "dropped", Count: n}); err != nil {
+					break
+				}
+			}
+			err = send(tailWSMessage{Type: "entry", Entry: &e})
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWSWriteWait))
+		case <-lifecycle.stopping:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"),
+				time.Now().Add(tailWSWriteWait))
+			slog.InfoContext(r.Context(), "WebSocket tail ended by shutdown")
+			return
+		}
+	}
+	slog.InfoContext(r.Context(), "WebSocket tail stopped", "err", err)
+}
+
+// readTailRequests forwards client messages until the connection fails or done is closed,
+// then closes out. Messages that are not valid JSON are forwarded with err set so the client can be told.
+func readTailRequests(conn *websocket.Conn, out chan<- tailWSRequest, done <-chan struct{}) {
+	defer close(out)
+
+	conn.SetReadLimit(64 << 10)
+	conn.SetReadDeadline(time.Now().Add(tailWSPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(tailWSPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req tailWSRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			req.err = fmt.Errorf("invalid message: %v", err)
+		}
+		select {
+		case out <- req:
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseTailRequest validates a filter update from the client.
+func parseTailRequest(req tailWSRequest) (entryFilter, error) {
+	if req.err != nil {
+		return entryFilter{}, req.err
+	}
+	if req.Type != "" && req.Type != "filter" {
+		return entryFilter{}, fmt.Errorf("unknown message type %q", req.Type)
+	}
+	if req.Backfill < 0 || req.Backfill > maxTailBackfill {
+		return entryFilter{}, fmt.Errorf("backfill must be between 0 and %d", maxTailBackfill)
+	}
+	q := url.Values{}
+	for k, v := range req.Filter {
+		q.Set(k, v)
+	}
+	return parseEntryFilter(q)
+}
+
+// sendBackfill replays the last n entries matching filter, oldest first, and returns the
+// highest id sent so live entries already covered can be skipped.
+func sendBackfill(r *http.Request, filter entryFilter, n int, send func(tailWSMessage) error) (int64, error) {
+	var last int64
+	if n > 0 {
+		entries, err := store.LatestEntries(r.Context(), filter, nil, n)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error loading tail backfill", "err", err)
+			return 0, send(tailWSMessage{Type: "error", Error: "Could not load backfill"})
+		}
+		slices.Reverse(entries)
+		for i := range entries {
+			if err := send(tailWSMessage{Type: "entry", Entry: &entries[i]}); err != nil {
+				return last, err
+			}
+			last = max(last, entries[i].ID)
+		}
+	}
+	return last, send(tailWSMessage{Type: "backfill_done"})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withSources registers list in the sources registry for the duration of the test.
+func withSources(t *testing.T, list ...Source) {
+	t.Helper()
+	sources.Lock()
+	saved := sources.byHash
+	sources.byHash = map[[sha256.Size]byte]Source{}
+	for _, s := range list {
+		sources.byHash[sha256.Sum256([]byte(s.Name))] = s
+	}
+	sources.Unlock()
+	t.Cleanup(func() {
+		sources.Lock()
+		sources.byHash = saved
+		sources.Unlock()
+	})
+}
+
+// dialTail opens a WebSocket tail as the caller p.
+func dialTail(t *testing.T, p principal, query string) *websocket.Conn {
+	t.Helper()
+	saved := store
+	store = &memoryStorage{MaxEntries: 100}
+	t.Cleanup(func() { store = saved })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tailWSHandler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readTail reads the next message of type want.
+func readTail(t *testing.T, conn *websocket.Conn, want string) tailWSMessage {
+	t.Helper()
+	var msg tailWSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != want {
+		t.Fatalf("got a %q message (%s), want %q", msg.Type, msg.Error, want)
+	}
+	return msg
+}
+
+func TestTailWSFilterUpdateKeepsScope(t *testing.T) {
+	withSources(t,
+		Source{ID: 1, Name: "alpha-api", Project: "alpha"},
+		Source{ID: 2, Name: "beta-api", Project: "beta"},
+	)
+	conn := dialTail(t, principal{tenant: "acme", project: "alpha"}, "backfill=0")
+	readTail(t, conn, "backfill_done")
+
+	for _, update := range []map[string]string{
+		{},
+		{"level": "ERROR"},
+		{"q": "project=beta OR project=alpha"},
+	} {
+		if err := conn.WriteJSON(tailWSRequest{Type: "filter", Filter: update}); err != nil {
+			t.Fatal(err)
+		}
+		readTail(t, conn, "filter_ok")
+
+		// Entries of other projects of the tenant come first, so a leak would be read
+		// before the entry of the caller's project.
+		entry := func(id, source int64, tenant string) StoredEntry {
+			e := StoredEntry{ID: id, Tenant: tenant, SourceID: source}
+			e.Level = "ERROR"
+			e.Message = "boom"
+			return e
+		}
+		tail.publish([]StoredEntry{entry(1, 2, "acme"), entry(2, 0, "acme"), entry(3, 1, "other"), entry(4, 1, "acme")})
+		if msg := readTail(t, conn, "entry"); msg.Entry.ID != 4 {
+			t.Fatalf("filter %v: got entry %d of source %d, want only entry 4 of the caller's project",
+				update, msg.Entry.ID, msg.Entry.SourceID)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Messages are grouped into templates with Drain (He et al., "Drain: An Online Log Parsing
+// Approach with Fixed Depth Tree", ICWS 2017). Messages are tokenized on whitespace and
+// routed through a fixed-depth tree keyed by token count and leading tokens; in the leaf
+// the most similar template absorbs the message if enough tokens agree, turning the
+// differing positions into <*>, otherwise the message starts a new template.
+
+// Drain parameters.
+const (
+	drainDepth       = 4   // tree depth counting the root, length layer and leaves
+	drainSimilarity  = 0.4 // minimum fraction of agreeing tokens to join a template
+	drainMaxChildren = 100 // children per internal node before tokens fall into <*>
+	drainWildcard    = "<*>"
+)
+
+// drainVariableRegex matches tokens that are variables on their own: numbers with optional
+// units, hex values, UUIDs and long hex ids.
+var drainVariableRegex = regexp.MustCompile(`^(?:[-+]?\d+(?:[.:,]\d+)*[a-zA-Z%]{0,3}|0[xX][0-9a-fA-F]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]*\d[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*|[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\d[0-9a-fA-F]*)$`)
+
+// drainCluster is one template.
+type drainCluster struct {
+	id        int64
+	tokens    []string
+	count     int64
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+type drainNode struct {
+	children map[string]*drainNode
+	clusters []*drainCluster
+}
+
+func newDrainNode() *drainNode {
+	return &drainNode{children: map[string]*drainNode{}}
+}
+
+// templateMiner is the in-process Drain tree, persisted to log_templates.
+type templateMiner struct {
+	mu     sync.Mutex
+	root   *drainNode
+	nextID int64
+}
+
+var miner = &templateMiner{root: newDrainNode(), nextID: 1}
+
+// templateUpdate is the change to one template caused by a batch of entries.
+type templateUpdate struct {
+	id        int64
+	template  string
+	added     int64
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// drainTokens splits a message into tokens, masking obvious variables.
+func drainTokens(message string) []string {
+	tokens := strings.Fields(message)
+	for i, t := range tokens {
+		if drainVariableRegex.MatchString(t) || len(t) > 1 && isIPToken(t) {
+			tokens[i] = drainWildcard
+		}
+	}
+	return tokens
+}
+
+// isIPToken reports whether t is an IP address, possibly with a port.
+func isIPToken(t string) bool {
+	if _, err := netip.ParseAddr(t); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddrPort(t)
+	return err == nil
+}
+
+func hasDigit(s string) bool {
+	return strings.ContainsAny(s, "0123456789")
+}
+
+// leaf returns the leaf node for tokens, creating the path if create is set.
+func (m *templateMiner) leaf(tokens []string, create bool) *drainNode {
+	node := m.root
+	key := strconv.Itoa(len(tokens))
+	next, ok := node.children[key]
+	if !ok {
+		if !create {
+			return nil
+		}
+		next = newDrainNode()
+		node.children[key] = next
+	}
+	node = next
+
+	for i := 0; i < drainDepth-3 && i < len(tokens); i++ {
+		key := tokens[i]
+		if hasDigit(key) {
+			key = drainWildcard
+		}
+		next, ok := node.children[key]
+		if !ok {
+			if len(node.children) >= drainMaxChildren {
+				key = drainWildcard
+			}
+			if next, ok = node.children[key]; !ok {
+				if !create {
+					return nil
+				}
+				next = newDrainNode()
+				node.children[key] = next
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// similarity returns the fraction of positions where template and tokens agree, and the
+// number of wildcards in template as a tie breaker.
+func similarity(template, tokens []string) (float64, int) {
+	same, wildcards := 0, 0
+	for i, t := range template {
+		if t == drainWildcard {
+			wildcards++
+			continue
+		}
+		if t == tokens[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(template)), wildcards
+}
+
+// add assigns message to a template, returning it, or nil for an empty message.
+// m.mu must be held.
+func (m *templateMiner) add(message string, now time.Time) *drainCluster {
+	tokens := drainTokens(message)
+	if len(tokens) == 0 {
+		return nil
+	}
+	node := m.leaf(tokens, true)
+
+	var best *drainCluster
+	bestSim, bestWildcards := -1.0, -1
+	for _, c := range node.clusters {
+		sim, wildcards := similarity(c.tokens, tokens)
+		if sim > bestSim || sim == bestSim && wildcards > bestWildcards {
+			best, bestSim, bestWildcards = c, sim, wildcards
+		}
+	}
+
+	if best == nil || bestSim < drainSimilarity {
+		best = &drainCluster{id: m.nextID, tokens: tokens, firstSeen: now}
+		m.nextID++
+		node.clusters = append(node.clusters, best)
+	} else {
+		for i, t := range best.tokens {
+			if t != tokens[i] {
+				best.tokens[i] = drainWildcard
+			}
+		}
+	}
+	best.count++
+	best.lastSeen = now
+	return best
+}
+
+// match returns the template message would be assigned to without changing the tree, 0
+// if it would start a new one.
+func (m *templateMiner) match(message string) int64 {
+	tokens := drainTokens(message)
+	if len(tokens) == 0 {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node := m.leaf(tokens, false)
+	if node == nil {
+		return 0
+	}
+
+	var best *drainCluster
+	bestSim, bestWildcards := -1.0, -1
+	for _, c := range node.clusters {
+		sim, wildcards := similarity(c.tokens, tokens)
+		if sim > bestSim || sim == bestSim && wildcards > bestWildcards {
+			best, bestSim, bestWildcards = c, sim, wildcards
+		}
+	}
+	if best == nil || bestSim < drainSimilarity {
+		return 0
+	}
+	return best.id
+}
+
+// mine sets TemplateID on each entry and returns the resulting template changes.
+func (m *templateMiner) mine(entries []StoredEntry) []templateUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var updates []templateUpdate
+	index := map[int64]int{}
+	for i := range entries {
+		message := entries[i].Message
+		if entries[i].Raw != "" {
+			message = entries[i].Raw
+		}
+		c := m.add(message, entries[i].ReceivedAt)
+		if c == nil {
+			continue
+		}
+		entries[i].TemplateID = c.id
+
+		j, ok := index[c.id]
+		if !ok {
+			j = len(updates)
+			index[c.id] = j
+			updates = append(updates, templateUpdate{id: c.id, firstSeen: c.firstSeen})
+		}
+		updates[j].added += int64(entries[i].Repeats)
+		updates[j].template = strings.Join(c.tokens, " ")
+		updates[j].lastSeen = c.lastSeen
+	}
+	return updates
+}
+
+// templateUpsertSQL records a templateUpdate; counts add up across requests.
+const templateUpsertSQL = `
+	INSERT INTO log_templates (id, template, count, first_seen, last_seen)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (id) DO UPDATE SET
+		template = EXCLUDED.template,
+		count = log_templates.count + EXCLUDED.count,
+		last_seen = GREATEST(log_templates.last_seen, EXCLUDED.last_seen)`
+
+// loadTemplates rebuilds the Drain tree from log_templates.
+func loadTemplates() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, `SELECT id, template, count, first_seen, last_seen FROM log_templates ORDER BY id`)
+	if err != nil {
+		fatal("Failed to load log templates", "err", err)
+	}
+
+	miner.mu.Lock()
+	defer miner.mu.Unlock()
+
+	var c drainCluster
+	var template string
+	n := 0
+	_, err = pgx.ForEachRow(rows, []any{&c.id, &template, &c.count, &c.firstSeen, &c.lastSeen}, func() error {
+		cluster := c
+		cluster.tokens = strings.Fields(template)
+		if len(cluster.tokens) > 0 {
+			node := miner.leaf(cluster.tokens, true)
+			node.clusters = append(node.clusters, &cluster)
+		}
+		miner.nextID = max(miner.nextID, c.id+1)
+		n++
+		return nil
+	})
+	if err != nil {
+		fatal("Failed to load log templates", "err", err)
+	}
+	slog.Info("Loaded log templates", "templates", n)
+}
+
+// Limits for the number of templates returned by /api/templates.
+const (
+	defaultTemplateLimit = 100
+	maxTemplateLimit     = 1000
+)
+
+// LogTemplate is a message template and how often it has been seen.
+type LogTemplate struct {
+	ID        int64     `json:"id"`
+	Template  string    `json:"template"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// LogTemplates is the response of /api/templates.
+type LogTemplates struct {
+	Templates []LogTemplate `json:"templates"`
+}
+
+// templatesHandler handles GET /api/templates, listing mined templates by count, or with
+// sort=new by when they first appeared. since only includes templates first seen at or
+// after an RFC 3339 time, to spot new kinds of messages.
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultTemplateLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTemplateLimit {
+			http.Error(w, "Invalid 'limit': must be between 1 and "+strconv.Itoa(maxTemplateLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid 'since' timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	order := "count DESC, id"
+	switch query.Get("sort") {
+	case "", "count":
+	case "new":
+		order = "first_seen DESC, id DESC"
+	default:
+		http.Error(w, "Invalid 'sort': must be count or new", http.StatusBadRequest)
+		return
+	}
+
+	templates, err := listTemplates(r.Context(), since, order, limit)
+	if err != nil {
+		http.Error(w, "Could not list log templates", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing log templates", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, LogTemplates{Templates: templates})
+}
+
+// listTemplates returns up to limit templates first seen at or after since, in SQL order.
+func listTemplates(ctx context.Context, since time.Time, order string, limit int) ([]LogTemplate, error) {
+	rows, err := dbPool.Query(ctx, `
+	SELECT id, template, count, first_seen, last_seen FROM log_templates
+	WHERE first_seen >= $1
+	ORDER BY `+order+`
+	LIMIT $2`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := pgx.CollectRows(rows, pgx.RowToStructByPos[LogTemplate])
+	if templates == nil {
+		templates = []LogTemplate{}
+	}
+	return templates, err
+}
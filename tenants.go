@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Teams can share one instance as tenants, registered in the tenants table with PUT
+// /api/tenants/{id}. Each has tenant keys: API keys bound to it (see apikeys.go). Records
+// ingested with a tenant key are tagged with its tenant in delogged.tenant, as are their
+// sources in source_activity, and the entry routes (apiRoute.Tenanted) only return that
+// tenant's entries to it. An alert rule can be limited to a tenant, counting only its
+// entries and sources. Tenant keys can't be granted the admin role, and are refused from
+// the routes that aren't scoped, such as alerts, issues and stats. Other callers see every
+// tenant's entries, and can filter on the tenant field of the query language. A tenant can
+// keep its records for longer or shorter than the others (see retention.go), and change
+// how its payloads are parsed, redacted and enriched (see overrides.go). PostgreSQL can
+// also keep tenants apart for direct SQL access (see rowsecurity.go).
+//
+// Admins offboard a tenant in steps, the last three answering 409 unless it is suspended:
+//
+//  1. POST /api/tenants/{id}/suspend refuses its keys with 403 until POST .../resume
+//  2. GET /api/tenants/{id}/export exports its entries, as GET /api/export does
+//  3. POST /api/tenants/{id}/purge deletes its records and source activity, in the
+//     background, answering 202
+//  4. DELETE /api/tenants/{id} deletes it with its keys and alert rules, once it has no
+//     records left; its usage is kept for billing
+//
+// POST /api/tenants/{id}/rotate-keys replaces its keys with new ones, for a leaked key,
+// returning them the only time they are shown.
+//
+// Suspension, rotation and deletion take effect at once on the replica that made them,
+// and on the others when they are notified (see replicas.go), normally within moments.
+
+// tenantPattern is the syntax of tenant ids.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// requestTenant returns the tenant of the caller, or "" if it isn't bound to one.
+func requestTenant(ctx context.Context) string {
+	p, _ := principalFromContext(ctx)
+	return p.tenant
+}
+
+// requestFilter reads the entry filter of a request from q, restricted to the caller's
+// tenant and project.
+func requestFilter(r *http.Request, q url.Values) (entryFilter, error) {
+	f, err := parseEntryFilter(q)
+	return scopeFilter(r.Context(), f), err
+}
+
+// scopeFilter restricts f to the tenant and project of the caller in ctx, whatever f
+// already has. Every filter read from a caller goes through it.
+func scopeFilter(ctx context.Context, f entryFilter) entryFilter {
+	f.Tenant = requestTenant(ctx)
+	f.Project = requestProject(ctx)
+	return f
+}
+
+// Tenant is a registered tenant.
+type Tenant struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Retention   string     `json:"retention,omitempty"` // how long its records are kept, "" for RETENTION
+	CreatedAt   time.Time  `json:"created_at"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	// Overrides change how its payloads are ingested, see overrides.go.
+	Overrides TenantOverrides `json:"overrides"`
+}
+
+// tenants holds the registered tenants by id.
+var tenants struct {
+	sync.RWMutex
+	byID map[string]Tenant
+}
+
+// loadTenants reads the registered tenants into memory.
+func loadTenants() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := reloadTenants(ctx); err != nil {
+		fatal("Failed to load tenants", "err", err)
+	}
+}
+
+// reloadTenants replaces the tenants in memory with the registered ones, keeping them if
+// the database can't be read.
+func reloadTenants(ctx context.Context) error {
+	rows, err := dbPool.Query(ctx, `SELECT id, name, retention, created_at, suspended_at, overrides FROM tenants`)
+	if err != nil {
+		return err
+	}
+	byID := map[string]Tenant{}
+	var t Tenant
+	_, err = pgx.ForEachRow(rows, []any{&t.ID, &t.Name, &t.Retention, &t.CreatedAt, &t.SuspendedAt, &t.Overrides}, func() error {
+		// Overrides naming what was removed since are ignored whole.
+		if err := t.Overrides.prepare(); err != nil {
+			slog.Warn("Ignoring invalid tenant overrides", "tenant", t.ID, "err", err)
+			t.Overrides = TenantOverrides{}
+		}
+		byID[t.ID] = t
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tenants.Lock()
+	tenants.byID = byID
+	tenants.Unlock()
+	return nil
+}
+
+// tenantSuspended reports whether id is a suspended tenant.
+func tenantSuspended(id string) bool {
+	tenants.RLock()
+	defer tenants.RUnlock()
+	return tenants.byID[id].SuspendedAt != nil
+}
+
+// tenantExists reports whether id is a registered tenant.
+func tenantExists(id string) bool {
+	tenants.RLock()
+	defer tenants.RUnlock()
+	_, ok := tenants.byID[id]
+	return ok
+}
+
+// Tenants is the response of GET /api/tenants.
+type Tenants struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// listTenantsHandler handles GET /api/tenants.
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenants.RLock()
+	list := []Tenant{}
+	for _, t := range tenants.byID {
+		list = append(list, t)
+	}
+	tenants.RUnlock()
+	slices.SortFunc(list, func(a, b Tenant) int { return strings.Compare(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, Tenants{Tenants: list})
+}
+
+// putTenantHandler handles PUT /api/tenants/{id}, registering a tenant or changing its name,
+// retention and overrides.
+func putTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var t Tenant
+	if err := readJSON(r, &t); err != nil {
+		http.Error(w, "Invalid tenant: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	t.ID, t.Name = r.PathValue("id"), strings.TrimSpace(t.Name)
+	if !tenantPattern.MatchString(t.ID) {
+		http.Error(w, "Invalid tenant: the id must be lowercase letters, digits, - and _", http.StatusBadRequest)
+		return
+	}
+	if t.Retention != "" {
+		if _, err := parseRetention(t.Retention); err != nil {
+			http.Error(w, "Invalid tenant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := t.Overrides.prepare(); err != nil {
+		http.Error(w, "Invalid tenant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := createTenantRole(r.Context(), t.ID); err != nil {
+		http.Error(w, "Could not create tenant role", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating tenant role", "tenant", t.ID, "err", err)
+		return
+	}
+
+	err := dbPool.QueryRow(r.Context(), `
+	INSERT INTO tenants (id, name, retention, overrides) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, retention = EXCLUDED.retention, overrides = EXCLUDED.overrides
+	RETURNING created_at, suspended_at`,
+		t.ID, t.Name, t.Retention, t.Overrides).Scan(&t.CreatedAt, &t.SuspendedAt)
+	if err != nil {
+		http.Error(w, "Could not save tenant", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving tenant", "tenant", t.ID, "err", err)
+		return
+	}
+
+	tenants.Lock()
+	tenants.byID[t.ID] = t
+	tenants.Unlock()
+	notifyAuthChange(r.Context())
+
+	slog.InfoContext(r.Context(), "Saved tenant", "tenant", t.ID, "name", t.Name, "retention", t.Retention)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// lookupTenant returns the tenant of the request's id path parameter, answering 404 if it
+// isn't registered.
+func lookupTenant(w http.ResponseWriter, r *http.Request) (Tenant, bool) {
+	tenants.RLock()
+	t, ok := tenants.byID[r.PathValue("id")]
+	tenants.RUnlock()
+	if !ok {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+	}
+	return t, ok
+}
+
+// lookupSuspendedTenant is lookupTenant, answering 409 if the tenant isn't suspended.
+func lookupSuspendedTenant(w http.ResponseWriter, r *http.Request) (Tenant, bool) {
+	t, ok := lookupTenant(w, r)
+	if ok && t.SuspendedAt == nil {
+		http.Error(w, "Tenant is active: suspend it first", http.StatusConflict)
+		return t, false
+	}
+	return t, ok
+}
+
+// setTenantSuspendedHandler returns the handler of POST /api/tenants/{id}/suspend or
+// /resume.
+func setTenantSuspendedHandler(suspended bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := lookupTenant(w, r)
+		if !ok {
+			return
+		}
+		err := dbPool.QueryRow(r.Context(), `
+		UPDATE tenants SET suspended_at = CASE WHEN $2 THEN COALESCE(suspended_at, now()) END WHERE id = $1
+		RETURNING suspended_at`,
+			t.ID, suspended).Scan(&t.SuspendedAt)
+		if err != nil {
+			http.Error(w, "Could not save tenant", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error saving tenant", "tenant", t.ID, "err", err)
+			return
+		}
+
+		tenants.Lock()
+		tenants.byID[t.ID] = t
+		tenants.Unlock()
+		notifyAuthChange(r.Context())
+
+		slog.InfoContext(r.Context(), "Saved tenant", "tenant", t.ID, "suspended", suspended)
+		writeJSON(w, http.StatusOK, t)
+	}
+}
+
+// rotateTenantKeysHandler handles POST /api/tenants/{id}/rotate-keys.
+func rotateTenantKeysHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupTenant(w, r)
+	if !ok {
+		return
+	}
+	keys, err := rotateTenantKeys(r.Context(), t.ID)
+	if err != nil {
+		http.Error(w, "Could not rotate keys", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error rotating tenant keys", "tenant", t.ID, "err", err)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	slog.InfoContext(r.Context(), "Rotated tenant keys", "tenant", t.ID, "keys", len(keys))
+	writeJSON(w, http.StatusOK, APIKeys{Keys: keys})
+}
+
+// exportTenantHandler handles GET /api/tenants/{id}/export, taking the parameters of GET
+// /api/export but search.
+func exportTenantHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupSuspendedTenant(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	filter, err := parseEntryFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Tenant = t.ID
+	exportEntries(w, r, filter, query)
+}
+
+// TenantPurge is the response of POST /api/tenants/{id}/purge.
+type TenantPurge struct {
+	Tenant    string    `json:"tenant"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// purgeTenantHandler handles POST /api/tenants/{id}/purge, deleting the tenant's records in
+// the background.
+func purgeTenantHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupSuspendedTenant(w, r)
+	if !ok {
+		return
+	}
+	purge := TenantPurge{Tenant: t.ID, StartedAt: time.Now()}
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		deleted, err := deleteRecords("tenant = $1", t.ID)
+		if err == nil {
+			_, err = dbPool.Exec(ctx, `DELETE FROM source_activity WHERE tenant = $1`, t.ID)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to purge tenant", "tenant", t.ID, "records", deleted, "err", err)
+			return
+		}
+		slog.InfoContext(ctx, "Purged tenant", "tenant", t.ID, "records", deleted, "duration", time.Since(purge.StartedAt))
+	}()
+	writeJSON(w, http.StatusAccepted, purge)
+}
+
+// deleteTenantHandler handles DELETE /api/tenants/{id}.
+func deleteTenantHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupSuspendedTenant(w, r)
+	if !ok {
+		return
+	}
+	var stored bool
+	if err := dbPool.QueryRow(r.Context(), `SELECT EXISTS (SELECT 1 FROM delogged WHERE tenant = $1)`, t.ID).Scan(&stored); err != nil {
+		http.Error(w, "Could not delete tenant", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting tenant", "tenant", t.ID, "err", err)
+		return
+	}
+	if stored {
+		http.Error(w, "Tenant has stored records: purge them first", http.StatusConflict)
+		return
+	}
+
+	var rules []int64
+	err := pgx.BeginFunc(r.Context(), dbPool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(r.Context(), `DELETE FROM alert_rules WHERE tenant = $1 RETURNING id`, t.ID)
+		if err != nil {
+			return err
+		}
+		if rules, err = pgx.CollectRows(rows, pgx.RowTo[int64]); err != nil {
+			return err
+		}
+		for _, sql := range []string{
+			`DELETE FROM api_keys WHERE tenant = $1`,
+			`DELETE FROM source_activity WHERE tenant = $1`,
+			`DELETE FROM tenants WHERE id = $1`,
+		} {
+			if _, err := tx.Exec(r.Context(), sql, t.ID); err != nil {
+				return err
+			}
+		}
+		return dropTenantRole(r.Context(), tx, t.ID)
+	})
+	if err != nil {
+		http.Error(w, "Could not delete tenant", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting tenant", "tenant", t.ID, "err", err)
+		return
+	}
+
+	for _, id := range rules {
+		alerts.remove(id)
+	}
+	forgetTenantKeys(t.ID)
+	tenants.Lock()
+	delete(tenants.byID, t.ID)
+	tenants.Unlock()
+	notifyAuthChange(r.Context())
+
+	slog.InfoContext(r.Context(), "Deleted tenant", "tenant", t.ID, "alert_rules", len(rules))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"delogger/enrich"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Timestamps parsed from lines are stored in UTC in log_time next to the original string.
+// A timestamp without zone information is read in its source's configured timezone,
+// falling back to DEFAULT_LOG_TIMEZONE (an IANA name, default UTC). The formats
+// recognised are those of enrich.LogTime.
+
+// sourceTimezones holds the per-source timezones from source_timezones.
+var sourceTimezones = struct {
+	sync.RWMutex
+	byName      map[string]*time.Location
+	defaultZone *time.Location
+}{byName: map[string]*time.Location{}, defaultZone: time.UTC}
+
+// sourceName returns the source of a request from its client address, without the port.
+// It matches sourceExpr in SQL.
+func sourceName(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// parseLogTime converts a timestamp as written in a line to UTC, reading it in source's
+// timezone if it has none. ok is false if the format is not recognised.
+func parseLogTime(value, source string) (t time.Time, ok bool) {
+	sourceTimezones.RLock()
+	loc, found := sourceTimezones.byName[source]
+	if !found {
+		loc = sourceTimezones.defaultZone
+	}
+	sourceTimezones.RUnlock()
+	return enrich.LogTime(value, loc)
+}
+
+// loadSourceTimezones reads DEFAULT_LOG_TIMEZONE and the per-source timezones into memory.
+func loadSourceTimezones() {
+	defaultZone := time.UTC
+	if name := setting("DEFAULT_LOG_TIMEZONE"); name != "" {
+		var err error
+		defaultZone, err = time.LoadLocation(name)
+		if err != nil {
+			fatalConfig("Invalid DEFAULT_LOG_TIMEZONE", "value", name, "err", err)
+		}
+	}
+
+	byName := map[string]*time.Location{}
+	if !inMemory() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		rows, err := dbPool.Query(ctx, `SELECT source, timezone FROM source_timezones`)
+		if err != nil {
+			fatal("Failed to load source timezones", "err", err)
+		}
+		var source, timezone string
+		_, err = pgx.ForEachRow(rows, []any{&source, &timezone}, func() error {
+			loc, err := time.LoadLocation(timezone)
+			if err != nil {
+				slog.Warn("Ignoring invalid timezone of source", "timezone", timezone, "source", source, "err", err)
+				return nil
+			}
+			byName[source] = loc
+			return nil
+		})
+		if err != nil {
+			fatal("Failed to load source timezones", "err", err)
+		}
+	}
+
+	sourceTimezones.Lock()
+	sourceTimezones.byName = byName
+	sourceTimezones.defaultZone = defaultZone
+	sourceTimezones.Unlock()
+}
+
+// SourceTimezone is the timezone assumed for a source's timestamps that lack one.
+type SourceTimezone struct {
+	Source   string `json:"source"`
+	Timezone string `json:"timezone"`
+}
+
+// SourceTimezones is the response of GET /api/timezones.
+type SourceTimezones struct {
+	Default string           `json:"default"`
+	Sources []SourceTimezone `json:"sources"`
+}
+
+// listTimezonesHandler handles GET /api/timezones.
+func listTimezonesHandler(w http.ResponseWriter, r *http.Request) {
+	sourceTimezones.RLock()
+	result := SourceTimezones{Default: sourceTimezones.defaultZone.String(), Sources: []SourceTimezone{}}
+	for source, loc := range sourceTimezones.byName {
+		result.Sources = append(result.Sources, SourceTimezone{Source: source, Timezone: loc.String()})
+	}
+	sourceTimezones.RUnlock()
+
+	slices.SortFunc(result.Sources, func(a, b SourceTimezone) int { return strings.Compare(a.Source, b.Source) })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// putTimezoneHandler handles PUT /api/timezones/{source}, setting the timezone of a source.
+// It applies to entries ingested from then on.
+func putTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+	var tz SourceTimezone
+	if err := readJSON(r, &tz); err != nil {
+		http.Error(w, "Invalid source timezone: "+err.Error(), bodyErrorStatus(err))
+		return
+	}
+	tz.Source = source
+	loc, err := time.LoadLocation(tz.Timezone)
+	if err != nil || tz.Timezone == "" {
+		http.Error(w, "Invalid source timezone: unknown timezone "+tz.Timezone, http.StatusBadRequest)
+		return
+	}
+
+	_, err = dbPool.Exec(r.Context(), `
+	INSERT INTO source_timezones (source, timezone) VALUES ($1, $2)
+	ON CONFLICT (source) DO UPDATE SET timezone = EXCLUDED.timezone`,
+		tz.Source, tz.Timezone)
+	if err != nil {
+		http.Error(w, "Could not save source timezone", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving timezone of source", "source", tz.Source, "err", err)
+		return
+	}
+
+	sourceTimezones.Lock()
+	sourceTimezones.byName[tz.Source] = loc
+	sourceTimezones.Unlock()
+
+	slog.InfoContext(r.Context(), "Set timezone of source", "source", tz.Source, "timezone", tz.Timezone)
+	writeJSON(w, http.StatusOK, tz)
+}
+
+// deleteTimezoneHandler handles DELETE /api/timezones/{source}, reverting the source to the default.
+func deleteTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+
+	tag, err := dbPool.Exec(r.Context(), `DELETE FROM source_timezones WHERE source = $1`, source)
+	if err != nil {
+		http.Error(w, "Could not delete source timezone", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting timezone of source", "source", source, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Source timezone not found", http.StatusNotFound)
+		return
+	}
+
+	sourceTimezones.Lock()
+	delete(sourceTimezones.byName, source)
+	sourceTimezones.Unlock()
+
+	slog.InfoContext(r.Context(), "Deleted timezone of source", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks HTTPS when given a certificate, or domains to obtain one for over
+// ACME, and can require agents to present a client certificate (mutual TLS):
+//
+//	TLS_CERT_FILE       PEM certificate chain of the server
+//	TLS_KEY_FILE        PEM private key of the server
+//	TLS_ACME_DOMAINS    comma-separated domains to get certificates for from Let's Encrypt,
+//	                    instead of TLS_CERT_FILE; port 443 must reach the server, or
+//	                    TLS_ACME_HTTP_ADDR port 80, for the CA's challenges
+//	TLS_ACME_EMAIL      contact address for the CA's expiry and policy notices
+//	TLS_ACME_CACHE      directory keeping the account key and certificates; default acme-cache
+//	TLS_ACME_DIRECTORY  directory URL of another ACME CA, e.g. Let's Encrypt staging
+//	TLS_ACME_HTTP_ADDR  address serving HTTP-01 challenges, e.g. :80; other requests are
+//	                    redirected to HTTPS
+//	TLS_CLIENT_CA_FILE  PEM CA bundle client certificates must chain to; enables mTLS
+//	TLS_CLIENT_AUTH     require (default) or optional, verifying certificates when presented
+//
+// SIGHUP reloads the certificate, key and client CA files, so renewed certificates are used
+// without a restart; on errors the loaded ones are kept. ACME certificates renew themselves.
+//
+// A verified client certificate identifies its source: the host of ingested records is the
+// certificate's first DNS name, or its common name, rather than the X-DeLogger-Host header,
+// which any client can set.
+
+// tlsFiles holds the certificate and client CAs loaded from the configured files.
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// load reads the files, replacing the loaded certificate and CAs only if all are valid.
+func (f *tlsFiles) load() error {
+	var cert *tls.Certificate
+	if f.certFile != "" || f.keyFile != "" {
+		c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + f.caFile)
+		}
+	}
+
+	f.mu.Lock()
+	f.cert, f.clientCAs = cert, pool
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *tlsFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert, nil
+}
+
+func (f *tlsFiles) currentClientCAs() *x509.CertPool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.clientCAs
+}
+
+// reloadOnHangup reloads the files on every SIGHUP from now on.
+func (f *tlsFiles) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := f.load(); err != nil {
+				slog.Error("Failed to reload TLS files, keeping the loaded ones", "err", err)
+				continue
+			}
+			slog.Info("Reloaded TLS files")
+		}
+	}()
+}
+
+// serverTLSConfig returns the TLS configuration of the listener, or nil to serve plain HTTP.
+func serverTLSConfig() *tls.Config {
+	files := &tlsFiles{certFile: setting("TLS_CERT_FILE"), keyFile: setting("TLS_KEY_FILE"), caFile: setting("TLS_CLIENT_CA_FILE")}
+	domains := setting("TLS_ACME_DOMAINS")
+
+	var config *tls.Config
+	switch {
+	case domains != "" && (files.certFile != "" || files.keyFile != ""):
+		fatalConfig("TLS_ACME_DOMAINS and TLS_CERT_FILE are exclusive")
+	case domains != "":
+		config = acmeTLSConfig(domains)
+	case files.certFile != "" || files.keyFile != "":
+		config = &tls.Config{GetCertificate: files.getCertificate}
+	case files.caFile != "":
+		fatalConfig("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE, or TLS_ACME_DOMAINS")
+	default:
+		return nil
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	if err := files.load(); err != nil {
+		fatalConfig("Failed to load TLS files", "err", err)
+	}
+	if files.certFile != "" || files.caFile != "" {
+		files.reloadOnHangup()
+	}
+	if files.caFile == "" {
+		return config
+	}
+
+	switch mode := setting("TLS_CLIENT_AUTH"); mode {
+	case "", "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		fatalConfig("Invalid TLS_CLIENT_AUTH: must be require or optional", "value", mode)
+	}
+	config.ClientCAs = files.currentClientCAs()
+	// Each handshake uses the CAs loaded last.
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.ClientCAs = files.currentClientCAs()
+		return c, nil
+	}
+	slog.Info("Verifying client certificates", "ca", files.caFile, "auth", config.ClientAuth.String())
+	return config
+}
+
+// acmeTLSConfig obtains and renews certificates for domains from an ACME CA.
+func acmeTLSConfig(domains string) *tls.Config {
+	var hosts []string
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			hosts = append(hosts, d)
+		}
+	}
+	cache := setting("TLS_ACME_CACHE")
+	if cache == "" {
+		cache = "acme-cache"
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cache),
+		Email:      setting("TLS_ACME_EMAIL"),
+	}
+	if dir := setting("TLS_ACME_DIRECTORY"); dir != "" {
+		m.Client = &acme.Client{DirectoryURL: dir}
+	}
+	if addr := setting("TLS_ACME_HTTP_ADDR"); addr != "" {
+		go func() {
+			server := newServer(m.HTTPHandler(nil))
+			server.Addr = addr
+			fatal("ACME challenge server stopped", "err", server.ListenAndServe())
+		}()
+	}
+	slog.Info("Obtaining certificates over ACME", "domains", hosts, "cache", cache)
+	return m.TLSConfig()
+}
+
+// clientCertIdentity returns the name of r's verified client certificate, or "".
+func clientCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+	return leaf.Subject.CommonName
+}
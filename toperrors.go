@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Limits for the number of templates returned by /api/stats/top-errors.
+const (
+	defaultTopErrors = 10
+	maxTopErrors     = 100
+)
+
+// errorLevelCond selects entries logged at error severity or worse. The level check covers
+// entries stored before severities were normalized.
+const errorLevelCond = `(e.severity_number >= 17 OR upper(e.level) IN ('ERROR', 'ERR', 'FATAL', 'CRITICAL', 'CRIT'))`
+
+// messageTemplateExpr normalizes an entry's message by replacing the variable parts
+// (UUIDs, quoted strings, hex and decimal numbers, IPs) with <*>, so messages that
+// differ only in ids or durations group together.
+const messageTemplateExpr = `regexp_replace(regexp_replace(regexp_replace(regexp_replace(e.message,
+		'[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}', '<*>', 'g'),
+		'"[^"]*"|''[^'']*''', '<*>', 'g'),
+		'\m0[xX][0-9a-fA-F]+\M', '<*>', 'g'),
+		'[0-9]+([.:][0-9]+)*', '<*>', 'g')`
+
+// ErrorTemplate is a group of error messages sharing one normalized template.
+type ErrorTemplate struct {
+	Template  string    `json:"template"`
+	Example   string    `json:"example"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// TopErrors is the response of /api/stats/top-errors.
+type TopErrors struct {
+	Errors []ErrorTemplate `json:"errors"`
+}
+
+// topErrorsHandler handles GET /api/stats/top-errors, returning the most frequent error
+// templates among entries matching the usual filter parameters.
+func topErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// The templates are computed from the messages in the database.
+	if err := encryption.searchable("Top errors"); err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	filter, err := requestFilter(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultTopErrors
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTopErrors {
+			http.Error(w, "Invalid 'limit': must be between 1 and "+strconv.Itoa(maxTopErrors), http.StatusBadRequest)
+			return
+		}
+	}
+
+	templates, err := loadTopErrors(r.Context(), filter, limit)
+	if err != nil {
+		writeQueryError(w, r, err, "compute top errors")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TopErrors{Errors: templates})
+}
+
+// loadTopErrors returns the most frequent error templates among entries matching filter.
+func loadTopErrors(ctx context.Context, filter entryFilter, limit int) ([]ErrorTemplate, error) {
+	var args sqlArgs
+	where := andWhere(filter.where(&args), errorLevelCond)
+	sql := `
+	SELECT template, min(message), sum(repeats)::bigint, min(received_at), max(received_at)
+	FROM (
+		SELECT ` + messageTemplateExpr + ` AS template, e.message, e.received_at, e.repeats
+		FROM delogged_entries e
+		JOIN delogged d ON d.id = e.log_id
+		` + where + `
+	) t
+	GROUP BY template
+	ORDER BY sum(repeats) DESC, template
+	LIMIT ` + args.add(limit)
+
+	ctx, cancel := filter.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ErrorTemplate, error) {
+		var t ErrorTemplate
+		err := row.Scan(&t.Template, &t.Example, &t.Count, &t.FirstSeen, &t.LastSeen)
+		return t, err
+	})
+	if templates == nil {
+		templates = []ErrorTemplate{}
+	}
+	return templates, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Requests, the stages of ingestion and database calls are traced with OpenTelemetry and
+// exported over OTLP/HTTP, configured by the standard environment variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT         collector base URL, e.g. http://otel-collector:4318;
+//	                                    tracing is off unless it or the next one is set
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  full URL of the traces endpoint instead
+//	OTEL_EXPORTER_OTLP_HEADERS          headers sent to the collector, e.g. authorization=Bearer ...
+//	OTEL_SERVICE_NAME                   service name of the spans; default delogger
+//	OTEL_TRACES_SAMPLER                 e.g. parentbased_traceidratio with OTEL_TRACES_SAMPLER_ARG=0.1
+//
+// Incoming W3C traceparent headers are honoured, so a client's trace continues into ours.
+// Database spans are only recorded within a traced request, not for background work.
+
+// tracer creates the spans of this server. It forwards to the provider set by setupTracing.
+var tracer = otel.Tracer("delogger")
+
+// traceProvider is the SDK provider while tracing is on, to flush spans on shutdown.
+var traceProvider *sdktrace.TracerProvider
+
+// setupTracing installs the OTLP exporter if an endpoint is configured.
+func setupTracing() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if setting("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && setting("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		fatalConfig("Invalid OTLP exporter configuration", "err", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "delogger")))
+	if err != nil {
+		fatal("Failed to build trace resource", "err", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name.
+	res, err = resource.Merge(res, resource.Environment())
+	if err != nil {
+		fatal("Failed to build trace resource", "err", err)
+	}
+
+	traceProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(traceProvider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("Error exporting traces", "err", err)
+	}))
+	slog.Info("Exporting traces over OTLP")
+}
+
+// traceHandler wraps the handler of route in a server span named after the method and route.
+func traceHandler(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("client.address", sourceName(r.RemoteAddr)),
+				attribute.Int64("http.request.body.size", r.ContentLength),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// dbTracer records pgx queries, batches and copies as client spans.
+type dbTracer struct{}
+
+// startDBSpan starts a span for a database call if ctx is traced.
+func startDBSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) context.Context {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx
+	}
+	attrs = append(attrs, attribute.String("db.system.name", "postgresql"))
+	ctx, _ = tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx
+}
+
+// endDBSpan ends the span started by startDBSpan, recording err.
+func endDBSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// sqlOperation returns the first keyword of a statement, e.g. INSERT.
+func sqlOperation(sql string) string {
+	op, _, _ := strings.Cut(strings.TrimSpace(sql), " ")
+	return strings.ToUpper(strings.TrimSpace(op))
+}
+
+func (dbTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	op := sqlOperation(data.SQL)
+	return startDBSpan(ctx, op, attribute.String("db.operation.name", op), attribute.String("db.query.text", data.SQL))
+}
+
+func (dbTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	if trace.SpanFromContext(ctx).IsRecording() {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("db.response.returned_rows", data.CommandTag.RowsAffected()))
+	}
+	endDBSpan(ctx, data.Err)
+}
+
+func (dbTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	return startDBSpan(ctx, "BATCH", attribute.String("db.operation.name", "BATCH"),
+		attribute.Int("db.operation.batch.size", data.Batch.Len()))
+}
+
+func (dbTracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (dbTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	endDBSpan(ctx, data.Err)
+}
+
+func (dbTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return startDBSpan(ctx, "COPY "+data.TableName.Sanitize(), attribute.String("db.operation.name", "COPY"),
+		attribute.String("db.collection.name", data.TableName.Sanitize()))
+}
+
+func (dbTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	endDBSpan(ctx, data.Err)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Usage is metered per tenant for chargeback: the records stored, their entries and the
+// bytes of their payloads as stored, and the queries made on the routes reading entries
+// (apiRoute.Query). Callers without a tenant are metered under the tenant "". Counts are
+// kept in memory and added to the tenant_usage table by day every minute and at shutdown.
+//
+//	USAGE_SUMMARY_URL  URL each month's usage summary is POSTed to as JSON, once the month
+//	                   is over; optional
+//
+// GET /api/usage returns a month's usage by tenant; tenant keys only see their own. Once a
+// month is over, its summary is logged, and posted to USAGE_SUMMARY_URL if set; the
+// usage_summaries table records the months summarized, so each is summarized once across
+// restarts and replicas, and a failed post is retried the next hour. Usage is only metered
+// with PostgreSQL.
+
+// usageFlushInterval is how often the counts are added to the table.
+const usageFlushInterval = time.Minute
+
+// TenantUsage is the usage of a tenant over a period.
+type TenantUsage struct {
+	Tenant  string `json:"tenant"`
+	Records int64  `json:"records"`
+	Entries int64  `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Queries int64  `json:"queries"`
+}
+
+// usageKey identifies the counts of a tenant on a UTC day, as 2006-01-02.
+type usageKey struct{ tenant, day string }
+
+var usage = struct {
+	sync.Mutex
+	enabled    bool
+	pending    map[usageKey]*TenantUsage
+	summaryURL string
+	summarized string    // the last month summarized by this server, as 2006-01
+	retryAt    time.Time // when to summarize again after a failure
+}{pending: map[usageKey]*TenantUsage{}}
+
+// setupUsage reads USAGE_SUMMARY_URL.
+func setupUsage() {
+	if v := setting("USAGE_SUMMARY_URL"); v != "" {
+		if err := validateHTTPURL(v); err != nil {
+			fatalConfig("Invalid USAGE_SUMMARY_URL", "err", err)
+		}
+		usage.summaryURL = v
+	}
+}
+
+// startUsage starts metering, and the job storing the counts and summarizing the months.
+func startUsage() {
+	usage.Lock()
+	usage.enabled = true
+	usage.Unlock()
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			flushUsage(ctx)
+			summarizeUsage(ctx, time.Now())
+			cancel()
+		}
+	}()
+}
+
+// meter adds to the counts of tenant for today.
+func meter(tenant string, add func(*TenantUsage)) {
+	usage.Lock()
+	defer usage.Unlock()
+	if !usage.enabled {
+		return
+	}
+	key := usageKey{tenant, time.Now().UTC().Format(time.DateOnly)}
+	u := usage.pending[key]
+	if u == nil {
+		u = &TenantUsage{Tenant: tenant}
+		usage.pending[key] = u
+	}
+	add(u)
+}
+
+// meterRecord counts a stored record with its entries.
+func meterRecord(r *LogRecord, entries int) {
+	meter(r.Tenant, func(u *TenantUsage) {
+		u.Records++
+		u.Entries += int64(entries)
+		u.Bytes += int64(r.requestBodySize())
+	})
+}
+
+// meterQuery wraps the handler of a query route to count its calls.
+func meterQuery(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meter(requestTenant(r.Context()), func(u *TenantUsage) { u.Queries++ })
+		h(w, r)
+	}
+}
+
+// flushUsage adds the counts to the table, keeping those it fails to add for the next time.
+func flushUsage(ctx context.Context) {
+	usage.Lock()
+	pending := usage.pending
+	usage.pending = map[usageKey]*TenantUsage{}
+	usage.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	batch := &pgx.Batch{}
+	for key, u := range pending {
+		batch.Queue(`
+		INSERT INTO tenant_usage (tenant, day, records, entries, bytes, queries) VALUES ($1, $2::date, $3, $4, $5, $6)
+		ON CONFLICT (tenant, day) DO UPDATE SET
+			records = tenant_usage.records + EXCLUDED.records, entries = tenant_usage.entries + EXCLUDED.entries,
+			bytes = tenant_usage.bytes + EXCLUDED.bytes, queries = tenant_usage.queries + EXCLUDED.queries`,
+			key.tenant, key.day, u.Records, u.Entries, u.Bytes, u.Queries)
+	}
+	if err := dbPool.SendBatch(ctx, batch).Close(); err != nil {
+		slog.Error("Failed to store usage", "err", err)
+		usage.Lock()
+		for key, u := range pending {
+			meterLocked(key, u)
+		}
+		usage.Unlock()
+	}
+}
+
+// meterLocked adds u to the counts of key; usage must be locked.
+func meterLocked(key usageKey, u *TenantUsage) {
+	p := usage.pending[key]
+	if p == nil {
+		usage.pending[key] = u
+		return
+	}
+	p.Records += u.Records
+	p.Entries += u.Entries
+	p.Bytes += u.Bytes
+	p.Queries += u.Queries
+}
+
+// UsageReport is the usage of every tenant over a month, the response of GET /api/usage
+// and the monthly summary.
+type UsageReport struct {
+	Month   string        `json:"month"` // 2006-01
+	Tenants []TenantUsage `json:"tenants"`
+}
+
+// loadUsage returns the usage of month, which starts at from, of tenant or of every tenant
+// if tenant is nil.
+func loadUsage(ctx context.Context, from time.Time, tenant *string) (UsageReport, error) {
+	var args sqlArgs
+	sql := `SELECT tenant, sum(records)::bigint, sum(entries)::bigint, sum(bytes)::bigint, sum(queries)::bigint
+	FROM tenant_usage WHERE day >= ` + args.add(from) + ` AND day < ` + args.add(from.AddDate(0, 1, 0))
+	if tenant != nil {
+		sql += ` AND tenant = ` + args.add(*tenant)
+	}
+	sql += ` GROUP BY tenant ORDER BY tenant`
+
+	rows, err := dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	tenants, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (TenantUsage, error) {
+		var u TenantUsage
+		err := row.Scan(&u.Tenant, &u.Records, &u.Entries, &u.Bytes, &u.Queries)
+		return u, err
+	})
+	if tenants == nil {
+		tenants = []TenantUsage{}
+	}
+	return UsageReport{Month: from.Format("2006-01"), Tenants: tenants}, err
+}
+
+// summarizeUsage summarizes the month before now once it is over, unless it was already.
+// It waits a few flushes into the new month, for every server to have stored its counts.
+// It is only called by the usage job, which alone reads summarized and retryAt.
+func summarizeUsage(ctx context.Context, now time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := start.AddDate(0, -1, 0)
+	month := from.Format("2006-01")
+	if usage.summarized == month || now.Sub(start) < 5*usageFlushInterval || now.Before(usage.retryAt) {
+		return
+	}
+
+	tag, err := dbPool.Exec(ctx, `INSERT INTO usage_summaries (month) VALUES ($1) ON CONFLICT DO NOTHING`, from)
+	if err != nil {
+		slog.Error("Failed to summarize usage", "month", month, "err", err)
+		return
+	}
+	usage.summarized = month
+	if tag.RowsAffected() == 0 {
+		return
+	}
+
+	report, err := loadUsage(ctx, from, nil)
+	if err == nil && usage.summaryURL != "" {
+		err = postJSON(ctx, usage.summaryURL, nil, report)
+	}
+	if err != nil {
+		slog.Error("Failed to summarize usage, retrying in an hour", "month", month, "err", err)
+		if _, err := dbPool.Exec(ctx, `DELETE FROM usage_summaries WHERE month = $1`, from); err != nil {
+			slog.Error("Failed to summarize usage", "month", month, "err", err)
+			return
+		}
+		usage.summarized, usage.retryAt = "", now.Add(time.Hour)
+		return
+	}
+	for _, u := range report.Tenants {
+		slog.Info("Monthly usage", "month", month, "tenant", u.Tenant, "records", u.Records, "entries", u.Entries,
+			"bytes", u.Bytes, "queries", u.Queries)
+	}
+}
+
+// usageHandler handles GET /api/usage.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if v := r.URL.Query().Get("month"); v != "" {
+		m, err := time.Parse("2006-01", v)
+		if err != nil {
+			http.Error(w, "invalid 'month': must be a month such as 2006-01", http.StatusBadRequest)
+			return
+		}
+		from = m
+	}
+	var tenant *string
+	if t := requestTenant(r.Context()); t != "" {
+		tenant = &t
+	} else if requestProject(r.Context()) != "" {
+		http.Error(w, "Forbidden: usage is metered by tenant, not project", http.StatusForbidden)
+		return
+	} else if r.URL.Query().Has("tenant") {
+		t := strings.TrimSpace(r.URL.Query().Get("tenant"))
+		tenant = &t
+	}
+
+	report, err := loadUsage(r.Context(), from, tenant)
+	if err != nil {
+		http.Error(w, "Could not load usage", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error loading usage", "err", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Without them the commit and date come from the VCS information the go command embeds.
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+)
+
+// VersionInfo is the response of GET /api/version.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	// Parsers, Sinks (notification channel types) and ExportFormats are compiled in;
+	// Features are the optional ones switched on by configuration.
+	Parsers       []string        `json:"parsers"`
+	Sinks         []string        `json:"sinks"`
+	ExportFormats []string        `json:"export_formats"`
+	Features      map[string]bool `json:"features"`
+	// Disabled are the parsers, inputs and enrichments switched off, see features.go.
+	Disabled []string `json:"disabled"`
+}
+
+// buildInfo fills in commit and buildDate from the embedded VCS information if they
+// weren't set with -ldflags.
+func buildInfo() (string, string) {
+	c, d := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	return c, d
+}
+
+// versionHandler handles GET /api/version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := VersionInfo{
+		Version:       version,
+		GoVersion:     runtime.Version(),
+		Sinks:         make([]string, 0, len(notifiers)),
+		ExportFormats: exportFormats,
+		Features: map[string]bool{
+			"tracing":     traceProvider != nil,
+			"geoip":       geoip.Load() != nil,
+			"reverse_dns": rdns.Load() != nil,
+			"email":       mailer != nil,
+			"redaction":   redaction.Load() != nil,
+			"dedup":       dedup != nil,
+			"encryption":  encryption != nil,
+		},
+		Disabled: disabledFeatures(),
+	}
+	info.Commit, info.BuildDate = buildInfo()
+	for _, p := range builtinParsers {
+		info.Parsers = append(info.Parsers, p.Name)
+	}
+	for name := range notifiers {
+		info.Sinks = append(info.Sinks, name)
+	}
+	slices.Sort(info.Sinks)
+	writeJSON(w, http.StatusOK, info)
+}